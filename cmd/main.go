@@ -6,16 +6,17 @@ import (
 	"fmt"
 
 	http "github.com/bogdanfinn/fhttp"
+	"github.com/zatxm/any-proxy/internal/access"
 	"github.com/zatxm/any-proxy/internal/bing"
 	"github.com/zatxm/any-proxy/internal/claude"
 	"github.com/zatxm/any-proxy/internal/config"
 	"github.com/zatxm/any-proxy/internal/coze/discord"
-	"github.com/zatxm/any-proxy/internal/gemini"
 	oapi "github.com/zatxm/any-proxy/internal/openai/api"
 	"github.com/zatxm/any-proxy/internal/openai/arkose/har"
 	"github.com/zatxm/any-proxy/internal/openai/arkose/solve"
 	"github.com/zatxm/any-proxy/internal/openai/auth"
 	"github.com/zatxm/any-proxy/internal/openai/image"
+	"github.com/zatxm/any-proxy/internal/pool"
 	"github.com/zatxm/fhblade"
 )
 
@@ -47,8 +48,38 @@ func main() {
 		go discord.Parse(ctx)
 	}
 
+	app := newApp()
+
+	// run
+	var runErr error
+	if cfg.HttpsInfo.Enable {
+		runErr = app.RunTLS(cfg.Port, cfg.HttpsInfo.PemFile, cfg.HttpsInfo.KeyFile)
+	} else {
+		runErr = app.Run(cfg.Port)
+	}
+	if runErr != nil {
+		fmt.Println(runErr)
+	}
+}
+
+// 注册中间件及路由
+func newApp() *fhblade.Blade {
 	app := fhblade.New()
 
+	// middleware,需在注册路由前添加,之后注册的路由才会使用
+	app.Use(func(next fhblade.Handler) fhblade.Handler {
+		return func(c *fhblade.Context) error {
+			// cors
+			c.Response().SetHeader("Access-Control-Allow-Origin", "*")
+			c.Response().SetHeader("Access-Control-Allow-Headers", "*")
+			c.Response().SetHeader("Access-Control-Allow-Methods", "*")
+			return next(c)
+		}
+	})
+
+	// 客户端密钥校验,配置了client_keys才开启
+	app.Use(access.Middleware())
+
 	// ping
 	app.Get("/ping", func(c *fhblade.Context) error {
 		return c.JSONAndStatus(http.StatusOK, fhblade.H{"ping": "ok"})
@@ -56,6 +87,16 @@ func main() {
 
 	// all
 	app.Post("/c/v1/chat/completions", oapi.DoChatCompletions())
+	app.Get("/c/v1/models", oapi.DoModels())
+	app.Post("/c/v1/messages", oapi.DoMessages())
+	app.Post("/c/v1/responses", oapi.DoResponses())
+	app.Post("/c/v1/completions", oapi.DoCompletions())
+	app.Post("/c/v1/embeddings", oapi.DoEmbeddings())
+	app.Post("/c/v1/images/generations", oapi.DoImagesGenerations())
+
+	// 密钥状态管理
+	app.Get("/c/admin/keys", pool.DoKeys())
+	app.Post("/c/admin/keys/reset", pool.DoResetKeys())
 
 	// bing
 	app.Get("/bing/conversation", bing.DoListConversation())
@@ -69,7 +110,7 @@ func main() {
 	app.Any("/claude/api/*path", claude.ProxyApi())
 
 	// google gemini
-	app.Any("/gemini/*path", gemini.Do())
+	app.Any("/gemini/*path", oapi.DoGemini())
 
 	// web login token
 	app.Post("/auth/token/web", auth.DoWeb())
@@ -98,17 +139,6 @@ func main() {
 	// chatgpt web图片
 	app.Get("/gptimage/*path", image.Do())
 
-	// middleware
-	app.Use(func(next fhblade.Handler) fhblade.Handler {
-		return func(c *fhblade.Context) error {
-			// cors
-			c.Response().SetHeader("Access-Control-Allow-Origin", "*")
-			c.Response().SetHeader("Access-Control-Allow-Headers", "*")
-			c.Response().SetHeader("Access-Control-Allow-Methods", "*")
-			return next(c)
-		}
-	})
-
 	// platform session key
 	app.Post("auth/session/platform", auth.DoPlatformSession())
 
@@ -121,14 +151,5 @@ func main() {
 	// proxy /backend-api/*
 	app.Any("/backend-api/*path", oapi.DoWeb("backend-api"))
 
-	// run
-	var runErr error
-	if cfg.HttpsInfo.Enable {
-		runErr = app.RunTLS(cfg.Port, cfg.HttpsInfo.PemFile, cfg.HttpsInfo.KeyFile)
-	} else {
-		runErr = app.Run(cfg.Port)
-	}
-	if runErr != nil {
-		fmt.Println(runErr)
-	}
+	return app
 }
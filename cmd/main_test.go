@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+	"time"
+
+	http "github.com/bogdanfinn/fhttp"
+	"github.com/bogdanfinn/fhttp/httptest"
+	"github.com/zatxm/any-proxy/internal/config"
+	"github.com/zatxm/any-proxy/internal/types"
+	"github.com/zatxm/fhblade"
+)
+
+// 所有路由都要经过客户端密钥校验
+func TestClientKeyRoutes(t *testing.T) {
+	cfg, err := config.Parse("../etc/c.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.ClientKeys = []config.ClientKey{
+		{Key: "sk-client", Name: "test", Enabled: true, Providers: []string{"claude"}},
+	}
+	defer func() { cfg.ClientKeys = nil }()
+	app := newApp()
+
+	tests := []struct {
+		method  string
+		path    string
+		key     string
+		body    string
+		code    int
+		errCode string
+	}{
+		{http.MethodPost, "/c/v1/chat/completions", "", `{"model":"gpt-4o"}`, http.StatusUnauthorized, "invalid_api_key"},
+		{http.MethodPost, "/c/v1/chat/completions", "sk-other", `{"model":"gpt-4o"}`, http.StatusUnauthorized, "invalid_api_key"},
+		{http.MethodPost, "/c/v1/chat/completions", "sk-client", `{"model":"gpt-4o"}`, http.StatusForbidden, "provider_not_allowed"},
+		{http.MethodPost, "/c/v1/messages", "", `{"model":"claude-3-haiku"}`, http.StatusUnauthorized, "invalid_api_key"},
+		{http.MethodPost, "/c/v1/embeddings", "", `{"input":"hi"}`, http.StatusUnauthorized, "invalid_api_key"},
+		{http.MethodPost, "/gemini/v1beta/models/gemini-pro:generateContent", "", `{}`, http.StatusUnauthorized, "invalid_api_key"},
+		{http.MethodPost, "/claude/api/v1/messages", "", `{}`, http.StatusUnauthorized, "invalid_api_key"},
+		{http.MethodPost, "/backend-anon/conversation", "", `{}`, http.StatusUnauthorized, "invalid_api_key"},
+		{http.MethodPost, "/v1/chat/completions", "", `{}`, http.StatusUnauthorized, "invalid_api_key"},
+		{http.MethodGet, "/ping", "", "", http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.path, bytes.NewBufferString(tt.body))
+		if tt.key != "" {
+			req.Header.Set("Authorization", "Bearer "+tt.key)
+		}
+		rec := httptest.NewRecorder()
+		app.ServeHTTP(rec, req)
+		if rec.Code != tt.code {
+			t.Errorf("%s %s: code = %d, want %d, body %s", tt.method, tt.path, rec.Code, tt.code, rec.Body.String())
+			continue
+		}
+		if tt.errCode == "" {
+			continue
+		}
+		var res types.ErrorResponse
+		if err := fhblade.Json.Unmarshal(rec.Body.Bytes(), &res); err != nil || res.Error == nil {
+			t.Errorf("%s %s: invalid error body %s", tt.method, tt.path, rec.Body.String())
+			continue
+		}
+		if res.Error.Code != tt.errCode {
+			t.Errorf("%s %s: error code = %s, want %s", tt.method, tt.path, res.Error.Code, tt.errCode)
+		}
+	}
+}
+
+// 限额作用在通用接口上,请求体错误的请求也计入请求数
+func TestClientKeyLimitRoutes(t *testing.T) {
+	cfg, err := config.Parse("../etc/c.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 用量按密钥保存在内存中,每次运行用不同的密钥
+	key := "sk-limited-" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	cfg.ClientKeys = []config.ClientKey{
+		{Key: key, Name: "limited", Enabled: true, RPM: 1},
+	}
+	defer func() { cfg.ClientKeys = nil }()
+	app := newApp()
+
+	codes := []int{http.StatusBadRequest, http.StatusTooManyRequests}
+	for i, want := range codes {
+		req := httptest.NewRequest(http.MethodPost, "/c/v1/chat/completions", bytes.NewBufferString(`{`))
+		req.Header.Set("Authorization", "Bearer "+key)
+		rec := httptest.NewRecorder()
+		app.ServeHTTP(rec, req)
+		if rec.Code != want {
+			t.Fatalf("request %d: code = %d, want %d, body %s", i, rec.Code, want, rec.Body.String())
+		}
+		if want == http.StatusTooManyRequests && rec.Header().Get("Retry-After") == "" {
+			t.Errorf("missing Retry-After")
+		}
+	}
+}
@@ -3,11 +3,13 @@ module github.com/zatxm/any-proxy
 go 1.22.2
 
 require (
+	github.com/andybalholm/brotli v1.0.5
 	github.com/bogdanfinn/fhttp v0.5.28
 	github.com/bwmarrin/discordgo v0.28.1
 	github.com/google/uuid v1.6.0
 	github.com/gorilla/websocket v1.5.1
 	github.com/h2non/filetype v1.1.3
+	github.com/klauspost/compress v1.16.7
 	github.com/zatxm/fhblade v0.0.0-20240108032359-f02aa4f5523f
 	github.com/zatxm/tls-client v0.0.0-20231223102741-4e348055c451
 	go.uber.org/zap v1.27.0
@@ -16,7 +18,6 @@ require (
 )
 
 require (
-	github.com/andybalholm/brotli v1.0.5 // indirect
 	github.com/bogdanfinn/utls v1.6.1 // indirect
 	github.com/cloudflare/circl v1.3.6 // indirect
 	github.com/gabriel-vasile/mimetype v1.4.2 // indirect
@@ -24,7 +25,6 @@ require (
 	github.com/go-playground/universal-translator v0.18.1 // indirect
 	github.com/go-playground/validator/v10 v10.16.0 // indirect
 	github.com/json-iterator/go v1.1.12 // indirect
-	github.com/klauspost/compress v1.16.7 // indirect
 	github.com/leodido/go-urn v1.2.4 // indirect
 	github.com/modern-go/concurrent v0.0.0-20180228061459-e0a39a4cb421 // indirect
 	github.com/modern-go/reflect2 v1.0.2 // indirect
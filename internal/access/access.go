@@ -0,0 +1,272 @@
+package access
+
+import (
+	"crypto/subtle"
+	"path"
+	"strings"
+
+	http "github.com/bogdanfinn/fhttp"
+	"github.com/zatxm/any-proxy/internal/config"
+	"github.com/zatxm/any-proxy/internal/types"
+	"github.com/zatxm/fhblade"
+	"go.uber.org/zap"
+)
+
+// 请求上下文中保存的客户端密钥
+const clientKey = "client_key"
+
+// 不需要客户端密钥的路径,管理接口用admin_key
+var publicPaths = []string{"/ping", "/gptimage/", "/c/admin/"}
+
+// 客户端密钥校验,没配置client_keys时不校验
+// 从Authorization、x-api-key、x-goog-api-key或?key=取密钥,通过后从请求中去掉,不会再当作上游密钥使用
+// 按路径及请求体的provider、model(未传provider按路由)检查权限,再检查请求数、并发流及token额度
+func Middleware() fhblade.Middleware {
+	return func(next fhblade.Handler) fhblade.Handler {
+		return func(c *fhblade.Context) error {
+			// 上下文会复用,先清掉上一个请求的值
+			c.SetKey(clientKey, (*config.ClientKey)(nil))
+			c.SetKey(consumedKey, false)
+			if len(config.V().ClientKeys) == 0 || c.Request().Method() == http.MethodOptions {
+				return next(c)
+			}
+			reqPath := c.Request().Path()
+			for _, v := range publicPaths {
+				if reqPath == v || (strings.HasSuffix(v, "/") && strings.HasPrefix(reqPath, v)) {
+					return next(c)
+				}
+			}
+
+			k := take(c)
+			if k == nil {
+				return deny(c, http.StatusUnauthorized, "invalid_api_key", "Incorrect API key provided")
+			}
+			if !k.Enabled {
+				return deny(c, http.StatusUnauthorized, "api_key_disabled", "API key is disabled")
+			}
+			c.SetKey(clientKey, k)
+
+			t := resolve(c, reqPath)
+			provider, model := t.provider, t.model
+			if provider != "" && !contains(k.Providers, provider) {
+				return deny(c, http.StatusForbidden, "provider_not_allowed", "API key is not allowed to use provider "+provider)
+			}
+			// 通用接口不传model时用上游默认模型,限制了模型的也要检查
+			if (model != "" || provider != "" && strings.HasPrefix(reqPath, "/c/v1/")) && !matchModel(k.Models, model) {
+				return deny(c, http.StatusForbidden, "model_not_allowed", "API key is not allowed to use model '"+model+"'")
+			}
+			// coze的x-auth-id为user,密钥标识为x-bot-id
+			idHeader := "x-auth-id"
+			if provider == "coze" {
+				idHeader = "x-bot-id"
+			}
+			if id := c.Request().Header(idHeader); id != "" && !contains(k.KeyIds, id) {
+				return deny(c, http.StatusForbidden, "key_id_not_allowed", "API key is not allowed to use upstream key "+id)
+			}
+
+			release, e := admit(k, t.stream)
+			if e != nil {
+				return e.write(c)
+			}
+			defer release()
+			// 通用接口由输出统计用量,透传接口没有计入的取上游响应中的用量,没有的按请求及响应字节数估算
+			if provider == "" || strings.HasPrefix(reqPath, "/c/v1/") || (k.DailyTokens <= 0 && k.MonthlyTokens <= 0) {
+				return next(c)
+			}
+			rw := c.Response().Rw()
+			m := newMeter(rw)
+			c.Response().SetRw(m)
+			err := next(c)
+			c.Response().SetRw(rw)
+			Consume(c, m.tokens(t.size))
+			return err
+		}
+	}
+}
+
+// 请求使用的客户端密钥,没开启时为nil
+func Key(c *fhblade.Context) *config.ClientKey {
+	if v, ok := c.GetKey(clientKey); ok {
+		return v.(*config.ClientKey)
+	}
+	return nil
+}
+
+// 是否可以使用provider、model,model为空只检查provider
+func Allowed(c *fhblade.Context, provider, model string) bool {
+	k := Key(c)
+	if k == nil {
+		return true
+	}
+	return contains(k.Providers, provider) && (model == "" || matchModel(k.Models, model))
+}
+
+// 是否可以使用上游密钥标识
+func KeyAllowed(c *fhblade.Context, id string) bool {
+	k := Key(c)
+	return k == nil || contains(k.KeyIds, id)
+}
+
+// 找到匹配的客户端密钥并从请求中去掉
+func take(c *fhblade.Context) *config.ClientKey {
+	req := c.Request().Req()
+	for _, h := range []string{"Authorization", "x-api-key", "x-goog-api-key"} {
+		v := strings.TrimPrefix(req.Header.Get(h), "Bearer ")
+		if v == "" {
+			continue
+		}
+		if k := find(v); k != nil {
+			req.Header.Del(h)
+			return k
+		}
+	}
+	query := req.URL.Query()
+	if v := query.Get("key"); v != "" {
+		if k := find(v); k != nil {
+			query.Del("key")
+			req.URL.RawQuery = query.Encode()
+			return k
+		}
+	}
+	return nil
+}
+
+func find(key string) *config.ClientKey {
+	keys := config.V().ClientKeys
+	for i := range keys {
+		if subtle.ConstantTimeCompare([]byte(keys[i].Key), []byte(key)) == 1 {
+			return &keys[i]
+		}
+	}
+	return nil
+}
+
+// 请求实际使用的上游,size为请求体字节数
+type target struct {
+	provider string
+	model    string
+	stream   bool
+	size     int
+}
+
+// 请求实际使用的provider及model
+// 通用接口取请求体的provider、model,没传provider的按路由,都没有的为接口默认的上游
+func resolve(c *fhblade.Context, reqPath string) target {
+	switch {
+	case reqPath == "/c/v1/models":
+		return target{}
+	case strings.HasPrefix(reqPath, "/c/v1/"):
+		t := peek(c)
+		if t.provider == "" {
+			if r := config.MatchRoute(t.model); r != nil {
+				t.provider = r.Provider
+			} else if reqPath == "/c/v1/messages" {
+				t.provider = "claude"
+			} else if reqPath != "/c/v1/images/generations" {
+				t.provider = "openai"
+			}
+		}
+		return t
+	case strings.HasPrefix(reqPath, "/gemini/"):
+		t := peek(c)
+		t.provider, t.stream = "gemini", strings.Contains(reqPath, ":streamGenerateContent")
+		// {version}/models/{model}:generateContent按路由转到其他上游
+		_, rest, ok := strings.Cut(reqPath, "/models/")
+		t.model, _, _ = strings.Cut(rest, ":")
+		if ok && t.model != "" {
+			if r := config.MatchRoute(t.model); r != nil {
+				t.provider = r.Provider
+			}
+		}
+		return t
+	case strings.HasPrefix(reqPath, "/claude/"):
+		t := peek(c)
+		t.provider = "claude"
+		return t
+	case strings.HasPrefix(reqPath, "/bing/"):
+		t := peek(c)
+		t.provider, t.model = "bing", ""
+		return t
+	case strings.HasPrefix(reqPath, "/v1/"), strings.HasPrefix(reqPath, "/dashboard/"):
+		t := peek(c)
+		t.provider = "openai"
+		return t
+	case strings.HasPrefix(reqPath, "/backend-api/"), strings.HasPrefix(reqPath, "/backend-anon/"), strings.HasPrefix(reqPath, "/public-api/"):
+		t := peek(c)
+		// 网页版对话都是流式返回
+		t.provider, t.stream = "openai-chat-web", t.stream || strings.HasSuffix(reqPath, "/conversation")
+		return t
+	}
+	// 登录、arkose等不使用上游密钥的接口
+	return target{}
+}
+
+// 读取json请求体的provider、model、stream,请求体保留给后面的处理
+// 处理时不看Content-Type都按json解析,这里也不判断
+func peek(c *fhblade.Context) target {
+	if c.Request().Method() == http.MethodGet {
+		return target{}
+	}
+	body, err := c.Request().RawDataSetBody()
+	if err != nil || len(body) == 0 {
+		return target{}
+	}
+	var p struct {
+		Provider string `json:"provider"`
+		Model    string `json:"model"`
+		Stream   bool   `json:"stream"`
+	}
+	if err := fhblade.Json.Unmarshal(body, &p); err != nil {
+		return target{size: len(body)}
+	}
+	return target{provider: p.Provider, model: p.Model, stream: p.Stream, size: len(body)}
+}
+
+func contains(list []string, v string) bool {
+	if len(list) == 0 {
+		return true
+	}
+	for _, s := range list {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
+func matchModel(patterns []string, model string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, p := range patterns {
+		if p == model {
+			return true
+		}
+		if ok, _ := path.Match(p, model); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func deny(c *fhblade.Context, code int, errCode, msg string) error {
+	errType := "invalid_request_error"
+	if code == http.StatusForbidden {
+		errType = "permission_error"
+	}
+	name := ""
+	if k := Key(c); k != nil {
+		name = k.Name
+	}
+	fhblade.Log.Debug("client key denied",
+		zap.String("path", c.Request().Path()),
+		zap.String("name", name),
+		zap.String("code", errCode))
+	return c.JSONAndStatus(code, types.ErrorResponse{
+		Error: &types.CError{
+			Message: msg,
+			Type:    errType,
+			Code:    errCode,
+		},
+	})
+}
@@ -0,0 +1,198 @@
+package access
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	http "github.com/bogdanfinn/fhttp"
+	"github.com/zatxm/any-proxy/internal/config"
+	"github.com/zatxm/any-proxy/internal/types"
+	"github.com/zatxm/fhblade"
+	"go.uber.org/zap"
+)
+
+// 请求上下文中标记已经计入token用量
+const consumedKey = "client_key_consumed"
+
+// 客户端密钥的用量,按密钥区分,只保存在内存中
+type usage struct {
+	// 最近一分钟内的请求时间
+	requests    []time.Time
+	streams     int
+	day         string
+	dayTokens   int
+	month       string
+	monthTokens int
+}
+
+var (
+	usageMu sync.Mutex
+	usages  = make(map[string]*usage)
+)
+
+// 超出限制,typ同openai的requests、tokens
+type exceeded struct {
+	typ       string
+	message   string
+	limit     int
+	remaining int
+	reset     time.Duration
+}
+
+func limited(k *config.ClientKey) bool {
+	return k.RPM > 0 || k.MaxStreams > 0 || k.DailyTokens > 0 || k.MonthlyTokens > 0
+}
+
+// 取用量,跨天、跨月的清零,调用时需持有usageMu
+func usageOf(k *config.ClientKey, now time.Time) *usage {
+	u := usages[k.Key]
+	if u == nil {
+		u = &usage{}
+		usages[k.Key] = u
+	}
+	if day := now.Format(time.DateOnly); u.day != day {
+		u.day, u.dayTokens = day, 0
+	}
+	if month := now.Format("2006-01"); u.month != month {
+		u.month, u.monthTokens = month, 0
+	}
+	if k.RPM > 0 {
+		n := 0
+		for n < len(u.requests) && !now.Before(u.requests[n].Add(time.Minute)) {
+			n++
+		}
+		u.requests = u.requests[n:]
+	}
+	return u
+}
+
+// 检查各项限制,通过后计入请求数,流式请求结束时调用返回的release
+// token额度在请求前检查,最后一个请求可能超出一些
+func admit(k *config.ClientKey, stream bool) (func(), *exceeded) {
+	if !limited(k) {
+		return func() {}, nil
+	}
+	now := time.Now()
+	usageMu.Lock()
+	defer usageMu.Unlock()
+	u := usageOf(k, now)
+	name := k.Name
+	if name == "" {
+		name = "default"
+	}
+
+	if k.RPM > 0 && len(u.requests) >= k.RPM {
+		reset := u.requests[0].Add(time.Minute).Sub(now)
+		return nil, &exceeded{
+			typ: "requests",
+			message: fmt.Sprintf("Rate limit reached for client key %s on requests per min (RPM): Limit %d, Used %d, Requested 1. Please try again in %s.",
+				name, k.RPM, len(u.requests), ceil(reset)),
+			limit: k.RPM,
+			reset: reset,
+		}
+	}
+	if k.DailyTokens > 0 && u.dayTokens >= k.DailyTokens {
+		y, m, d := now.Date()
+		reset := time.Date(y, m, d+1, 0, 0, 0, 0, now.Location()).Sub(now)
+		return nil, &exceeded{
+			typ: "tokens",
+			message: fmt.Sprintf("Rate limit reached for client key %s on tokens per day (TPD): Limit %d, Used %d. Please try again in %s.",
+				name, k.DailyTokens, u.dayTokens, ceil(reset)),
+			limit: k.DailyTokens,
+			reset: reset,
+		}
+	}
+	if k.MonthlyTokens > 0 && u.monthTokens >= k.MonthlyTokens {
+		y, m, _ := now.Date()
+		reset := time.Date(y, m+1, 1, 0, 0, 0, 0, now.Location()).Sub(now)
+		return nil, &exceeded{
+			typ: "tokens",
+			message: fmt.Sprintf("Rate limit reached for client key %s on tokens per month: Limit %d, Used %d. Please try again in %s.",
+				name, k.MonthlyTokens, u.monthTokens, ceil(reset)),
+			limit: k.MonthlyTokens,
+			reset: reset,
+		}
+	}
+	// 不知道进行中的流什么时候结束,建议1秒后重试
+	if stream && k.MaxStreams > 0 && u.streams >= k.MaxStreams {
+		return nil, &exceeded{
+			typ: "requests",
+			message: fmt.Sprintf("Rate limit reached for client key %s on concurrent streams: Limit %d, Used %d. Please try again in 1s.",
+				name, k.MaxStreams, u.streams),
+			limit: k.MaxStreams,
+			reset: time.Second,
+		}
+	}
+
+	if k.RPM > 0 {
+		u.requests = append(u.requests, now)
+	}
+	if !stream {
+		return func() {}, nil
+	}
+	u.streams++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			usageMu.Lock()
+			u.streams--
+			usageMu.Unlock()
+		})
+	}, nil
+}
+
+// 计入请求使用的token数,上游返回的用量或本地估算
+// 一个请求只计一次,没计入的透传请求结束时取响应中的用量或估算
+func Consume(c *fhblade.Context, tokens int) {
+	k := Key(c)
+	if k == nil {
+		return
+	}
+	if c.GetKeyBool(consumedKey) {
+		return
+	}
+	c.SetKey(consumedKey, true)
+	if tokens <= 0 || (k.DailyTokens <= 0 && k.MonthlyTokens <= 0) {
+		return
+	}
+	usageMu.Lock()
+	u := usageOf(k, time.Now())
+	u.dayTokens += tokens
+	u.monthTokens += tokens
+	usageMu.Unlock()
+}
+
+// 按字节数粗略估算,透传接口拿不到上游用量时使用
+func estimate(size int) int {
+	return (size + 3) / 4
+}
+
+// 向上取整到秒,同openai的x-ratelimit-reset格式如1m30s
+func ceil(d time.Duration) time.Duration {
+	if d < time.Second {
+		return time.Second
+	}
+	return (d + time.Second - 1).Truncate(time.Second)
+}
+
+// 429返回,带Retry-After及x-ratelimit-*重置信息
+func (e *exceeded) write(c *fhblade.Context) error {
+	reset := ceil(e.reset)
+	c.Response().SetHeader("Retry-After", strconv.Itoa(int(reset/time.Second)))
+	c.Response().SetHeader("x-ratelimit-limit-"+e.typ, strconv.Itoa(e.limit))
+	c.Response().SetHeader("x-ratelimit-remaining-"+e.typ, strconv.Itoa(e.remaining))
+	c.Response().SetHeader("x-ratelimit-reset-"+e.typ, reset.String())
+	fhblade.Log.Debug("client key rate limited",
+		zap.String("path", c.Request().Path()),
+		zap.String("name", Key(c).Name),
+		zap.String("type", e.typ))
+	return c.JSONAndStatus(http.StatusTooManyRequests, types.ErrorResponse{
+		Error: &types.CError{
+			Message: e.message,
+			Type:    e.typ,
+			Code:    "rate_limit_exceeded",
+		},
+	})
+}
@@ -0,0 +1,207 @@
+package access
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	http "github.com/bogdanfinn/fhttp"
+	"github.com/bogdanfinn/fhttp/httptest"
+	"github.com/zatxm/any-proxy/internal/config"
+	"github.com/zatxm/any-proxy/internal/types"
+	"github.com/zatxm/fhblade"
+)
+
+func setKeys(t *testing.T, keys ...config.ClientKey) {
+	t.Helper()
+	cfg, err := config.Parse("../../etc/c.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.ClientKeys = keys
+	t.Cleanup(func() {
+		cfg.ClientKeys = nil
+		// 用量是全局的,清掉测试用的
+		usageMu.Lock()
+		for _, k := range keys {
+			delete(usages, k.Key)
+		}
+		usageMu.Unlock()
+	})
+}
+
+// 中间件需在注册路由前添加,tokens为处理时计入的用量,为负不计入
+func newApp(tokens int, block chan struct{}) *fhblade.Blade {
+	app := fhblade.New()
+	app.Use(Middleware())
+	handler := func(c *fhblade.Context) error {
+		if block != nil && strings.Contains(c.Request().RawQuery(), "wait") {
+			<-block
+		}
+		if tokens >= 0 {
+			Consume(c, tokens)
+		}
+		return c.JSONAndStatus(http.StatusOK, fhblade.H{"ok": true})
+	}
+	app.Post("/c/v1/chat/completions", handler)
+	app.Any("/v1/*path", handler)
+	return app
+}
+
+func send(app *fhblade.Blade, key, target, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, target, bytes.NewBufferString(body))
+	req.Header.Set("Authorization", "Bearer "+key)
+	rec := httptest.NewRecorder()
+	app.ServeHTTP(rec, req)
+	return rec
+}
+
+// 检查429返回体及重置信息
+func checkExceeded(t *testing.T, rec *httptest.ResponseRecorder, typ string, limit int, message string, maxReset time.Duration) {
+	t.Helper()
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("code = %d, want 429, body %s", rec.Code, rec.Body.String())
+	}
+	var res types.ErrorResponse
+	if err := fhblade.Json.Unmarshal(rec.Body.Bytes(), &res); err != nil || res.Error == nil {
+		t.Fatalf("invalid error body %s", rec.Body.String())
+	}
+	if res.Error.Type != typ || res.Error.Code != "rate_limit_exceeded" {
+		t.Errorf("error type, code = %s, %s, want %s, rate_limit_exceeded", res.Error.Type, res.Error.Code, typ)
+	}
+	if !strings.Contains(res.Error.Message, message) {
+		t.Errorf("message %q does not contain %q", res.Error.Message, message)
+	}
+	h := rec.Header()
+	retry, err := strconv.Atoi(h.Get("Retry-After"))
+	if err != nil || retry < 1 || time.Duration(retry)*time.Second > maxReset {
+		t.Errorf("Retry-After = %q, want 1..%d", h.Get("Retry-After"), int(maxReset/time.Second))
+	}
+	if v := h.Get("x-ratelimit-limit-" + typ); v != strconv.Itoa(limit) {
+		t.Errorf("x-ratelimit-limit-%s = %q, want %d", typ, v, limit)
+	}
+	if v := h.Get("x-ratelimit-remaining-" + typ); v != "0" {
+		t.Errorf("x-ratelimit-remaining-%s = %q, want 0", typ, v)
+	}
+	reset, err := time.ParseDuration(h.Get("x-ratelimit-reset-" + typ))
+	if err != nil || reset != time.Duration(retry)*time.Second {
+		t.Errorf("x-ratelimit-reset-%s = %q, want %ds", typ, h.Get("x-ratelimit-reset-"+typ), retry)
+	}
+}
+
+func TestRPM(t *testing.T) {
+	setKeys(t, config.ClientKey{Key: "sk-rpm", Name: "rpm", Enabled: true, RPM: 2})
+	app := newApp(-1, nil)
+	for i := 0; i < 2; i++ {
+		if rec := send(app, "sk-rpm", "/c/v1/chat/completions", `{}`); rec.Code != http.StatusOK {
+			t.Fatalf("request %d: code = %d", i, rec.Code)
+		}
+	}
+	rec := send(app, "sk-rpm", "/c/v1/chat/completions", `{}`)
+	checkExceeded(t, rec, "requests", 2, "requests per min (RPM): Limit 2, Used 2", time.Minute)
+}
+
+func TestTokenBudgets(t *testing.T) {
+	tests := []struct {
+		name    string
+		key     config.ClientKey
+		target  string
+		body    string
+		tokens  int
+		allowed int
+		limit   int
+		message string
+		reset   time.Duration
+	}{
+		{
+			name:    "daily",
+			key:     config.ClientKey{Key: "sk-day", Enabled: true, DailyTokens: 150},
+			target:  "/c/v1/chat/completions",
+			body:    `{}`,
+			tokens:  100,
+			allowed: 2,
+			limit:   150,
+			message: "tokens per day (TPD): Limit 150, Used 200",
+			reset:   24 * time.Hour,
+		},
+		{
+			name:    "monthly",
+			key:     config.ClientKey{Key: "sk-month", Enabled: true, MonthlyTokens: 100},
+			target:  "/c/v1/chat/completions",
+			body:    `{}`,
+			tokens:  60,
+			allowed: 2,
+			limit:   100,
+			message: "tokens per month: Limit 100, Used 120",
+			reset:   31 * 24 * time.Hour,
+		},
+		{
+			// 透传接口响应中没有用量的按请求体及响应估算,39+11字节约13个token
+			name:    "passthrough estimate",
+			key:     config.ClientKey{Key: "sk-estimate", Enabled: true, DailyTokens: 10},
+			target:  "/v1/chat/completions",
+			body:    `{"model":"gpt-4o","input":"0123456789"}`,
+			tokens:  -1,
+			allowed: 1,
+			limit:   10,
+			message: "tokens per day (TPD): Limit 10, Used 13",
+			reset:   24 * time.Hour,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setKeys(t, tt.key)
+			app := newApp(tt.tokens, nil)
+			for i := 0; i < tt.allowed; i++ {
+				if rec := send(app, tt.key.Key, tt.target, tt.body); rec.Code != http.StatusOK {
+					t.Fatalf("request %d: code = %d, body %s", i, rec.Code, rec.Body.String())
+				}
+			}
+			rec := send(app, tt.key.Key, tt.target, tt.body)
+			checkExceeded(t, rec, "tokens", tt.limit, tt.message, tt.reset)
+		})
+	}
+}
+
+func TestMaxStreams(t *testing.T) {
+	setKeys(t, config.ClientKey{Key: "sk-stream", Enabled: true, MaxStreams: 1})
+	block := make(chan struct{})
+	app := newApp(-1, block)
+	done := make(chan int)
+	go func() {
+		done <- send(app, "sk-stream", "/c/v1/chat/completions?wait=1", `{"stream":true}`).Code
+	}()
+	deadline := time.Now().Add(time.Second)
+	for {
+		usageMu.Lock()
+		streams := 0
+		if u := usages["sk-stream"]; u != nil {
+			streams = u.streams
+		}
+		usageMu.Unlock()
+		if streams == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("stream not started")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	rec := send(app, "sk-stream", "/c/v1/chat/completions", `{"stream":true}`)
+	checkExceeded(t, rec, "requests", 1, "concurrent streams: Limit 1, Used 1", time.Second)
+	// 非流式请求不受限制
+	if rec := send(app, "sk-stream", "/c/v1/chat/completions", `{}`); rec.Code != http.StatusOK {
+		t.Errorf("non stream code = %d, want 200", rec.Code)
+	}
+
+	close(block)
+	if code := <-done; code != http.StatusOK {
+		t.Fatalf("first stream code = %d", code)
+	}
+	if rec := send(app, "sk-stream", "/c/v1/chat/completions", `{"stream":true}`); rec.Code != http.StatusOK {
+		t.Errorf("stream after release code = %d, want 200", rec.Code)
+	}
+}
@@ -0,0 +1,245 @@
+package access
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	http "github.com/bogdanfinn/fhttp"
+	"github.com/klauspost/compress/zstd"
+	"github.com/zatxm/fhblade"
+)
+
+const (
+	// 压缩的响应最多保存的字节数,超出的按输出字节数估算
+	maxMeterRaw = 8 << 20
+	// 一个用量对象最大的字节数,超出的丢弃
+	maxMeterObject = 64 << 10
+)
+
+// openai、claude、gemini响应中用量的key
+var usageKeys = [][]byte{[]byte(`"usage":`), []byte(`"usageMetadata":`)}
+
+// 各上游的用量字段
+// openai chat为prompt、completion,responses及claude为input、output,gemini为*TokenCount
+type upstreamUsage struct {
+	PromptTokens             int `json:"prompt_tokens"`
+	CompletionTokens         int `json:"completion_tokens"`
+	TotalTokens              int `json:"total_tokens"`
+	InputTokens              int `json:"input_tokens"`
+	OutputTokens             int `json:"output_tokens"`
+	CacheCreationInputTokens int `json:"cache_creation_input_tokens"`
+	CacheReadInputTokens     int `json:"cache_read_input_tokens"`
+	PromptTokenCount         int `json:"promptTokenCount"`
+	CandidatesTokenCount     int `json:"candidatesTokenCount"`
+	ThoughtsTokenCount       int `json:"thoughtsTokenCount"`
+	TotalTokenCount          int `json:"totalTokenCount"`
+}
+
+// 流式时用量分几次返回(如claude的message_start、message_delta),后面的覆盖前面的
+func (u *upstreamUsage) merge(v *upstreamUsage) {
+	for _, f := range [][2]*int{
+		{&u.PromptTokens, &v.PromptTokens},
+		{&u.CompletionTokens, &v.CompletionTokens},
+		{&u.TotalTokens, &v.TotalTokens},
+		{&u.InputTokens, &v.InputTokens},
+		{&u.OutputTokens, &v.OutputTokens},
+		{&u.CacheCreationInputTokens, &v.CacheCreationInputTokens},
+		{&u.CacheReadInputTokens, &v.CacheReadInputTokens},
+		{&u.PromptTokenCount, &v.PromptTokenCount},
+		{&u.CandidatesTokenCount, &v.CandidatesTokenCount},
+		{&u.ThoughtsTokenCount, &v.ThoughtsTokenCount},
+		{&u.TotalTokenCount, &v.TotalTokenCount},
+	} {
+		if *f[1] > 0 {
+			*f[0] = *f[1]
+		}
+	}
+}
+
+// 各格式的合计取最大的
+func (u *upstreamUsage) total() int {
+	return max(u.TotalTokens,
+		u.TotalTokenCount,
+		u.PromptTokens+u.CompletionTokens,
+		u.InputTokens+u.OutputTokens+u.CacheCreationInputTokens+u.CacheReadInputTokens,
+		u.PromptTokenCount+u.CandidatesTokenCount+u.ThoughtsTokenCount)
+}
+
+// 透传接口的响应,统计输出的字节数并取上游返回的用量
+// 没压缩的边输出边查找,压缩的保存原始数据结束时解压后查找
+type meter struct {
+	http.ResponseWriter
+	written int
+	usage   upstreamUsage
+	found   bool
+	// 还没处理完的数据
+	buf      []byte
+	encoding string
+	started  bool
+	raw      bytes.Buffer
+	overflow bool
+}
+
+func newMeter(rw http.ResponseWriter) *meter {
+	return &meter{ResponseWriter: rw}
+}
+
+func (m *meter) Write(p []byte) (int, error) {
+	if !m.started {
+		m.started = true
+		m.encoding = strings.ToLower(strings.TrimSpace(m.Header().Get("Content-Encoding")))
+		if m.encoding == "identity" {
+			m.encoding = ""
+		}
+	}
+	n, err := m.ResponseWriter.Write(p)
+	m.written += n
+	switch {
+	case m.encoding == "":
+		m.scan(p[:n])
+	case !m.overflow && m.raw.Len()+n <= maxMeterRaw:
+		m.raw.Write(p[:n])
+	default:
+		m.overflow = true
+		m.raw.Reset()
+	}
+	return n, err
+}
+
+func (m *meter) Flush() {
+	if f, ok := m.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (m *meter) Unwrap() http.ResponseWriter {
+	return m.ResponseWriter
+}
+
+// 查找完整的用量对象,不完整的留到下次
+func (m *meter) scan(p []byte) {
+	m.buf = append(m.buf, p...)
+	for {
+		i, key := nextUsageKey(m.buf)
+		if i == -1 {
+			// 保留可能是key开头的尾部
+			if keep := len(usageKeys[1]) - 1; len(m.buf) > keep {
+				m.buf = append(m.buf[:0], m.buf[len(m.buf)-keep:]...)
+			}
+			return
+		}
+		rest := bytes.TrimLeft(m.buf[i+len(key):], " \t\r\n")
+		if len(rest) == 0 {
+			m.buf = append(m.buf[:0], m.buf[i:]...)
+			return
+		}
+		if rest[0] != '{' {
+			// null等
+			m.buf = m.buf[i+len(key):]
+			continue
+		}
+		end := objectEnd(rest)
+		if end == -1 {
+			if len(rest) > maxMeterObject {
+				m.buf = m.buf[:0]
+				return
+			}
+			m.buf = append(m.buf[:0], m.buf[i:]...)
+			return
+		}
+		var u upstreamUsage
+		if err := fhblade.Json.Unmarshal(rest[:end], &u); err == nil {
+			m.usage.merge(&u)
+			m.found = true
+		}
+		m.buf = rest[end:]
+	}
+}
+
+func nextUsageKey(b []byte) (int, []byte) {
+	i, key := -1, []byte(nil)
+	for _, k := range usageKeys {
+		if j := bytes.Index(b, k); j != -1 && (i == -1 || j < i) {
+			i, key = j, k
+		}
+	}
+	return i, key
+}
+
+// b以{开头,返回对应}后的位置,不完整返回-1
+func objectEnd(b []byte) int {
+	depth, inString, escaped := 0, false, false
+	for k, ch := range b {
+		switch {
+		case escaped:
+			escaped = false
+		case inString:
+			if ch == '\\' {
+				escaped = true
+			} else if ch == '"' {
+				inString = false
+			}
+		case ch == '"':
+			inString = true
+		case ch == '{':
+			depth++
+		case ch == '}':
+			if depth--; depth == 0 {
+				return k + 1
+			}
+		}
+	}
+	return -1
+}
+
+// 请求使用的token数,上游没返回用量的按请求体及响应字节数估算
+func (m *meter) tokens(size int) int {
+	if m.encoding != "" && !m.overflow && m.raw.Len() > 0 {
+		if r := decoder(m.encoding, m.raw.Bytes()); r != nil {
+			buf := make([]byte, 32<<10)
+			for {
+				n, err := r.Read(buf)
+				m.scan(buf[:n])
+				if err != nil {
+					break
+				}
+			}
+			r.Close()
+		}
+		m.raw.Reset()
+	}
+	if m.found {
+		if total := m.usage.total(); total > 0 {
+			return total
+		}
+	}
+	return estimate(size + m.written)
+}
+
+// 同请求上游的Accept-Encoding,不支持的返回nil
+func decoder(encoding string, data []byte) io.ReadCloser {
+	switch encoding {
+	case "gzip":
+		if r, err := gzip.NewReader(bytes.NewReader(data)); err == nil {
+			return r
+		}
+	case "deflate":
+		// 一般是zlib格式,也有直接deflate的
+		if r, err := zlib.NewReader(bytes.NewReader(data)); err == nil {
+			return r
+		}
+		return flate.NewReader(bytes.NewReader(data))
+	case "br":
+		return io.NopCloser(brotli.NewReader(bytes.NewReader(data)))
+	case "zstd":
+		if d, err := zstd.NewReader(bytes.NewReader(data)); err == nil {
+			return d.IOReadCloser()
+		}
+	}
+	return nil
+}
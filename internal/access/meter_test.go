@@ -0,0 +1,126 @@
+package access
+
+import (
+	"bytes"
+	"compress/gzip"
+	"testing"
+
+	http "github.com/bogdanfinn/fhttp"
+	"github.com/zatxm/any-proxy/internal/config"
+	"github.com/zatxm/fhblade"
+)
+
+func gzipped(s string) string {
+	var b bytes.Buffer
+	zw := gzip.NewWriter(&b)
+	zw.Write([]byte(s))
+	zw.Close()
+	return b.String()
+}
+
+// 透传接口按上游响应中的用量计入
+func TestPassthroughUsage(t *testing.T) {
+	tests := []struct {
+		name     string
+		target   string
+		encoding string
+		chunks   []string
+		tokens   int
+	}{
+		{
+			name:   "openai json",
+			target: "/v1/chat/completions",
+			chunks: []string{`{"id":"x","choices":[],"usage":{"prompt_tokens":12,"completion_tokens":30,"total_tokens":42,"prompt_tokens_details":{"cached_tokens":0}}}`},
+			tokens: 42,
+		},
+		{
+			name:   "openai stream split",
+			target: "/v1/chat/completions",
+			chunks: []string{
+				"data: {\"choices\":[{\"delta\":{\"content\":\"\\\"usage\\\": {\"}}],\"usage\":null}\n\n",
+				"data: {\"choices\":[],\"us", "age\":{\"prompt_tokens\":5,\"compl", "etion_tokens\":7,\"total_tokens\":12}}\n\ndata: [DONE]\n\n",
+			},
+			tokens: 12,
+		},
+		{
+			name:   "responses",
+			target: "/v1/responses",
+			chunks: []string{"event: response.completed\ndata: {\"response\":{\"usage\":{\"input_tokens\":20,\"output_tokens\":8,\"total_tokens\":28}}}\n\n"},
+			tokens: 28,
+		},
+		{
+			name:   "claude stream",
+			target: "/claude/api/v1/messages",
+			chunks: []string{
+				"event: message_start\ndata: {\"message\":{\"usage\":{\"input_tokens\":25,\"cache_read_input_tokens\":100,\"output_tokens\":1}}}\n\n",
+				"event: content_block_delta\ndata: {\"delta\":{\"text\":\"hi\"}}\n\n",
+				"event: message_delta\ndata: {\"usage\":{\"output_tokens\":15}}\n\n",
+			},
+			tokens: 140,
+		},
+		{
+			name:   "gemini stream",
+			target: "/gemini/v1beta/models/gemini-pro:streamGenerateContent",
+			chunks: []string{
+				`[{"candidates":[],"usageMetadata":{"promptTokenCount":9,"candidatesTokenCount":2,"totalTokenCount":11}}`,
+				`,{"candidates":[],"usageMetadata":{"promptTokenCount":9,"candidatesTokenCount":40,"totalTokenCount":49}}]`,
+			},
+			tokens: 49,
+		},
+		{
+			name:     "gzip",
+			target:   "/v1/chat/completions",
+			encoding: "gzip",
+			chunks:   []string{gzipped(`{"usage":{"prompt_tokens":100,"completion_tokens":200,"total_tokens":300}}`)},
+			tokens:   300,
+		},
+		{
+			// 没有用量按请求体2字节及响应38字节估算
+			name:   "no usage",
+			target: "/backend-api/conversation",
+			chunks: []string{"data: {\"message\":\"0123456789012345\"}\n\n"},
+			tokens: 10,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key := "sk-meter-" + tt.name
+			setKeys(t, config.ClientKey{Key: key, Enabled: true, DailyTokens: 100000})
+			app := fhblade.New()
+			app.Use(Middleware())
+			handler := func(c *fhblade.Context) error {
+				if tt.encoding != "" {
+					c.Response().SetHeader("Content-Encoding", tt.encoding)
+				}
+				rw := c.Response().Rw()
+				rw.WriteHeader(http.StatusOK)
+				for _, chunk := range tt.chunks {
+					rw.Write([]byte(chunk))
+					rw.(http.Flusher).Flush()
+				}
+				return nil
+			}
+			app.Any("/v1/*path", handler)
+			app.Any("/claude/*path", handler)
+			app.Any("/gemini/*path", handler)
+			app.Any("/backend-api/*path", handler)
+			rec := send(app, key, tt.target, `{}`)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("code = %d, body %s", rec.Code, rec.Body.String())
+			}
+			var body string
+			for _, chunk := range tt.chunks {
+				body += chunk
+			}
+			if rec.Body.String() != body {
+				t.Errorf("body changed: %q", rec.Body.String())
+			}
+			usageMu.Lock()
+			got := usages[key].dayTokens
+			usageMu.Unlock()
+			if got != tt.tokens {
+				t.Errorf("tokens = %d, want %d", got, tt.tokens)
+			}
+		})
+	}
+}
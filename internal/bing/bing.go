@@ -2,17 +2,20 @@ package bing
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"mime/multipart"
 	ohttp "net/http"
 	"net/url"
+	"regexp"
 	"strings"
 	"time"
 
 	http "github.com/bogdanfinn/fhttp"
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
+	"github.com/zatxm/any-proxy/internal/chat"
 	"github.com/zatxm/any-proxy/internal/client"
 	"github.com/zatxm/any-proxy/internal/config"
 	"github.com/zatxm/any-proxy/internal/types"
@@ -89,6 +92,18 @@ var (
 	WssScheme                     = "wss"
 	WssHost                       = "sydney.bing.com"
 	WssPath                       = "/sydney/ChatHub"
+	ImageCreateUrl                = "https://www.bing.com/images/create"
+	ImageResultUrl                = "https://www.bing.com/images/create/async/results/"
+
+	// Image Creator轮询结果的间隔及超时
+	imagePollInterval = 3 * time.Second
+	imageTimeout      = 300 * time.Second
+	imageSrcRegexp    = regexp.MustCompile(`src="(https://[^"]+/th/id/OIG[^"]*)"`)
+
+	ErrImageCookie   = errors.New("bing image_cookie not config")
+	ErrImageBlocked  = errors.New("bing image prompt has been blocked")
+	ErrImageLanguage = errors.New("bing image creator does not support this language")
+	ErrImageTimeout  = errors.New("bing image generation timeout")
 )
 
 func DoDeleteConversation() func(*fhblade.Context) error {
@@ -160,19 +175,17 @@ func DoSendMessage() func(*fhblade.Context) error {
 		if err := c.ShouldBindJSON(&p); err != nil {
 			return c.JSONAndStatus(http.StatusBadRequest, fhblade.H{"errorMessage": "params error"})
 		}
-		return DoChatCompletions(c, p)
+		return DoChatCompletions(c, p, chat.NewWriter(c, true))
 	}
 }
 
-func DoChatCompletions(c *fhblade.Context, p types.ChatCompletionRequest) error {
+func DoChatCompletions(c *fhblade.Context, p types.ChatCompletionRequest, w chat.Writer) error {
 	prompt := p.ParsePromptText()
 	if prompt == "" {
-		return c.JSONAndStatus(http.StatusBadRequest, types.ErrorResponse{
-			Error: &types.CError{
-				Message: "params error",
-				Type:    "invalid_request_error",
-				Code:    "request_err",
-			},
+		return w.Error(http.StatusBadRequest, &types.CError{
+			Message: "params error",
+			Type:    "invalid_request_error",
+			Code:    "request_err",
 		})
 	}
 	if p.Bing == nil {
@@ -183,12 +196,10 @@ func DoChatCompletions(c *fhblade.Context, p types.ChatCompletionRequest) error
 		var err error
 		jpgBase64, err = processImageBase64(p.Bing.ImageBase64)
 		if err != nil {
-			return c.JSONAndStatus(http.StatusBadRequest, types.ErrorResponse{
-				Error: &types.CError{
-					Message: err.Error(),
-					Type:    "invalid_request_error",
-					Code:    "request_err",
-				},
+			return w.Error(http.StatusBadRequest, &types.CError{
+				Message: err.Error(),
+				Type:    "invalid_request_error",
+				Code:    "request_err",
 			})
 		}
 	}
@@ -196,13 +207,7 @@ func DoChatCompletions(c *fhblade.Context, p types.ChatCompletionRequest) error
 	if p.Bing.Conversation == nil {
 		conversation, err := createConversation()
 		if err != nil {
-			return c.JSONAndStatus(http.StatusBadRequest, types.ErrorResponse{
-				Error: &types.CError{
-					Message: err.Error(),
-					Type:    "invalid_request_error",
-					Code:    "request_err",
-				},
-			})
+			return chat.StatusError(http.StatusBadGateway, err.Error()).Write(c, w)
 		}
 		p.Bing.Conversation = conversation
 	}
@@ -234,12 +239,10 @@ func DoChatCompletions(c *fhblade.Context, p types.ChatCompletionRequest) error
 			fhblade.Log.Error("bing DoSendMessage() img upload http.NewRequest err",
 				zap.Error(err),
 				zap.String("data", requestBody.String()))
-			return c.JSONAndStatus(http.StatusInternalServerError, types.ErrorResponse{
-				Error: &types.CError{
-					Message: err.Error(),
-					Type:    "invalid_request_error",
-					Code:    "request_err",
-				},
+			return w.Error(http.StatusInternalServerError, &types.CError{
+				Message: err.Error(),
+				Type:    "invalid_request_error",
+				Code:    "request_err",
 			})
 		}
 		req.Header = dheaders
@@ -254,13 +257,7 @@ func DoChatCompletions(c *fhblade.Context, p types.ChatCompletionRequest) error
 			fhblade.Log.Error("bing DoSendMessage() img upload gClient.Do err",
 				zap.Error(err),
 				zap.String("data", requestBody.String()))
-			return c.JSONAndStatus(http.StatusInternalServerError, types.ErrorResponse{
-				Error: &types.CError{
-					Message: err.Error(),
-					Type:    "invalid_request_error",
-					Code:    "request_err",
-				},
-			})
+			return chat.ConnError(err).Write(c, w)
 		}
 		defer resp.Body.Close()
 		imgRes := &types.BingImgBlob{}
@@ -268,12 +265,10 @@ func DoChatCompletions(c *fhblade.Context, p types.ChatCompletionRequest) error
 			fhblade.Log.Error("bing DoSendMessage() img upload res json err",
 				zap.Error(err),
 				zap.String("data", requestBody.String()))
-			return c.JSONAndStatus(http.StatusInternalServerError, types.ErrorResponse{
-				Error: &types.CError{
-					Message: err.Error(),
-					Type:    "invalid_request_error",
-					Code:    "request_err",
-				},
+			return w.Error(http.StatusInternalServerError, &types.CError{
+				Message: err.Error(),
+				Type:    "invalid_request_error",
+				Code:    "request_err",
 			})
 		}
 		imgUrlId := imgRes.BlobId
@@ -283,7 +278,27 @@ func DoChatCompletions(c *fhblade.Context, p types.ChatCompletionRequest) error
 		p.Bing.Conversation.ImageUrl = ImageUrl + imgUrlId
 	}
 
-	msgByte := generateMessage(p.Bing.Conversation, prompt, isStartOfSession)
+	// 新会话按配置带上之前的消息
+	var previousMessages []*types.BingPreviousMessage
+	if isStartOfSession {
+		history, last := chat.SplitHistory(p.Messages)
+		if last != nil && len(history) > 0 {
+			switch config.V().Bing.HistoryMode {
+			case chat.HistoryTranscript:
+				prompt = chat.Transcript(history, chat.MessageText(last))
+			case chat.HistoryChain:
+				previousMessages = []*types.BingPreviousMessage{&types.BingPreviousMessage{
+					Author:      "user",
+					Description: chat.HistoryText(history),
+					ContextType: "WebPage",
+					MessageType: "Context",
+					MessageId:   "discover-web--page-ping-mriduna-----",
+				}}
+				prompt = chat.MessageText(last)
+			}
+		}
+	}
+	msgByte := generateMessage(p.Bing.Conversation, prompt, isStartOfSession, previousMessages)
 
 	urlParams := url.Values{"sec_access_token": {p.Bing.Conversation.Signature}}
 	u := url.URL{
@@ -300,12 +315,10 @@ func DoChatCompletions(c *fhblade.Context, p types.ChatCompletionRequest) error
 			fhblade.Log.Error("bing DoSendMessage() set proxy err",
 				zap.Error(err),
 				zap.String("url", proxyCfgUrl))
-			return c.JSONAndStatus(http.StatusInternalServerError, types.ErrorResponse{
-				Error: &types.CError{
-					Message: err.Error(),
-					Type:    "invalid_request_error",
-					Code:    "request_err",
-				},
+			return w.Error(http.StatusInternalServerError, &types.CError{
+				Message: err.Error(),
+				Type:    "invalid_request_error",
+				Code:    "request_err",
 			})
 		}
 		dialer.Proxy = ohttp.ProxyURL(proxyURL)
@@ -321,36 +334,15 @@ func DoChatCompletions(c *fhblade.Context, p types.ChatCompletionRequest) error
 		fhblade.Log.Error("bing DoSendMessage() wc req err",
 			zap.String("url", wssUrl),
 			zap.Error(err))
-		return c.JSONAndStatus(http.StatusInternalServerError, types.ErrorResponse{
-			Error: &types.CError{
-				Message: err.Error(),
-				Type:    "invalid_request_error",
-				Code:    "request_err",
-			},
-		})
+		return chat.ConnError(err).Write(c, w)
 	}
 	defer wc.Close()
-
-	rw := c.Response().Rw()
-	flusher, ok := rw.(http.Flusher)
-	if !ok {
-		return c.JSONAndStatus(http.StatusNotImplemented, types.ErrorResponse{
-			Error: &types.CError{
-				Message: "Flushing not supported",
-				Type:    "invalid_systems_error",
-				Code:    "systems_error",
-			},
-		})
-	}
-	header := rw.Header()
-	header.Set("Content-Type", vars.ContentTypeStream)
-	header.Set("Cache-Control", "no-cache")
-	header.Set("Connection", "keep-alive")
-	header.Set("Access-Control-Allow-Origin", "*")
-	rw.WriteHeader(200)
+	// 并发请求中其他请求出错时关闭连接结束读取
+	defer context.AfterFunc(chat.Context(c, w), func() { wc.Close() })()
 
 	splitByte := []byte{WsDelimiterByte}
 	endByteTag := []byte(`{"type":3`)
+	var wsErr *chat.UpstreamError
 	cancle := make(chan struct{})
 	// 处理返回数据
 	go func() {
@@ -366,8 +358,6 @@ func DoChatCompletions(c *fhblade.Context, p types.ChatCompletionRequest) error
 			for k := range msgArr {
 				if len(msgArr[k]) > 0 {
 					if bytes.HasPrefix(msgArr[k], endByteTag) {
-						fmt.Fprint(rw, "data: [DONE]\n\n")
-						flusher.Flush()
 						close(cancle)
 						return
 					}
@@ -411,8 +401,13 @@ func DoChatCompletions(c *fhblade.Context, p types.ChatCompletionRequest) error
 							}
 						}
 					case 2:
-						fmt.Fprint(rw, "data: [DONE]\n\n")
-						flusher.Flush()
+						// 最终结果不是Success的为限流、验证码等错误
+						if resArr.Item != nil && resArr.Item.Result != nil {
+							result := resArr.Item.Result
+							if result.Value != "" && result.Value != "Success" {
+								wsErr = chat.BingError(result.Value, result.Message)
+							}
+						}
 						close(cancle)
 						return
 					}
@@ -428,16 +423,14 @@ func DoChatCompletions(c *fhblade.Context, p types.ChatCompletionRequest) error
 									Content: tMsg,
 								},
 							})
-							outRes := types.ChatCompletionResponse{
+							outRes := &types.ChatCompletionResponse{
 								ID:      p.Bing.Conversation.ConversationId,
 								Choices: choices,
 								Created: now,
 								Model:   ThisModel,
 								Object:  "chat.completion.chunk",
 								Bing:    p.Bing.Conversation}
-							resJson, _ := fhblade.Json.Marshal(outRes)
-							fmt.Fprintf(rw, "data: %s\n\n", resJson)
-							flusher.Flush()
+							w.Write(outRes)
 						}
 					}
 				}
@@ -450,51 +443,178 @@ func DoChatCompletions(c *fhblade.Context, p types.ChatCompletionRequest) error
 	err = wc.WriteMessage(websocket.TextMessage, msgStart)
 	if err != nil {
 		fhblade.Log.Error("bing DoSendMessage() wc write err", zap.Error(err))
-		return c.JSONAndStatus(http.StatusInternalServerError, types.ErrorResponse{
-			Error: &types.CError{
-				Message: err.Error(),
-				Type:    "invalid_request_error",
-				Code:    "request_err",
-			},
+		return w.Error(http.StatusInternalServerError, &types.CError{
+			Message: err.Error(),
+			Type:    "invalid_request_error",
+			Code:    "request_err",
 		})
 	}
 	msgInput := append([]byte(`{"type":6}`), WsDelimiterByte)
 	err = wc.WriteMessage(websocket.TextMessage, msgInput)
 	if err != nil {
 		fhblade.Log.Error("bing DoSendMessage() wc write input err", zap.Error(err))
-		return c.JSONAndStatus(http.StatusInternalServerError, types.ErrorResponse{
-			Error: &types.CError{
-				Message: err.Error(),
-				Type:    "invalid_request_error",
-				Code:    "request_err",
-			},
+		return w.Error(http.StatusInternalServerError, &types.CError{
+			Message: err.Error(),
+			Type:    "invalid_request_error",
+			Code:    "request_err",
 		})
 	}
 	err = wc.WriteMessage(websocket.TextMessage, msgByte)
 	if err != nil {
 		fhblade.Log.Error("bing DoSendMessage() wc write msg err", zap.Error(err))
-		return c.JSONAndStatus(http.StatusInternalServerError, types.ErrorResponse{
-			Error: &types.CError{
-				Message: err.Error(),
-				Type:    "invalid_request_error",
-				Code:    "request_err",
-			},
+		return w.Error(http.StatusInternalServerError, &types.CError{
+			Message: err.Error(),
+			Type:    "invalid_request_error",
+			Code:    "request_err",
 		})
 	}
 
+	// 超时关闭连接,等读取协程退出后再结束输出
 	timer := time.NewTimer(900 * time.Second)
 	defer timer.Stop()
+	select {
+	case <-cancle:
+		wc.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	case <-timer.C:
+		wc.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+		wc.Close()
+		<-cancle
+	}
+	if wsErr != nil {
+		return wsErr.Write(c, w)
+	}
+	return w.Done()
+}
+
+// Image Creator生成图片,返回图片地址
+// 提交提示词后重定向地址带任务id,再轮询结果页
+func GenerateImages(c *fhblade.Context, prompt string) ([]string, error) {
+	cookie := config.V().Bing.ImageCookie
+	if cookie == "" {
+		return nil, ErrImageCookie
+	}
+	if !strings.Contains(cookie, "=") {
+		cookie = "_U=" + cookie
+	}
+	gClient := client.CPool.Get().(tlsClient.HttpClient)
+	defer client.CPool.Put(gClient)
+	proxyUrl := config.BingProxyUrl()
+	if proxyUrl != "" {
+		gClient.SetProxy(proxyUrl)
+	}
+	gClient.SetFollowRedirect(false)
+	defer gClient.SetFollowRedirect(true)
+
+	// rt=4为加速生成,失败再用rt=3
+	q := url.QueryEscape(prompt)
+	id := ""
+	for _, rt := range []string{"4", "3"} {
+		goUrl := ImageCreateUrl + "?q=" + q + "&rt=" + rt + "&FORM=GENCRE"
+		req, err := http.NewRequest(http.MethodPost, goUrl, strings.NewReader("q="+q+"&qs=ds"))
+		if err != nil {
+			return nil, err
+		}
+		req.Header = imageHeaders(cookie)
+		req.Header.Set("content-type", "application/x-www-form-urlencoded")
+		resp, err := gClient.Do(req)
+		if err != nil {
+			fhblade.Log.Error("bing GenerateImages() create req err", zap.Error(err))
+			return nil, err
+		}
+		body, _ := tools.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err := imageBodyError(body); err != nil {
+			return nil, err
+		}
+		if u, err := url.Parse(resp.Header.Get("Location")); err == nil {
+			id = u.Query().Get("id")
+		}
+		if id != "" {
+			break
+		}
+	}
+	if id == "" {
+		fhblade.Log.Error("bing GenerateImages() create no id", zap.String("prompt", prompt))
+		return nil, errors.New("bing image create failed, check image_cookie")
+	}
+
+	// 轮询结果,结果页为空表示还在生成
+	pollUrl := ImageResultUrl + id + "?q=" + q
+	timer := time.NewTimer(imageTimeout)
+	defer timer.Stop()
+	ticker := time.NewTicker(imagePollInterval)
+	defer ticker.Stop()
+	clientGone := c.Request().Context().Done()
 	for {
 		select {
-		case <-cancle:
-			wc.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
-			return nil
+		case <-clientGone:
+			return nil, c.Request().Context().Err()
 		case <-timer.C:
-			close(cancle)
-			wc.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
-			return nil
+			return nil, ErrImageTimeout
+		case <-ticker.C:
 		}
+		req, err := http.NewRequest(http.MethodGet, pollUrl, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header = imageHeaders(cookie)
+		resp, err := gClient.Do(req)
+		if err != nil {
+			fhblade.Log.Error("bing GenerateImages() poll req err", zap.Error(err))
+			return nil, err
+		}
+		body, _ := tools.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			fhblade.Log.Error("bing GenerateImages() poll res status err",
+				zap.Int("code", resp.StatusCode),
+				zap.ByteString("data", body))
+			return nil, fmt.Errorf("bing image result status %d", resp.StatusCode)
+		}
+		if len(bytes.TrimSpace(body)) == 0 {
+			continue
+		}
+		if err := imageBodyError(body); err != nil {
+			return nil, err
+		}
+		var urls []string
+		seen := make(map[string]bool)
+		for _, match := range imageSrcRegexp.FindAllSubmatch(body, -1) {
+			// 去掉缩略图参数取原图
+			u, _, _ := strings.Cut(string(match[1]), "?")
+			if !seen[u] {
+				seen[u] = true
+				urls = append(urls, u)
+			}
+		}
+		if len(urls) > 0 {
+			return urls, nil
+		}
+	}
+}
+
+func imageHeaders(cookie string) http.Header {
+	return http.Header{
+		"accept":          {"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8"},
+		"accept-encoding": {vars.AcceptEncoding},
+		"accept-language": {"en-US,en;q=0.9"},
+		"cookie":          {cookie},
+		"origin":          {OriginUrl},
+		"referer":         {ImageCreateUrl},
+		"user-agent":      {vars.UserAgent},
+	}
+}
+
+// 提示词被拦截或语言不支持时页面返回的提示
+func imageBodyError(body []byte) error {
+	text := strings.ToLower(tools.BytesToString(body))
+	if strings.Contains(text, "this prompt has been blocked") {
+		return ErrImageBlocked
+	}
+	if strings.Contains(text, "we're working hard to offer image creator in more languages") {
+		return ErrImageLanguage
 	}
+	return nil
 }
 
 func parseCookies() string {
@@ -551,7 +671,7 @@ func generateBoundary() string {
 	return "----WebKitFormBoundary" + support.GenerateRandomString(16)
 }
 
-func generateMessage(c *types.BingConversation, prompt string, isStartOfSession bool) []byte {
+func generateMessage(c *types.BingConversation, prompt string, isStartOfSession bool, previousMessages []*types.BingPreviousMessage) []byte {
 	id := uuid.NewString()
 	ct := &types.BingCenter{
 		Latitude:  34.0536909,
@@ -593,7 +713,8 @@ func generateMessage(c *types.BingConversation, prompt string, isStartOfSession
 		Tone:                           "Creative",
 		SpokenTextMode:                 "None",
 		ConversationId:                 c.ConversationId,
-		Participant:                    pc}
+		Participant:                    pc,
+		PreviousMessages:               previousMessages}
 	smr := &types.BingSendMessageRequest{
 		Arguments:    []*types.BingRequestArgument{arg},
 		InvocationId: uuid.NewString(),
@@ -604,3 +725,13 @@ func generateMessage(c *types.BingConversation, prompt string, isStartOfSession
 	opMsg = append(opMsg, WsDelimiterByte)
 	return opMsg
 }
+
+func Models() []*types.Model {
+	return []*types.Model{&types.Model{
+		ID:       ThisModel,
+		Object:   "model",
+		Created:  time.Now().Unix(),
+		OwnedBy:  "microsoft",
+		Provider: Provider,
+	}}
+}
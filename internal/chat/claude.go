@@ -0,0 +1,280 @@
+package chat
+
+import (
+	"strings"
+
+	http "github.com/bogdanfinn/fhttp"
+	"github.com/google/uuid"
+	"github.com/zatxm/any-proxy/internal/types"
+	"github.com/zatxm/fhblade"
+)
+
+// 按claude messages api格式输出,stream时返回anthropic sse事件
+// 只输出第一个choice
+func NewClaudeWriter(c *fhblade.Context, stream bool, model string, inputTokens int) Writer {
+	return &claudeWriter{
+		sse:         sse{c: c},
+		stream:      stream,
+		id:          "msg_" + strings.ReplaceAll(uuid.NewString(), "-", ""),
+		model:       model,
+		inputTokens: inputTokens,
+		collector:   NewCollector(),
+		index:       -1,
+	}
+}
+
+type claudeWriter struct {
+	sse
+	stream       bool
+	id           string
+	model        string
+	inputTokens  int
+	collector    *Collector
+	usage        *types.Usage
+	finishReason string
+	// 当前内容块序号及类型
+	index     int
+	blockType string
+	toolIndex int
+	begun     bool
+	done      bool
+}
+
+func (w *claudeWriter) Write(res *types.ChatCompletionResponse) error {
+	if w.done {
+		return nil
+	}
+	if res.Usage != nil {
+		w.usage = res.Usage
+	}
+	if !w.stream {
+		w.collector.Add(res)
+		return nil
+	}
+	for _, choice := range res.Choices {
+		if choice.Index != 0 {
+			continue
+		}
+		if choice.FinishReason != "" {
+			w.finishReason = choice.FinishReason
+		}
+		msg := choice.Delta
+		if msg == nil {
+			msg = choice.Message
+		}
+		if msg == nil {
+			continue
+		}
+		if msg.Content != "" {
+			if w.blockType != "text" {
+				if err := w.startBlock("text", fhblade.H{"type": "text", "text": ""}); err != nil {
+					return err
+				}
+			}
+			if err := w.delta(fhblade.H{"type": "text_delta", "text": msg.Content}); err != nil {
+				return err
+			}
+		}
+		for _, tc := range msg.ToolCalls {
+			// 带id的是新的函数调用,之后的只有参数片段
+			ti := w.toolIndex
+			if tc.Index != nil {
+				ti = *tc.Index
+			}
+			if tc.ID != "" || w.blockType != "tool_use" || ti != w.toolIndex {
+				w.toolIndex = ti
+				id := tc.ID
+				if id == "" {
+					id = "toolu_" + strings.ReplaceAll(uuid.NewString(), "-", "")
+				}
+				if err := w.startBlock("tool_use", fhblade.H{
+					"type":  "tool_use",
+					"id":    id,
+					"name":  tc.Function.Name,
+					"input": fhblade.H{},
+				}); err != nil {
+					return err
+				}
+			}
+			if tc.Function.Arguments != "" {
+				if err := w.delta(fhblade.H{"type": "input_json_delta", "partial_json": tc.Function.Arguments}); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// 第一次输出前返回message_start
+func (w *claudeWriter) begin() error {
+	if w.begun {
+		return nil
+	}
+	w.begun = true
+	return w.event("message_start", fhblade.H{
+		"type": "message_start",
+		"message": &types.ClaudeApiCompletionResponse{
+			ID:      w.id,
+			Type:    "message",
+			Role:    "assistant",
+			Content: []*types.ClaudeApiContent{},
+			Model:   w.model,
+			Usage:   &types.ClaudeApiUsage{InputTokens: w.inputTokens},
+		},
+	})
+}
+
+func (w *claudeWriter) startBlock(blockType string, block fhblade.H) error {
+	if err := w.stopBlock(); err != nil {
+		return err
+	}
+	w.index++
+	w.blockType = blockType
+	return w.event("content_block_start", fhblade.H{
+		"type":          "content_block_start",
+		"index":         w.index,
+		"content_block": block,
+	})
+}
+
+func (w *claudeWriter) stopBlock() error {
+	if err := w.begin(); err != nil {
+		return err
+	}
+	if w.blockType == "" {
+		return nil
+	}
+	w.blockType = ""
+	return w.event("content_block_stop", fhblade.H{"type": "content_block_stop", "index": w.index})
+}
+
+func (w *claudeWriter) delta(delta fhblade.H) error {
+	return w.event("content_block_delta", fhblade.H{
+		"type":  "content_block_delta",
+		"index": w.index,
+		"delta": delta,
+	})
+}
+
+func (w *claudeWriter) Error(code int, e *types.CError) error {
+	if w.done {
+		return nil
+	}
+	w.done = true
+	errRes := &types.ClaudeErrorResponse{
+		Type: "error",
+		Error: &types.ClaudeError{
+			Type:    ClaudeErrorType(code),
+			Message: e.Message,
+		},
+	}
+	if !w.started {
+		w.started = true
+		return errorJSON(w.c, code, e, errRes)
+	}
+	return w.event("error", errRes)
+}
+
+func (w *claudeWriter) Done() error {
+	if w.done {
+		return nil
+	}
+	w.done = true
+	if !w.stream {
+		return w.c.JSONAndStatus(http.StatusOK, w.message())
+	}
+	if err := w.stopBlock(); err != nil {
+		return err
+	}
+	usage := &types.ClaudeApiUsage{InputTokens: w.inputTokens}
+	if w.usage != nil {
+		usage.InputTokens = w.usage.PromptTokens
+		usage.OutputTokens = w.usage.CompletionTokens
+	}
+	if err := w.event("message_delta", fhblade.H{
+		"type": "message_delta",
+		"delta": fhblade.H{
+			"stop_reason":   ClaudeStopReason(w.finishReason),
+			"stop_sequence": nil,
+		},
+		"usage": usage,
+	}); err != nil {
+		return err
+	}
+	return w.event("message_stop", fhblade.H{"type": "message_stop"})
+}
+
+// 非流式汇总成一条message
+func (w *claudeWriter) message() *types.ClaudeApiCompletionResponse {
+	res := w.collector.Response()
+	out := &types.ClaudeApiCompletionResponse{
+		ID:      w.id,
+		Type:    "message",
+		Role:    "assistant",
+		Content: []*types.ClaudeApiContent{},
+		Model:   w.model,
+		Usage:   &types.ClaudeApiUsage{InputTokens: w.inputTokens},
+	}
+	if w.usage != nil {
+		out.Usage.InputTokens = w.usage.PromptTokens
+		out.Usage.OutputTokens = w.usage.CompletionTokens
+	}
+	if len(res.Choices) == 0 {
+		out.StopReason = types.NullString(ClaudeStopReason(""))
+		return out
+	}
+	choice := res.Choices[0]
+	if choice.Message.Content != "" {
+		out.Content = append(out.Content, &types.ClaudeApiContent{Type: "text", Text: choice.Message.Content})
+	}
+	for _, tc := range choice.Message.ToolCalls {
+		input := make(map[string]any)
+		fhblade.Json.UnmarshalFromString(tc.Function.Arguments, &input)
+		if input == nil {
+			input = make(map[string]any)
+		}
+		out.Content = append(out.Content, &types.ClaudeApiContent{
+			Type:  "tool_use",
+			ID:    tc.ID,
+			Name:  tc.Function.Name,
+			Input: input,
+		})
+	}
+	out.StopReason = types.NullString(ClaudeStopReason(choice.FinishReason))
+	return out
+}
+
+// openai结束原因转claude
+func ClaudeStopReason(finishReason string) string {
+	switch finishReason {
+	case "length":
+		return "max_tokens"
+	case "tool_calls":
+		return "tool_use"
+	case "content_filter":
+		return "refusal"
+	}
+	return "end_turn"
+}
+
+// 状态码对应的claude错误类型
+func ClaudeErrorType(code int) string {
+	switch {
+	case code == http.StatusUnauthorized:
+		return "authentication_error"
+	case code == http.StatusForbidden:
+		return "permission_error"
+	case code == http.StatusNotFound:
+		return "not_found_error"
+	case code == http.StatusRequestEntityTooLarge:
+		return "request_too_large"
+	case code == http.StatusTooManyRequests:
+		return "rate_limit_error"
+	case code == 529:
+		return "overloaded_error"
+	case code >= http.StatusInternalServerError:
+		return "api_error"
+	}
+	return "invalid_request_error"
+}
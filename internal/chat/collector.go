@@ -0,0 +1,147 @@
+package chat
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/zatxm/any-proxy/internal/types"
+)
+
+// 汇总流式返回的chunk,生成一次性返回的chat.completion
+type Collector struct {
+	res      *types.ChatCompletionResponse
+	choices  map[int]*collectChoice
+	contents map[int]*strings.Builder
+}
+
+type collectChoice struct {
+	choice    *types.ChatCompletionChoice
+	toolCalls []*types.ToolCall
+}
+
+func NewCollector() *Collector {
+	return &Collector{
+		choices:  make(map[int]*collectChoice),
+		contents: make(map[int]*strings.Builder),
+	}
+}
+
+func (cl *Collector) Add(res *types.ChatCompletionResponse) {
+	if cl.res == nil {
+		cl.res = &types.ChatCompletionResponse{
+			ID:                res.ID,
+			Created:           res.Created,
+			Model:             res.Model,
+			SystemFingerprint: res.SystemFingerprint,
+		}
+	}
+	if cl.res.ID == "" {
+		cl.res.ID = res.ID
+	}
+	if cl.res.Model == "" {
+		cl.res.Model = res.Model
+	}
+	// 各provider额外返回以最后一次为准
+	if res.Usage != nil {
+		cl.res.Usage = res.Usage
+	}
+	if res.Gemini != nil {
+		cl.res.Gemini = res.Gemini
+	}
+	if res.OpenAi != nil {
+		cl.res.OpenAi = res.OpenAi
+	}
+	if res.Bing != nil {
+		cl.res.Bing = res.Bing
+	}
+	if res.Coze != nil {
+		cl.res.Coze = res.Coze
+	}
+	if res.Claude != nil {
+		cl.res.Claude = res.Claude
+	}
+	for k := range res.Choices {
+		choice := res.Choices[k]
+		cc, ok := cl.choices[choice.Index]
+		if !ok {
+			cc = &collectChoice{
+				choice: &types.ChatCompletionChoice{
+					Index:   choice.Index,
+					Message: &types.ChatCompletionMessage{Role: "assistant"},
+				},
+			}
+			cl.choices[choice.Index] = cc
+			cl.contents[choice.Index] = &strings.Builder{}
+		}
+		if choice.FinishReason != "" {
+			cc.choice.FinishReason = choice.FinishReason
+		}
+		if choice.LogProbs != nil {
+			cc.choice.LogProbs = choice.LogProbs
+		}
+		msg := choice.Delta
+		if msg == nil {
+			msg = choice.Message
+		}
+		if msg == nil {
+			continue
+		}
+		cl.contents[choice.Index].WriteString(msg.Content)
+		for i := range msg.ToolCalls {
+			cc.addToolCall(msg.ToolCalls[i])
+		}
+	}
+}
+
+// 按index合并tool_calls,后续chunk只带arguments片段
+func (cc *collectChoice) addToolCall(tc *types.ToolCall) {
+	i := len(cc.toolCalls)
+	if tc.Index != nil {
+		i = *tc.Index
+	} else if tc.ID == "" && i > 0 {
+		i = i - 1
+	}
+	for len(cc.toolCalls) <= i {
+		cc.toolCalls = append(cc.toolCalls, &types.ToolCall{Type: "function"})
+	}
+	last := cc.toolCalls[i]
+	if tc.ID != "" {
+		last.ID = tc.ID
+	}
+	if tc.Type != "" {
+		last.Type = tc.Type
+	}
+	last.Function.Name += tc.Function.Name
+	last.Function.Arguments += tc.Function.Arguments
+}
+
+func (cl *Collector) Response() *types.ChatCompletionResponse {
+	res := cl.res
+	if res == nil {
+		res = &types.ChatCompletionResponse{}
+	}
+	res.Object = "chat.completion"
+	var indexes []int
+	for k := range cl.choices {
+		indexes = append(indexes, k)
+	}
+	sort.Ints(indexes)
+	choices := make([]*types.ChatCompletionChoice, 0, len(indexes))
+	for _, k := range indexes {
+		cc := cl.choices[k]
+		cc.choice.Message.Content = cl.contents[k].String()
+		if len(cc.toolCalls) > 0 {
+			cc.choice.Message.ToolCalls = cc.toolCalls
+		}
+		if cc.choice.FinishReason == "" {
+			if len(cc.toolCalls) > 0 {
+				cc.choice.FinishReason = "tool_calls"
+			} else {
+				cc.choice.FinishReason = "stop"
+			}
+		}
+		choices = append(choices, cc.choice)
+	}
+	res.Choices = choices
+	return res
+}
@@ -0,0 +1,246 @@
+package chat
+
+import (
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	http "github.com/bogdanfinn/fhttp"
+	"github.com/google/uuid"
+	"github.com/zatxm/any-proxy/internal/types"
+	"github.com/zatxm/fhblade"
+)
+
+// 按v1/completions的text_completion格式输出
+// echo[i]为choice i前面回显的提示词,stop在代理端再截断一次,不支持stop的上游也能生效
+func NewCompletionsWriter(c *fhblade.Context, stream bool, echo, stop []string) Writer {
+	hold := 0
+	for _, s := range stop {
+		if len(s) > hold {
+			hold = len(s)
+		}
+	}
+	if hold > 0 {
+		hold--
+	}
+	return &completionsWriter{
+		sse:     sse{c: c},
+		stream:  stream,
+		id:      "cmpl-" + strings.ReplaceAll(uuid.NewString(), "-", ""),
+		created: time.Now().Unix(),
+		echo:    echo,
+		stop:    stop,
+		hold:    hold,
+		choices: make(map[int]*completionChoice),
+	}
+}
+
+type completionsWriter struct {
+	sse
+	stream  bool
+	id      string
+	created int64
+	model   string
+	echo    []string
+	stop    []string
+	// 流式时保留可能是stop开头的尾部,等后续数据确认
+	hold    int
+	choices map[int]*completionChoice
+	indexes []int
+	usage   *types.Usage
+	done    bool
+}
+
+type completionChoice struct {
+	// 非流式汇总的文本
+	text strings.Builder
+	// 还没输出的回显
+	echo         string
+	pending      string
+	finishReason string
+	stopped      bool
+}
+
+func (w *completionsWriter) choice(index int) *completionChoice {
+	cc, ok := w.choices[index]
+	if !ok {
+		cc = &completionChoice{}
+		w.choices[index] = cc
+		w.indexes = append(w.indexes, index)
+		if index < len(w.echo) {
+			cc.echo = w.echo[index]
+		}
+	}
+	return cc
+}
+
+func (w *completionsWriter) Write(res *types.ChatCompletionResponse) error {
+	if w.done {
+		return nil
+	}
+	if w.model == "" {
+		w.model = res.Model
+	}
+	if res.Usage != nil {
+		w.usage = res.Usage
+	}
+	var choices []*types.CompletionChoice
+	for _, choice := range res.Choices {
+		cc := w.choice(choice.Index)
+		if cc.stopped {
+			continue
+		}
+		msg := choice.Delta
+		if msg == nil {
+			msg = choice.Message
+		}
+		if !w.stream {
+			if msg != nil {
+				cc.text.WriteString(msg.Content)
+			}
+			if choice.FinishReason != "" {
+				cc.finishReason = completionFinishReason(choice.FinishReason)
+			}
+			continue
+		}
+		content := ""
+		if msg != nil {
+			content = msg.Content
+		}
+		text := w.cut(cc, content, choice.FinishReason != "")
+		if choice.FinishReason != "" && !cc.stopped {
+			cc.finishReason = completionFinishReason(choice.FinishReason)
+		}
+		if cc.echo != "" {
+			text = cc.echo + text
+			cc.echo = ""
+		}
+		if text == "" && cc.finishReason == "" {
+			continue
+		}
+		choices = append(choices, &types.CompletionChoice{
+			Text:         text,
+			Index:        choice.Index,
+			FinishReason: cc.finishReason,
+		})
+	}
+	if !w.stream {
+		return nil
+	}
+	if len(choices) > 0 {
+		return w.event("", w.response(choices, nil))
+	}
+	// usage单独一条
+	if res.Usage != nil && len(res.Choices) == 0 {
+		return w.event("", w.response([]*types.CompletionChoice{}, res.Usage))
+	}
+	return nil
+}
+
+// 流式追加文本并按stop截断,返回可以输出的部分
+// 没结束时保留可能是stop开头的尾部
+func (w *completionsWriter) cut(cc *completionChoice, content string, final bool) string {
+	text := w.truncate(cc, cc.pending+content)
+	cc.pending = ""
+	if cc.stopped || final || w.hold == 0 {
+		return text
+	}
+	i := len(text) - w.hold
+	if i < 0 {
+		i = 0
+	}
+	for i > 0 && !utf8.RuneStart(text[i]) {
+		i--
+	}
+	cc.pending = text[i:]
+	return text[:i]
+}
+
+// 截断到第一个stop之前
+func (w *completionsWriter) truncate(cc *completionChoice, text string) string {
+	for _, s := range w.stop {
+		if s == "" {
+			continue
+		}
+		if i := strings.Index(text, s); i >= 0 {
+			text = text[:i]
+			cc.stopped = true
+			cc.finishReason = "stop"
+		}
+	}
+	return text
+}
+
+func (w *completionsWriter) response(choices []*types.CompletionChoice, usage *types.Usage) *types.CompletionResponse {
+	return &types.CompletionResponse{
+		ID:      w.id,
+		Object:  "text_completion",
+		Created: w.created,
+		Model:   w.model,
+		Choices: choices,
+		Usage:   usage,
+	}
+}
+
+func (w *completionsWriter) Error(code int, e *types.CError) error {
+	if w.done {
+		return nil
+	}
+	w.done = true
+	if !w.started {
+		w.started = true
+		return errorJSON(w.c, code, e, types.ErrorResponse{Error: e})
+	}
+	if err := w.event("", types.ErrorResponse{Error: e}); err != nil {
+		return err
+	}
+	return w.data("[DONE]")
+}
+
+func (w *completionsWriter) Done() error {
+	if w.done {
+		return nil
+	}
+	w.done = true
+	// 流式输出没有结束原因的剩下文本,非流式输出全部
+	var choices []*types.CompletionChoice
+	sort.Ints(w.indexes)
+	for _, index := range w.indexes {
+		cc := w.choices[index]
+		var text string
+		if w.stream {
+			if cc.finishReason != "" {
+				continue
+			}
+			text = cc.echo + w.cut(cc, "", true)
+		} else {
+			text = cc.echo + w.truncate(cc, cc.text.String())
+		}
+		if cc.finishReason == "" {
+			cc.finishReason = "stop"
+		}
+		choices = append(choices, &types.CompletionChoice{
+			Text:         text,
+			Index:        index,
+			FinishReason: cc.finishReason,
+		})
+	}
+	if !w.stream {
+		return w.c.JSONAndStatus(http.StatusOK, w.response(choices, w.usage))
+	}
+	if len(choices) > 0 {
+		if err := w.event("", w.response(choices, nil)); err != nil {
+			return err
+		}
+	}
+	return w.data("[DONE]")
+}
+
+// 工具调用等都按stop返回
+func completionFinishReason(finishReason string) string {
+	if finishReason == "length" {
+		return "length"
+	}
+	return "stop"
+}
@@ -0,0 +1,122 @@
+package chat
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/zatxm/any-proxy/internal/types"
+	"github.com/zatxm/fhblade"
+)
+
+// 流式输出的各条text_completion
+func completionEvents(t *testing.T, body string) []*types.CompletionResponse {
+	t.Helper()
+	var events []*types.CompletionResponse
+	for _, line := range strings.Split(body, "\n") {
+		data, ok := strings.CutPrefix(line, "data: ")
+		if !ok || data == "[DONE]" {
+			continue
+		}
+		res := &types.CompletionResponse{}
+		if err := fhblade.Json.UnmarshalFromString(data, res); err != nil {
+			t.Fatalf("invalid event %s", data)
+		}
+		events = append(events, res)
+	}
+	return events
+}
+
+func TestCompletionsStop(t *testing.T) {
+	tests := []struct {
+		name   string
+		stop   []string
+		chunks []string
+		text   string
+		finish string
+	}{
+		{"no stop", nil, []string{"Hello", " world"}, "Hello world", "stop"},
+		{"stop in one chunk", []string{"\n\n"}, []string{"a\n\nb"}, "a", "stop"},
+		{"stop across chunks", []string{"END"}, []string{"one E", "N", "D two"}, "one ", "stop"},
+		{"partial stop not matched", []string{"END"}, []string{"one EN", "d two"}, "one ENd two", "stop"},
+		{"partial stop at end", []string{"END"}, []string{"one EN"}, "one EN", "stop"},
+		{"earliest of stops", []string{"###", "\n"}, []string{"a\nb#", "##"}, "a", "stop"},
+		{"later stop across chunks", []string{"###", "x"}, []string{"ab#", "##cx"}, "ab", "stop"},
+		{"multibyte held", []string{"停止"}, []string{"你好停", "止了"}, "你好", "stop"},
+		{"multibyte not stop", []string{"停止"}, []string{"你好停", "下"}, "你好停下", "stop"},
+		{"ignored after stop", []string{"."}, []string{"a.", "b", "c"}, "a", "stop"},
+		{"empty stop ignored", []string{""}, []string{"a", "b"}, "ab", "stop"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := serve(t, func(c *fhblade.Context) error {
+				w := NewCompletionsWriter(c, true, nil, tt.stop)
+				for _, chunk := range tt.chunks {
+					if err := w.Write(textChunk(chunk)); err != nil {
+						return err
+					}
+				}
+				return w.Done()
+			})
+			var text strings.Builder
+			finish := ""
+			for _, res := range completionEvents(t, rec.Body.String()) {
+				for _, choice := range res.Choices {
+					if finish != "" {
+						t.Errorf("text %q after finish", choice.Text)
+					}
+					text.WriteString(choice.Text)
+					finish = choice.FinishReason
+				}
+			}
+			if text.String() != tt.text {
+				t.Errorf("text = %q, want %q", text.String(), tt.text)
+			}
+			if finish != tt.finish {
+				t.Errorf("finish reason = %q, want %q", finish, tt.finish)
+			}
+			if !strings.HasSuffix(strings.TrimSpace(rec.Body.String()), "data: [DONE]") {
+				t.Error("missing [DONE]")
+			}
+
+			// 非流式结果一致
+			rec = serve(t, func(c *fhblade.Context) error {
+				w := NewCompletionsWriter(c, false, nil, tt.stop)
+				for _, chunk := range tt.chunks {
+					w.Write(textChunk(chunk))
+				}
+				return w.Done()
+			})
+			res := &types.CompletionResponse{}
+			if err := fhblade.Json.Unmarshal(rec.Body.Bytes(), res); err != nil || len(res.Choices) != 1 {
+				t.Fatalf("invalid response %s", rec.Body.String())
+			}
+			if res.Choices[0].Text != tt.text || res.Choices[0].FinishReason != tt.finish {
+				t.Errorf("non stream = %q, %q, want %q, %q", res.Choices[0].Text, res.Choices[0].FinishReason, tt.text, tt.finish)
+			}
+		})
+	}
+}
+
+// 上游因长度结束时不被stop覆盖,stop截断后为stop
+func TestCompletionsStopFinishReason(t *testing.T) {
+	rec := serve(t, func(c *fhblade.Context) error {
+		w := NewCompletionsWriter(c, true, []string{"p: "}, []string{"ZZ"})
+		res := textChunk("abZ")
+		w.Write(res)
+		res = textChunk("cd")
+		res.Choices[0].FinishReason = "length"
+		w.Write(res)
+		return w.Done()
+	})
+	var text strings.Builder
+	finish := ""
+	for _, res := range completionEvents(t, rec.Body.String()) {
+		for _, choice := range res.Choices {
+			text.WriteString(choice.Text)
+			finish = choice.FinishReason
+		}
+	}
+	if text.String() != "p: abZcd" || finish != "length" {
+		t.Errorf("text, finish = %q, %q, want \"p: abZcd\", length", text.String(), finish)
+	}
+}
@@ -0,0 +1,400 @@
+package chat
+
+import (
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	http "github.com/bogdanfinn/fhttp"
+	"github.com/zatxm/any-proxy/internal/pool"
+	"github.com/zatxm/any-proxy/internal/types"
+	"github.com/zatxm/fhblade"
+	"github.com/zatxm/fhblade/tools"
+)
+
+const (
+	// 529为claude的过载,返回给客户端时用503
+	StatusOverloaded = 529
+	// chatgpt web被cloudflare拦截的403
+	CodeCloudflareBlocked = "cloudflare_blocked"
+)
+
+// 上游错误转成openai格式,保留上游的信息
+// Code为返回的http状态码,RetryAfter为建议重试的秒数,0表示未知
+type UpstreamError struct {
+	Code       int
+	Err        *types.CError
+	RetryAfter int
+}
+
+func (e *UpstreamError) Error() string {
+	return e.Err.Message
+}
+
+// 按状态码对应openai的错误类型
+func StatusError(code int, message string) *UpstreamError {
+	if message == "" {
+		message = http.StatusText(code)
+	}
+	e := &types.CError{Message: message}
+	switch {
+	case code == http.StatusUnauthorized:
+		e.Type, e.Code = "invalid_request_error", "invalid_api_key"
+	case code == http.StatusPaymentRequired:
+		// openai余额不足返回429
+		code = http.StatusTooManyRequests
+		e.Type, e.Code = "insufficient_quota", "insufficient_quota"
+	case code == http.StatusForbidden:
+		e.Type, e.Code = "permission_error", "permission_denied"
+	case code == http.StatusNotFound:
+		e.Type, e.Code = "invalid_request_error", "not_found"
+	case code == http.StatusRequestEntityTooLarge:
+		e.Type, e.Code = "invalid_request_error", "request_too_large"
+	case code == http.StatusTooManyRequests:
+		e.Type, e.Code = "requests", "rate_limit_exceeded"
+	case code == http.StatusBadGateway:
+		e.Type, e.Code = "server_error", "bad_gateway"
+	case code == http.StatusServiceUnavailable || code == StatusOverloaded:
+		code = http.StatusServiceUnavailable
+		e.Type, e.Code = "server_error", "overloaded"
+	case code == http.StatusGatewayTimeout || code == http.StatusRequestTimeout:
+		e.Type, e.Code = "server_error", "timeout"
+	case code >= http.StatusInternalServerError:
+		e.Type, e.Code = "server_error", "upstream_error"
+	case code >= http.StatusBadRequest:
+		e.Type, e.Code = "invalid_request_error", "invalid_request"
+	default:
+		// 200返回的错误,如流中途的error事件
+		code = http.StatusBadGateway
+		e.Type, e.Code = "server_error", "upstream_error"
+	}
+	return &UpstreamError{Code: code, Err: e}
+}
+
+// 连接上游失败
+func ConnError(err error) *UpstreamError {
+	return &UpstreamError{
+		Code: http.StatusBadGateway,
+		Err: &types.CError{
+			Message: err.Error(),
+			Type:    "server_error",
+			Code:    "upstream_connection_error",
+		},
+	}
+}
+
+// 没有可用的上游密钥
+func NoKeyError(provider string) *UpstreamError {
+	return &UpstreamError{
+		Code: http.StatusUnauthorized,
+		Err: &types.CError{
+			Message: "no " + provider + " credential available, pass Authorization or configure keys",
+			Type:    "invalid_request_error",
+			Code:    "invalid_api_key",
+		},
+	}
+}
+
+// 从响应头取重试时间
+func (e *UpstreamError) WithHeader(h http.Header) *UpstreamError {
+	if retry := RetryAfter(h); retry > 0 {
+		e.RetryAfter = retry
+	}
+	return e
+}
+
+// 响应头的重试秒数,Retry-After为秒数或http日期,没有取Retry-After-Ms
+func RetryAfter(h http.Header) int {
+	retry := 0
+	if v := h.Get("Retry-After"); v != "" {
+		if s, err := strconv.Atoi(v); err == nil {
+			retry = s
+		} else if t, err := http.ParseTime(v); err == nil {
+			retry = int(time.Until(t).Seconds())
+		}
+	}
+	if retry <= 0 {
+		if v, err := strconv.Atoi(h.Get("Retry-After-Ms")); err == nil && v > 0 {
+			retry = (v + 999) / 1000
+		}
+	}
+	if retry < 0 {
+		retry = 0
+	}
+	return retry
+}
+
+// 按返回的状态码更新所用密钥的状态,cloudflare拦截与密钥无关
+func (e *UpstreamError) Report(l *pool.Lease) *UpstreamError {
+	if e.Err.Code != CodeCloudflareBlocked {
+		l.Report(e.reportCode(), e.RetryAfter)
+	}
+	return e
+}
+
+// 余额不足返回客户端的是429,密钥需按402隔离而不是冷却
+func (e *UpstreamError) reportCode() int {
+	if e.Err.Code == "insufficient_quota" {
+		return http.StatusPaymentRequired
+	}
+	return e.Code
+}
+
+// 通过Writer输出,已经开始输出时只能在流中返回错误
+// 重试时间随错误传递,由实际输出错误的Writer写响应头,并发请求时不会同时写
+func (e *UpstreamError) Write(c *fhblade.Context, w Writer) error {
+	e.Err.RetryAfter = e.RetryAfter
+	return w.Error(e.Code, e.Err)
+}
+
+// 直接返回openai格式的json错误
+func (e *UpstreamError) JSON(c *fhblade.Context) error {
+	e.Err.RetryAfter = e.RetryAfter
+	return errorJSON(c, e.Code, e.Err, types.ErrorResponse{Error: e.Err})
+}
+
+// 返回json错误,带上Retry-After,body为各接口格式的错误
+func errorJSON(c *fhblade.Context, code int, e *types.CError, body any) error {
+	if e.RetryAfter > 0 {
+		c.Response().SetHeader("Retry-After", strconv.Itoa(e.RetryAfter))
+	}
+	return c.JSONAndStatus(code, body)
+}
+
+// 官方api已经是openai格式,解析不了的按状态码转换
+func OpenaiError(code int, body []byte) *UpstreamError {
+	errRes := &types.ErrorResponse{}
+	if err := fhblade.Json.Unmarshal(body, errRes); err == nil && errRes.Error != nil && errRes.Error.Message != "" {
+		e := StatusError(code, errRes.Error.Message)
+		if errRes.Error.Type != "" {
+			e.Err.Type = errRes.Error.Type
+		}
+		if errRes.Error.Code != "" {
+			e.Err.Code = errRes.Error.Code
+		}
+		e.Err.Param = errRes.Error.Param
+		return e
+	}
+	return StatusError(code, bodyMessage(body))
+}
+
+// claude的错误类型对应的状态码,流中途的错误没有状态码
+func ClaudeError(code int, ce *types.ClaudeError) *UpstreamError {
+	if ce == nil {
+		return StatusError(code, "")
+	}
+	switch ce.Type {
+	case "invalid_request_error":
+		code = http.StatusBadRequest
+	case "authentication_error":
+		code = http.StatusUnauthorized
+	case "billing_error":
+		code = http.StatusPaymentRequired
+	case "permission_error":
+		code = http.StatusForbidden
+	case "not_found_error":
+		code = http.StatusNotFound
+	case "request_too_large":
+		code = http.StatusRequestEntityTooLarge
+	case "rate_limit_error":
+		code = http.StatusTooManyRequests
+	case "api_error":
+		code = http.StatusInternalServerError
+	case "overloaded_error":
+		code = StatusOverloaded
+	}
+	e := StatusError(code, ce.Message)
+	// claude web超出限额时message为带resetsAt的json
+	var limit struct {
+		ResetsAt int64 `json:"resetsAt"`
+	}
+	if strings.HasPrefix(ce.Message, "{") && fhblade.Json.UnmarshalFromString(ce.Message, &limit) == nil && limit.ResetsAt > 0 {
+		if retry := int(time.Until(time.Unix(limit.ResetsAt, 0)).Seconds()); retry > 0 {
+			e.RetryAfter = retry
+		}
+	}
+	return e
+}
+
+// claude api、web的错误响应体
+func ClaudeErrorBody(code int, body []byte) *UpstreamError {
+	errRes := &types.ClaudeErrorResponse{}
+	if err := fhblade.Json.Unmarshal(body, errRes); err == nil && errRes.Error != nil {
+		return ClaudeError(code, errRes.Error)
+	}
+	return StatusError(code, bodyMessage(body))
+}
+
+// gemini错误响应体,流式时为数组
+// status对应状态码,RetryInfo的retryDelay作为重试时间,密钥无效的按401返回
+func GeminiError(code int, body []byte) *UpstreamError {
+	var ge *types.GeminiError
+	errRes := &types.GeminiErrorResponse{}
+	if err := fhblade.Json.Unmarshal(body, errRes); err == nil && errRes.Error != nil {
+		ge = errRes.Error
+	} else {
+		var arr []*types.GeminiErrorResponse
+		if err := fhblade.Json.Unmarshal(body, &arr); err == nil && len(arr) > 0 && arr[0].Error != nil {
+			ge = arr[0].Error
+		}
+	}
+	if ge == nil {
+		return StatusError(code, bodyMessage(body))
+	}
+	switch ge.Status {
+	case "INVALID_ARGUMENT", "FAILED_PRECONDITION", "OUT_OF_RANGE":
+		code = http.StatusBadRequest
+	case "UNAUTHENTICATED":
+		code = http.StatusUnauthorized
+	case "PERMISSION_DENIED":
+		code = http.StatusForbidden
+	case "NOT_FOUND":
+		code = http.StatusNotFound
+	case "RESOURCE_EXHAUSTED":
+		code = http.StatusTooManyRequests
+	case "INTERNAL", "UNKNOWN":
+		code = http.StatusInternalServerError
+	case "UNAVAILABLE":
+		code = http.StatusServiceUnavailable
+	case "DEADLINE_EXCEEDED":
+		code = http.StatusGatewayTimeout
+	}
+	retry := 0
+	for _, detail := range ge.Details {
+		if reason, _ := detail["reason"].(string); reason == "API_KEY_INVALID" {
+			code = http.StatusUnauthorized
+		}
+		if delay, ok := detail["retryDelay"].(string); ok {
+			if d, err := time.ParseDuration(delay); err == nil {
+				retry = int(d.Seconds())
+			}
+		}
+	}
+	e := StatusError(code, ge.Message)
+	e.RetryAfter = retry
+	return e
+}
+
+// coze api错误,http 200的json响应为code、msg,流中的error_information为err_code、err_msg
+func CozeError(errCode int, msg string) *UpstreamError {
+	code := http.StatusBadGateway
+	switch {
+	case errCode == 4100:
+		code = http.StatusUnauthorized
+	case errCode == 4101:
+		code = http.StatusForbidden
+	case errCode == 4013:
+		code = http.StatusTooManyRequests
+	case errCode == 4011 || errCode == 4028:
+		code = http.StatusPaymentRequired
+	case errCode == 4015 || errCode == 4200:
+		code = http.StatusNotFound
+	case errCode >= 4000 && errCode < 5000:
+		code = http.StatusBadRequest
+	case errCode >= 5000:
+		code = http.StatusInternalServerError
+	}
+	if msg == "" {
+		msg = "coze error code " + strconv.Itoa(errCode)
+	}
+	return StatusError(code, msg)
+}
+
+// coze非流式的错误响应体
+func CozeErrorBody(code int, body []byte) *UpstreamError {
+	var res struct {
+		Code int    `json:"code"`
+		Msg  string `json:"msg"`
+	}
+	if err := fhblade.Json.Unmarshal(body, &res); err == nil && res.Code != 0 {
+		return CozeError(res.Code, res.Msg)
+	}
+	return StatusError(code, bodyMessage(body))
+}
+
+// coze流中的error_information
+func CozeErrorInformation(info map[string]interface{}) *UpstreamError {
+	errCode, _ := info["err_code"].(float64)
+	msg, _ := info["err_msg"].(string)
+	if msg == "" {
+		msg, _ = fhblade.Json.MarshalToString(info)
+	}
+	return CozeError(int(errCode), msg)
+}
+
+// chatgpt web错误,detail为字符串或带message、code的对象
+// 403没有json的一般是cloudflare拦截
+func WebError(code int, body []byte) *UpstreamError {
+	var res struct {
+		Detail any `json:"detail"`
+	}
+	msg := ""
+	if err := fhblade.Json.Unmarshal(body, &res); err == nil {
+		switch v := res.Detail.(type) {
+		case string:
+			msg = v
+		case map[string]any:
+			msg, _ = v["message"].(string)
+			if c, _ := v["code"].(string); c != "" {
+				if msg == "" {
+					msg = c
+				}
+				// 令牌过期按401返回
+				if c == "token_expired" || c == "invalid_jwt" {
+					code = http.StatusUnauthorized
+				}
+			}
+		}
+	} else if code == http.StatusForbidden {
+		msg = "request blocked by cloudflare"
+		e := StatusError(code, msg)
+		e.Err.Code = CodeCloudflareBlocked
+		return e
+	}
+	if msg == "" {
+		msg = bodyMessage(body)
+	}
+	return StatusError(code, msg)
+}
+
+// bing最终结果的value不是Success时的错误
+func BingError(value, message string) *UpstreamError {
+	code := http.StatusBadGateway
+	switch value {
+	case "Throttled":
+		code = http.StatusTooManyRequests
+	case "CaptchaChallenge":
+		code = http.StatusForbidden
+	case "UnauthorizedRequest", "Unauthorized":
+		code = http.StatusUnauthorized
+	case "InvalidSession", "InvalidRequest":
+		code = http.StatusBadRequest
+	case "ServiceUnavailable":
+		code = http.StatusServiceUnavailable
+	}
+	if message == "" {
+		message = value
+	}
+	e := StatusError(code, message)
+	if value == "CaptchaChallenge" {
+		e.Err.Code = "captcha_required"
+	}
+	return e
+}
+
+// 非json的响应体截取一部分作为信息,html只返回状态
+func bodyMessage(body []byte) string {
+	msg := strings.TrimSpace(tools.BytesToString(body))
+	if strings.HasPrefix(msg, "<") {
+		return ""
+	}
+	if len(msg) > 512 {
+		i := 512
+		for i > 0 && !utf8.RuneStart(msg[i]) {
+			i--
+		}
+		msg = msg[:i]
+	}
+	return msg
+}
@@ -0,0 +1,36 @@
+package chat
+
+import (
+	"testing"
+
+	http "github.com/bogdanfinn/fhttp"
+	"github.com/zatxm/any-proxy/internal/types"
+)
+
+// 返回客户端的状态码及更新密钥状态用的状态码
+func TestReportCode(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    *UpstreamError
+		code   int
+		report int
+	}{
+		{"claude billing", ClaudeError(0, &types.ClaudeError{Type: "billing_error", Message: "credit balance too low"}), http.StatusTooManyRequests, http.StatusPaymentRequired},
+		{"claude billing body", ClaudeErrorBody(http.StatusBadRequest, []byte(`{"type":"error","error":{"type":"billing_error","message":"no credit"}}`)), http.StatusTooManyRequests, http.StatusPaymentRequired},
+		{"claude rate limit", ClaudeError(0, &types.ClaudeError{Type: "rate_limit_error"}), http.StatusTooManyRequests, http.StatusTooManyRequests},
+		{"claude auth", ClaudeError(0, &types.ClaudeError{Type: "authentication_error"}), http.StatusUnauthorized, http.StatusUnauthorized},
+		{"openai quota", OpenaiError(http.StatusTooManyRequests, []byte(`{"error":{"message":"quota","type":"insufficient_quota","code":"insufficient_quota"}}`)), http.StatusTooManyRequests, http.StatusPaymentRequired},
+		{"coze balance", CozeError(4028, ""), http.StatusTooManyRequests, http.StatusPaymentRequired},
+		{"server error", StatusError(http.StatusBadGateway, ""), http.StatusBadGateway, http.StatusBadGateway},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.err.Code != tt.code {
+				t.Errorf("code = %d, want %d", tt.err.Code, tt.code)
+			}
+			if got := tt.err.reportCode(); got != tt.report {
+				t.Errorf("report code = %d, want %d", got, tt.report)
+			}
+		})
+	}
+}
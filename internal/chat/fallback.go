@@ -0,0 +1,58 @@
+package chat
+
+import (
+	http "github.com/bogdanfinn/fhttp"
+	"github.com/zatxm/any-proxy/internal/types"
+)
+
+// 还没输出数据前遇到可重试的错误不返回客户端,由调用方换下一个上游
+type FallbackWriter struct {
+	w       Writer
+	written bool
+	code    int
+	err     *types.CError
+}
+
+func NewFallbackWriter(w Writer) *FallbackWriter {
+	return &FallbackWriter{w: w}
+}
+
+// 连接错误、鉴权失败、429和5xx可以换上游重试
+func CanFallback(code int) bool {
+	return code == http.StatusUnauthorized ||
+		code == http.StatusForbidden ||
+		code == http.StatusTooManyRequests ||
+		code >= http.StatusInternalServerError
+}
+
+func (f *FallbackWriter) Write(res *types.ChatCompletionResponse) error {
+	if f.err != nil {
+		return nil
+	}
+	f.written = true
+	return f.w.Write(res)
+}
+
+func (f *FallbackWriter) Error(code int, e *types.CError) error {
+	if f.err != nil {
+		return nil
+	}
+	if !f.written && CanFallback(code) {
+		f.code = code
+		f.err = e
+		return nil
+	}
+	return f.w.Error(code, e)
+}
+
+func (f *FallbackWriter) Done() error {
+	if f.err != nil {
+		return nil
+	}
+	return f.w.Done()
+}
+
+// 返回被拦截的错误,nil表示上游已正常处理
+func (f *FallbackWriter) Failed() (int, *types.CError) {
+	return f.code, f.err
+}
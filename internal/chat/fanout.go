@@ -0,0 +1,145 @@
+package chat
+
+import (
+	"context"
+	"sync"
+
+	"github.com/zatxm/any-proxy/internal/types"
+)
+
+// n>1时并发请求上游,每个请求的结果作为一个choice合并输出
+// concurrency为同时请求的数量,<=0不限制
+// 任一请求出错整体返回错误并取消其他请求,各请求的usage合并后最后返回
+// 各请求共用一个fhblade.Context,只能通过Writer输出,上游请求用Context(c, w)取可取消的context
+func FanOut(ctx context.Context, n, concurrency int, w Writer, do func(i int, w Writer) error) error {
+	if concurrency <= 0 || concurrency > n {
+		concurrency = n
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	f := &fanOut{ctx: ctx, cancel: cancel, w: w, usages: make([]*types.Usage, n)}
+	sem := make(chan struct{}, concurrency)
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			// 已经出错的不再请求
+			if ctx.Err() != nil {
+				return
+			}
+			errs[i] = do(i, &fanOutWriter{f: f, index: i})
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failed {
+		return nil
+	}
+	if usage := f.usage(); usage != nil && f.tpl != nil {
+		if err := f.w.Write(&types.ChatCompletionResponse{
+			ID:                f.tpl.ID,
+			Created:           f.tpl.Created,
+			Model:             f.tpl.Model,
+			SystemFingerprint: f.tpl.SystemFingerprint,
+			Object:            "chat.completion.chunk",
+			Usage:             usage,
+		}); err != nil {
+			return err
+		}
+	}
+	return f.w.Done()
+}
+
+type fanOut struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	// 输出都经过w,同时只有一个请求写入
+	mu     sync.Mutex
+	w      Writer
+	tpl    *types.ChatCompletionResponse
+	usages []*types.Usage
+	failed bool
+}
+
+// 提示词只算一次,生成的token累加
+func (f *fanOut) usage() *types.Usage {
+	var usage *types.Usage
+	for _, u := range f.usages {
+		if u == nil {
+			continue
+		}
+		if usage == nil {
+			usage = &types.Usage{}
+		}
+		if u.PromptTokens > usage.PromptTokens {
+			usage.PromptTokens = u.PromptTokens
+		}
+		usage.CompletionTokens += u.CompletionTokens
+	}
+	if usage != nil {
+		usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+	}
+	return usage
+}
+
+// 单个请求的输出,choice的index改成请求序号,id等统一成第一个请求的
+type fanOutWriter struct {
+	f     *fanOut
+	index int
+}
+
+func (fw *fanOutWriter) Write(res *types.ChatCompletionResponse) error {
+	f := fw.f
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failed {
+		return nil
+	}
+	if res.Usage != nil {
+		f.usages[fw.index] = res.Usage
+	}
+	if len(res.Choices) == 0 {
+		return nil
+	}
+	if f.tpl == nil {
+		f.tpl = res
+	}
+	out := *res
+	out.ID = f.tpl.ID
+	out.Created = f.tpl.Created
+	out.Model = f.tpl.Model
+	out.Usage = nil
+	out.Choices = make([]*types.ChatCompletionChoice, len(res.Choices))
+	for k := range res.Choices {
+		choice := *res.Choices[k]
+		choice.Index = fw.index
+		out.Choices[k] = &choice
+	}
+	return f.w.Write(&out)
+}
+
+func (fw *fanOutWriter) Error(code int, e *types.CError) error {
+	f := fw.f
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failed {
+		return nil
+	}
+	f.failed = true
+	f.cancel()
+	return f.w.Error(code, e)
+}
+
+func (fw *fanOutWriter) Done() error {
+	return nil
+}
@@ -0,0 +1,118 @@
+package chat
+
+import (
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	http "github.com/bogdanfinn/fhttp"
+	"github.com/bogdanfinn/fhttp/httptest"
+	"github.com/zatxm/any-proxy/internal/types"
+	"github.com/zatxm/fhblade"
+)
+
+func serve(t *testing.T, handler func(c *fhblade.Context) error) *httptest.ResponseRecorder {
+	t.Helper()
+	app := fhblade.New()
+	app.Post("/test", handler)
+	req := httptest.NewRequest(http.MethodPost, "/test", strings.NewReader(`{}`))
+	rec := httptest.NewRecorder()
+	app.ServeHTTP(rec, req)
+	return rec
+}
+
+// 多个请求同时失败只输出一次错误,Retry-After由输出错误的Writer写入
+func TestFanOutConcurrentErrors(t *testing.T) {
+	rec := serve(t, func(c *fhblade.Context) error {
+		start := make(chan struct{})
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			close(start)
+		}()
+		return FanOut(c.Request().Context(), 8, 0, NewWriter(c, false), func(i int, w Writer) error {
+			<-start
+			e := StatusError(http.StatusTooManyRequests, "rate limited")
+			e.RetryAfter = 30
+			return e.Write(c, w)
+		})
+	})
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("code = %d, want 429, body %s", rec.Code, rec.Body.String())
+	}
+	if v := rec.Header().Get("Retry-After"); v != "30" {
+		t.Errorf("Retry-After = %q, want 30", v)
+	}
+	var res types.ErrorResponse
+	if err := fhblade.Json.Unmarshal(rec.Body.Bytes(), &res); err != nil || res.Error == nil {
+		t.Fatalf("invalid error body %s", rec.Body.String())
+	}
+	if res.Error.Code != "rate_limit_exceeded" {
+		t.Errorf("error code = %s", res.Error.Code)
+	}
+}
+
+// 一个请求出错后取消其他请求,还没开始的不再请求
+func TestFanOutCancel(t *testing.T) {
+	var started, canceled atomic.Int32
+	done := make(chan error, 1)
+	rec := serve(t, func(c *fhblade.Context) error {
+		go func() {
+			done <- FanOut(c.Request().Context(), 5, 3, NewWriter(c, false), func(i int, w Writer) error {
+				started.Add(1)
+				if i == 0 {
+					time.Sleep(10 * time.Millisecond)
+					return w.Error(http.StatusBadGateway, &types.CError{Message: "bad gateway", Type: "server_error"})
+				}
+				select {
+				case <-Context(c, w).Done():
+					canceled.Add(1)
+					return w.Error(http.StatusBadGateway, &types.CError{Message: "canceled"})
+				case <-time.After(5 * time.Second):
+					return w.Done()
+				}
+			})
+		}()
+		select {
+		case err := <-done:
+			return err
+		case <-time.After(2 * time.Second):
+			t.Error("fan out not canceled")
+			return nil
+		}
+	})
+	if rec.Code != http.StatusBadGateway || !strings.Contains(rec.Body.String(), "bad gateway") {
+		t.Errorf("code = %d, body %s", rec.Code, rec.Body.String())
+	}
+	if n := started.Load(); n != 3 {
+		t.Errorf("started = %d, want 3", n)
+	}
+	if n := canceled.Load(); n != 2 {
+		t.Errorf("canceled = %d, want 2", n)
+	}
+}
+
+// 分支内包装的Writer也能取到可取消的context
+func TestContextUnwrap(t *testing.T) {
+	serve(t, func(c *fhblade.Context) error {
+		if ctx := Context(c, NewWriter(c, false)); ctx != c.Request().Context() {
+			t.Error("plain writer should use request context")
+		}
+		return FanOut(c.Request().Context(), 1, 0, NewWriter(c, false), func(i int, w Writer) error {
+			branch := Context(c, w)
+			if branch == c.Request().Context() {
+				t.Error("branch writer should use fan out context")
+			}
+			p := types.ChatCompletionRequest{Tools: []types.Tool{{Type: "function", Function: &types.FunctionDefinition{Name: "f"}}}}
+			_, tw := EmulateTools(p, w)
+			if Context(c, tw) != branch {
+				t.Error("tool writer should unwrap to branch context")
+			}
+			bw := &bufferWriter{parent: w, collector: NewCollector()}
+			if Context(c, bw) != branch {
+				t.Error("buffer writer should unwrap to branch context")
+			}
+			return w.Done()
+		})
+	})
+}
@@ -0,0 +1,204 @@
+package chat
+
+import (
+	http "github.com/bogdanfinn/fhttp"
+	"github.com/zatxm/any-proxy/internal/types"
+	"github.com/zatxm/any-proxy/internal/vars"
+	"github.com/zatxm/fhblade"
+)
+
+// 按gemini generateContent格式输出
+// stream时alt=sse返回sse,否则同google返回json数组
+// 函数调用参数是分片返回的,汇总后在最后一条数据中返回
+func NewGeminiWriter(c *fhblade.Context, stream, array bool, model string) Writer {
+	w := &geminiWriter{
+		sse:       sse{c: c},
+		stream:    stream,
+		array:     array,
+		model:     model,
+		collector: NewCollector(),
+	}
+	if array {
+		w.contentType = vars.ContentTypeJSON
+	}
+	return w
+}
+
+type geminiWriter struct {
+	sse
+	stream    bool
+	array     bool
+	model     string
+	collector *Collector
+	// 已输出的数据条数,json数组用
+	count int
+	done  bool
+}
+
+func (w *geminiWriter) Write(res *types.ChatCompletionResponse) error {
+	if w.done {
+		return nil
+	}
+	w.collector.Add(res)
+	if !w.stream {
+		return nil
+	}
+	out := &types.GeminiGenerateContentResponse{ModelVersion: w.model}
+	for _, choice := range res.Choices {
+		msg := choice.Delta
+		if msg == nil {
+			msg = choice.Message
+		}
+		if msg == nil || msg.Content == "" {
+			continue
+		}
+		out.Candidates = append(out.Candidates, &types.GeminiCandidate{
+			Content: &types.GeminiContent{
+				Parts: []*types.GeminiPart{&types.GeminiPart{Text: msg.Content}},
+				Role:  "model",
+			},
+			Index: choice.Index,
+		})
+	}
+	if len(out.Candidates) == 0 {
+		return nil
+	}
+	return w.chunk(out)
+}
+
+func (w *geminiWriter) chunk(v any) error {
+	if !w.array {
+		return w.event("", v)
+	}
+	outJson, _ := fhblade.Json.Marshal(v)
+	if err := w.start(); err != nil {
+		return err
+	}
+	sep := ",\r\n"
+	if w.count == 0 {
+		sep = "["
+	}
+	w.count++
+	w.rw.Write([]byte(sep))
+	w.rw.Write(outJson)
+	w.flusher.Flush()
+	return nil
+}
+
+// json数组结尾
+func (w *geminiWriter) end() error {
+	if !w.array {
+		return nil
+	}
+	w.rw.Write([]byte("]"))
+	w.flusher.Flush()
+	return nil
+}
+
+func (w *geminiWriter) Error(code int, e *types.CError) error {
+	if w.done {
+		return nil
+	}
+	w.done = true
+	errRes := &types.GeminiErrorResponse{
+		Error: &types.GeminiError{
+			Code:    code,
+			Message: e.Message,
+			Status:  GeminiErrorStatus(code),
+		},
+	}
+	if !w.started {
+		w.started = true
+		return errorJSON(w.c, code, e, errRes)
+	}
+	if err := w.chunk(errRes); err != nil {
+		return err
+	}
+	return w.end()
+}
+
+func (w *geminiWriter) Done() error {
+	if w.done {
+		return nil
+	}
+	w.done = true
+	res := w.collector.Response()
+	out := &types.GeminiGenerateContentResponse{ModelVersion: w.model}
+	for _, choice := range res.Choices {
+		parts := []*types.GeminiPart{}
+		// 流式的文本已经输出
+		if !w.stream && choice.Message.Content != "" {
+			parts = append(parts, &types.GeminiPart{Text: choice.Message.Content})
+		}
+		for _, tc := range choice.Message.ToolCalls {
+			args := make(map[string]any)
+			fhblade.Json.UnmarshalFromString(tc.Function.Arguments, &args)
+			parts = append(parts, &types.GeminiPart{
+				FunctionCall: &types.GeminiFunctionCall{
+					Name: tc.Function.Name,
+					Args: args,
+				},
+			})
+		}
+		out.Candidates = append(out.Candidates, &types.GeminiCandidate{
+			Content:      &types.GeminiContent{Parts: parts, Role: "model"},
+			FinishReason: GeminiFinishReason(choice.FinishReason),
+			Index:        choice.Index,
+		})
+	}
+	if len(out.Candidates) == 0 {
+		out.Candidates = []*types.GeminiCandidate{&types.GeminiCandidate{
+			Content:      &types.GeminiContent{Parts: []*types.GeminiPart{}, Role: "model"},
+			FinishReason: GeminiFinishReason(""),
+		}}
+	}
+	if res.Usage != nil {
+		out.UsageMetadata = &types.GeminiUsageMetadata{
+			PromptTokenCount:     res.Usage.PromptTokens,
+			CandidatesTokenCount: res.Usage.CompletionTokens,
+			TotalTokenCount:      res.Usage.TotalTokens,
+		}
+	}
+	if !w.stream {
+		return w.c.JSONAndStatus(http.StatusOK, out)
+	}
+	if err := w.chunk(out); err != nil {
+		return err
+	}
+	return w.end()
+}
+
+// openai结束原因转gemini
+func GeminiFinishReason(finishReason string) string {
+	switch finishReason {
+	case "length":
+		return "MAX_TOKENS"
+	case "content_filter":
+		return "SAFETY"
+	}
+	return "STOP"
+}
+
+// 状态码对应的google api错误状态
+func GeminiErrorStatus(code int) string {
+	switch code {
+	case http.StatusUnauthorized:
+		return "UNAUTHENTICATED"
+	case http.StatusForbidden:
+		return "PERMISSION_DENIED"
+	case http.StatusNotFound:
+		return "NOT_FOUND"
+	case http.StatusTooManyRequests:
+		return "RESOURCE_EXHAUSTED"
+	case http.StatusNotImplemented:
+		return "UNIMPLEMENTED"
+	case http.StatusServiceUnavailable:
+		return "UNAVAILABLE"
+	case http.StatusGatewayTimeout:
+		return "DEADLINE_EXCEEDED"
+	}
+	if code >= http.StatusInternalServerError {
+		return "INTERNAL"
+	}
+	return "INVALID_ARGUMENT"
+}
@@ -0,0 +1,167 @@
+package chat
+
+import (
+	"strings"
+	"testing"
+
+	http "github.com/bogdanfinn/fhttp"
+	"github.com/zatxm/any-proxy/internal/types"
+	"github.com/zatxm/fhblade"
+)
+
+func intPtr(i int) *int {
+	return &i
+}
+
+// 文本分两次返回,函数调用参数分片返回,最后带用量
+func geminiChunks() []*types.ChatCompletionResponse {
+	delta := func(msg *types.ChatCompletionMessage, finishReason string) *types.ChatCompletionResponse {
+		return &types.ChatCompletionResponse{
+			Object:  "chat.completion.chunk",
+			Choices: []*types.ChatCompletionChoice{{Index: 0, Delta: msg, FinishReason: finishReason}},
+		}
+	}
+	return []*types.ChatCompletionResponse{
+		delta(&types.ChatCompletionMessage{Role: "assistant", Content: "hel"}, ""),
+		delta(&types.ChatCompletionMessage{Content: "lo"}, ""),
+		delta(&types.ChatCompletionMessage{ToolCalls: []*types.ToolCall{{
+			Index:    intPtr(0),
+			ID:       "call_abc",
+			Type:     "function",
+			Function: types.FunctionCall{Name: "get_weather", Arguments: `{"city":`},
+		}}}, ""),
+		delta(&types.ChatCompletionMessage{ToolCalls: []*types.ToolCall{{
+			Index:    intPtr(0),
+			Function: types.FunctionCall{Arguments: `"Paris"}`},
+		}}}, "tool_calls"),
+		{
+			Object: "chat.completion.chunk",
+			Usage:  &types.Usage{PromptTokens: 5, CompletionTokens: 7, TotalTokens: 12},
+		},
+	}
+}
+
+func serveGemini(t *testing.T, stream, array bool) (http.Header, string) {
+	t.Helper()
+	rec := serve(t, func(c *fhblade.Context) error {
+		w := NewGeminiWriter(c, stream, array, "gpt-test")
+		for _, res := range geminiChunks() {
+			if err := w.Write(res); err != nil {
+				return err
+			}
+		}
+		return w.Done()
+	})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("code = %d, body %s", rec.Code, rec.Body.String())
+	}
+	return rec.Header(), rec.Body.String()
+}
+
+// 流式的文本逐条输出,函数调用、结束原因及用量在最后一条
+func checkGeminiStream(t *testing.T, out []*types.GeminiGenerateContentResponse) {
+	t.Helper()
+	if len(out) != 3 {
+		t.Fatalf("got %d chunks, want 3", len(out))
+	}
+	for k, want := range []string{"hel", "lo"} {
+		parts := out[k].Candidates[0].Content.Parts
+		if len(parts) != 1 || parts[0].Text != want {
+			t.Errorf("chunk %d parts = %+v, want %s", k, parts, want)
+		}
+		if out[k].ModelVersion != "gpt-test" {
+			t.Errorf("chunk %d modelVersion = %s", k, out[k].ModelVersion)
+		}
+	}
+	last := out[2]
+	candidate := last.Candidates[0]
+	if candidate.FinishReason != "STOP" {
+		t.Errorf("finishReason = %s, want STOP", candidate.FinishReason)
+	}
+	parts := candidate.Content.Parts
+	if len(parts) != 1 || parts[0].FunctionCall == nil {
+		t.Fatalf("last chunk parts = %+v, want one functionCall", parts)
+	}
+	fc := parts[0].FunctionCall
+	if fc.Name != "get_weather" || fc.Args["city"] != "Paris" {
+		t.Errorf("functionCall = %+v", fc)
+	}
+	u := last.UsageMetadata
+	if u == nil || u.PromptTokenCount != 5 || u.CandidatesTokenCount != 7 || u.TotalTokenCount != 12 {
+		t.Errorf("usageMetadata = %+v", u)
+	}
+}
+
+// 没传alt=sse时同google返回json数组
+func TestGeminiWriterArray(t *testing.T) {
+	header, body := serveGemini(t, true, true)
+	if ct := header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %s", ct)
+	}
+	if !strings.HasPrefix(body, "[") || !strings.HasSuffix(body, "]") {
+		t.Fatalf("body is not a json array: %s", body)
+	}
+	var out []*types.GeminiGenerateContentResponse
+	if err := fhblade.Json.UnmarshalFromString(body, &out); err != nil {
+		t.Fatalf("invalid json array: %v, %s", err, body)
+	}
+	checkGeminiStream(t, out)
+}
+
+func TestGeminiWriterSSE(t *testing.T) {
+	header, body := serveGemini(t, true, false)
+	if ct := header.Get("Content-Type"); !strings.HasPrefix(ct, "text/event-stream") {
+		t.Errorf("Content-Type = %s", ct)
+	}
+	var out []*types.GeminiGenerateContentResponse
+	for _, event := range strings.Split(strings.TrimSpace(body), "\n\n") {
+		data, ok := strings.CutPrefix(event, "data: ")
+		if !ok {
+			t.Fatalf("invalid event %q", event)
+		}
+		var res types.GeminiGenerateContentResponse
+		if err := fhblade.Json.UnmarshalFromString(data, &res); err != nil {
+			t.Fatalf("invalid data %s: %v", data, err)
+		}
+		out = append(out, &res)
+	}
+	checkGeminiStream(t, out)
+}
+
+// 非流式返回一个json对象,文本和函数调用在同一个candidate
+func TestGeminiWriterNonStream(t *testing.T) {
+	_, body := serveGemini(t, false, false)
+	var out types.GeminiGenerateContentResponse
+	if err := fhblade.Json.UnmarshalFromString(body, &out); err != nil {
+		t.Fatalf("invalid json %s: %v", body, err)
+	}
+	if len(out.Candidates) != 1 {
+		t.Fatalf("candidates = %d, want 1", len(out.Candidates))
+	}
+	parts := out.Candidates[0].Content.Parts
+	if len(parts) != 2 || parts[0].Text != "hello" || parts[1].FunctionCall == nil || parts[1].FunctionCall.Args["city"] != "Paris" {
+		t.Errorf("parts = %s", body)
+	}
+	if out.UsageMetadata == nil || out.UsageMetadata.TotalTokenCount != 12 {
+		t.Errorf("usageMetadata = %+v", out.UsageMetadata)
+	}
+}
+
+// 已输出数据后出错,错误作为数组最后一个元素,数组仍是完整的json
+func TestGeminiWriterArrayError(t *testing.T) {
+	rec := serve(t, func(c *fhblade.Context) error {
+		w := NewGeminiWriter(c, true, true, "gpt-test")
+		if err := w.Write(geminiChunks()[0]); err != nil {
+			return err
+		}
+		return w.Error(http.StatusTooManyRequests, &types.CError{Message: "rate limited"})
+	})
+	var out []map[string]any
+	if err := fhblade.Json.Unmarshal(rec.Body.Bytes(), &out); err != nil || len(out) != 2 {
+		t.Fatalf("invalid json array %s", rec.Body.String())
+	}
+	e, _ := out[1]["error"].(map[string]any)
+	if e["status"] != "RESOURCE_EXHAUSTED" || e["message"] != "rate limited" {
+		t.Errorf("error = %v", out[1])
+	}
+}
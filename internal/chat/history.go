@@ -0,0 +1,95 @@
+package chat
+
+import (
+	"strings"
+
+	"github.com/zatxm/any-proxy/internal/types"
+)
+
+// 多轮对话历史的发送方式,各provider配置history_mode
+const (
+	// 只发送最后一条user消息,默认
+	HistoryLast = "last"
+	// 之前的消息渲染成文本放在第一次提问中
+	HistoryTranscript = "transcript"
+	// 之前的消息作为上游原生的上下文,chatgpt web为父消息链,bing为previousMessages,coze为chat_history
+	HistoryChain = "chain"
+)
+
+// 消息文本,多模态消息只取文本部分
+func MessageText(m *types.ChatCompletionMessage) string {
+	if m.MultiContent == nil {
+		return m.Content
+	}
+	var texts []string
+	for _, part := range m.MultiContent {
+		if part.Type == "text" && part.Text != "" {
+			texts = append(texts, part.Text)
+		}
+	}
+	return strings.Join(texts, "\n")
+}
+
+// 拆分出最后一条user消息及之前的历史,之后的消息忽略
+func SplitHistory(ms []*types.ChatCompletionMessage) ([]*types.ChatCompletionMessage, *types.ChatCompletionMessage) {
+	for k := len(ms) - 1; k >= 0; k-- {
+		if ms[k].Role == "user" {
+			return ms[:k], ms[k]
+		}
+	}
+	return ms, nil
+}
+
+// 历史消息渲染成文本,后面接最后一条user消息
+func Transcript(history []*types.ChatCompletionMessage, prompt string) string {
+	if len(history) == 0 {
+		return prompt
+	}
+	var b strings.Builder
+	b.WriteString("Here is the conversation so far:\n\n")
+	b.WriteString(HistoryText(history))
+	b.WriteString("\n\nContinue the conversation. Reply to this latest user message:\n")
+	b.WriteString(prompt)
+	return b.String()
+}
+
+// 按角色逐条渲染消息
+func HistoryText(history []*types.ChatCompletionMessage) string {
+	parts := make([]string, 0, len(history))
+	for _, m := range history {
+		text := MessageText(m)
+		if text == "" {
+			continue
+		}
+		parts = append(parts, roleName(m.Role)+": "+text)
+	}
+	return strings.Join(parts, "\n\n")
+}
+
+func roleName(role string) string {
+	switch role {
+	case "system", "developer":
+		return "System"
+	case "assistant":
+		return "Assistant"
+	case "tool":
+		return "Tool"
+	}
+	return "User"
+}
+
+// 合并system、developer消息,返回合并后的文本及剩下的消息
+func SplitSystem(ms []*types.ChatCompletionMessage) (string, []*types.ChatCompletionMessage) {
+	var systems []string
+	rest := make([]*types.ChatCompletionMessage, 0, len(ms))
+	for _, m := range ms {
+		if m.Role != "system" && m.Role != "developer" {
+			rest = append(rest, m)
+			continue
+		}
+		if text := MessageText(m); text != "" {
+			systems = append(systems, text)
+		}
+	}
+	return strings.Join(systems, "\n\n"), rest
+}
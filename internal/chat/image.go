@@ -0,0 +1,259 @@
+package chat
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"net"
+	"net/netip"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	http "github.com/bogdanfinn/fhttp"
+	"github.com/h2non/filetype"
+	"github.com/zatxm/any-proxy/internal/config"
+	"github.com/zatxm/any-proxy/internal/vars"
+	"github.com/zatxm/any-proxy/pkg/support"
+	"github.com/zatxm/fhblade"
+	tlsClient "github.com/zatxm/tls-client"
+	"github.com/zatxm/tls-client/profiles"
+	"go.uber.org/zap"
+)
+
+const (
+	// 图片大小限制
+	maxImageSize = 20 << 20
+	// 下载图片最多跳转次数
+	maxImageRedirects   = 5
+	imageTimeoutSeconds = 60
+)
+
+var (
+	ErrImageURL      = errors.New("image_url must be a data url or http(s) url")
+	ErrImageTooLarge = fmt.Errorf("image exceeds %d MB", maxImageSize>>20)
+	ErrImageHost     = errors.New("image_url host is not allowed")
+
+	// net.IP方法之外不能访问的地址段
+	deniedPrefixes = []netip.Prefix{
+		netip.MustParsePrefix("0.0.0.0/8"),
+		netip.MustParsePrefix("100.64.0.0/10"),
+		netip.MustParsePrefix("192.0.0.0/24"),
+		netip.MustParsePrefix("198.18.0.0/15"),
+		netip.MustParsePrefix("240.0.0.0/4"),
+		netip.MustParsePrefix("64:ff9b::/96"),
+	}
+)
+
+type Image struct {
+	MimeType string
+	Data     []byte
+}
+
+func (i *Image) Base64() string {
+	return base64.StdEncoding.EncodeToString(i.Data)
+}
+
+// 图片宽高,不支持的格式返回0
+func (i *Image) Dimensions() (int, int) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(i.Data))
+	if err != nil {
+		return 0, 0
+	}
+	return cfg.Width, cfg.Height
+}
+
+// 按类型生成文件名
+func (i *Image) FileName(name string) string {
+	ext := strings.TrimPrefix(i.MimeType, "image/")
+	if ext == "jpeg" {
+		ext = "jpg"
+	}
+	return name + "." + ext
+}
+
+// 读取image_url,data url直接解码,远程url下载并限制大小
+// 远程url不能是内网地址,每次跳转都检查;ctx随请求取消,proxyUrl为上游使用的代理,为空用全局代理
+func LoadImage(ctx context.Context, u, proxyUrl string) (*Image, error) {
+	if strings.HasPrefix(u, "data:") {
+		return decodeDataURL(u)
+	}
+	if !support.EqURL(u) {
+		return nil, ErrImageURL
+	}
+	if proxyUrl == "" {
+		proxyUrl = config.ProxyUrl()
+	}
+	gClient, err := imageClient(proxyUrl)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := fetchImage(ctx, gClient, u)
+	if err != nil {
+		fhblade.Log.Error("load image req err", zap.Error(err), zap.String("url", u))
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetch image %s status %d", u, resp.StatusCode)
+	}
+	if resp.ContentLength > maxImageSize {
+		return nil, ErrImageTooLarge
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxImageSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxImageSize {
+		return nil, ErrImageTooLarge
+	}
+	mimeType := strings.TrimSpace(strings.Split(resp.Header.Get("Content-Type"), ";")[0])
+	return newImage(mimeType, data)
+}
+
+// 不自动跳转,跳转地址检查后再请求
+func fetchImage(ctx context.Context, gClient tlsClient.HttpClient, u string) (*http.Response, error) {
+	for redirects := 0; ; redirects++ {
+		if err := checkImageHost(ctx, u); err != nil {
+			return nil, err
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header = http.Header{
+			"accept":     {"image/*"},
+			"user-agent": {vars.UserAgent},
+		}
+		resp, err := gClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		switch resp.StatusCode {
+		case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		default:
+			return resp, nil
+		}
+		resp.Body.Close()
+		if redirects >= maxImageRedirects {
+			return nil, fmt.Errorf("fetch image %s: too many redirects", u)
+		}
+		loc, err := req.URL.Parse(resp.Header.Get("Location"))
+		if err != nil {
+			return nil, err
+		}
+		u = loc.String()
+		if !support.EqURL(u) {
+			return nil, ErrImageURL
+		}
+	}
+}
+
+// 没有代理时连接前检查实际连接的ip,防止检查后解析结果变化
+// 有代理时由代理解析,只能在请求前检查
+func imageClient(proxyUrl string) (tlsClient.HttpClient, error) {
+	options := []tlsClient.HttpClientOption{
+		tlsClient.WithTimeoutSeconds(imageTimeoutSeconds),
+		tlsClient.WithClientProfile(profiles.Okhttp4Android13),
+		tlsClient.WithNotFollowRedirects(),
+	}
+	if proxyUrl != "" {
+		options = append(options, tlsClient.WithProxyUrl(proxyUrl))
+	} else {
+		options = append(options, tlsClient.WithDialer(net.Dialer{
+			Timeout: imageTimeoutSeconds * time.Second,
+			Control: denyInternalDial,
+		}))
+	}
+	return tlsClient.NewHttpClient(tlsClient.NewNoopLogger(), options...)
+}
+
+// 解析url的host,有一个是内网地址都不允许
+func checkImageHost(ctx context.Context, u string) error {
+	pu, err := url.Parse(u)
+	if err != nil {
+		return ErrImageURL
+	}
+	host := pu.Hostname()
+	if ip := net.ParseIP(host); ip != nil {
+		if internalIP(ip) {
+			return ErrImageHost
+		}
+		return nil
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		if internalIP(addr.IP) {
+			return ErrImageHost
+		}
+	}
+	return nil
+}
+
+func denyInternalDial(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || internalIP(ip) {
+		return ErrImageHost
+	}
+	return nil
+}
+
+// 本机、内网、链路本地、组播等地址
+func internalIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return true
+	}
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return true
+	}
+	addr = addr.Unmap()
+	for _, p := range deniedPrefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func decodeDataURL(u string) (*Image, error) {
+	meta, raw, ok := strings.Cut(strings.TrimPrefix(u, "data:"), ",")
+	if !ok || !strings.HasSuffix(meta, ";base64") {
+		return nil, ErrImageURL
+	}
+	data, err := base64.StdEncoding.DecodeString(raw)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxImageSize {
+		return nil, ErrImageTooLarge
+	}
+	return newImage(strings.TrimSuffix(meta, ";base64"), data)
+}
+
+// 声明的类型不是图片时按内容识别
+func newImage(mimeType string, data []byte) (*Image, error) {
+	if !strings.HasPrefix(mimeType, "image/") {
+		kind, err := filetype.Match(data)
+		if err != nil || !strings.HasPrefix(kind.MIME.Value, "image/") {
+			return nil, errors.New("image_url is not an image")
+		}
+		mimeType = kind.MIME.Value
+	}
+	return &Image{MimeType: mimeType, Data: data}, nil
+}
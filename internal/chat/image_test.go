@@ -0,0 +1,147 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	http "github.com/bogdanfinn/fhttp"
+	"github.com/bogdanfinn/fhttp/httptest"
+	"github.com/zatxm/any-proxy/internal/config"
+	tlsClient "github.com/zatxm/tls-client"
+)
+
+func TestInternalIP(t *testing.T) {
+	for _, tc := range []struct {
+		ip   string
+		want bool
+	}{
+		{"127.0.0.1", true},
+		{"10.1.2.3", true},
+		{"172.16.0.1", true},
+		{"192.168.1.1", true},
+		{"169.254.169.254", true},
+		{"100.64.0.1", true},
+		{"0.0.0.0", true},
+		{"::1", true},
+		{"fe80::1", true},
+		{"fd00::1", true},
+		{"::ffff:127.0.0.1", true},
+		{"::ffff:10.0.0.1", true},
+		{"8.8.8.8", false},
+		{"2001:4860:4860::8888", false},
+	} {
+		if got := internalIP(net.ParseIP(tc.ip)); got != tc.want {
+			t.Errorf("internalIP(%s) = %v, want %v", tc.ip, got, tc.want)
+		}
+	}
+}
+
+func TestCheckImageHost(t *testing.T) {
+	for _, u := range []string{
+		"http://127.0.0.1/a.png",
+		"http://localhost:8080/a.png",
+		"http://[::1]/a.png",
+		"http://[::ffff:127.0.0.1]/a.png",
+		"http://169.254.169.254/latest/meta-data",
+	} {
+		if err := checkImageHost(context.Background(), u); !errors.Is(err, ErrImageHost) {
+			t.Errorf("checkImageHost(%s) = %v, want ErrImageHost", u, err)
+		}
+	}
+	if err := checkImageHost(context.Background(), "https://8.8.8.8/a.png"); err != nil {
+		t.Errorf("public ip rejected: %v", err)
+	}
+}
+
+func TestLoadImageInternal(t *testing.T) {
+	if _, err := config.Parse("../../etc/c.yaml"); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("internal image url requested")
+	}))
+	defer srv.Close()
+	if _, err := LoadImage(context.Background(), srv.URL+"/a.png", ""); !errors.Is(err, ErrImageHost) {
+		t.Fatalf("err = %v, want ErrImageHost", err)
+	}
+}
+
+// 请求前检查通过后解析结果变了,连接时也拒绝
+func TestImageClientDial(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("internal image url requested")
+	}))
+	defer srv.Close()
+	gClient, err := imageClient("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+	if resp, err := gClient.Do(req); err == nil {
+		resp.Body.Close()
+		t.Fatal("dial to internal address allowed")
+	}
+}
+
+// 按url返回响应,不真正请求
+type stubClient struct {
+	tlsClient.HttpClient
+	responses map[string]*http.Response
+	requested []string
+}
+
+func (s *stubClient) Do(req *http.Request) (*http.Response, error) {
+	u := req.URL.String()
+	s.requested = append(s.requested, u)
+	resp, ok := s.responses[u]
+	if !ok {
+		return nil, errors.New("unexpected request " + u)
+	}
+	resp.Body = io.NopCloser(strings.NewReader(""))
+	return resp, nil
+}
+
+func redirect(location string) *http.Response {
+	return &http.Response{StatusCode: http.StatusFound, Header: http.Header{"Location": {location}}}
+}
+
+func TestFetchImageRedirect(t *testing.T) {
+	ctx := context.Background()
+
+	// 跳转到内网地址
+	s := &stubClient{responses: map[string]*http.Response{
+		"http://8.8.8.8/a.png": redirect("http://127.0.0.1/a.png"),
+	}}
+	if _, err := fetchImage(ctx, s, "http://8.8.8.8/a.png"); !errors.Is(err, ErrImageHost) {
+		t.Fatalf("redirect to internal: err = %v, want ErrImageHost", err)
+	}
+	if len(s.requested) != 1 {
+		t.Errorf("requested %v", s.requested)
+	}
+
+	// 相对地址跳转到公网的正常返回
+	s = &stubClient{responses: map[string]*http.Response{
+		"http://8.8.8.8/a.png": redirect("/b.png"),
+		"http://8.8.8.8/b.png": {StatusCode: http.StatusOK, Header: http.Header{}},
+	}}
+	resp, err := fetchImage(ctx, s, "http://8.8.8.8/a.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || len(s.requested) != 2 {
+		t.Errorf("status %d, requested %v", resp.StatusCode, s.requested)
+	}
+
+	// 跳转次数超出
+	s = &stubClient{responses: map[string]*http.Response{
+		"http://8.8.8.8/a.png": redirect("http://8.8.8.8/a.png"),
+	}}
+	if _, err := fetchImage(ctx, s, "http://8.8.8.8/a.png"); err == nil || !strings.Contains(err.Error(), "too many redirects") {
+		t.Fatalf("redirect loop: err = %v", err)
+	}
+}
@@ -0,0 +1,307 @@
+package chat
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	http "github.com/bogdanfinn/fhttp"
+	"github.com/zatxm/any-proxy/internal/types"
+	"github.com/zatxm/fhblade"
+)
+
+const (
+	// 输出不是合法json时最多重试次数
+	jsonRetries = 2
+)
+
+// response_format要求输出json
+func IsJSONFormat(f *types.ChatCompletionResponseFormat) bool {
+	return f != nil && (f.Type == "json_object" || f.Type == "json_schema")
+}
+
+func jsonSchema(f *types.ChatCompletionResponseFormat) any {
+	if f != nil && f.Type == "json_schema" && f.JSONSchema != nil {
+		return f.JSONSchema.Schema
+	}
+	return nil
+}
+
+// 要求输出json的提示词
+func JSONPrompt(f *types.ChatCompletionResponseFormat) string {
+	prompt := "Respond only with a valid JSON object, without any other text or markdown code fences."
+	if schema := jsonSchema(f); schema != nil {
+		schemaJson, _ := fhblade.Json.MarshalToString(schema)
+		prompt += "\nThe JSON must conform to this JSON schema:\n" + schemaJson
+	}
+	return prompt
+}
+
+// 在最后一条user消息后追加提示词,不修改原消息
+func AppendPrompt(ms []*types.ChatCompletionMessage, prompt string) []*types.ChatCompletionMessage {
+	out := make([]*types.ChatCompletionMessage, len(ms))
+	copy(out, ms)
+	for k := len(out) - 1; k >= 0; k-- {
+		if out[k].Role != "user" {
+			continue
+		}
+		m := *out[k]
+		if m.MultiContent != nil {
+			m.MultiContent = append(append([]*types.ChatMessagePart{}, m.MultiContent...),
+				&types.ChatMessagePart{Type: "text", Text: prompt})
+		} else {
+			m.Content += "\n\n" + prompt
+		}
+		out[k] = &m
+		return out
+	}
+	return append(out, &types.ChatCompletionMessage{Role: "user", Content: prompt})
+}
+
+// 上游不支持json输出的,汇总结果校验,不符合的重试,最终还不符合返回错误
+// 流式请求校验通过后一次返回
+func EnforceJSON(p types.ChatCompletionRequest, w Writer, do func(types.ChatCompletionRequest, Writer) error) error {
+	format := p.ResponseFormat
+	messages := p.Messages
+	p.Messages = AppendPrompt(messages, JSONPrompt(format))
+	var lastErr error
+	for i := 0; i <= jsonRetries; i++ {
+		bw := &bufferWriter{parent: w, collector: NewCollector()}
+		if err := do(p, bw); err != nil {
+			return err
+		}
+		if bw.err != nil {
+			return w.Error(bw.code, bw.err)
+		}
+		res := bw.collector.Response()
+		if len(res.Choices) == 0 {
+			lastErr = errors.New("empty reply")
+		} else {
+			choice := res.Choices[0]
+			// 调用了函数不校验
+			if len(choice.Message.ToolCalls) > 0 {
+				return writeCollected(w, res)
+			}
+			content, err := ParseJSONContent(choice.Message.Content, jsonSchema(format))
+			if err == nil {
+				choice.Message.Content = content
+				return writeCollected(w, res)
+			}
+			lastErr = err
+		}
+		p.Messages = AppendPrompt(messages, JSONPrompt(format)+
+			"\nA previous reply was rejected because: "+lastErr.Error()+". Reply again with only the JSON.")
+	}
+	return w.Error(http.StatusBadGateway, &types.CError{
+		Message: fmt.Sprintf("upstream reply is not valid JSON after %d attempts: %s", jsonRetries+1, lastErr.Error()),
+		Type:    "invalid_response_error",
+		Code:    "invalid_json_output",
+	})
+}
+
+func writeCollected(w Writer, res *types.ChatCompletionResponse) error {
+	res.Object = "chat.completion.chunk"
+	if err := w.Write(res); err != nil {
+		return err
+	}
+	return w.Done()
+}
+
+// 只汇总不输出
+type bufferWriter struct {
+	// 只用于取上游请求的context
+	parent    Writer
+	collector *Collector
+	code      int
+	err       *types.CError
+}
+
+func (b *bufferWriter) Write(res *types.ChatCompletionResponse) error {
+	if b.err == nil {
+		b.collector.Add(res)
+	}
+	return nil
+}
+
+func (b *bufferWriter) Error(code int, e *types.CError) error {
+	if b.err == nil {
+		b.code = code
+		b.err = e
+	}
+	return nil
+}
+
+func (b *bufferWriter) Done() error {
+	return nil
+}
+
+func (b *bufferWriter) Unwrap() Writer {
+	return b.parent
+}
+
+// 从生成的文本中取出json对象并按schema校验
+func ParseJSONContent(content string, schema any) (string, error) {
+	text := strings.TrimSpace(content)
+	if strings.HasPrefix(text, "```") {
+		text = strings.TrimPrefix(text, "```json")
+		text = strings.TrimPrefix(text, "```")
+		text = strings.TrimSuffix(strings.TrimSpace(text), "```")
+		text = strings.TrimSpace(text)
+	}
+	if !strings.HasPrefix(text, "{") {
+		start, end := strings.Index(text, "{"), strings.LastIndex(text, "}")
+		if start == -1 || end < start {
+			return "", errors.New("no JSON object found")
+		}
+		text = text[start : end+1]
+	}
+	var v any
+	if err := fhblade.Json.UnmarshalFromString(text, &v); err != nil {
+		return "", fmt.Errorf("invalid JSON: %s", err.Error())
+	}
+	if _, ok := v.(map[string]any); !ok {
+		return "", errors.New("reply is not a JSON object")
+	}
+	if schema != nil {
+		if err := validateSchema(v, schema, "$"); err != nil {
+			return "", err
+		}
+	}
+	return text, nil
+}
+
+// 常用的json schema校验,不支持$ref等
+func validateSchema(v any, schema any, path string) error {
+	s, ok := schema.(map[string]any)
+	if !ok {
+		return nil
+	}
+	if anyOf, ok := s["anyOf"].([]any); ok {
+		if !matchAny(v, anyOf, path) {
+			return fmt.Errorf("%s does not match anyOf", path)
+		}
+	}
+	if oneOf, ok := s["oneOf"].([]any); ok {
+		if !matchAny(v, oneOf, path) {
+			return fmt.Errorf("%s does not match oneOf", path)
+		}
+	}
+	if t, ok := s["type"]; ok && !matchType(v, t) {
+		return fmt.Errorf("%s should be %v", path, t)
+	}
+	if enum, ok := s["enum"].([]any); ok {
+		found := false
+		for _, e := range enum {
+			if fmt.Sprint(e) == fmt.Sprint(v) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s should be one of %v", path, enum)
+		}
+	}
+	switch val := v.(type) {
+	case map[string]any:
+		props, _ := s["properties"].(map[string]any)
+		if required, ok := s["required"].([]any); ok {
+			for _, r := range required {
+				name, _ := r.(string)
+				if _, ok := val[name]; !ok {
+					return fmt.Errorf("%s.%s is required", path, name)
+				}
+			}
+		}
+		for name, pv := range val {
+			if ps, ok := props[name]; ok {
+				if err := validateSchema(pv, ps, path+"."+name); err != nil {
+					return err
+				}
+				continue
+			}
+			switch ap := s["additionalProperties"].(type) {
+			case bool:
+				if !ap {
+					return fmt.Errorf("%s.%s is not allowed", path, name)
+				}
+			case map[string]any:
+				if err := validateSchema(pv, ap, path+"."+name); err != nil {
+					return err
+				}
+			}
+		}
+	case []any:
+		if n, ok := s["minItems"].(float64); ok && float64(len(val)) < n {
+			return fmt.Errorf("%s should have at least %v items", path, n)
+		}
+		if n, ok := s["maxItems"].(float64); ok && float64(len(val)) > n {
+			return fmt.Errorf("%s should have at most %v items", path, n)
+		}
+		if items, ok := s["items"]; ok {
+			for k := range val {
+				if err := validateSchema(val[k], items, path+"["+strconv.Itoa(k)+"]"); err != nil {
+					return err
+				}
+			}
+		}
+	case float64:
+		if n, ok := s["minimum"].(float64); ok && val < n {
+			return fmt.Errorf("%s should be >= %v", path, n)
+		}
+		if n, ok := s["maximum"].(float64); ok && val > n {
+			return fmt.Errorf("%s should be <= %v", path, n)
+		}
+	}
+	return nil
+}
+
+func matchAny(v any, schemas []any, path string) bool {
+	for _, sc := range schemas {
+		if validateSchema(v, sc, path) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func matchType(v any, t any) bool {
+	switch tv := t.(type) {
+	case string:
+		return isType(v, tv)
+	case []any:
+		for _, one := range tv {
+			if name, ok := one.(string); ok && isType(v, name) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func isType(v any, t string) bool {
+	switch t {
+	case "object":
+		_, ok := v.(map[string]any)
+		return ok
+	case "array":
+		_, ok := v.([]any)
+		return ok
+	case "string":
+		_, ok := v.(string)
+		return ok
+	case "number":
+		_, ok := v.(float64)
+		return ok
+	case "integer":
+		n, ok := v.(float64)
+		return ok && n == float64(int64(n))
+	case "boolean":
+		_, ok := v.(bool)
+		return ok
+	case "null":
+		return v == nil
+	}
+	return true
+}
@@ -0,0 +1,89 @@
+package chat
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/zatxm/fhblade"
+)
+
+const testSchema = `{
+	"type": "object",
+	"properties": {
+		"name": {"type": "string"},
+		"age": {"type": "integer", "minimum": 0},
+		"score": {"type": "number"},
+		"active": {"type": "boolean"},
+		"tags": {"type": "array", "items": {"type": "string"}, "maxItems": 2},
+		"role": {"enum": ["admin", "user"]},
+		"note": {"type": ["string", "null"]},
+		"address": {
+			"type": "object",
+			"properties": {"city": {"type": "string"}},
+			"required": ["city"],
+			"additionalProperties": false
+		}
+	},
+	"required": ["name", "age"]
+}`
+
+func TestParseJSONContent(t *testing.T) {
+	var schema any
+	if err := fhblade.Json.UnmarshalFromString(testSchema, &schema); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		content string
+		want    string
+		// 为空表示校验通过
+		err string
+	}{
+		{"valid", `{"name":"a","age":1}`, `{"name":"a","age":1}`, ""},
+		{"all fields", `{"name":"a","age":1,"score":1.5,"active":true,"tags":["x"],"role":"user","note":null,"address":{"city":"c"}}`, "", ""},
+		{"code fence", "```json\n{\"name\":\"a\",\"age\":1}\n```", `{"name":"a","age":1}`, ""},
+		{"surrounding text", `Here it is: {"name":"a","age":1} done`, `{"name":"a","age":1}`, ""},
+		{"missing required", `{"name":"a"}`, "", "$.age is required"},
+		{"missing nested required", `{"name":"a","age":1,"address":{}}`, "", "$.address.city is required"},
+		{"string type", `{"name":1,"age":1}`, "", "$.name should be string"},
+		{"integer type", `{"name":"a","age":1.5}`, "", "$.age should be integer"},
+		{"number type", `{"name":"a","age":1,"score":"high"}`, "", "$.score should be number"},
+		{"boolean type", `{"name":"a","age":1,"active":"yes"}`, "", "$.active should be boolean"},
+		{"array item type", `{"name":"a","age":1,"tags":["x",2]}`, "", "$.tags[1] should be string"},
+		{"max items", `{"name":"a","age":1,"tags":["x","y","z"]}`, "", "$.tags should have at most 2 items"},
+		{"minimum", `{"name":"a","age":-1}`, "", "$.age should be >= 0"},
+		{"enum", `{"name":"a","age":1,"role":"root"}`, "", "$.role should be one of"},
+		{"type list", `{"name":"a","age":1,"note":1}`, "", "$.note should be"},
+		{"additional properties", `{"name":"a","age":1,"address":{"city":"c","zip":"1"}}`, "", "$.address.zip is not allowed"},
+		{"not object", `["a"]`, "", "no JSON object found"},
+		{"invalid json", `{"name":}`, "", "invalid JSON"},
+		{"no json", `sorry`, "", "no JSON object found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseJSONContent(tt.content, schema)
+			if tt.err == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if tt.want != "" && got != tt.want {
+					t.Errorf("got %s, want %s", got, tt.want)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("error = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+// 没有schema时只要求是json对象
+func TestParseJSONContentNoSchema(t *testing.T) {
+	if _, err := ParseJSONContent(`{"any":[1,"x"]}`, nil); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := ParseJSONContent(`"text"`, nil); err == nil {
+		t.Error("string reply should fail")
+	}
+}
@@ -0,0 +1,320 @@
+package chat
+
+import (
+	"strings"
+
+	http "github.com/bogdanfinn/fhttp"
+	"github.com/google/uuid"
+	"github.com/zatxm/any-proxy/internal/types"
+	"github.com/zatxm/fhblade"
+)
+
+// 按responses api格式输出,stream时返回response.*类型的sse事件
+// 只输出第一个choice,结束后回调最终的response
+func NewResponsesWriter(c *fhblade.Context, stream bool, res *types.Response, onDone func(*types.Response)) Writer {
+	return &responsesWriter{
+		sse:       sse{c: c},
+		stream:    stream,
+		res:       res,
+		onDone:    onDone,
+		collector: NewCollector(),
+	}
+}
+
+type responsesWriter struct {
+	sse
+	stream       bool
+	res          *types.Response
+	onDone       func(*types.Response)
+	collector    *Collector
+	usage        *types.Usage
+	finishReason string
+	seq          int
+	// 当前输出项,文本或函数调用
+	message   *types.ResponseOutputMessage
+	call      *types.ResponseFunctionCall
+	text      strings.Builder
+	toolIndex int
+	begun     bool
+	done      bool
+}
+
+// 输出项id
+func ResponseItemId(prefix string) string {
+	return prefix + "_" + strings.ReplaceAll(uuid.NewString(), "-", "")
+}
+
+func (w *responsesWriter) Write(res *types.ChatCompletionResponse) error {
+	if w.done {
+		return nil
+	}
+	if res.Usage != nil {
+		w.usage = res.Usage
+	}
+	if !w.stream {
+		w.collector.Add(res)
+		return nil
+	}
+	for _, choice := range res.Choices {
+		if choice.Index != 0 {
+			continue
+		}
+		if choice.FinishReason != "" {
+			w.finishReason = choice.FinishReason
+		}
+		msg := choice.Delta
+		if msg == nil {
+			msg = choice.Message
+		}
+		if msg == nil {
+			continue
+		}
+		if msg.Content != "" {
+			if w.message == nil {
+				if err := w.startMessage(); err != nil {
+					return err
+				}
+			}
+			w.text.WriteString(msg.Content)
+			if err := w.emit("response.output_text.delta", fhblade.H{
+				"item_id":       w.message.ID,
+				"output_index":  len(w.res.Output),
+				"content_index": 0,
+				"delta":         msg.Content,
+			}); err != nil {
+				return err
+			}
+		}
+		for _, tc := range msg.ToolCalls {
+			// 带id的是新的函数调用,之后的只有参数片段
+			ti := w.toolIndex
+			if tc.Index != nil {
+				ti = *tc.Index
+			}
+			if tc.ID != "" || w.call == nil || ti != w.toolIndex {
+				w.toolIndex = ti
+				if err := w.startCall(tc); err != nil {
+					return err
+				}
+			}
+			if tc.Function.Arguments == "" {
+				continue
+			}
+			w.call.Arguments += tc.Function.Arguments
+			if err := w.emit("response.function_call_arguments.delta", fhblade.H{
+				"item_id":      w.call.ID,
+				"output_index": len(w.res.Output),
+				"delta":        tc.Function.Arguments,
+			}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// 事件带type及递增的sequence_number
+func (w *responsesWriter) emit(event string, data fhblade.H) error {
+	data["type"] = event
+	data["sequence_number"] = w.seq
+	w.seq++
+	return w.event(event, data)
+}
+
+// 第一次输出前返回response.created、response.in_progress
+func (w *responsesWriter) begin() error {
+	if w.begun {
+		return nil
+	}
+	w.begun = true
+	w.res.Status = "in_progress"
+	if err := w.emit("response.created", fhblade.H{"response": w.res}); err != nil {
+		return err
+	}
+	return w.emit("response.in_progress", fhblade.H{"response": w.res})
+}
+
+func (w *responsesWriter) startMessage() error {
+	if err := w.closeItem(); err != nil {
+		return err
+	}
+	w.message = &types.ResponseOutputMessage{
+		Type:    "message",
+		ID:      ResponseItemId("msg"),
+		Status:  "in_progress",
+		Role:    "assistant",
+		Content: []*types.ResponseOutputText{},
+	}
+	w.text.Reset()
+	if err := w.emit("response.output_item.added", fhblade.H{
+		"output_index": len(w.res.Output),
+		"item":         w.message,
+	}); err != nil {
+		return err
+	}
+	return w.emit("response.content_part.added", fhblade.H{
+		"item_id":       w.message.ID,
+		"output_index":  len(w.res.Output),
+		"content_index": 0,
+		"part":          outputText(""),
+	})
+}
+
+func (w *responsesWriter) startCall(tc *types.ToolCall) error {
+	if err := w.closeItem(); err != nil {
+		return err
+	}
+	callId := tc.ID
+	if callId == "" {
+		callId = ResponseItemId("call")
+	}
+	w.call = &types.ResponseFunctionCall{
+		Type:   "function_call",
+		ID:     ResponseItemId("fc"),
+		CallID: callId,
+		Name:   tc.Function.Name,
+		Status: "in_progress",
+	}
+	return w.emit("response.output_item.added", fhblade.H{
+		"output_index": len(w.res.Output),
+		"item":         w.call,
+	})
+}
+
+// 结束当前输出项并加入output
+func (w *responsesWriter) closeItem() error {
+	if err := w.begin(); err != nil {
+		return err
+	}
+	index := len(w.res.Output)
+	if w.message != nil {
+		item := w.message
+		w.message = nil
+		part := outputText(w.text.String())
+		if err := w.emit("response.output_text.done", fhblade.H{
+			"item_id":       item.ID,
+			"output_index":  index,
+			"content_index": 0,
+			"text":          part.Text,
+		}); err != nil {
+			return err
+		}
+		if err := w.emit("response.content_part.done", fhblade.H{
+			"item_id":       item.ID,
+			"output_index":  index,
+			"content_index": 0,
+			"part":          part,
+		}); err != nil {
+			return err
+		}
+		item.Status = "completed"
+		item.Content = []*types.ResponseOutputText{part}
+		w.res.Output = append(w.res.Output, item)
+		return w.emit("response.output_item.done", fhblade.H{"output_index": index, "item": item})
+	}
+	if w.call != nil {
+		item := w.call
+		w.call = nil
+		if err := w.emit("response.function_call_arguments.done", fhblade.H{
+			"item_id":      item.ID,
+			"output_index": index,
+			"arguments":    item.Arguments,
+		}); err != nil {
+			return err
+		}
+		item.Status = "completed"
+		w.res.Output = append(w.res.Output, item)
+		return w.emit("response.output_item.done", fhblade.H{"output_index": index, "item": item})
+	}
+	return nil
+}
+
+func outputText(text string) *types.ResponseOutputText {
+	return &types.ResponseOutputText{Type: "output_text", Text: text, Annotations: []any{}}
+}
+
+func (w *responsesWriter) Error(code int, e *types.CError) error {
+	if w.done {
+		return nil
+	}
+	w.done = true
+	if !w.started {
+		w.started = true
+		return errorJSON(w.c, code, e, types.ErrorResponse{Error: e})
+	}
+	w.res.Status = "failed"
+	w.res.Error = &types.ResponseError{Code: e.Code, Message: e.Message}
+	return w.emit("response.failed", fhblade.H{"response": w.res})
+}
+
+func (w *responsesWriter) Done() error {
+	if w.done {
+		return nil
+	}
+	w.done = true
+	if !w.stream {
+		w.output()
+		w.finish()
+		w.onDone(w.res)
+		return w.c.JSONAndStatus(http.StatusOK, w.res)
+	}
+	if err := w.closeItem(); err != nil {
+		return err
+	}
+	w.finish()
+	w.onDone(w.res)
+	return w.emit("response."+w.res.Status, fhblade.H{"response": w.res})
+}
+
+// 非流式由汇总结果生成output
+func (w *responsesWriter) output() {
+	res := w.collector.Response()
+	if len(res.Choices) == 0 {
+		return
+	}
+	choice := res.Choices[0]
+	w.finishReason = choice.FinishReason
+	if choice.Message.Content != "" {
+		w.res.Output = append(w.res.Output, &types.ResponseOutputMessage{
+			Type:    "message",
+			ID:      ResponseItemId("msg"),
+			Status:  "completed",
+			Role:    "assistant",
+			Content: []*types.ResponseOutputText{outputText(choice.Message.Content)},
+		})
+	}
+	for _, tc := range choice.Message.ToolCalls {
+		callId := tc.ID
+		if callId == "" {
+			callId = ResponseItemId("call")
+		}
+		w.res.Output = append(w.res.Output, &types.ResponseFunctionCall{
+			Type:      "function_call",
+			ID:        ResponseItemId("fc"),
+			CallID:    callId,
+			Name:      tc.Function.Name,
+			Arguments: tc.Function.Arguments,
+			Status:    "completed",
+		})
+	}
+}
+
+// 结束状态及usage,长度、内容过滤截断的为incomplete
+func (w *responsesWriter) finish() {
+	w.res.Status = "completed"
+	switch w.finishReason {
+	case "length":
+		w.res.Status = "incomplete"
+		w.res.IncompleteDetails = &types.ResponseIncompleteDetails{Reason: "max_output_tokens"}
+	case "content_filter":
+		w.res.Status = "incomplete"
+		w.res.IncompleteDetails = &types.ResponseIncompleteDetails{Reason: "content_filter"}
+	}
+	if w.usage != nil {
+		w.res.Usage = &types.ResponseUsage{
+			InputTokens:  w.usage.PromptTokens,
+			OutputTokens: w.usage.CompletionTokens,
+			TotalTokens:  w.usage.TotalTokens,
+		}
+	}
+}
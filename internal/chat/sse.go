@@ -0,0 +1,82 @@
+package chat
+
+import (
+	"errors"
+	"fmt"
+
+	http "github.com/bogdanfinn/fhttp"
+	"github.com/zatxm/any-proxy/internal/types"
+	"github.com/zatxm/any-proxy/internal/vars"
+	"github.com/zatxm/fhblade"
+)
+
+var (
+	ErrFlushNotSupported = errors.New("Flushing not supported")
+)
+
+// sse输出,第一次写入时才返回头部,之前出错还能返回正常的状态码
+type sse struct {
+	c       *fhblade.Context
+	rw      http.ResponseWriter
+	flusher http.Flusher
+	started bool
+	err     error
+	// 默认text/event-stream
+	contentType string
+}
+
+func (s *sse) start() error {
+	if s.started {
+		return s.err
+	}
+	s.started = true
+	rw := s.c.Response().Rw()
+	flusher, ok := rw.(http.Flusher)
+	if !ok {
+		s.err = ErrFlushNotSupported
+		s.c.JSONAndStatus(http.StatusNotImplemented, types.ErrorResponse{
+			Error: &types.CError{
+				Message: s.err.Error(),
+				Type:    "invalid_systems_error",
+				Code:    "systems_error",
+			},
+		})
+		return s.err
+	}
+	header := rw.Header()
+	contentType := s.contentType
+	if contentType == "" {
+		contentType = vars.ContentTypeStream
+	}
+	header.Set("Content-Type", contentType)
+	header.Set("Cache-Control", "no-cache")
+	header.Set("Connection", "keep-alive")
+	header.Set("Access-Control-Allow-Origin", "*")
+	rw.WriteHeader(http.StatusOK)
+	s.rw = rw
+	s.flusher = flusher
+	return nil
+}
+
+// 输出一个事件,event为空时只有data行
+func (s *sse) event(event string, v any) error {
+	outJson, _ := fhblade.Json.Marshal(v)
+	if err := s.start(); err != nil {
+		return err
+	}
+	if event != "" {
+		fmt.Fprintf(s.rw, "event: %s\n", event)
+	}
+	fmt.Fprintf(s.rw, "data: %s\n\n", outJson)
+	s.flusher.Flush()
+	return nil
+}
+
+func (s *sse) data(data string) error {
+	if err := s.start(); err != nil {
+		return err
+	}
+	fmt.Fprintf(s.rw, "data: %s\n\n", data)
+	s.flusher.Flush()
+	return nil
+}
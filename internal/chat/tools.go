@@ -0,0 +1,352 @@
+package chat
+
+import (
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/zatxm/any-proxy/internal/types"
+	"github.com/zatxm/fhblade"
+)
+
+const (
+	toolCallsStartTag = "<tool_calls>"
+	toolCallsEndTag   = "</tool_calls>"
+)
+
+// 模型返回的工具调用块
+type emulateToolCall struct {
+	Name      string `json:"name"`
+	Arguments any    `json:"arguments"`
+}
+
+// 不支持函数调用的上游通过提示词模拟
+// tools写入最后一条user消息,之后的tool_calls、tool结果也折叠进去
+// 返回的writer从生成的文本中解析<tool_calls>块转成tool_calls
+func EmulateTools(p types.ChatCompletionRequest, w Writer) (types.ChatCompletionRequest, Writer) {
+	tools := p.Tools
+	p.Tools = nil
+	if len(tools) == 0 {
+		return p, w
+	}
+	if v, ok := p.ToolChoice.(string); ok && v == "none" {
+		p.Messages = flattenToolMessages(p.Messages)
+		return p, w
+	}
+	p.Messages = foldToolMessages(p.Messages, toolsPrompt(tools, p.ToolChoice))
+	return p, &toolWriter{w: w}
+}
+
+func toolsPrompt(tools []types.Tool, toolChoice any) string {
+	var b strings.Builder
+	b.WriteString("You have access to the following tools. To call tools, reply with ONLY a block in this exact format and nothing else:\n")
+	b.WriteString(toolCallsStartTag)
+	b.WriteString("\n[{\"name\": \"tool_name\", \"arguments\": {\"arg\": \"value\"}}]\n")
+	b.WriteString(toolCallsEndTag)
+	b.WriteString("\nThe block must be valid JSON. If no tool is needed, answer directly without the block.\n")
+	switch v := toolChoice.(type) {
+	case string:
+		if v == "required" {
+			b.WriteString("You must call at least one tool.\n")
+		}
+	case map[string]any:
+		if fn, ok := v["function"].(map[string]any); ok {
+			if name, ok := fn["name"].(string); ok && name != "" {
+				b.WriteString("You must call the tool `" + name + "`.\n")
+			}
+		}
+	}
+	b.WriteString("\nTools:\n")
+	for k := range tools {
+		tool := tools[k]
+		if tool.Function == nil {
+			continue
+		}
+		b.WriteString("- ")
+		b.WriteString(tool.Function.Name)
+		if tool.Function.Description != "" {
+			b.WriteString(": ")
+			b.WriteString(tool.Function.Description)
+		}
+		b.WriteString("\n")
+		if tool.Function.Parameters != nil {
+			params, _ := fhblade.Json.MarshalToString(tool.Function.Parameters)
+			b.WriteString("  parameters: ")
+			b.WriteString(params)
+			b.WriteString("\n")
+		}
+	}
+	return b.String()
+}
+
+// assistant的tool_calls转成文本块
+func toolCallsText(tcs []*types.ToolCall) string {
+	calls := make([]*emulateToolCall, 0, len(tcs))
+	for _, tc := range tcs {
+		var args any = tc.Function.Arguments
+		var obj map[string]any
+		if err := fhblade.Json.UnmarshalFromString(tc.Function.Arguments, &obj); err == nil {
+			args = obj
+		}
+		calls = append(calls, &emulateToolCall{Name: tc.Function.Name, Arguments: args})
+	}
+	callsJson, _ := fhblade.Json.MarshalToString(calls)
+	return toolCallsStartTag + "\n" + callsJson + "\n" + toolCallsEndTag
+}
+
+func toolResultText(m *types.ChatCompletionMessage, names map[string]string) string {
+	name := names[m.ToolCallID]
+	if name == "" {
+		name = m.Name
+	}
+	return "Tool result (" + name + ", " + m.ToolCallID + "):\n" + m.Content
+}
+
+// 工具相关消息全部转成普通文本消息
+func flattenToolMessages(ms []*types.ChatCompletionMessage) []*types.ChatCompletionMessage {
+	names := make(map[string]string)
+	out := make([]*types.ChatCompletionMessage, 0, len(ms))
+	for _, m := range ms {
+		switch {
+		case m.Role == "assistant" && len(m.ToolCalls) > 0:
+			for _, tc := range m.ToolCalls {
+				names[tc.ID] = tc.Function.Name
+			}
+			content := m.Content
+			if content != "" {
+				content += "\n"
+			}
+			out = append(out, &types.ChatCompletionMessage{Role: "assistant", Content: content + toolCallsText(m.ToolCalls)})
+		case m.Role == "tool":
+			out = append(out, &types.ChatCompletionMessage{Role: "user", Content: toolResultText(m, names)})
+		default:
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+// 最后一条user消息加上工具说明,之后的工具调用及结果折叠进去
+// web上游一般只取最后一条user消息作为提问
+func foldToolMessages(ms []*types.ChatCompletionMessage, prompt string) []*types.ChatCompletionMessage {
+	last := -1
+	for k := len(ms) - 1; k >= 0; k-- {
+		if ms[k].Role == "user" {
+			last = k
+			break
+		}
+	}
+	ms = flattenToolMessages(ms)
+	if last == -1 {
+		return append(ms, &types.ChatCompletionMessage{Role: "user", Content: prompt})
+	}
+	// flatten不改变消息数量,last仍然对应最后一条原始user消息
+	user := ms[last]
+	var tail strings.Builder
+	for _, m := range ms[last+1:] {
+		tail.WriteString("\n\n")
+		if m.Role == "assistant" {
+			tail.WriteString("Assistant:\n")
+		}
+		tail.WriteString(m.Content)
+	}
+	if tail.Len() > 0 {
+		tail.WriteString("\n\nContinue: answer the user or call more tools.")
+	}
+	folded := &types.ChatCompletionMessage{Role: "user", Name: user.Name}
+	if user.MultiContent != nil {
+		folded.MultiContent = append([]*types.ChatMessagePart{
+			&types.ChatMessagePart{Type: "text", Text: prompt},
+		}, user.MultiContent...)
+		if tail.Len() > 0 {
+			folded.MultiContent = append(folded.MultiContent, &types.ChatMessagePart{Type: "text", Text: tail.String()})
+		}
+	} else {
+		folded.Content = prompt + "\n" + user.Content + tail.String()
+	}
+	out := make([]*types.ChatCompletionMessage, 0, last+1)
+	out = append(out, ms[:last]...)
+	return append(out, folded)
+}
+
+// 解析生成文本中的<tool_calls>块,其余文本原样输出
+// 可能是标签开头的文本先暂存,结束原因在Done时统一返回
+type toolWriter struct {
+	w            Writer
+	tpl          *types.ChatCompletionResponse
+	buf          string
+	inBlock      bool
+	toolIndex    int
+	finishReason string
+}
+
+func (t *toolWriter) Write(res *types.ChatCompletionResponse) error {
+	if t.tpl == nil || res.ID != "" {
+		t.tpl = res
+	}
+	for _, choice := range res.Choices {
+		if choice.FinishReason != "" {
+			t.finishReason = choice.FinishReason
+		}
+		msg := choice.Delta
+		if msg == nil {
+			msg = choice.Message
+		}
+		if msg != nil {
+			t.buf += msg.Content
+		}
+	}
+	return t.flush(false)
+}
+
+func (t *toolWriter) flush(end bool) error {
+	for {
+		if t.inBlock {
+			i := strings.Index(t.buf, toolCallsEndTag)
+			if i == -1 {
+				if !end {
+					return nil
+				}
+				// 没有结束标签也尝试解析
+				if t.emitToolCalls(t.buf) {
+					t.buf = ""
+					return nil
+				}
+				text := toolCallsStartTag + t.buf
+				t.buf = ""
+				t.inBlock = false
+				return t.emitText(text)
+			}
+			block := t.buf[:i]
+			t.buf = t.buf[i+len(toolCallsEndTag):]
+			t.inBlock = false
+			if !t.emitToolCalls(block) {
+				if err := t.emitText(toolCallsStartTag + block + toolCallsEndTag); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		i := strings.Index(t.buf, toolCallsStartTag)
+		if i != -1 {
+			if err := t.emitText(t.buf[:i]); err != nil {
+				return err
+			}
+			t.buf = t.buf[i+len(toolCallsStartTag):]
+			t.inBlock = true
+			continue
+		}
+		keep := 0
+		if !end {
+			keep = tagPrefixLen(t.buf)
+		}
+		text := t.buf[:len(t.buf)-keep]
+		t.buf = t.buf[len(t.buf)-keep:]
+		return t.emitText(text)
+	}
+}
+
+// 结尾可能是开始标签的部分
+func tagPrefixLen(s string) int {
+	for l := len(toolCallsStartTag) - 1; l > 0; l-- {
+		if strings.HasSuffix(s, toolCallsStartTag[:l]) {
+			return l
+		}
+	}
+	return 0
+}
+
+func (t *toolWriter) emitToolCalls(block string) bool {
+	block = strings.TrimSpace(block)
+	block = strings.TrimPrefix(block, "```json")
+	block = strings.TrimPrefix(block, "```")
+	block = strings.TrimSuffix(block, "```")
+	block = strings.TrimSpace(block)
+	var calls []*emulateToolCall
+	if err := fhblade.Json.UnmarshalFromString(block, &calls); err != nil {
+		call := &emulateToolCall{}
+		if err := fhblade.Json.UnmarshalFromString(block, call); err != nil || call.Name == "" {
+			return false
+		}
+		calls = []*emulateToolCall{call}
+	}
+	var toolCalls []*types.ToolCall
+	for _, call := range calls {
+		if call.Name == "" {
+			continue
+		}
+		args, ok := call.Arguments.(string)
+		if !ok {
+			if call.Arguments == nil {
+				args = "{}"
+			} else {
+				args, _ = fhblade.Json.MarshalToString(call.Arguments)
+			}
+		}
+		ti := t.toolIndex
+		t.toolIndex++
+		toolCalls = append(toolCalls, &types.ToolCall{
+			Index: &ti,
+			ID:    "call_" + strings.ReplaceAll(uuid.NewString(), "-", ""),
+			Type:  "function",
+			Function: types.FunctionCall{
+				Name:      call.Name,
+				Arguments: args,
+			},
+		})
+	}
+	if len(toolCalls) == 0 {
+		return false
+	}
+	t.w.Write(t.chunk(&types.ChatCompletionMessage{Role: "assistant", ToolCalls: toolCalls}, ""))
+	return true
+}
+
+func (t *toolWriter) emitText(text string) error {
+	if text == "" {
+		return nil
+	}
+	return t.w.Write(t.chunk(&types.ChatCompletionMessage{Role: "assistant", Content: text}, ""))
+}
+
+func (t *toolWriter) chunk(msg *types.ChatCompletionMessage, finishReason string) *types.ChatCompletionResponse {
+	res := &types.ChatCompletionResponse{Object: "chat.completion.chunk"}
+	if t.tpl != nil {
+		res.ID = t.tpl.ID
+		res.Created = t.tpl.Created
+		res.Model = t.tpl.Model
+		res.OpenAi = t.tpl.OpenAi
+		res.Bing = t.tpl.Bing
+		res.Coze = t.tpl.Coze
+	}
+	res.Choices = []*types.ChatCompletionChoice{&types.ChatCompletionChoice{
+		Index:        0,
+		Message:      msg,
+		FinishReason: finishReason,
+	}}
+	return res
+}
+
+func (t *toolWriter) Error(code int, e *types.CError) error {
+	return t.w.Error(code, e)
+}
+
+func (t *toolWriter) Done() error {
+	if err := t.flush(true); err != nil {
+		return err
+	}
+	finishReason := t.finishReason
+	if t.toolIndex > 0 {
+		finishReason = "tool_calls"
+	}
+	if finishReason == "" {
+		finishReason = "stop"
+	}
+	if t.tpl != nil {
+		t.w.Write(t.chunk(&types.ChatCompletionMessage{Role: "assistant"}, finishReason))
+	}
+	return t.w.Done()
+}
+
+func (t *toolWriter) Unwrap() Writer {
+	return t.w
+}
@@ -0,0 +1,169 @@
+package chat
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/zatxm/any-proxy/internal/types"
+)
+
+// 记录收到的文本、工具调用及结束原因
+type recordWriter struct {
+	text         strings.Builder
+	calls        []string
+	finishReason string
+	done         bool
+}
+
+func (r *recordWriter) Write(res *types.ChatCompletionResponse) error {
+	for _, choice := range res.Choices {
+		msg := choice.Delta
+		if msg == nil {
+			msg = choice.Message
+		}
+		if msg != nil {
+			r.text.WriteString(msg.Content)
+			for _, tc := range msg.ToolCalls {
+				r.calls = append(r.calls, tc.Function.Name+tc.Function.Arguments)
+			}
+		}
+		if choice.FinishReason != "" {
+			r.finishReason = choice.FinishReason
+		}
+	}
+	return nil
+}
+
+func (r *recordWriter) Error(code int, e *types.CError) error {
+	return nil
+}
+
+func (r *recordWriter) Done() error {
+	r.done = true
+	return nil
+}
+
+func textChunk(content string) *types.ChatCompletionResponse {
+	return &types.ChatCompletionResponse{
+		ID:      "chatcmpl-test",
+		Choices: []*types.ChatCompletionChoice{{Delta: &types.ChatCompletionMessage{Content: content}}},
+	}
+}
+
+func TestToolCallExtraction(t *testing.T) {
+	tests := []struct {
+		name   string
+		chunks []string
+		text   string
+		calls  []string
+		finish string
+	}{
+		{
+			name:   "plain text",
+			chunks: []string{"Hello", " world"},
+			text:   "Hello world",
+			finish: "stop",
+		},
+		{
+			name:   "text around block",
+			chunks: []string{`Let me check. <tool_calls>[{"name":"weather","arguments":{"city":"Paris"}}]</tool_calls> Done.`},
+			text:   "Let me check.  Done.",
+			calls:  []string{`weather{"city":"Paris"}`},
+			finish: "tool_calls",
+		},
+		{
+			name:   "tags split across chunks",
+			chunks: []string{"Sure <tool", "_ca", `lls>[{"name":"a","argu`, `ments":{}}]</tool_`, "calls>"},
+			text:   "Sure ",
+			calls:  []string{"a{}"},
+			finish: "tool_calls",
+		},
+		{
+			name:   "multiple calls and blocks",
+			chunks: []string{`<tool_calls>[{"name":"a","arguments":{"x":1}},{"name":"b"}]</tool_calls>`, `then <tool_calls>{"name":"c","arguments":"{\"y\":2}"}</tool_calls>`},
+			text:   "then ",
+			calls:  []string{`a{"x":1}`, "b{}", `c{"y":2}`},
+			finish: "tool_calls",
+		},
+		{
+			name:   "code fence in block",
+			chunks: []string{"<tool_calls>\n```json\n[{\"name\":\"a\",\"arguments\":{}}]\n```\n</tool_calls>"},
+			calls:  []string{"a{}"},
+			finish: "tool_calls",
+		},
+		{
+			name:   "unclosed block at end",
+			chunks: []string{`ok <tool_calls>[{"name":"a","arguments":{}}]`},
+			text:   "ok ",
+			calls:  []string{"a{}"},
+			finish: "tool_calls",
+		},
+		{
+			name:   "invalid block kept as text",
+			chunks: []string{"x <tool_calls>not json</tool_calls> y"},
+			text:   "x <tool_calls>not json</tool_calls> y",
+			finish: "stop",
+		},
+		{
+			name:   "unclosed invalid block kept as text",
+			chunks: []string{"x <tool_calls>oops"},
+			text:   "x <tool_calls>oops",
+			finish: "stop",
+		},
+		{
+			name:   "partial tag at end kept as text",
+			chunks: []string{"a <tool"},
+			text:   "a <tool",
+			finish: "stop",
+		},
+		{
+			name:   "less than sign",
+			chunks: []string{"1 <", " 2"},
+			text:   "1 < 2",
+			finish: "stop",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &recordWriter{}
+			p := types.ChatCompletionRequest{
+				Messages: []*types.ChatCompletionMessage{{Role: "user", Content: "hi"}},
+				Tools:    []types.Tool{{Type: "function", Function: &types.FunctionDefinition{Name: "a"}}},
+			}
+			_, w := EmulateTools(p, r)
+			for _, chunk := range tt.chunks {
+				if err := w.Write(textChunk(chunk)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := w.Done(); err != nil {
+				t.Fatal(err)
+			}
+			if got := r.text.String(); got != tt.text {
+				t.Errorf("text = %q, want %q", got, tt.text)
+			}
+			if strings.Join(r.calls, "|") != strings.Join(tt.calls, "|") {
+				t.Errorf("calls = %v, want %v", r.calls, tt.calls)
+			}
+			if r.finishReason != tt.finish {
+				t.Errorf("finish reason = %s, want %s", r.finishReason, tt.finish)
+			}
+			if !r.done {
+				t.Error("Done not passed through")
+			}
+		})
+	}
+}
+
+// 不生成<tool_calls>块时不影响上游的结束原因
+func TestToolWriterFinishReason(t *testing.T) {
+	r := &recordWriter{}
+	w := &toolWriter{w: r}
+	res := textChunk("cut")
+	res.Choices[0].FinishReason = "length"
+	w.Write(res)
+	w.Done()
+	if r.finishReason != "length" {
+		t.Errorf("finish reason = %s, want length", r.finishReason)
+	}
+}
@@ -0,0 +1,165 @@
+package chat
+
+import (
+	"unicode"
+
+	"github.com/zatxm/any-proxy/internal/access"
+	"github.com/zatxm/any-proxy/internal/types"
+	"github.com/zatxm/fhblade"
+)
+
+const (
+	// 每条消息固定开销
+	messageTokens = 3
+	// 图片按低精度估算
+	imageTokens = 85
+)
+
+// 统计用量,优先用上游返回的,没有的按文本估算
+// 非流式一直返回usage,流式在stream_options.include_usage时最后返回一个usage chunk
+// 结束时计入客户端密钥的token用量
+func NewUsageWriter(c *fhblade.Context, p types.ChatCompletionRequest, w Writer) Writer {
+	include := !p.Stream || (p.StreamOptions != nil && p.StreamOptions.IncludeUsage)
+	return &usageWriter{c: c, w: w, include: include, prompt: PromptTokens(p)}
+}
+
+type usageWriter struct {
+	c          *fhblade.Context
+	w          Writer
+	include    bool
+	prompt     int
+	completion tokenCounter
+	upstream   *types.Usage
+	tpl        *types.ChatCompletionResponse
+}
+
+func (u *usageWriter) Write(res *types.ChatCompletionResponse) error {
+	if u.tpl == nil || res.ID != "" {
+		u.tpl = res
+	}
+	if res.Usage != nil {
+		u.upstream = res.Usage
+		out := *res
+		out.Usage = nil
+		res = &out
+	}
+	if len(res.Choices) == 0 {
+		return nil
+	}
+	for _, choice := range res.Choices {
+		msg := choice.Delta
+		if msg == nil {
+			msg = choice.Message
+		}
+		if msg == nil {
+			continue
+		}
+		u.completion.add(msg.Content)
+		for _, tc := range msg.ToolCalls {
+			u.completion.add(tc.Function.Name)
+			u.completion.add(tc.Function.Arguments)
+		}
+	}
+	return u.w.Write(res)
+}
+
+// 已经有输出的按输出计入用量,没有的不计
+func (u *usageWriter) Error(code int, e *types.CError) error {
+	tokens := 0
+	if u.tpl != nil {
+		tokens = u.usage().TotalTokens
+	}
+	access.Consume(u.c, tokens)
+	return u.w.Error(code, e)
+}
+
+func (u *usageWriter) Done() error {
+	usage := u.usage()
+	access.Consume(u.c, usage.TotalTokens)
+	if u.include && u.tpl != nil {
+		res := &types.ChatCompletionResponse{
+			ID:                u.tpl.ID,
+			Choices:           []*types.ChatCompletionChoice{},
+			Created:           u.tpl.Created,
+			Model:             u.tpl.Model,
+			SystemFingerprint: u.tpl.SystemFingerprint,
+			Object:            "chat.completion.chunk",
+			Usage:             usage,
+		}
+		if err := u.w.Write(res); err != nil {
+			return err
+		}
+	}
+	return u.w.Done()
+}
+
+// 上游没返回的字段用估算值补全
+func (u *usageWriter) usage() *types.Usage {
+	usage := &types.Usage{}
+	if u.upstream != nil {
+		*usage = *u.upstream
+	}
+	if usage.PromptTokens == 0 {
+		usage.PromptTokens = u.prompt
+	}
+	if usage.CompletionTokens == 0 {
+		usage.CompletionTokens = u.completion.tokens()
+	}
+	usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+	return usage
+}
+
+// 估算请求消息的token数
+func PromptTokens(p types.ChatCompletionRequest) int {
+	var tc tokenCounter
+	n := messageTokens
+	for _, m := range p.Messages {
+		n += messageTokens
+		tc.add(m.Role)
+		tc.add(m.Name)
+		tc.add(m.Content)
+		for _, part := range m.MultiContent {
+			if part.Type == "image_url" {
+				n += imageTokens
+				continue
+			}
+			tc.add(part.Text)
+		}
+		for _, call := range m.ToolCalls {
+			tc.add(call.Function.Name)
+			tc.add(call.Function.Arguments)
+		}
+	}
+	if len(p.Tools) > 0 {
+		toolsJson, _ := fhblade.Json.MarshalToString(p.Tools)
+		tc.add(toolsJson)
+	}
+	return n + tc.tokens()
+}
+
+// 估算文本的token数
+func EstimateTokens(s string) int {
+	var tc tokenCounter
+	tc.add(s)
+	return tc.tokens()
+}
+
+// 中日韩字符大致一字一token,其他约4个字符一token
+type tokenCounter struct {
+	cjk   int
+	other int
+}
+
+func (tc *tokenCounter) add(s string) {
+	for _, r := range s {
+		if unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul) {
+			tc.cjk++
+		} else {
+			tc.other++
+		}
+	}
+}
+
+func (tc *tokenCounter) tokens() int {
+	return tc.cjk + (tc.other+3)/4
+}
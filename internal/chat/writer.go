@@ -0,0 +1,119 @@
+package chat
+
+import (
+	"context"
+
+	http "github.com/bogdanfinn/fhttp"
+	"github.com/zatxm/any-proxy/internal/types"
+	"github.com/zatxm/fhblade"
+)
+
+// 对话输出,各provider统一通过此接口返回openai格式数据
+type Writer interface {
+	// 写入一条chat.completion.chunk
+	Write(res *types.ChatCompletionResponse) error
+	// 返回错误,还没写入数据时按code返回json
+	Error(code int, e *types.CError) error
+	// 结束输出
+	Done() error
+}
+
+// 请求上游用的context,n>1并发请求时其他请求出错会取消,其他情况为客户端请求的context
+func Context(c *fhblade.Context, w Writer) context.Context {
+	for w != nil {
+		switch v := w.(type) {
+		case *fanOutWriter:
+			return v.f.ctx
+		case interface{ Unwrap() Writer }:
+			w = v.Unwrap()
+		default:
+			return c.Request().Context()
+		}
+	}
+	return c.Request().Context()
+}
+
+// stream=true返回sse,否则汇总后返回一次json
+func NewWriter(c *fhblade.Context, stream bool) Writer {
+	if stream {
+		return &streamWriter{sse: sse{c: c}}
+	}
+	return &jsonWriter{c: c, collector: NewCollector()}
+}
+
+type streamWriter struct {
+	sse
+	done bool
+}
+
+func (w *streamWriter) Write(res *types.ChatCompletionResponse) error {
+	if w.done {
+		return nil
+	}
+	// 标准openai sdk流式读取delta,chunk中不带message
+	// 复制后修改,res可能还会交给其他Writer
+	out := *res
+	out.Choices = make([]*types.ChatCompletionChoice, len(res.Choices))
+	for k := range res.Choices {
+		choice := *res.Choices[k]
+		if choice.Delta == nil {
+			choice.Delta = choice.Message
+		}
+		choice.Message = nil
+		out.Choices[k] = &choice
+	}
+	return w.event("", &out)
+}
+
+func (w *streamWriter) Error(code int, e *types.CError) error {
+	if w.done {
+		return nil
+	}
+	w.done = true
+	if !w.started {
+		w.started = true
+		return errorJSON(w.c, code, e, types.ErrorResponse{Error: e})
+	}
+	if err := w.event("", types.ErrorResponse{Error: e}); err != nil {
+		return err
+	}
+	return w.data("[DONE]")
+}
+
+func (w *streamWriter) Done() error {
+	if w.done {
+		return nil
+	}
+	w.done = true
+	return w.data("[DONE]")
+}
+
+type jsonWriter struct {
+	c         *fhblade.Context
+	collector *Collector
+	done      bool
+}
+
+func (w *jsonWriter) Write(res *types.ChatCompletionResponse) error {
+	if w.done {
+		return nil
+	}
+	w.collector.Add(res)
+	return nil
+}
+
+func (w *jsonWriter) Error(code int, e *types.CError) error {
+	if w.done {
+		return nil
+	}
+	w.done = true
+	return errorJSON(w.c, code, e, types.ErrorResponse{Error: e})
+}
+
+func (w *jsonWriter) Done() error {
+	if w.done {
+		return nil
+	}
+	w.done = true
+	return w.c.JSONAndStatus(http.StatusOK, w.collector.Response())
+}
@@ -0,0 +1,49 @@
+package chat
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/zatxm/any-proxy/internal/types"
+	"github.com/zatxm/fhblade"
+)
+
+// 流式chunk只带delta,不修改传入的响应
+func TestStreamWriterDelta(t *testing.T) {
+	msg := &types.ChatCompletionMessage{Role: "assistant", Content: "hi"}
+	res := &types.ChatCompletionResponse{
+		ID:     "chatcmpl-test",
+		Object: "chat.completion.chunk",
+		Choices: []*types.ChatCompletionChoice{
+			{Index: 0, Message: msg},
+			{Index: 1, Delta: &types.ChatCompletionMessage{Content: "delta"}, Message: msg},
+		},
+	}
+	rec := serve(t, func(c *fhblade.Context) error {
+		w := NewWriter(c, true)
+		if err := w.Write(res); err != nil {
+			return err
+		}
+		return w.Done()
+	})
+	var chunk struct {
+		Choices []map[string]any `json:"choices"`
+	}
+	data, _, _ := strings.Cut(strings.TrimPrefix(rec.Body.String(), "data: "), "\n")
+	if err := fhblade.Json.UnmarshalFromString(data, &chunk); err != nil || len(chunk.Choices) != 2 {
+		t.Fatalf("invalid chunk %s", rec.Body.String())
+	}
+	for k, want := range []string{"hi", "delta"} {
+		choice := chunk.Choices[k]
+		if _, ok := choice["message"]; ok {
+			t.Errorf("choice %d has message: %v", k, choice)
+		}
+		delta, _ := choice["delta"].(map[string]any)
+		if delta["content"] != want {
+			t.Errorf("choice %d delta = %v, want %s", k, choice["delta"], want)
+		}
+	}
+	if res.Choices[0].Delta != nil || res.Choices[0].Message != msg || res.Choices[1].Message != msg {
+		t.Error("response passed in was modified")
+	}
+}
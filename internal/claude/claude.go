@@ -3,17 +3,18 @@ package claude
 import (
 	"bufio"
 	"bytes"
-	"fmt"
+	"context"
 	"io"
-	"math/rand"
 	"strings"
 	"time"
 
 	http "github.com/bogdanfinn/fhttp"
 	"github.com/bogdanfinn/fhttp/httputil"
 	"github.com/google/uuid"
+	"github.com/zatxm/any-proxy/internal/chat"
 	"github.com/zatxm/any-proxy/internal/client"
 	"github.com/zatxm/any-proxy/internal/config"
+	"github.com/zatxm/any-proxy/internal/pool"
 	"github.com/zatxm/any-proxy/internal/types"
 	"github.com/zatxm/any-proxy/internal/vars"
 	"github.com/zatxm/fhblade"
@@ -26,6 +27,8 @@ const (
 	Provider = "claude"
 
 	ApiMessagesUrl = "https://api.anthropic.com/v1/messages"
+	ApiModelsUrl   = "https://api.anthropic.com/v1/models"
+	WebModel       = "claude-web"
 
 	ClaudeTypeApi = "api"
 	ClaudeTypeWeb = "web"
@@ -45,6 +48,12 @@ var (
 		"sec-fetch-site":     {"same-origin"},
 		"user-agent":         {vars.UserAgent},
 	}
+	defaultApiModels = []string{
+		"claude-3-5-sonnet-20240620",
+		"claude-3-opus-20240229",
+		"claude-3-sonnet-20240229",
+		"claude-3-haiku-20240307",
+	}
 )
 
 // 转发web请求
@@ -118,7 +127,7 @@ func ProxyApi() func(*fhblade.Context) error {
 					},
 				})
 			}
-			return apiToApi(c, p, c.Request().Header("x-auth-id"))
+			return apiToApi(c, chat.NewWriter(c, true), p, c.Request().Header("x-auth-id"), "")
 		}
 
 		path = "/" + path
@@ -151,101 +160,96 @@ func ProxyApi() func(*fhblade.Context) error {
 	}
 }
 
-func DoChatCompletions(c *fhblade.Context, p types.ChatCompletionRequest) error {
+// 是否走api,model为claude-web或type为web的走web
+func IsApi(p types.ChatCompletionRequest) bool {
+	return p.Model != WebModel && (p.Claude == nil || p.Claude.Type == ClaudeTypeApi)
+}
+
+func DoChatCompletions(c *fhblade.Context, p types.ChatCompletionRequest, w chat.Writer) error {
 	// 走api转api
-	if p.Claude == nil || p.Claude.Type == ClaudeTypeApi {
-		var messages []*types.ClaudeApiMessage
-		for k := range p.Messages {
-			message := p.Messages[k]
-			if message.MultiContent == nil {
-				switch message.Role {
-				case "assistant":
-					messages = append(messages, &types.ClaudeApiMessage{
-						Role:    "assistant",
-						Content: message.Content,
-					})
-				case "user":
-					messages = append(messages, &types.ClaudeApiMessage{
-						Role:    "user",
-						Content: message.Content,
-					})
-				}
+	if IsApi(p) {
+		// 要求输出json时加提示词并预填{,有tools时只加提示词
+		prefill := ""
+		if chat.IsJSONFormat(p.ResponseFormat) {
+			p.Messages = chat.AppendPrompt(p.Messages, chat.JSONPrompt(p.ResponseFormat))
+			if len(p.Tools) == 0 {
+				prefill = "{"
 			}
 		}
+		// system、developer消息合并为system
+		system, messages := chat.SplitSystem(p.Messages)
+		apiMessages, err := parseApiMessages(chat.Context(c, w), messages)
+		if err != nil {
+			return w.Error(http.StatusBadRequest, &types.CError{
+				Message: err.Error(),
+				Type:    "invalid_request_error",
+				Code:    "invalid_image_url",
+			})
+		}
 		rq := &types.ClaudeApiCompletionRequest{
 			Model:     p.Model,
-			Messages:  messages,
+			Messages:  apiMessages,
 			MaxTokens: p.MaxTokens,
 		}
+		if system != "" {
+			rq.System = system
+		}
+		if prefill != "" {
+			if l := len(rq.Messages); l > 0 && rq.Messages[l-1].Role == "user" {
+				rq.Messages = append(rq.Messages, &types.ClaudeApiMessage{Role: "assistant", Content: prefill})
+			} else {
+				prefill = ""
+			}
+		}
 		if &p.Temperature != nil {
 			rq.Temperature = p.Temperature
 		}
 		if &p.TopP != nil {
 			rq.TopP = p.TopP
 		}
+		parseApiTools(rq, p.Tools, p.ToolChoice)
 		reqIndex := c.Request().Header("x-auth-id")
 		if reqIndex == "" && p.Claude != nil && p.Claude.Index != "" {
 			reqIndex = p.Claude.Index
 		}
-		return apiToApi(c, *rq, reqIndex)
+		return apiToApi(c, w, *rq, reqIndex, prefill)
 	}
 
 	// 剩下的走web转api
 	prompt := p.ParsePromptText()
 	if prompt == "" {
-		return c.JSONAndStatus(http.StatusBadRequest, types.ErrorResponse{
-			Error: &types.CError{
-				Message: "params error",
-				Type:    "invalid_request_error",
-				Code:    "request_err",
-			},
+		return w.Error(http.StatusBadRequest, &types.CError{
+			Message: "params error",
+			Type:    "invalid_request_error",
+			Code:    "request_err",
 		})
 	}
+	// web没有system字段,放在提问前面
+	if system, _ := chat.SplitSystem(p.Messages); system != "" {
+		prompt = system + "\n\n" + prompt
+	}
 
 	// 获取sessionKey
 	reqIndex := ""
-	if p.Claude.Index != "" {
+	if p.Claude != nil && p.Claude.Index != "" {
 		reqIndex = p.Claude.Index
 	} else {
 		reqIndex = c.Request().Header("x-auth-id")
 	}
-	sessionKey, organizationID, index := parseClaudeWebSessionKey(c, reqIndex)
+	sessionKey, organizationID, index, lease := parseClaudeWebSessionKey(c, reqIndex)
+	defer lease.Done()
 	if sessionKey == "" {
-		return c.JSONAndStatus(http.StatusInternalServerError, types.ErrorResponse{
-			Error: &types.CError{
-				Message: "key error",
-				Type:    "invalid_request_error",
-				Code:    "request_err",
-			},
-		})
+		return chat.NoKeyError("claude web").Write(c, w)
 	}
 
 	if organizationID == "" {
 		var err error
 		organizationID, err = parseOrganizationID(sessionKey, index)
 		if err != nil {
-			return c.JSONAndStatus(http.StatusInternalServerError, types.ErrorResponse{
-				Error: &types.CError{
-					Message: err.Error(),
-					Type:    "invalid_request_error",
-					Code:    "request_err",
-				},
-			})
+			return chat.StatusError(http.StatusBadGateway, err.Error()).Write(c, w)
 		}
 	}
 
-	rw := c.Response().Rw()
-	flusher, ok := rw.(http.Flusher)
-	if !ok {
-		return c.JSONAndStatus(http.StatusNotImplemented, types.ErrorResponse{
-			Error: &types.CError{
-				Message: "Flushing not supported",
-				Type:    "invalid_systems_error",
-				Code:    "systems_error",
-			},
-		})
-	}
-
 	// 可能需要创建会话
 	conversateionId := ""
 	if p.Claude != nil && p.Claude.Conversation != nil && p.Claude.Conversation.Uuid != "" {
@@ -260,16 +264,14 @@ func DoChatCompletions(c *fhblade.Context, p types.ChatCompletionRequest) error
 		goUrl := "https://claude.ai/api/organizations/" + organizationID + "/chat_conversations"
 		rq := &types.ClaudeCreateConversationRequest{Uuid: uuid.NewString()}
 		reqJson, _ := fhblade.Json.Marshal(rq)
-		req, err := http.NewRequest(http.MethodPost, goUrl, bytes.NewReader(reqJson))
+		req, err := http.NewRequestWithContext(chat.Context(c, w), http.MethodPost, goUrl, bytes.NewReader(reqJson))
 		if err != nil {
 			client.CcPool.Put(gClient)
 			fhblade.Log.Error("claude web create conversation send msg new req err", zap.Error(err))
-			return c.JSONAndStatus(http.StatusInternalServerError, types.ErrorResponse{
-				Error: &types.CError{
-					Message: err.Error(),
-					Type:    "invalid_request_error",
-					Code:    "request_err",
-				},
+			return w.Error(http.StatusInternalServerError, &types.CError{
+				Message: err.Error(),
+				Type:    "invalid_request_error",
+				Code:    "request_err",
 			})
 		}
 		req.Header = defaultHeader
@@ -280,15 +282,17 @@ func DoChatCompletions(c *fhblade.Context, p types.ChatCompletionRequest) error
 		if err != nil {
 			client.CcPool.Put(gClient)
 			fhblade.Log.Error("claude web create conversation send msg req err", zap.Error(err))
-			return c.JSONAndStatus(http.StatusInternalServerError, types.ErrorResponse{
-				Error: &types.CError{
-					Message: err.Error(),
-					Type:    "invalid_request_error",
-					Code:    "request_err",
-				},
-			})
+			return chat.ConnError(err).Write(c, w)
 		}
 		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+			client.CcPool.Put(gClient)
+			body, _ := tools.ReadAll(resp.Body)
+			fhblade.Log.Error("claude web create conversation res status err",
+				zap.Int("code", resp.StatusCode),
+				zap.ByteString("data", body))
+			return chat.ClaudeErrorBody(resp.StatusCode, body).WithHeader(resp.Header).Report(lease).Write(c, w)
+		}
 		conversation := &types.ClaudeConversation{}
 		err = fhblade.Json.NewDecoder(resp.Body).Decode(&conversation)
 		if err != nil {
@@ -297,12 +301,10 @@ func DoChatCompletions(c *fhblade.Context, p types.ChatCompletionRequest) error
 			fhblade.Log.Error("claude web create conversation res err",
 				zap.Error(err),
 				zap.ByteString("data", body))
-			return c.JSONAndStatus(http.StatusInternalServerError, types.ErrorResponse{
-				Error: &types.CError{
-					Message: err.Error(),
-					Type:    "invalid_request_error",
-					Code:    "request_err",
-				},
+			return w.Error(http.StatusInternalServerError, &types.CError{
+				Message: err.Error(),
+				Type:    "invalid_request_error",
+				Code:    "request_err",
 			})
 		}
 		conversateionId = conversation.Uuid
@@ -315,18 +317,16 @@ func DoChatCompletions(c *fhblade.Context, p types.ChatCompletionRequest) error
 		Timezone: defaultTimezone,
 	}
 	reqJson, _ := fhblade.Json.Marshal(rq)
-	req, err := http.NewRequest(http.MethodPost, askUrl, bytes.NewReader(reqJson))
+	req, err := http.NewRequestWithContext(chat.Context(c, w), http.MethodPost, askUrl, bytes.NewReader(reqJson))
 	if err != nil {
 		client.CcPool.Put(gClient)
 		fhblade.Log.Error("claude web send msg new req err",
 			zap.Error(err),
 			zap.ByteString("data", reqJson))
-		return c.JSONAndStatus(http.StatusInternalServerError, types.ErrorResponse{
-			Error: &types.CError{
-				Message: err.Error(),
-				Type:    "invalid_request_error",
-				Code:    "request_err",
-			},
+		return w.Error(http.StatusInternalServerError, &types.CError{
+			Message: err.Error(),
+			Type:    "invalid_request_error",
+			Code:    "request_err",
 		})
 	}
 	req.Header = defaultHeader
@@ -339,23 +339,19 @@ func DoChatCompletions(c *fhblade.Context, p types.ChatCompletionRequest) error
 		fhblade.Log.Error("claude web send msg req err",
 			zap.Error(err),
 			zap.ByteString("data", reqJson))
-		return c.JSONAndStatus(http.StatusInternalServerError, types.ErrorResponse{
-			Error: &types.CError{
-				Message: err.Error(),
-				Type:    "invalid_request_error",
-				Code:    "request_err",
-			},
-		})
+		return chat.ConnError(err).Write(c, w)
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := tools.ReadAll(resp.Body)
+		fhblade.Log.Error("claude web send msg res status err",
+			zap.Int("code", resp.StatusCode),
+			zap.ByteString("data", body))
+		return chat.ClaudeErrorBody(resp.StatusCode, body).WithHeader(resp.Header).Report(lease).Write(c, w)
+	}
+	lease.Report(resp.StatusCode, 0)
 
 	// 处理响应
-	header := rw.Header()
-	header.Set("Content-Type", vars.ContentTypeStream)
-	header.Set("Cache-Control", "no-cache")
-	header.Set("Connection", "keep-alive")
-	header.Set("Access-Control-Allow-Origin", "*")
-	rw.WriteHeader(200)
 	reader := bufio.NewReader(resp.Body)
 	now := time.Now().Unix()
 	for {
@@ -378,9 +374,7 @@ func DoChatCompletions(c *fhblade.Context, p types.ChatCompletionRequest) error
 				continue
 			}
 			if chatRes.Error != nil {
-				fmt.Fprintf(rw, "data: %s\n\n", raw)
-				flusher.Flush()
-				break
+				return chat.ClaudeError(0, chatRes.Error).Report(lease).Write(c, w)
 			}
 			if chatRes.Completion != "" {
 				var choices []*types.ChatCompletionChoice
@@ -405,57 +399,35 @@ func DoChatCompletions(c *fhblade.Context, p types.ChatCompletionRequest) error
 						},
 					},
 				}
-				outJson, _ := fhblade.Json.Marshal(outRes)
-				fmt.Fprintf(rw, "data: %s\n\n", outJson)
-				flusher.Flush()
+				w.Write(outRes)
 			}
 		}
 	}
-	fmt.Fprint(rw, "data: [DONE]\n\n")
-	flusher.Flush()
-	return nil
+	return w.Done()
 }
 
 // 通过api请求返回openai格式
-func apiToApi(c *fhblade.Context, p types.ClaudeApiCompletionRequest, idSign string) error {
+// prefill为预填的assistant内容,上游从其后继续生成,返回时补在最前面
+func apiToApi(c *fhblade.Context, w chat.Writer, p types.ClaudeApiCompletionRequest, idSign, prefill string) error {
 	// 鉴权
-	auth, pIndex := parseAuth(c, idSign)
+	auth, pIndex, lease := parseAuth(c, idSign)
+	defer lease.Done()
 	if auth == "" {
-		return c.JSONAndStatus(http.StatusInternalServerError, types.ErrorResponse{
-			Error: &types.CError{
-				Message: "empty api key",
-				Type:    "invalid_request_error",
-				Code:    "request_err",
-			},
-		})
-	}
-
-	rw := c.Response().Rw()
-	flusher, ok := rw.(http.Flusher)
-	if !ok {
-		return c.JSONAndStatus(http.StatusNotImplemented, types.ErrorResponse{
-			Error: &types.CError{
-				Message: "Flushing not supported",
-				Type:    "invalid_systems_error",
-				Code:    "systems_error",
-			},
-		})
+		return chat.NoKeyError("claude api").Write(c, w)
 	}
 
 	// 请求
 	p.Stream = true
 	reqJson, _ := fhblade.Json.Marshal(p)
-	req, err := http.NewRequest(http.MethodPost, ApiMessagesUrl, bytes.NewReader(reqJson))
+	req, err := http.NewRequestWithContext(chat.Context(c, w), http.MethodPost, ApiMessagesUrl, bytes.NewReader(reqJson))
 	if err != nil {
 		fhblade.Log.Error("claude api2api send msg new req err",
 			zap.Error(err),
 			zap.ByteString("data", reqJson))
-		return c.JSONAndStatus(http.StatusInternalServerError, types.ErrorResponse{
-			Error: &types.CError{
-				Message: err.Error(),
-				Type:    "invalid_request_error",
-				Code:    "request_err",
-			},
+		return w.Error(http.StatusInternalServerError, &types.CError{
+			Message: err.Error(),
+			Type:    "invalid_request_error",
+			Code:    "request_err",
 		})
 	}
 
@@ -477,72 +449,28 @@ func apiToApi(c *fhblade.Context, p types.ClaudeApiCompletionRequest, idSign str
 		fhblade.Log.Error("claude api2api send msg req err",
 			zap.Error(err),
 			zap.ByteString("data", reqJson))
-		return c.JSONAndStatus(http.StatusInternalServerError, types.ErrorResponse{
-			Error: &types.CError{
-				Message: err.Error(),
-				Type:    "invalid_request_error",
-				Code:    "request_err",
-			},
-		})
+		return chat.ConnError(err).Write(c, w)
 	}
 	defer resp.Body.Close()
 
-	// 处理错误返回
+	// 处理错误返回,保留claude的错误信息及retry-after
 	if resp.StatusCode != http.StatusOK {
-		resBody, err := tools.ReadAll(resp.Body)
-		if err != nil {
-			fhblade.Log.Error("claude api2api send msg res err",
-				zap.Error(err),
-				zap.String("httpCode", resp.Status))
-			return c.JSONAndStatus(resp.StatusCode, types.ErrorResponse{
-				Error: &types.CError{
-					Message: err.Error(),
-					Type:    "invalid_request_error",
-					Code:    "response_err",
-				},
-			})
-		}
-		apiRes := &types.ClaudeApiCompletionStreamResponse{}
-		if err := fhblade.Json.Unmarshal(resBody, &apiRes); err != nil {
-			fhblade.Log.Error("claude api2api send msg res go err",
-				zap.Error(err),
-				zap.ByteString("data", resBody),
-				zap.String("httpCode", resp.Status))
-			return c.JSONAndStatus(resp.StatusCode, types.ErrorResponse{
-				Error: &types.CError{
-					Message: err.Error(),
-					Type:    "invalid_request_error",
-					Code:    "response_err",
-				},
-			})
-		}
-		if apiRes.Error != nil {
-			return c.JSONAndStatus(resp.StatusCode, types.ErrorResponse{
-				Error: &types.CError{
-					Message: apiRes.Error.Message,
-					Type:    apiRes.Error.Type,
-					Code:    "response_err",
-				},
-			})
-		}
-		return c.JSONAndStatus(resp.StatusCode, types.ErrorResponse{
-			Error: &types.CError{
-				Message: "http error",
-				Type:    "invalid_request_error",
-				Code:    "response_err",
-			},
-		})
+		resBody, _ := tools.ReadAll(resp.Body)
+		fhblade.Log.Error("claude api2api send msg res status err",
+			zap.ByteString("data", resBody),
+			zap.String("httpCode", resp.Status))
+		return chat.ClaudeErrorBody(resp.StatusCode, resBody).WithHeader(resp.Header).Report(lease).Write(c, w)
 	}
+	lease.Report(resp.StatusCode, 0)
 
 	// 处理响应
-	header := rw.Header()
-	header.Set("Content-Type", vars.ContentTypeStream)
-	header.Set("Cache-Control", "no-cache")
-	header.Set("Connection", "keep-alive")
-	header.Set("Access-Control-Allow-Origin", "*")
-	rw.WriteHeader(200)
+	// message_start带id和model,content_block_delta为增量内容,message_delta带结束原因
+	// tool_use在content_block_start返回,参数通过input_json_delta增量返回
 	reader := bufio.NewReader(resp.Body)
 	now := time.Now().Unix()
+	id, model := "", p.Model
+	toolIndexes := make(map[int]int)
+	usage := &types.Usage{}
 	for {
 		line, err := reader.ReadString('\n')
 		if err != nil {
@@ -563,127 +491,263 @@ func apiToApi(c *fhblade.Context, p types.ClaudeApiCompletionRequest, idSign str
 				continue
 			}
 			if chatRes.Error != nil {
-				errJson, _ := fhblade.Json.Marshal(&types.CError{
-					Message: chatRes.Error.Message,
-					Type:    chatRes.Error.Type,
-					Code:    "response_err",
-				})
-				fmt.Fprintf(rw, "data: %s\n\n", errJson)
-				flusher.Flush()
-				break
+				return chat.ClaudeError(0, chatRes.Error).Report(lease).Write(c, w)
 			}
-			if chatRes.Message != nil && len(chatRes.Message.Content) > 0 {
-				mg := ""
-				for k := range chatRes.Message.Content {
-					cc := chatRes.Message.Content[k]
-					if cc.Type == "text" && cc.Text != "" {
-						mg = cc.Text
-					} else if cc.Role == "assistant" && cc.Content != "" {
-						mg = cc.Content
+			mg, finishReason := "", ""
+			var toolCall *types.ToolCall
+			switch chatRes.Type {
+			case "message_start":
+				if chatRes.Message != nil {
+					id = chatRes.Message.ID
+					model = chatRes.Message.Model
+					if chatRes.Message.Usage != nil {
+						usage.PromptTokens = chatRes.Message.Usage.InputTokens
+						usage.CompletionTokens = chatRes.Message.Usage.OutputTokens
 					}
 				}
-				if mg != "" {
-					var choices []*types.ChatCompletionChoice
-					choices = append(choices, &types.ChatCompletionChoice{
-						Index: 0,
-						Message: &types.ChatCompletionMessage{
-							Role:    "assistant",
-							Content: mg,
-						},
-					})
-					outRes := &types.ChatCompletionResponse{
-						ID:      chatRes.Message.ID,
-						Choices: choices,
-						Created: now,
-						Model:   chatRes.Message.Model,
-						Object:  "chat.completion.chunk",
-						Claude: &types.ClaudeCompletionResponse{
-							Type:  ClaudeTypeApi,
-							Index: pIndex,
+			case "content_block_start":
+				if chatRes.ContentBlock != nil && chatRes.ContentBlock.Type == "tool_use" {
+					ti := len(toolIndexes)
+					toolIndexes[chatRes.Index] = ti
+					toolCall = &types.ToolCall{
+						Index: &ti,
+						ID:    chatRes.ContentBlock.ID,
+						Type:  "function",
+						Function: types.FunctionCall{
+							Name: chatRes.ContentBlock.Name,
 						},
 					}
-					outJson, _ := fhblade.Json.Marshal(outRes)
-					fmt.Fprintf(rw, "data: %s\n\n", outJson)
-					flusher.Flush()
 				}
+			case "content_block_delta":
+				if chatRes.Delta != nil {
+					if chatRes.Delta.Type == "input_json_delta" {
+						if ti, ok := toolIndexes[chatRes.Index]; ok && chatRes.Delta.PartialJson != "" {
+							toolCall = &types.ToolCall{
+								Index:    &ti,
+								Function: types.FunctionCall{Arguments: chatRes.Delta.PartialJson},
+							}
+						}
+					} else {
+						mg = chatRes.Delta.Text
+					}
+				}
+			case "message_delta":
+				if chatRes.Delta != nil {
+					finishReason = parseFinishReason(string(chatRes.Delta.StopReason))
+				}
+				// output_tokens为累计值
+				if chatRes.Usage != nil {
+					usage.CompletionTokens = chatRes.Usage.OutputTokens
+				}
+			}
+			if mg != "" || toolCall != nil || finishReason != "" {
+				if prefill != "" && toolCall == nil {
+					mg = prefill + mg
+					prefill = ""
+				}
+				message := &types.ChatCompletionMessage{
+					Role:    "assistant",
+					Content: mg,
+				}
+				if toolCall != nil {
+					message.ToolCalls = []*types.ToolCall{toolCall}
+				}
+				var choices []*types.ChatCompletionChoice
+				choices = append(choices, &types.ChatCompletionChoice{
+					Index:        0,
+					Message:      message,
+					FinishReason: finishReason,
+				})
+				outRes := &types.ChatCompletionResponse{
+					ID:      id,
+					Choices: choices,
+					Created: now,
+					Model:   model,
+					Object:  "chat.completion.chunk",
+					Claude: &types.ClaudeCompletionResponse{
+						Type:  ClaudeTypeApi,
+						Index: pIndex,
+					},
+				}
+				if finishReason != "" {
+					usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+					outRes.Usage = usage
+				}
+				w.Write(outRes)
 			}
 		}
 	}
-	fmt.Fprint(rw, "data: [DONE]\n\n")
-	flusher.Flush()
-	return nil
+	return w.Done()
 }
 
-func parseAuth(c *fhblade.Context, index string) (string, string) {
-	auth := c.Request().Header("Authorization")
-	if auth != "" {
-		if strings.HasPrefix(auth, "Bearer ") {
-			return strings.TrimPrefix(auth, "Bearer "), ""
-		}
-		return auth, ""
-	}
-	auth = c.Request().Header("x-api-key")
-	if auth != "" {
-		return auth, ""
-	}
-	keys := config.V().Claude.ApiKeys
-	l := len(keys)
-	if l == 0 {
-		return "", ""
+// claude结束原因转openai
+func parseFinishReason(stopReason string) string {
+	switch stopReason {
+	case "", "null":
+		return ""
+	case "max_tokens":
+		return "length"
+	case "tool_use":
+		return "tool_calls"
+	default:
+		return "stop"
 	}
-	if index != "" {
-		for k := range keys {
-			v := keys[k]
-			if index == v.ID {
-				return v.Val, v.ID
+}
+
+// openai消息转claude,assistant的tool_calls转tool_use,tool消息转user的tool_result
+// claude要求user、assistant交替,连续相同角色的合并
+func parseApiMessages(ctx context.Context, ms []*types.ChatCompletionMessage) ([]*types.ClaudeApiMessage, error) {
+	var messages []*types.ClaudeApiMessage
+	for k := range ms {
+		message := ms[k]
+		role := message.Role
+		var parts []*types.ClaudeApiMessagePart
+		switch message.Role {
+		case "assistant":
+			if message.Content != "" {
+				parts = append(parts, &types.ClaudeApiMessagePart{Type: "text", Text: message.Content})
+			}
+			for _, tc := range message.ToolCalls {
+				parts = append(parts, &types.ClaudeApiMessagePart{
+					Type:  "tool_use",
+					ID:    tc.ID,
+					Name:  tc.Function.Name,
+					Input: parseToolInput(tc.Function.Arguments),
+				})
 			}
+		case "user":
+			if message.MultiContent == nil {
+				if message.Content != "" {
+					parts = append(parts, &types.ClaudeApiMessagePart{Type: "text", Text: message.Content})
+				}
+				break
+			}
+			// 图片按顺序转image块
+			for _, part := range message.MultiContent {
+				switch part.Type {
+				case "text":
+					if part.Text != "" {
+						parts = append(parts, &types.ClaudeApiMessagePart{Type: "text", Text: part.Text})
+					}
+				case "image_url":
+					if part.ImageURL == nil {
+						continue
+					}
+					img, err := chat.LoadImage(ctx, part.ImageURL.URL, config.ClaudeProxyUrl())
+					if err != nil {
+						return nil, err
+					}
+					parts = append(parts, &types.ClaudeApiMessagePart{
+						Type: "image",
+						Source: &types.ClaudeApiSource{
+							Type:      "base64",
+							MediaType: img.MimeType,
+							Data:      img.Base64(),
+						},
+					})
+				}
+			}
+		case "tool":
+			role = "user"
+			parts = append(parts, &types.ClaudeApiMessagePart{
+				Type:      "tool_result",
+				ToolUseId: message.ToolCallID,
+				Content:   message.Content,
+			})
 		}
-		return "", ""
-	}
-
-	if l == 1 {
-		return keys[0].Val, keys[0].ID
+		if len(parts) == 0 {
+			continue
+		}
+		l := len(messages)
+		if l > 0 && messages[l-1].Role == role {
+			messages[l-1].MultiContent = append(messages[l-1].MultiContent, parts...)
+			continue
+		}
+		messages = append(messages, &types.ClaudeApiMessage{Role: role, MultiContent: parts})
 	}
-
-	rand.Seed(time.Now().UnixNano())
-	i := rand.Intn(l)
-	v := keys[i]
-	return v.Val, v.ID
+	return messages, nil
 }
 
-func parseClaudeWebSessionKey(c *fhblade.Context, i string) (string, string, string) {
-	auth := c.Request().Header("Authorization")
-	if auth != "" {
-		if strings.HasPrefix(auth, "Bearer ") {
-			return strings.TrimPrefix(auth, "Bearer "), "", ""
+// tool_use的input必须是对象
+func parseToolInput(arguments string) map[string]any {
+	input := make(map[string]any)
+	if arguments != "" {
+		if err := fhblade.Json.UnmarshalFromString(arguments, &input); err != nil || input == nil {
+			return make(map[string]any)
 		}
-		return auth, "", ""
 	}
+	return input
+}
 
-	claudeSessionCfgs := config.V().Claude.WebSessions
-	l := len(claudeSessionCfgs)
-	if l == 0 {
-		return "", "", ""
+// openai tools、tool_choice转claude
+// tool_choice为none时不传tools
+func parseApiTools(rq *types.ClaudeApiCompletionRequest, tools []types.Tool, toolChoice any) {
+	if len(tools) == 0 {
+		return
 	}
-
-	if i != "" {
-		for k := range claudeSessionCfgs {
-			claudeSessionCfg := claudeSessionCfgs[k]
-			if i == claudeSessionCfg.ID {
-				return claudeSessionCfg.Val, claudeSessionCfg.OrganizationId, claudeSessionCfg.ID
+	if v, ok := toolChoice.(string); ok && v == "none" {
+		return
+	}
+	for k := range tools {
+		tool := tools[k]
+		if tool.Type != "function" || tool.Function == nil {
+			continue
+		}
+		schema := tool.Function.Parameters
+		if schema == nil {
+			schema = map[string]any{"type": "object", "properties": map[string]any{}}
+		}
+		rq.Tools = append(rq.Tools, &types.ClaudeApiTool{
+			Name:        tool.Function.Name,
+			Description: tool.Function.Description,
+			InputSchema: schema,
+		})
+	}
+	switch v := toolChoice.(type) {
+	case string:
+		switch v {
+		case "auto":
+			rq.ToolChoice = &types.ClaudeApiToolChoice{Type: "auto"}
+		case "required":
+			rq.ToolChoice = &types.ClaudeApiToolChoice{Type: "any"}
+		}
+	case map[string]any:
+		if fn, ok := v["function"].(map[string]any); ok {
+			if name, ok := fn["name"].(string); ok && name != "" {
+				rq.ToolChoice = &types.ClaudeApiToolChoice{Type: "tool", Name: name}
 			}
 		}
-		return "", "", ""
 	}
+}
 
-	if l == 1 {
-		return claudeSessionCfgs[0].Val, claudeSessionCfgs[0].OrganizationId, claudeSessionCfgs[0].ID
+// api密钥,请求头Authorization、x-api-key优先,lease用于上报上游状态及结束请求
+func parseAuth(c *fhblade.Context, index string) (string, string, *pool.Lease) {
+	if auth := pool.Authorization(c); auth != "" {
+		return auth, "", nil
+	}
+	if auth := c.Request().Header("x-api-key"); auth != "" {
+		return auth, "", nil
+	}
+	keys := config.V().Claude.ApiKeys
+	i, lease := pool.Pick(c, "claude-api", config.V().Claude.Balance, keys, index)
+	if i < 0 {
+		return "", "", lease
 	}
+	return keys[i].Val, keys[i].ID, lease
+}
 
-	rand.Seed(time.Now().UnixNano())
-	index := rand.Intn(l)
-	claudeSessionCfg := claudeSessionCfgs[index]
-	return claudeSessionCfg.Val, claudeSessionCfg.OrganizationId, claudeSessionCfg.ID
+// web的sessionKey、organization_id及标识
+func parseClaudeWebSessionKey(c *fhblade.Context, index string) (string, string, string, *pool.Lease) {
+	if auth := pool.Authorization(c); auth != "" {
+		return auth, "", "", nil
+	}
+	sessions := config.V().Claude.WebSessions
+	i, lease := pool.Pick(c, "claude-web", config.V().Claude.Balance, sessions, index)
+	if i < 0 {
+		return "", "", "", lease
+	}
+	v := sessions[i]
+	return v.Val, v.OrganizationId, v.ID, lease
 }
 
 func parseOrganizationID(sessionKey, index string) (string, error) {
@@ -742,3 +806,95 @@ func parseOrganizationID(sessionKey, index string) (string, error) {
 	}
 	return id, nil
 }
+
+// 模型列表,api按密钥池选一个密钥通过/v1/models获取,失败用默认列表
+func Models(c *fhblade.Context) []*types.Model {
+	var models []*types.Model
+	now := time.Now().Unix()
+	keys := config.V().Claude.ApiKeys
+	if len(keys) > 0 {
+		keyIds := make([]string, 0, len(keys))
+		for k := range keys {
+			keyIds = append(keyIds, keys[k].ID)
+		}
+		ids := defaultApiModels
+		i, lease := pool.Pick(c, "claude-api", config.V().Claude.Balance, keys, "")
+		if i >= 0 {
+			if v, err := apiModels(keys[i].Val, lease); err == nil {
+				ids = v
+			}
+		}
+		lease.Done()
+		for k := range ids {
+			models = append(models, &types.Model{
+				ID:       ids[k],
+				Object:   "model",
+				Created:  now,
+				OwnedBy:  "anthropic",
+				Provider: Provider,
+				Type:     ClaudeTypeApi,
+				KeyIds:   keyIds,
+			})
+		}
+	}
+	sessions := config.V().Claude.WebSessions
+	if len(sessions) > 0 {
+		keyIds := make([]string, 0, len(sessions))
+		for k := range sessions {
+			keyIds = append(keyIds, sessions[k].ID)
+		}
+		models = append(models, &types.Model{
+			ID:       WebModel,
+			Object:   "model",
+			Created:  now,
+			OwnedBy:  "anthropic",
+			Provider: Provider,
+			Type:     ClaudeTypeWeb,
+			KeyIds:   keyIds,
+		})
+	}
+	return models
+}
+
+func apiModels(auth string, lease *pool.Lease) ([]string, error) {
+	req, err := http.NewRequest(http.MethodGet, ApiModelsUrl, nil)
+	if err != nil {
+		fhblade.Log.Error("claude api models new req err", zap.Error(err))
+		return nil, err
+	}
+	req.Header = http.Header{
+		"x-api-key":         {auth},
+		"anthropic-version": {config.V().Claude.ApiVersion},
+		"accept":            {vars.ContentTypeJSON},
+	}
+	gClient := client.CPool.Get().(tlsClient.HttpClient)
+	proxyUrl := config.ClaudeProxyUrl()
+	if proxyUrl != "" {
+		gClient.SetProxy(proxyUrl)
+	}
+	resp, err := gClient.Do(req)
+	client.CPool.Put(gClient)
+	if err != nil {
+		fhblade.Log.Error("claude api models req err", zap.Error(err))
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := tools.ReadAll(resp.Body)
+		fhblade.Log.Error("claude api models res status err",
+			zap.Int("code", resp.StatusCode),
+			zap.ByteString("data", body))
+		return nil, chat.ClaudeErrorBody(resp.StatusCode, body).WithHeader(resp.Header).Report(lease)
+	}
+	lease.Report(resp.StatusCode, 0)
+	res := &types.ClaudeApiModelsResponse{}
+	if err := fhblade.Json.NewDecoder(resp.Body).Decode(res); err != nil {
+		fhblade.Log.Error("claude api models res err", zap.Error(err))
+		return nil, err
+	}
+	ids := make([]string, 0, len(res.Data))
+	for k := range res.Data {
+		ids = append(ids, res.Data[k].ID)
+	}
+	return ids, nil
+}
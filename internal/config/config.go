@@ -1,7 +1,9 @@
 package config
 
 import (
+	"fmt"
 	"io/ioutil"
+	"path"
 
 	"gopkg.in/yaml.v3"
 )
@@ -19,6 +21,12 @@ type Config struct {
 	Bing      bing      `yaml:"bing"`
 	Coze      coze      `yaml:"coze"`
 	Claude    claude    `yaml:"claude"`
+	Routes    []Route   `yaml:"routes"`
+	ChatN     chatN     `yaml:"chat_n"`
+	// 管理接口/c/admin/*的密钥,为空不开启
+	AdminKey string `yaml:"admin_key"`
+	// 客户端密钥,配置后请求需带其中一个
+	ClientKeys []ClientKey `yaml:"client_keys"`
 }
 
 type httpsInfo struct {
@@ -34,18 +42,27 @@ type openai struct {
 	ApiKeys      []ApiKeyMap `yaml:"api_keys"`
 	ImagePath    string      `yaml:"image_path"`
 	WebSessions  []ApiKeyMap `yaml:"web_sessions"`
+	// api_keys、web_sessions的选取策略
+	Balance string `yaml:"balance"`
+	// web chat通过提示词模拟函数调用
+	ToolEmulation bool `yaml:"tool_emulation"`
+	// 多轮对话历史发送方式,last、transcript、chain
+	HistoryMode string `yaml:"history_mode"`
 }
 
 type gemini struct {
 	ProxyUrl string         `yaml:"proxy_url"`
 	Model    string         `yaml:"model"`
 	ApiKeys  []geminiApiKey `yaml:"api_keys"`
+	// api_keys的选取策略
+	Balance string `yaml:"balance"`
 }
 
 type geminiApiKey struct {
 	ID      string `yaml:"id"`
 	Val     string `yaml:"val"`
 	Version string `yaml:"version"`
+	Weight  int    `yaml:"weight,omitempty"`
 }
 
 type arkose struct {
@@ -57,12 +74,22 @@ type arkose struct {
 
 type bing struct {
 	ProxyUrl string `yaml:"proxy_url"`
+	// Image Creator生成图片需要登录账号的_U cookie
+	ImageCookie string `yaml:"image_cookie"`
+	// 通过提示词模拟函数调用
+	ToolEmulation bool `yaml:"tool_emulation"`
+	// 多轮对话历史发送方式,last、transcript、chain
+	HistoryMode string `yaml:"history_mode"`
 }
 
 type coze struct {
 	ProxyUrl string      `yaml:"proxy_url"`
 	Discord  cozeDiscord `yaml:"discord"`
 	ApiChat  cozeApiChat `yaml:"api_chat"`
+	// 通过提示词模拟函数调用
+	ToolEmulation bool `yaml:"tool_emulation"`
+	// 多轮对话历史发送方式,last、transcript、chain
+	HistoryMode string `yaml:"history_mode"`
 }
 
 type cozeDiscord struct {
@@ -79,12 +106,15 @@ type cozeDiscord struct {
 type cozeApiChat struct {
 	AccessToken string       `yaml:"access_token"`
 	Bots        []cozeApiBot `yaml:"bots"`
+	// 不指定bot时的选取策略
+	Balance string `yaml:"balance"`
 }
 
 type cozeApiBot struct {
 	BotId       string `yaml:"bot_id"`
 	User        string `yaml:"user"`
 	AccessToken string `yaml:"access_token"`
+	Weight      int    `yaml:"weight,omitempty"`
 }
 
 type claude struct {
@@ -92,12 +122,90 @@ type claude struct {
 	ApiVersion  string      `yaml:"api_version"`
 	WebSessions []ApiKeyMap `yaml:"web_sessions"`
 	ApiKeys     []ApiKeyMap `yaml:"api_keys"`
+	// api_keys、web_sessions的选取策略
+	Balance string `yaml:"balance"`
+}
+
+// 模型路由,按请求model选择provider
+type Route struct {
+	// 请求模型,支持*、?通配
+	Model       string `yaml:"model"`
+	RouteTarget `yaml:",inline"`
+	// 上游连接错误、429、5xx等时依次尝试
+	Fallbacks []RouteTarget `yaml:"fallbacks,omitempty"`
+}
+
+type RouteTarget struct {
+	// 转发的provider,openai表示官方api
+	Provider string `yaml:"provider"`
+	// provider下的类型,如claude的api、web
+	Type string `yaml:"type,omitempty"`
+	// 实际请求上游的模型,为空保持请求模型
+	UpstreamModel string `yaml:"upstream_model,omitempty"`
+	// 默认使用的密钥标识,请求头x-auth-id优先
+	KeyId string `yaml:"key_id,omitempty"`
+}
+
+// 代理发给客户端的密钥,providers、models、key_ids为空不限制
+type ClientKey struct {
+	Key     string `yaml:"key"`
+	Name    string `yaml:"name"`
+	Enabled bool   `yaml:"enabled"`
+	// 可用的provider,同路由的provider
+	Providers []string `yaml:"providers,omitempty"`
+	// 可请求的模型,支持*、?通配
+	Models []string `yaml:"models,omitempty"`
+	// 可用的上游密钥标识,coze为bot_id
+	KeyIds []string `yaml:"key_ids,omitempty"`
+	// 每分钟请求数,0不限制
+	RPM int `yaml:"rpm,omitempty"`
+	// 同时进行的流式请求数
+	MaxStreams int `yaml:"max_streams,omitempty"`
+	// 每天、每月token数,按本地时间自然日、月重置
+	DailyTokens   int `yaml:"daily_tokens,omitempty"`
+	MonthlyTokens int `yaml:"monthly_tokens,omitempty"`
+}
+
+// n>1时并发请求上游
+type chatN struct {
+	// n的上限,默认8
+	Max int `yaml:"max"`
+	// 同时请求上游的数量,0不限制
+	Concurrency int `yaml:"concurrency"`
 }
 
 type ApiKeyMap struct {
 	ID             string `yaml:"id"`
 	Val            string `yaml:"val"`
 	OrganizationId string `yaml:"organization_id,omitempty"`
+	// weighted策略的权重,默认1
+	Weight int `yaml:"weight,omitempty"`
+}
+
+// 密钥池按ID、权重选取
+func (k ApiKeyMap) KeyId() string {
+	return k.ID
+}
+
+func (k ApiKeyMap) KeyWeight() int {
+	return k.Weight
+}
+
+func (k geminiApiKey) KeyId() string {
+	return k.ID
+}
+
+func (k geminiApiKey) KeyWeight() int {
+	return k.Weight
+}
+
+// coze按bot_id标识
+func (k cozeApiBot) KeyId() string {
+	return k.BotId
+}
+
+func (k cozeApiBot) KeyWeight() int {
+	return k.Weight
 }
 
 func V() *Config {
@@ -112,9 +220,45 @@ func Parse(filename string) (*Config, error) {
 	if err := yaml.Unmarshal(data, &cfg); err != nil {
 		return nil, err
 	}
+	if err := checkKeyIds(cfg); err != nil {
+		return nil, err
+	}
 	return cfg, nil
 }
 
+// 密钥池按标识区分状态,标识不能为空或重复
+func checkKeyIds(c *Config) error {
+	checks := []error{
+		keyIds("openai.api_keys", c.Openai.ApiKeys),
+		keyIds("openai.web_sessions", c.Openai.WebSessions),
+		keyIds("google_gemini.api_keys", c.Gemini.ApiKeys),
+		keyIds("claude.api_keys", c.Claude.ApiKeys),
+		keyIds("claude.web_sessions", c.Claude.WebSessions),
+		keyIds("coze.api_chat.bots", c.Coze.ApiChat.Bots),
+	}
+	for _, err := range checks {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func keyIds[K interface{ KeyId() string }](name string, keys []K) error {
+	exist := make(map[string]bool, len(keys))
+	for k := range keys {
+		id := keys[k].KeyId()
+		if id == "" {
+			return fmt.Errorf("%s[%d]: id is required", name, k)
+		}
+		if exist[id] {
+			return fmt.Errorf("%s[%d]: duplicate id %s", name, k, id)
+		}
+		exist[id] = true
+	}
+	return nil
+}
+
 func ProxyUrl() string {
 	return cfg.ProxyUrl
 }
@@ -139,6 +283,32 @@ func CozeProxyUrl() string {
 	return cfg.Coze.ProxyUrl
 }
 
+func Routes() []Route {
+	return cfg.Routes
+}
+
+// 按请求model匹配路由,按配置顺序第一个命中的生效,没有返回nil
+func MatchRoute(model string) *Route {
+	for k := range cfg.Routes {
+		r := &cfg.Routes[k]
+		if r.Model == model {
+			return r
+		}
+		if ok, _ := path.Match(r.Model, model); ok {
+			return r
+		}
+	}
+	return nil
+}
+
 func OpenaiChatWebUrl() string {
 	return cfg.Openai.ChatWebUrl
 }
+
+func ChatN() (int, int) {
+	max := cfg.ChatN.Max
+	if max <= 0 {
+		max = 8
+	}
+	return max, cfg.ChatN.Concurrency
+}
@@ -0,0 +1,41 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// 密钥池的标识不能为空或重复
+func TestParseKeyIds(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		err  string
+	}{
+		{"ok", "claude:\n  api_keys:\n    - id: a\n      val: x\n    - id: b\n      val: y\n", ""},
+		{"empty id", "openai:\n  api_keys:\n    - id: a\n      val: x\n    - val: y\n", "openai.api_keys[1]: id is required"},
+		{"duplicate id", "google_gemini:\n  api_keys:\n    - id: a\n    - id: a\n", "google_gemini.api_keys[1]: duplicate id a"},
+		{"empty bot id", "coze:\n  api_chat:\n    bots:\n      - user: u\n", "coze.api_chat.bots[0]: id is required"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "c.yaml")
+			if err := os.WriteFile(file, []byte(tt.yaml), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			cfg = nil
+			_, err := Parse(file)
+			if tt.err == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("error = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
@@ -4,21 +4,23 @@ import (
 	"bufio"
 	"bytes"
 	"errors"
-	"fmt"
 	"io"
-	"math/rand"
 	"strings"
 	"time"
 
 	http "github.com/bogdanfinn/fhttp"
 	"github.com/google/uuid"
+	"github.com/zatxm/any-proxy/internal/access"
+	"github.com/zatxm/any-proxy/internal/chat"
 	"github.com/zatxm/any-proxy/internal/client"
 	"github.com/zatxm/any-proxy/internal/config"
 	"github.com/zatxm/any-proxy/internal/coze/discord"
+	"github.com/zatxm/any-proxy/internal/pool"
 	"github.com/zatxm/any-proxy/internal/types"
 	"github.com/zatxm/any-proxy/internal/vars"
 	"github.com/zatxm/any-proxy/pkg/support"
 	"github.com/zatxm/fhblade"
+	"github.com/zatxm/fhblade/tools"
 	tlsClient "github.com/zatxm/tls-client"
 	"go.uber.org/zap"
 )
@@ -26,6 +28,7 @@ import (
 const (
 	Provider     = "coze"
 	ApiChatModel = "coze-api"
+	DiscordModel = "coze-discord"
 )
 
 var (
@@ -33,20 +36,22 @@ var (
 	ApiChatUrl           = "https://api.coze.com/open_api/v2/chat"
 	startTag             = []byte("data:")
 	endTag               = []byte{10}
+
+	ErrDiscordDisabled = errors.New("not support coze discord")
+	ErrImageDailyLimit = errors.New(discord.CozeDailyLimitError)
+	ErrImageTimeout    = errors.New("coze discord image generation timeout")
 )
 
-func DoChatCompletions(c *fhblade.Context, p types.ChatCompletionRequest) error {
+func DoChatCompletions(c *fhblade.Context, p types.ChatCompletionRequest, w chat.Writer) error {
 	if p.Model == ApiChatModel {
-		return doApiChat(c, p)
+		return doApiChat(c, p, w)
 	}
 	cozeCfg := config.V().Coze.Discord
 	if !cozeCfg.Enable {
-		return c.JSONAndStatus(http.StatusInternalServerError, types.ErrorResponse{
-			Error: &types.CError{
-				Message: "not support coze discord",
-				Type:    "invalid_config_error",
-				Code:    "systems_err",
-			},
+		return w.Error(http.StatusInternalServerError, &types.CError{
+			Message: "not support coze discord",
+			Type:    "invalid_config_error",
+			Code:    "systems_err",
 		})
 	}
 	// 判断请求内容
@@ -58,9 +63,11 @@ func DoChatCompletions(c *fhblade.Context, p types.ChatCompletionRequest) error
 				var err error
 				prompt, err = buildGPT4VForImageContent(message.MultiContent)
 				if err != nil {
-					return c.JSONAndStatus(http.StatusOK, fhblade.H{
-						"success": false,
-						"message": err.Error()})
+					return w.Error(http.StatusBadRequest, &types.CError{
+						Message: err.Error(),
+						Type:    "invalid_request_error",
+						Code:    "discord_request_err",
+					})
 				}
 			} else {
 				prompt = message.Content
@@ -68,22 +75,18 @@ func DoChatCompletions(c *fhblade.Context, p types.ChatCompletionRequest) error
 		}
 	}
 	if prompt == "" {
-		return c.JSONAndStatus(http.StatusBadRequest, types.ErrorResponse{
-			Error: &types.CError{
-				Message: "params error",
-				Type:    "invalid_request_error",
-				Code:    "discord_request_err",
-			},
+		return w.Error(http.StatusBadRequest, &types.CError{
+			Message: "params error",
+			Type:    "invalid_request_error",
+			Code:    "discord_request_err",
 		})
 	}
 	sentMsg, err := discord.SendMessage(prompt, "")
 	if err != nil {
-		return c.JSONAndStatus(http.StatusBadRequest, types.ErrorResponse{
-			Error: &types.CError{
-				Message: err.Error(),
-				Type:    "invalid_request_error",
-				Code:    "discord_request_err",
-			},
+		return w.Error(http.StatusBadRequest, &types.CError{
+			Message: err.Error(),
+			Type:    "invalid_request_error",
+			Code:    "discord_request_err",
 		})
 	}
 
@@ -101,51 +104,79 @@ func DoChatCompletions(c *fhblade.Context, p types.ChatCompletionRequest) error
 	}
 	durationTime := time.Duration(duration) * time.Second
 	timer := time.NewTimer(durationTime)
-	rw := c.Response().Rw()
-	flusher, ok := rw.(http.Flusher)
-	if !ok {
-		return c.JSONAndStatus(http.StatusNotImplemented, types.ErrorResponse{
-			Error: &types.CError{
-				Message: "Flushing not supported",
-				Type:    "invalid_systems_error",
-				Code:    "systems_error",
-			},
-		})
-	}
-	header := rw.Header()
-	header.Set("Content-Type", vars.ContentTypeStream)
-	header.Set("Cache-Control", "no-cache")
-	header.Set("Connection", "keep-alive")
-	header.Set("Access-Control-Allow-Origin", "*")
-	rw.WriteHeader(200)
-	clientGone := rw.(http.CloseNotifier).CloseNotify()
+	defer timer.Stop()
+	clientGone := chat.Context(c, w).Done()
 	lastMsg := ""
 	for {
 		select {
 		case <-clientGone:
 			return nil
-		default:
-			select {
-			case reply := <-replyChan:
-				timer.Reset(durationTime)
-				tMsg := strings.TrimPrefix(reply.Choices[0].Message.Content, lastMsg)
-				lastMsg = reply.Choices[0].Message.Content
-				if tMsg != "" {
-					reply.Choices[0].Message.Content = tMsg
-					reply.Object = "chat.completion.chunk"
-					bs, _ := fhblade.Json.MarshalToString(reply)
-					fmt.Fprintf(rw, "data: %s\n\n", bs)
-					flusher.Flush()
+		case reply := <-replyChan:
+			timer.Reset(durationTime)
+			tMsg := strings.TrimPrefix(reply.Choices[0].Message.Content, lastMsg)
+			lastMsg = reply.Choices[0].Message.Content
+			if tMsg != "" || reply.Choices[0].FinishReason != "" {
+				reply.Choices[0].Message.Content = tMsg
+				reply.Object = "chat.completion.chunk"
+				w.Write(&reply)
+			}
+		case <-timer.C:
+			return w.Done()
+		case <-stopChan:
+			return w.Done()
+		}
+	}
+}
+
+// discord托管的coze bot生成图片,等bot回复结束后返回其中的图片地址
+func GenerateImages(c *fhblade.Context, prompt string) ([]string, error) {
+	cozeCfg := config.V().Coze.Discord
+	if !cozeCfg.Enable {
+		return nil, ErrDiscordDisabled
+	}
+	sentMsg, err := discord.SendMessage(prompt, "")
+	if err != nil {
+		return nil, err
+	}
+
+	replyChan := make(chan types.ImagesGenerationResponse)
+	discord.RepliesOpenAIImageChans[sentMsg.ID] = replyChan
+	defer delete(discord.RepliesOpenAIImageChans, sentMsg.ID)
+
+	stopChan := make(chan discord.ChannelStopChan)
+	discord.ReplyStopChans[sentMsg.ID] = stopChan
+	defer delete(discord.ReplyStopChans, sentMsg.ID)
+
+	duration := cozeCfg.RequestOutTime
+	if duration == 0 {
+		duration = defaultTimeout
+	}
+	timer := time.NewTimer(time.Duration(duration) * time.Second)
+	defer timer.Stop()
+	clientGone := c.Request().Context().Done()
+	// 回复会多次更新,取最后一次带图片的
+	var urls []string
+	for {
+		select {
+		case <-clientGone:
+			return nil, c.Request().Context().Err()
+		case reply := <-replyChan:
+			if reply.DailyLimit {
+				return nil, ErrImageDailyLimit
+			}
+			if len(reply.Data) > 0 {
+				urls = urls[:0]
+				for _, v := range reply.Data {
+					urls = append(urls, v.URL)
 				}
-			case <-timer.C:
-				fmt.Fprint(rw, "data: [DONE]\n\n")
-				flusher.Flush()
-				return nil
-			case <-stopChan:
-				fmt.Fprint(rw, "data: [DONE]\n\n")
-				flusher.Flush()
-				return nil
 			}
+		case <-timer.C:
+			if len(urls) > 0 {
+				return urls, nil
+			}
+			return nil, ErrImageTimeout
+		case <-stopChan:
+			return urls, nil
 		}
 	}
 }
@@ -182,26 +213,19 @@ func buildGPT4VForImageContent(objs []*types.ChatMessagePart) (string, error) {
 	return contentBuilder.String(), nil
 }
 
-func doApiChat(c *fhblade.Context, p types.ChatCompletionRequest) error {
+func doApiChat(c *fhblade.Context, p types.ChatCompletionRequest, w chat.Writer) error {
 	prompt := p.ParsePromptText()
 	if prompt == "" {
-		return c.JSONAndStatus(http.StatusBadRequest, types.ErrorResponse{
-			Error: &types.CError{
-				Message: "params error",
-				Type:    "invalid_request_error",
-				Code:    "request_err",
-			},
+		return w.Error(http.StatusBadRequest, &types.CError{
+			Message: "params error",
+			Type:    "invalid_request_error",
+			Code:    "request_err",
 		})
 	}
-	botId, user, token := parseAuth(c, p)
+	botId, user, token, lease := parseAuth(c, p)
+	defer lease.Done()
 	if botId == "" || user == "" || token == "" {
-		return c.JSONAndStatus(http.StatusInternalServerError, types.ErrorResponse{
-			Error: &types.CError{
-				Message: "config error",
-				Type:    "invalid_config_error",
-				Code:    "systems_err",
-			},
-		})
+		return chat.NoKeyError("coze api").Write(c, w)
 	}
 	if !strings.HasPrefix(token, "Bearer ") {
 		token = "Bearer " + token
@@ -216,19 +240,32 @@ func doApiChat(c *fhblade.Context, p types.ChatCompletionRequest) error {
 		r.ConversationId = p.Coze.Conversation.ConversationId
 	} else {
 		r.ConversationId = uuid.NewString()
+		// 新对话按配置带上之前的消息,传了chat_history的优先
+		if p.Coze != nil && len(p.Coze.ChatHistory) > 0 {
+			r.ChatHistory = p.Coze.ChatHistory
+		} else {
+			history, last := chat.SplitHistory(p.Messages)
+			if last != nil && len(history) > 0 {
+				switch config.V().Coze.HistoryMode {
+				case chat.HistoryTranscript:
+					r.Query = chat.Transcript(history, chat.MessageText(last))
+				case chat.HistoryChain:
+					r.ChatHistory = parseChatHistory(history)
+					r.Query = chat.MessageText(last)
+				}
+			}
+		}
 	}
 	reqJson, _ := fhblade.Json.MarshalToString(r)
-	req, err := http.NewRequest(http.MethodPost, ApiChatUrl, strings.NewReader(reqJson))
+	req, err := http.NewRequestWithContext(chat.Context(c, w), http.MethodPost, ApiChatUrl, strings.NewReader(reqJson))
 	if err != nil {
 		fhblade.Log.Error("coze chat api v1 send msg new req err",
 			zap.Error(err),
 			zap.String("data", reqJson))
-		return c.JSONAndStatus(http.StatusBadRequest, types.ErrorResponse{
-			Error: &types.CError{
-				Message: err.Error(),
-				Type:    "invalid_request_error",
-				Code:    "systems_err",
-			},
+		return w.Error(http.StatusBadRequest, &types.CError{
+			Message: err.Error(),
+			Type:    "invalid_request_error",
+			Code:    "systems_err",
 		})
 	}
 	req.Header = http.Header{
@@ -248,32 +285,18 @@ func doApiChat(c *fhblade.Context, p types.ChatCompletionRequest) error {
 		fhblade.Log.Error("coze chat api v1 send msg req err",
 			zap.Error(err),
 			zap.String("data", reqJson))
-		return c.JSONAndStatus(http.StatusBadRequest, types.ErrorResponse{
-			Error: &types.CError{
-				Message: err.Error(),
-				Type:    "invalid_request_error",
-				Code:    "systems_err",
-			},
-		})
+		return chat.ConnError(err).Write(c, w)
 	}
 	defer resp.Body.Close()
-	rw := c.Response().Rw()
-	flusher, ok := rw.(http.Flusher)
-	if !ok {
-		return c.JSONAndStatus(http.StatusInternalServerError, types.ErrorResponse{
-			Error: &types.CError{
-				Message: "Flushing not supported",
-				Type:    "invalid_request_error",
-				Code:    "systems_err",
-			},
-		})
+	// 鉴权、参数等错误http状态为200,返回json的code、msg
+	if resp.StatusCode != http.StatusOK || strings.Contains(resp.Header.Get("Content-Type"), "json") {
+		body, _ := tools.ReadAll(resp.Body)
+		fhblade.Log.Error("coze chat api v1 send msg res status err",
+			zap.Int("code", resp.StatusCode),
+			zap.ByteString("data", body))
+		return chat.CozeErrorBody(resp.StatusCode, body).WithHeader(resp.Header).Report(lease).Write(c, w)
 	}
-	header := rw.Header()
-	header.Set("Content-Type", vars.ContentTypeStream)
-	header.Set("Cache-Control", "no-cache")
-	header.Set("Connection", "keep-alive")
-	header.Set("Access-Control-Allow-Origin", "*")
-	rw.WriteHeader(200)
+	lease.Report(resp.StatusCode, 0)
 	// 读取响应体
 	reader := bufio.NewReader(resp.Body)
 	now := time.Now().Unix()
@@ -300,14 +323,12 @@ func doApiChat(c *fhblade.Context, p types.ChatCompletionRequest) error {
 				break
 			}
 			if chatRes.Event == "error" {
-				fmt.Fprintf(rw, "data: %s\n\n", raw)
-				flusher.Flush()
-				break
+				return chat.CozeErrorInformation(chatRes.ErrorInformation).Report(lease).Write(c, w)
 			}
 			if chatRes.Message.Type == "answer" && chatRes.Message.Content != "" {
 				var choices []*types.ChatCompletionChoice
 				choices = append(choices, &types.ChatCompletionChoice{
-					Index: chatRes.Index,
+					Index: 0,
 					Message: &types.ChatCompletionMessage{
 						Role:    "assistant",
 						Content: chatRes.Message.Content,
@@ -326,20 +347,45 @@ func doApiChat(c *fhblade.Context, p types.ChatCompletionRequest) error {
 						User:           user,
 					},
 				}
-				outJson, _ := fhblade.Json.Marshal(outRes)
-				fmt.Fprintf(rw, "data: %s\n\n", outJson)
-				flusher.Flush()
+				w.Write(outRes)
 			}
 		}
 	}
-	fmt.Fprint(rw, "data: [DONE]\n\n")
-	flusher.Flush()
+	return w.Done()
+}
 
-	return nil
+// 之前的消息转成chat_history,system、tool等作为user消息
+func parseChatHistory(history []*types.ChatCompletionMessage) []*types.CozeApiChatMessage {
+	var chatHistory []*types.CozeApiChatMessage
+	for _, m := range history {
+		text := chat.MessageText(m)
+		if text == "" {
+			continue
+		}
+		if m.Role == "assistant" {
+			chatHistory = append(chatHistory, &types.CozeApiChatMessage{
+				Role:        "assistant",
+				Type:        "answer",
+				Content:     text,
+				ContentType: "text",
+			})
+			continue
+		}
+		if m.Role != "user" {
+			text = chat.HistoryText([]*types.ChatCompletionMessage{m})
+		}
+		chatHistory = append(chatHistory, &types.CozeApiChatMessage{
+			Role:        "user",
+			Content:     text,
+			ContentType: "text",
+		})
+	}
+	return chatHistory
 }
 
 // 随机获取设置的coze bot id
-func parseAuth(c *fhblade.Context, p types.ChatCompletionRequest) (string, string, string) {
+// 返回bot_id、user、token,lease用于上报上游状态及结束请求
+func parseAuth(c *fhblade.Context, p types.ChatCompletionRequest) (string, string, string, *pool.Lease) {
 	// 优先取header再取body传值
 	token := c.Request().Header("Authorization")
 	user := c.Request().Header("x-auth-id")
@@ -349,63 +395,94 @@ func parseAuth(c *fhblade.Context, p types.ChatCompletionRequest) (string, strin
 		if strings.HasPrefix(token, "Bearer ") {
 			token = strings.TrimPrefix(token, "Bearer ")
 		}
-		return botId, user, token
+		return botId, user, token, nil
 	}
 	if p.Coze != nil && p.Coze.Conversation != nil && p.Coze.Conversation.BotId != "" && p.Coze.Conversation.User != "" {
 		botId = p.Coze.Conversation.BotId
 		user = p.Coze.Conversation.User
 	}
 
-	// 根据user和botId查找配置
-	if user != "" && botId != "" {
-		if token != "" {
+	// 根据user和botId查找配置,只有botId时取配置的user
+	if botId != "" {
+		if user != "" && token != "" {
 			if strings.HasPrefix(token, "Bearer ") {
 				token = strings.TrimPrefix(token, "Bearer ")
 			}
-			return botId, user, token
+			return botId, user, token, nil
+		}
+		// 使用配置的token时检查客户端密钥是否允许
+		if !access.KeyAllowed(c, botId) {
+			return "", "", "", nil
 		}
 		cozeApiChatCfg := config.V().Coze.ApiChat
 		botCfgs := cozeApiChatCfg.Bots
 		exist := false
 		for k := range botCfgs {
 			botCfg := botCfgs[k]
-			if botId == botCfg.BotId && user == botCfg.User {
-				token = botCfg.AccessToken
+			if botId == botCfg.BotId && (user == "" || user == botCfg.User) {
+				user = botCfg.User
+				if token == "" {
+					token = botCfg.AccessToken
+				}
 				exist = true
 				break
 			}
 		}
 		if !exist {
-			return "", "", "" //不匹配
+			return "", "", "", nil //不匹配
 		}
 		if token == "" {
 			token = cozeApiChatCfg.AccessToken
 		}
-		return botId, user, token
+		return botId, user, token, nil
 	}
 
-	// 随机获取
+	// 按策略选取
 	cozeApiChatCfg := config.V().Coze.ApiChat
 	botCfgs := cozeApiChatCfg.Bots
-	l := len(botCfgs)
-	if l == 0 {
-		return "", "", ""
+	i, lease := pool.Pick(c, "coze-api", cozeApiChatCfg.Balance, botCfgs, "")
+	if i < 0 {
+		return "", "", "", lease
 	}
-	if l == 1 {
-		token = botCfgs[0].AccessToken
-		if token == "" {
-			token = cozeApiChatCfg.AccessToken
-		}
-		return botCfgs[0].BotId, botCfgs[0].User, token
-	}
-
-	rand.Seed(time.Now().UnixNano())
-	index := rand.Intn(l)
-	botCfg := botCfgs[index]
+	botCfg := botCfgs[i]
 	token = botCfg.AccessToken
 	if token == "" {
 		token = cozeApiChatCfg.AccessToken
 	}
+	return botCfg.BotId, botCfg.User, token, lease
+}
 
-	return botCfg.BotId, botCfg.User, token
+// 模型列表,api按配置的bot,discord按托管的coze bot
+func Models() []*types.Model {
+	var models []*types.Model
+	now := time.Now().Unix()
+	bots := config.V().Coze.ApiChat.Bots
+	if len(bots) > 0 {
+		botIds := make([]string, 0, len(bots))
+		for k := range bots {
+			botIds = append(botIds, bots[k].BotId)
+		}
+		models = append(models, &types.Model{
+			ID:       ApiChatModel,
+			Object:   "model",
+			Created:  now,
+			OwnedBy:  "coze",
+			Provider: Provider,
+			Type:     "api",
+			KeyIds:   botIds,
+		})
+	}
+	discordCfg := config.V().Coze.Discord
+	if discordCfg.Enable {
+		models = append(models, &types.Model{
+			ID:       DiscordModel,
+			Object:   "model",
+			Created:  now,
+			OwnedBy:  "coze",
+			Provider: Provider,
+			Type:     "discord",
+			KeyIds:   discordCfg.CozeBot,
+		})
+	}
+	return models
 }
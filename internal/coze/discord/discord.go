@@ -253,7 +253,7 @@ func dealOpenAIImageMessageCreate(m *discordgo.MessageCreate) types.ImagesGenera
 	submatches := re.FindAllStringSubmatch(m.Content, -1)
 	for k := range submatches {
 		match := submatches[k]
-		response.Data = append(response.Data, &types.ChatMessageImageURL{URL: match[1]})
+		response.Data = append(response.Data, &types.ImageData{URL: match[1]})
 	}
 	if len(m.Embeds) > 0 {
 		for k := range m.Embeds {
@@ -262,7 +262,7 @@ func dealOpenAIImageMessageCreate(m *discordgo.MessageCreate) types.ImagesGenera
 				if m.Content != "" {
 					m.Content += "\n"
 				}
-				response.Data = append(response.Data, &types.ChatMessageImageURL{URL: embed.Image.URL})
+				response.Data = append(response.Data, &types.ImageData{URL: embed.Image.URL})
 			}
 		}
 	}
@@ -337,7 +337,7 @@ func dealOpenAIImageMessageUpdate(m *discordgo.MessageUpdate) types.ImagesGenera
 	submatches := re.FindAllStringSubmatch(m.Content, -1)
 	for k := range submatches {
 		match := submatches[k]
-		response.Data = append(response.Data, &types.ChatMessageImageURL{URL: match[1]})
+		response.Data = append(response.Data, &types.ImageData{URL: match[1]})
 	}
 	if len(m.Embeds) > 0 {
 		for k := range m.Embeds {
@@ -346,7 +346,7 @@ func dealOpenAIImageMessageUpdate(m *discordgo.MessageUpdate) types.ImagesGenera
 				if m.Content != "" {
 					m.Content += "\n"
 				}
-				response.Data = append(response.Data, &types.ChatMessageImageURL{URL: embed.Image.URL})
+				response.Data = append(response.Data, &types.ImageData{URL: embed.Image.URL})
 			}
 		}
 	}
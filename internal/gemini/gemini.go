@@ -3,17 +3,22 @@ package gemini
 import (
 	"bufio"
 	"bytes"
-	"fmt"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
 	"io"
-	"math/rand"
+	"math"
 	"strings"
 	"time"
 
 	http "github.com/bogdanfinn/fhttp"
 	"github.com/bogdanfinn/fhttp/httputil"
 	"github.com/google/uuid"
+	"github.com/zatxm/any-proxy/internal/access"
+	"github.com/zatxm/any-proxy/internal/chat"
 	"github.com/zatxm/any-proxy/internal/client"
 	"github.com/zatxm/any-proxy/internal/config"
+	"github.com/zatxm/any-proxy/internal/pool"
 	"github.com/zatxm/any-proxy/internal/types"
 	"github.com/zatxm/any-proxy/internal/vars"
 	"github.com/zatxm/fhblade"
@@ -28,11 +33,12 @@ const (
 	ApiUrl       = "https://generativelanguage.googleapis.com"
 	ApiVersion   = "v1beta"
 	DefaultModel = "gemini-pro"
+	// batchEmbedContents每次最多100条
+	embedBatchSize = 100
 )
 
 var (
-	startTag = []byte(`            "text": "`)
-	endTag   = []byte{34, 10}
+	startTag = []byte("data: ")
 )
 
 // 转发
@@ -52,7 +58,7 @@ func Do() func(*fhblade.Context) error {
 					},
 				})
 			}
-			return apiToApi(c, p, c.Request().Header("x-auth-id"))
+			return apiToApi(c, chat.NewWriter(c, true), p, c.Request().Header("x-auth-id"))
 		}
 		query := c.Request().RawQuery()
 		// 请求头
@@ -81,7 +87,7 @@ func Do() func(*fhblade.Context) error {
 }
 
 // 通过api请求返回openai格式
-func apiToApi(c *fhblade.Context, p types.StreamGenerateContent, idSign string) error {
+func apiToApi(c *fhblade.Context, w chat.Writer, p types.StreamGenerateContent, idSign string) error {
 	model := p.Model
 	if model == "" {
 		model = config.V().Gemini.Model
@@ -89,29 +95,22 @@ func apiToApi(c *fhblade.Context, p types.StreamGenerateContent, idSign string)
 			model = DefaultModel
 		}
 	}
-	goUrl, index := parseApiUrl(c, model, idSign)
+	goUrl, index, lease := parseApiUrl(c, model, idSign)
+	defer lease.Done()
 	if goUrl == "" {
-		return c.JSONAndStatus(http.StatusInternalServerError, types.ErrorResponse{
-			Error: &types.CError{
-				Message: "key error",
-				Type:    "invalid_request_error",
-				Code:    "request_err",
-			},
-		})
+		return chat.NoKeyError("gemini").Write(c, w)
 	}
 	reqJson, _ := fhblade.Json.Marshal(p)
-	req, err := http.NewRequest(http.MethodPost, goUrl, bytes.NewReader(reqJson))
+	req, err := http.NewRequestWithContext(chat.Context(c, w), http.MethodPost, goUrl, bytes.NewReader(reqJson))
 	if err != nil {
 		fhblade.Log.Error("gemini v1 send msg new req err",
 			zap.Error(err),
 			zap.String("url", goUrl),
 			zap.ByteString("data", reqJson))
-		return c.JSONAndStatus(http.StatusInternalServerError, types.ErrorResponse{
-			Error: &types.CError{
-				Message: err.Error(),
-				Type:    "invalid_request_error",
-				Code:    "request_err",
-			},
+		return w.Error(http.StatusInternalServerError, &types.CError{
+			Message: err.Error(),
+			Type:    "invalid_request_error",
+			Code:    "request_err",
 		})
 	}
 	req.Header = http.Header{
@@ -129,36 +128,23 @@ func apiToApi(c *fhblade.Context, p types.StreamGenerateContent, idSign string)
 			zap.Error(err),
 			zap.String("url", goUrl),
 			zap.ByteString("data", reqJson))
-		return c.JSONAndStatus(http.StatusInternalServerError, types.ErrorResponse{
-			Error: &types.CError{
-				Message: err.Error(),
-				Type:    "invalid_request_error",
-				Code:    "request_err",
-			},
-		})
+		return chat.ConnError(err).Write(c, w)
 	}
 	defer resp.Body.Close()
-	rw := c.Response().Rw()
-	flusher, ok := rw.(http.Flusher)
-	if !ok {
-		return c.JSONAndStatus(http.StatusNotImplemented, types.ErrorResponse{
-			Error: &types.CError{
-				Message: "Flushing not supported",
-				Type:    "invalid_systems_error",
-				Code:    "systems_error",
-			},
-		})
+	if resp.StatusCode != http.StatusOK {
+		body, _ := tools.ReadAll(resp.Body)
+		fhblade.Log.Error("gemini v1 send msg res status err",
+			zap.Int("code", resp.StatusCode),
+			zap.ByteString("data", body))
+		return chat.GeminiError(resp.StatusCode, body).WithHeader(resp.Header).Report(lease).Write(c, w)
 	}
-	header := rw.Header()
-	header.Set("Content-Type", vars.ContentTypeStream)
-	header.Set("Cache-Control", "no-cache")
-	header.Set("Connection", "keep-alive")
-	header.Set("Access-Control-Allow-Origin", "*")
-	rw.WriteHeader(200)
-	// 读取响应体
+	lease.Report(resp.StatusCode, 0)
+	// 读取响应体,alt=sse每行data为完整的GenerateContentResponse
 	reader := bufio.NewReader(resp.Body)
 	id := uuid.NewString()
 	now := time.Now().Unix()
+	toolIndex := 0
+	var usage *types.Usage
 	for {
 		line, err := reader.ReadBytes('\n')
 		if err != nil {
@@ -167,60 +153,126 @@ func apiToApi(c *fhblade.Context, p types.StreamGenerateContent, idSign string)
 			}
 			break
 		}
-		if bytes.HasPrefix(line, startTag) {
-			raw := bytes.TrimPrefix(line, startTag)
-			raw = bytes.TrimSuffix(raw, endTag)
-			var choices []*types.ChatCompletionChoice
+		if !bytes.HasPrefix(line, startTag) {
+			continue
+		}
+		raw := bytes.TrimSpace(bytes.TrimPrefix(line, startTag))
+		// 流中途的错误
+		if bytes.HasPrefix(raw, []byte(`{"error"`)) {
+			return chat.GeminiError(http.StatusInternalServerError, raw).Report(lease).Write(c, w)
+		}
+		chatRes := &types.GeminiGenerateContentResponse{}
+		if err := fhblade.Json.Unmarshal(raw, chatRes); err != nil {
+			fhblade.Log.Error("gemini v1 deal data err",
+				zap.Error(err),
+				zap.ByteString("data", line))
+			continue
+		}
+		// usageMetadata为累计值,以最后一次为准
+		if chatRes.UsageMetadata != nil {
+			usage = &types.Usage{
+				PromptTokens:     chatRes.UsageMetadata.PromptTokenCount,
+				CompletionTokens: chatRes.UsageMetadata.CandidatesTokenCount,
+				TotalTokens:      chatRes.UsageMetadata.TotalTokenCount,
+			}
+		}
+		var choices []*types.ChatCompletionChoice
+		for _, candidate := range chatRes.Candidates {
+			message := &types.ChatCompletionMessage{Role: "assistant"}
+			if candidate.Content != nil {
+				for _, part := range candidate.Content.Parts {
+					if part.FunctionCall != nil {
+						ti := toolIndex
+						toolIndex++
+						args, _ := fhblade.Json.MarshalToString(part.FunctionCall.Args)
+						if part.FunctionCall.Args == nil {
+							args = "{}"
+						}
+						message.ToolCalls = append(message.ToolCalls, &types.ToolCall{
+							Index: &ti,
+							ID:    "call_" + strings.ReplaceAll(uuid.NewString(), "-", ""),
+							Type:  "function",
+							Function: types.FunctionCall{
+								Name:      part.FunctionCall.Name,
+								Arguments: args,
+							},
+						})
+						continue
+					}
+					message.Content += part.Text
+				}
+			}
+			finishReason := parseFinishReason(candidate.FinishReason)
+			if finishReason == "stop" && toolIndex > 0 {
+				finishReason = "tool_calls"
+			}
+			if message.Content == "" && len(message.ToolCalls) == 0 && finishReason == "" {
+				continue
+			}
 			choices = append(choices, &types.ChatCompletionChoice{
-				Index: 0,
-				Message: &types.ChatCompletionMessage{
-					Role:    "assistant",
-					Content: tools.BytesToString(raw),
-				},
+				Index:        candidate.Index,
+				Message:      message,
+				FinishReason: finishReason,
 			})
-			outRes := &types.ChatCompletionResponse{
-				ID:      id,
-				Choices: choices,
-				Created: now,
-				Model:   model,
-				Object:  "chat.completion.chunk",
-				Gemini: &types.GeminiCompletionResponse{
-					Type:  "api",
-					Index: index,
-				},
-			}
-			outJson, _ := fhblade.Json.Marshal(outRes)
-			fmt.Fprintf(rw, "data: %s\n\n", outJson)
-			flusher.Flush()
 		}
+		if len(choices) == 0 {
+			continue
+		}
+		outRes := &types.ChatCompletionResponse{
+			ID:      id,
+			Choices: choices,
+			Created: now,
+			Model:   model,
+			Object:  "chat.completion.chunk",
+			Gemini: &types.GeminiCompletionResponse{
+				Type:  "api",
+				Index: index,
+			},
+		}
+		w.Write(outRes)
+	}
+	if usage != nil {
+		w.Write(&types.ChatCompletionResponse{
+			ID:      id,
+			Created: now,
+			Model:   model,
+			Object:  "chat.completion.chunk",
+			Usage:   usage,
+		})
 	}
-	fmt.Fprint(rw, "data: [DONE]\n\n")
-	flusher.Flush()
-	return nil
+	return w.Done()
 }
 
-// 目前仅支持文字对话
-func DoChatCompletions(c *fhblade.Context, p types.ChatCompletionRequest) error {
-	var contents []*types.GeminiContent
-	for k := range p.Messages {
-		message := p.Messages[k]
-		if message.MultiContent == nil {
-			parts := []*types.GeminiPart{&types.GeminiPart{Text: message.Content}}
-			switch message.Role {
-			case "assistant":
-				contents = append(contents, &types.GeminiContent{Parts: parts, Role: "model"})
-			case "user":
-				contents = append(contents, &types.GeminiContent{Parts: parts, Role: "user"})
-			}
-		}
+// gemini结束原因转openai
+func parseFinishReason(reason string) string {
+	switch reason {
+	case "", "FINISH_REASON_UNSPECIFIED":
+		return ""
+	case "MAX_TOKENS":
+		return "length"
+	case "SAFETY", "RECITATION", "BLOCKLIST", "PROHIBITED_CONTENT", "SPII":
+		return "content_filter"
+	default:
+		return "stop"
+	}
+}
+
+// 目前仅支持文字对话及函数调用
+func DoChatCompletions(c *fhblade.Context, p types.ChatCompletionRequest, w chat.Writer) error {
+	system, messages := chat.SplitSystem(p.Messages)
+	contents, err := parseContents(chat.Context(c, w), messages)
+	if err != nil {
+		return w.Error(http.StatusBadRequest, &types.CError{
+			Message: err.Error(),
+			Type:    "invalid_request_error",
+			Code:    "invalid_image_url",
+		})
 	}
 	if len(contents) == 0 {
-		return c.JSONAndStatus(http.StatusBadRequest, types.ErrorResponse{
-			Error: &types.CError{
-				Message: "params error",
-				Type:    "invalid_request_error",
-				Code:    "request_err",
-			},
+		return w.Error(http.StatusBadRequest, &types.CError{
+			Message: "params error",
+			Type:    "invalid_request_error",
+			Code:    "request_err",
 		})
 	}
 	goReq := &types.StreamGenerateContent{
@@ -230,18 +282,400 @@ func DoChatCompletions(c *fhblade.Context, p types.ChatCompletionRequest) error
 	if &p.MaxTokens != nil {
 		goReq.GenerationConfig.MaxOutputTokens = p.MaxTokens
 	}
+	// system、developer消息合并为systemInstruction
+	if system != "" {
+		goReq.SystemInstruction = &types.GeminiContent{
+			Parts: []*types.GeminiPart{&types.GeminiPart{Text: system}},
+		}
+	}
+	parseTools(goReq, p.Tools, p.ToolChoice)
+	if chat.IsJSONFormat(p.ResponseFormat) {
+		goReq.GenerationConfig.ResponseMimeType = "application/json"
+		if p.ResponseFormat.JSONSchema != nil {
+			goReq.GenerationConfig.ResponseSchema = parseSchema(p.ResponseFormat.JSONSchema.Schema)
+		}
+	}
 	goReq.Model = p.Model
 	reqIndex := c.Request().Header("x-auth-id")
 	if reqIndex == "" && p.Gemini != nil && p.Gemini.Index != "" {
 		reqIndex = p.Gemini.Index
 	}
-	return apiToApi(c, *goReq, reqIndex)
+	return apiToApi(c, w, *goReq, reqIndex)
+}
+
+// openai消息转gemini
+// assistant的tool_calls转functionCall,tool消息转functionResponse,连续相同角色的合并
+// user消息的图片按顺序转inlineData
+func parseContents(ctx context.Context, ms []*types.ChatCompletionMessage) ([]*types.GeminiContent, error) {
+	var contents []*types.GeminiContent
+	// tool消息只有tool_call_id,需要找回函数名
+	toolNames := make(map[string]string)
+	for k := range ms {
+		message := ms[k]
+		var role string
+		var parts []*types.GeminiPart
+		switch message.Role {
+		case "assistant":
+			role = "model"
+			if message.Content != "" {
+				parts = append(parts, &types.GeminiPart{Text: message.Content})
+			}
+			for _, tc := range message.ToolCalls {
+				toolNames[tc.ID] = tc.Function.Name
+				parts = append(parts, &types.GeminiPart{
+					FunctionCall: &types.GeminiFunctionCall{
+						Name: tc.Function.Name,
+						Args: parseToolArgs(tc.Function.Arguments),
+					},
+				})
+			}
+		case "user":
+			role = "user"
+			if message.MultiContent == nil {
+				if message.Content != "" {
+					parts = append(parts, &types.GeminiPart{Text: message.Content})
+				}
+				break
+			}
+			for _, part := range message.MultiContent {
+				switch part.Type {
+				case "text":
+					if part.Text != "" {
+						parts = append(parts, &types.GeminiPart{Text: part.Text})
+					}
+				case "image_url":
+					if part.ImageURL == nil {
+						continue
+					}
+					img, err := chat.LoadImage(ctx, part.ImageURL.URL, config.GeminiProxyUrl())
+					if err != nil {
+						return nil, err
+					}
+					parts = append(parts, &types.GeminiPart{
+						InlineData: &types.GeminiBlob{
+							MimeType: img.MimeType,
+							Data:     img.Base64(),
+						},
+					})
+				}
+			}
+		case "tool":
+			role = "function"
+			name := toolNames[message.ToolCallID]
+			if name == "" {
+				name = message.Name
+			}
+			parts = append(parts, &types.GeminiPart{
+				FunctionResponse: &types.GeminiFunctionResponse{
+					Name:     name,
+					Response: parseToolResponse(message.Content),
+				},
+			})
+		}
+		if len(parts) == 0 {
+			continue
+		}
+		l := len(contents)
+		if l > 0 && contents[l-1].Role == role {
+			contents[l-1].Parts = append(contents[l-1].Parts, parts...)
+			continue
+		}
+		contents = append(contents, &types.GeminiContent{Parts: parts, Role: role})
+	}
+	return contents, nil
+}
+
+func parseToolArgs(arguments string) map[string]any {
+	args := make(map[string]any)
+	if arguments != "" {
+		if err := fhblade.Json.UnmarshalFromString(arguments, &args); err != nil || args == nil {
+			return make(map[string]any)
+		}
+	}
+	return args
+}
+
+// functionResponse的response须为对象,不是json对象的包一层
+func parseToolResponse(content string) map[string]any {
+	res := make(map[string]any)
+	if err := fhblade.Json.UnmarshalFromString(content, &res); err == nil && res != nil {
+		return res
+	}
+	return map[string]any{"content": content}
+}
+
+// openai tools、tool_choice转functionDeclarations、toolConfig
+func parseTools(goReq *types.StreamGenerateContent, ts []types.Tool, toolChoice any) {
+	var declarations []*types.GeminiFunctionDeclaration
+	for k := range ts {
+		tool := ts[k]
+		if tool.Type != "function" || tool.Function == nil {
+			continue
+		}
+		declarations = append(declarations, &types.GeminiFunctionDeclaration{
+			Name:        tool.Function.Name,
+			Description: tool.Function.Description,
+			Parameters:  parseSchema(tool.Function.Parameters),
+		})
+	}
+	if len(declarations) == 0 {
+		return
+	}
+	goReq.Tools = []*types.GeminiTool{&types.GeminiTool{FunctionDeclarations: declarations}}
+	fc := &types.GeminiFunctionCallingConfig{}
+	switch v := toolChoice.(type) {
+	case string:
+		switch v {
+		case "none":
+			fc.Mode = "NONE"
+		case "auto":
+			fc.Mode = "AUTO"
+		case "required":
+			fc.Mode = "ANY"
+		}
+	case map[string]any:
+		if fn, ok := v["function"].(map[string]any); ok {
+			if name, ok := fn["name"].(string); ok && name != "" {
+				fc.Mode = "ANY"
+				fc.AllowedFunctionNames = []string{name}
+			}
+		}
+	}
+	if fc.Mode != "" {
+		goReq.ToolConfig = &types.GeminiToolConfig{FunctionCallingConfig: fc}
+	}
+}
+
+// gemini只支持OpenAPI schema子集,去掉不支持的字段
+// 没有参数的object不能传properties为空
+func parseSchema(schema any) any {
+	m, ok := schema.(map[string]any)
+	if !ok {
+		return nil
+	}
+	out := make(map[string]any)
+	for k, v := range m {
+		switch k {
+		case "type", "format", "description", "nullable", "enum", "required", "minItems", "maxItems":
+			out[k] = v
+		case "items":
+			if items := parseSchema(v); items != nil {
+				out[k] = items
+			}
+		case "properties":
+			props, ok := v.(map[string]any)
+			if !ok {
+				continue
+			}
+			outProps := make(map[string]any)
+			for name, prop := range props {
+				if sp := parseSchema(prop); sp != nil {
+					outProps[name] = sp
+				}
+			}
+			if len(outProps) > 0 {
+				out[k] = outProps
+			}
+		}
+	}
+	if t, _ := out["type"].(string); t == "object" && out["properties"] == nil {
+		return nil
+	}
+	// required只保留还存在的属性
+	if required, ok := out["required"].([]any); ok {
+		props, _ := out["properties"].(map[string]any)
+		var names []any
+		for _, name := range required {
+			if n, ok := name.(string); ok && props[n] != nil {
+				names = append(names, n)
+			}
+		}
+		if len(names) > 0 {
+			out["required"] = names
+		} else {
+			delete(out, "required")
+		}
+	}
+	return out
+}
+
+// openai embeddings请求,单个输入用embedContent,多个用batchEmbedContents
+// gemini不返回token数,usage按文本估算
+func DoEmbeddings(c *fhblade.Context, p types.EmbeddingRequest) error {
+	inputs, ok := embeddingInputs(p.Input)
+	if !ok {
+		return c.JSONAndStatus(http.StatusBadRequest, types.ErrorResponse{
+			Error: &types.CError{
+				Message: "gemini embeddings only support string or array of strings input",
+				Type:    "invalid_request_error",
+				Param:   "input",
+				Code:    "invalid_parameter",
+			},
+		})
+	}
+	auth, version, index, lease := parseAuth(c, c.Request().Header("x-auth-id"))
+	defer lease.Done()
+	if auth == "" {
+		return chat.NoKeyError("gemini").JSON(c)
+	}
+	if index != "" {
+		c.Response().SetHeader("x-auth-id", index)
+	}
+	model := "models/" + strings.TrimPrefix(p.Model, "models/")
+	// 超出单次上限的分批请求,按顺序拼接
+	embeddings := make([]*types.GeminiContentEmbedding, 0, len(inputs))
+	for start := 0; start < len(inputs); start += embedBatchSize {
+		end := min(start+embedBatchSize, len(inputs))
+		batch, e := embedContents(auth, version, model, inputs[start:end], p.Dimensions, lease)
+		if e != nil {
+			return e.JSON(c)
+		}
+		embeddings = append(embeddings, batch...)
+	}
+	res := &types.EmbeddingResponse{
+		Object: "list",
+		Data:   make([]*types.Embedding, 0, len(embeddings)),
+		Model:  p.Model,
+		Usage:  &types.EmbeddingUsage{},
+	}
+	for k := range embeddings {
+		var values []float64
+		if embeddings[k] != nil {
+			values = embeddings[k].Values
+		}
+		res.Data = append(res.Data, &types.Embedding{
+			Object:    "embedding",
+			Embedding: encodeEmbedding(values, p.EncodingFormat),
+			Index:     k,
+		})
+		res.Usage.PromptTokens += chat.EstimateTokens(inputs[k])
+	}
+	res.Usage.TotalTokens = res.Usage.PromptTokens
+	access.Consume(c, res.Usage.TotalTokens)
+	return c.JSONAndStatus(http.StatusOK, res)
+}
+
+// 请求一批embeddings,一条用embedContent,多条用batchEmbedContents
+func embedContents(auth, version, model string, inputs []string, dimensions int, lease *pool.Lease) ([]*types.GeminiContentEmbedding, *chat.UpstreamError) {
+	requests := make([]*types.GeminiEmbedContentRequest, len(inputs))
+	for k := range inputs {
+		requests[k] = &types.GeminiEmbedContentRequest{
+			Model: model,
+			Content: &types.GeminiContent{
+				Parts: []*types.GeminiPart{&types.GeminiPart{Text: inputs[k]}},
+				Role:  "user",
+			},
+			OutputDimensionality: dimensions,
+		}
+	}
+	action := ":batchEmbedContents"
+	var reqJson []byte
+	if len(requests) == 1 {
+		action = ":embedContent"
+		reqJson, _ = fhblade.Json.Marshal(requests[0])
+	} else {
+		reqJson, _ = fhblade.Json.Marshal(&types.GeminiBatchEmbedContentsRequest{Requests: requests})
+	}
+	goUrl := ApiUrl + "/" + version + "/" + model + action + "?key=" + auth
+	req, err := http.NewRequest(http.MethodPost, goUrl, bytes.NewReader(reqJson))
+	if err != nil {
+		return nil, &chat.UpstreamError{
+			Code: http.StatusInternalServerError,
+			Err: &types.CError{
+				Message: err.Error(),
+				Type:    "invalid_request_error",
+				Code:    "request_err",
+			},
+		}
+	}
+	req.Header = http.Header{
+		"content-type": {vars.ContentTypeJSON},
+	}
+	gClient := client.CPool.Get().(tlsClient.HttpClient)
+	proxyUrl := config.GeminiProxyUrl()
+	if proxyUrl != "" {
+		gClient.SetProxy(proxyUrl)
+	}
+	resp, err := gClient.Do(req)
+	client.CPool.Put(gClient)
+	if err != nil {
+		fhblade.Log.Error("gemini embeddings req err", zap.Error(err))
+		return nil, chat.ConnError(err)
+	}
+	defer resp.Body.Close()
+	body, _ := tools.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		fhblade.Log.Error("gemini embeddings res status err",
+			zap.Int("code", resp.StatusCode),
+			zap.ByteString("data", body))
+		return nil, chat.GeminiError(resp.StatusCode, body).WithHeader(resp.Header).Report(lease)
+	}
+	lease.Report(resp.StatusCode, 0)
+	var embeddings []*types.GeminiContentEmbedding
+	if len(requests) == 1 {
+		embedRes := &types.GeminiEmbedContentResponse{}
+		err = fhblade.Json.Unmarshal(body, embedRes)
+		embeddings = []*types.GeminiContentEmbedding{embedRes.Embedding}
+	} else {
+		batchRes := &types.GeminiBatchEmbedContentsResponse{}
+		err = fhblade.Json.Unmarshal(body, batchRes)
+		embeddings = batchRes.Embeddings
+	}
+	if err != nil || len(embeddings) != len(inputs) {
+		fhblade.Log.Error("gemini embeddings deal data err", zap.ByteString("data", body))
+		return nil, &chat.UpstreamError{
+			Code: http.StatusBadGateway,
+			Err: &types.CError{
+				Message: "invalid embeddings response",
+				Type:    "invalid_request_error",
+				Code:    "response_err",
+			},
+		}
+	}
+	return embeddings, nil
 }
 
-func parseApiUrl(c *fhblade.Context, model, idSign string) (string, string) {
-	auth, version, index := parseAuth(c, idSign)
+// 只支持字符串或字符串数组
+func embeddingInputs(input any) ([]string, bool) {
+	switch v := input.(type) {
+	case string:
+		return []string{v}, true
+	case []any:
+		if len(v) == 0 {
+			return nil, false
+		}
+		inputs := make([]string, 0, len(v))
+		for _, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				return nil, false
+			}
+			inputs = append(inputs, s)
+		}
+		return inputs, true
+	}
+	return nil, false
+}
+
+// base64同openai,float32小端字节后编码
+func encodeEmbedding(values []float64, format string) any {
+	if format != "base64" {
+		if values == nil {
+			return []float64{}
+		}
+		return values
+	}
+	buf := make([]byte, 4*len(values))
+	for k, v := range values {
+		binary.LittleEndian.PutUint32(buf[4*k:], math.Float32bits(float32(v)))
+	}
+	return base64.StdEncoding.EncodeToString(buf)
+}
+
+func parseApiUrl(c *fhblade.Context, model, idSign string) (string, string, *pool.Lease) {
+	auth, version, index, lease := parseAuth(c, idSign)
 	if auth == "" {
-		return "", ""
+		return "", "", lease
 	}
 	var apiUrlBuild strings.Builder
 	apiUrlBuild.WriteString(ApiUrl)
@@ -250,44 +684,49 @@ func parseApiUrl(c *fhblade.Context, model, idSign string) (string, string) {
 	apiUrlBuild.WriteString("/models/")
 	apiUrlBuild.WriteString(model)
 	apiUrlBuild.WriteString(":streamGenerateContent")
-	apiUrlBuild.WriteString("?key=")
+	apiUrlBuild.WriteString("?alt=sse&key=")
 	apiUrlBuild.WriteString(auth)
-	return apiUrlBuild.String(), index
+	return apiUrlBuild.String(), index, lease
 }
 
-func parseAuth(c *fhblade.Context, index string) (string, string, string) {
-	auth := c.Request().Header("Authorization")
-	if auth != "" {
+// 返回密钥、版本、标识,lease用于上报上游状态及结束请求
+func parseAuth(c *fhblade.Context, index string) (string, string, string, *pool.Lease) {
+	if auth := pool.Authorization(c); auth != "" {
 		version := c.Request().Header("x-version")
 		if version == "" {
 			version = ApiVersion
 		}
-		if strings.HasPrefix(auth, "Bearer ") {
-			return strings.TrimPrefix(auth, "Bearer "), version, ""
-		}
-		return auth, version, ""
+		return auth, version, "", nil
 	}
 	keys := config.V().Gemini.ApiKeys
-	l := len(keys)
-	if l == 0 {
-		return "", "", ""
-	}
-	if index != "" {
-		for k := range keys {
-			v := keys[k]
-			if index == v.ID {
-				return v.Val, v.Version, v.ID
-			}
-		}
-		return "", "", ""
+	i, lease := pool.Pick(c, "gemini", config.V().Gemini.Balance, keys, index)
+	if i < 0 {
+		return "", "", "", lease
 	}
+	return keys[i].Val, keys[i].Version, keys[i].ID, lease
+}
 
-	if l == 1 {
-		return keys[0].Val, keys[0].Version, keys[0].ID
+// 模型列表,取配置的默认模型
+func Models() []*types.Model {
+	keys := config.V().Gemini.ApiKeys
+	if len(keys) == 0 {
+		return nil
 	}
-
-	rand.Seed(time.Now().UnixNano())
-	i := rand.Intn(l)
-	v := keys[i]
-	return v.Val, v.Version, v.ID
+	model := config.V().Gemini.Model
+	if model == "" {
+		model = DefaultModel
+	}
+	keyIds := make([]string, 0, len(keys))
+	for k := range keys {
+		keyIds = append(keyIds, keys[k].ID)
+	}
+	return []*types.Model{&types.Model{
+		ID:       model,
+		Object:   "model",
+		Created:  time.Now().Unix(),
+		OwnedBy:  "google",
+		Provider: Provider,
+		Type:     "api",
+		KeyIds:   keyIds,
+	}}
 }
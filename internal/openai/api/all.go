@@ -1,16 +1,32 @@
 package api
 
 import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+
 	http "github.com/bogdanfinn/fhttp"
+	"github.com/zatxm/any-proxy/internal/access"
 	"github.com/zatxm/any-proxy/internal/bing"
+	"github.com/zatxm/any-proxy/internal/chat"
 	"github.com/zatxm/any-proxy/internal/claude"
+	"github.com/zatxm/any-proxy/internal/config"
 	coze "github.com/zatxm/any-proxy/internal/coze/api"
 	"github.com/zatxm/any-proxy/internal/gemini"
 	"github.com/zatxm/any-proxy/internal/types"
 	"github.com/zatxm/fhblade"
+	"go.uber.org/zap"
+)
+
+const (
+	// 请求由其他格式转换而来
+	convertKey = "chat_convert"
 )
 
-// v1/chat/completions通用接口，目前只支持stream=true
+// v1/chat/completions通用接口
+// stream=true流式返回,否则汇总上游数据后一次返回
+// 返回usage,上游没有的按文本估算
+// 没传provider时按配置的routes根据model选择
 func DoChatCompletions() func(*fhblade.Context) error {
 	return func(c *fhblade.Context) error {
 		var p types.ChatCompletionRequest
@@ -23,20 +39,275 @@ func DoChatCompletions() func(*fhblade.Context) error {
 				},
 			})
 		}
-		switch p.Provider {
-		case Provider:
-			return DoChatCompletionsByWeb(c, p)
-		case gemini.Provider:
-			return gemini.DoChatCompletions(c, p)
-		case bing.Provider:
-			return bing.DoChatCompletions(c, p)
-		case coze.Provider:
-			return coze.DoChatCompletions(c, p)
-		case claude.Provider:
-			return claude.DoChatCompletions(c, p)
-		default:
-			return DoHttp(c, "/v1/chat/completions")
-		}
-		return nil
+		// 上下文会复用,清掉其他接口设置的转换标记
+		c.SetKey(convertKey, false)
+		w := chat.NewUsageWriter(c, p, chat.NewWriter(c, p.Stream))
+		return doChat(c, p, w)
+	}
+}
+
+func doChat(c *fhblade.Context, p types.ChatCompletionRequest, w chat.Writer) error {
+	if p.Provider == "" {
+		if r := config.MatchRoute(p.Model); r != nil {
+			return doRoute(c, p, r, w)
+		}
+	}
+	return doProvider(c, p, w)
+}
+
+// 其他格式的接口转成chat请求处理,官方api不能直接转发请求体
+func doConvert(c *fhblade.Context, p types.ChatCompletionRequest, w chat.Writer) error {
+	c.SetKey(convertKey, true)
+	return doChat(c, p, w)
+}
+
+// n>1时并发请求上游合并成多个choice,官方api原生支持n直接转发
+func doProvider(c *fhblade.Context, p types.ChatCompletionRequest, w chat.Writer) error {
+	if p.N <= 1 || !isChatProvider(p.Provider) {
+		return doChoice(c, p, w)
+	}
+	max, concurrency := config.ChatN()
+	if p.N > max {
+		return w.Error(http.StatusBadRequest, &types.CError{
+			Message: fmt.Sprintf("n must be less than or equal to %d", max),
+			Type:    "invalid_request_error",
+			Param:   "n",
+			Code:    "invalid_parameter",
+		})
+	}
+	n := p.N
+	p.N = 1
+	return chat.FanOut(c.Request().Context(), n, concurrency, w, func(i int, w chat.Writer) error {
+		return doChoice(c, forkRequest(p), w)
+	})
+}
+
+// 复制各provider的参数,并发请求时互不影响
+func forkRequest(p types.ChatCompletionRequest) types.ChatCompletionRequest {
+	if p.OpenAi != nil {
+		op := *p.OpenAi
+		if op.Conversation != nil {
+			conversation := *op.Conversation
+			op.Conversation = &conversation
+		}
+		p.OpenAi = &op
+	}
+	if p.Bing != nil {
+		bp := *p.Bing
+		if bp.Conversation != nil {
+			conversation := *bp.Conversation
+			bp.Conversation = &conversation
+		}
+		p.Bing = &bp
+	}
+	if p.Coze != nil {
+		cp := *p.Coze
+		if cp.Conversation != nil {
+			conversation := *cp.Conversation
+			cp.Conversation = &conversation
+		}
+		p.Coze = &cp
+	}
+	if p.Claude != nil {
+		cp := *p.Claude
+		p.Claude = &cp
+	}
+	if p.Gemini != nil {
+		gp := *p.Gemini
+		p.Gemini = &gp
+	}
+	return p
+}
+
+func doChoice(c *fhblade.Context, p types.ChatCompletionRequest, w chat.Writer) error {
+	if chat.IsJSONFormat(p.ResponseFormat) && !nativeJSON(p) {
+		return chat.EnforceJSON(p, w, func(p types.ChatCompletionRequest, w chat.Writer) error {
+			return callProvider(c, p, w)
+		})
+	}
+	return callProvider(c, p, w)
+}
+
+func callProvider(c *fhblade.Context, p types.ChatCompletionRequest, w chat.Writer) error {
+	if len(p.Tools) > 0 && toolEmulation(p.Provider) {
+		p, w = chat.EmulateTools(p, w)
+	}
+	switch p.Provider {
+	case Provider:
+		return DoChatCompletionsByWeb(c, p, w)
+	case gemini.Provider:
+		return gemini.DoChatCompletions(c, p, w)
+	case bing.Provider:
+		return bing.DoChatCompletions(c, p, w)
+	case coze.Provider:
+		return coze.DoChatCompletions(c, p, w)
+	case claude.Provider:
+		return claude.DoChatCompletions(c, p, w)
+	default:
+		if c.GetKeyBool(convertKey) {
+			return doPlatformChat(c, p, w)
+		}
+		return DoHttp(c, "/v1/chat/completions")
+	}
+}
+
+// 上游原生支持json输出,gemini用responseMimeType,claude api预填,官方api直接转发
+func nativeJSON(p types.ChatCompletionRequest) bool {
+	switch p.Provider {
+	case gemini.Provider:
+		return true
+	case claude.Provider:
+		return claude.IsApi(p)
+	case Provider, bing.Provider, coze.Provider:
+		return false
+	}
+	return true
+}
+
+// 不支持函数调用的上游是否开启提示词模拟
+func toolEmulation(provider string) bool {
+	switch provider {
+	case Provider:
+		return config.V().Openai.ToolEmulation
+	case bing.Provider:
+		return config.V().Bing.ToolEmulation
+	case coze.Provider:
+		return config.V().Coze.ToolEmulation
+	}
+	return false
+}
+
+// 依次请求路由及fallbacks,还没输出数据前失败的换下一个
+// 响应头x-provider返回实际处理的上游
+func doRoute(c *fhblade.Context, p types.ChatCompletionRequest, r *config.Route, w chat.Writer) error {
+	targets := fallbackTargets(c, p.Model, r)
+	header := c.Request().Req().Header
+	authId := header.Get("x-auth-id")
+	botId := header.Get("x-bot-id")
+	apply := func(t *config.RouteTarget) types.ChatCompletionRequest {
+		// 还原请求头,每个上游的密钥标识不同
+		setHeader(header, "x-auth-id", authId)
+		setHeader(header, "x-bot-id", botId)
+		c.Response().SetHeader("x-provider", routeName(t))
+		return applyRoute(c, p, t)
+	}
+	last := len(targets) - 1
+	for k := range targets[:last] {
+		t := &targets[k]
+		rp := apply(t)
+		// 官方api直接转发响应,不能再换上游
+		if !isChatProvider(t.Provider) {
+			return doProvider(c, rp, w)
+		}
+		fw := chat.NewFallbackWriter(w)
+		if err := doProvider(c, rp, fw); err != nil {
+			return err
+		}
+		code, e := fw.Failed()
+		if e == nil {
+			return nil
+		}
+		fhblade.Log.Debug("chat completions fallback",
+			zap.String("model", r.Model),
+			zap.String("provider", routeName(t)),
+			zap.Int("code", code),
+			zap.String("msg", e.Message))
+	}
+	return doProvider(c, apply(&targets[last]), w)
+}
+
+// 路由的上游及fallback,客户端密钥不能使用的provider、模型不作为fallback
+// fallback设置了upstream_model的按实际请求的模型检查,没设置的按请求模型
+func fallbackTargets(c *fhblade.Context, model string, r *config.Route) []config.RouteTarget {
+	targets := []config.RouteTarget{r.RouteTarget}
+	for _, t := range r.Fallbacks {
+		m := model
+		if t.UpstreamModel != "" {
+			m = t.UpstreamModel
+		}
+		if access.Allowed(c, t.Provider, m) {
+			targets = append(targets, t)
+		}
+	}
+	return targets
+}
+
+func isChatProvider(provider string) bool {
+	switch provider {
+	case Provider, gemini.Provider, bing.Provider, coze.Provider, claude.Provider:
+		return true
+	}
+	return false
+}
+
+func routeName(t *config.RouteTarget) string {
+	if t.Type != "" {
+		return t.Provider + "/" + t.Type
+	}
+	return t.Provider
+}
+
+func setHeader(header http.Header, key, val string) {
+	if val == "" {
+		header.Del(key)
+		return
+	}
+	header.Set(key, val)
+}
+
+// 设置provider、上游模型和默认密钥,返回新的请求参数
+func applyRoute(c *fhblade.Context, p types.ChatCompletionRequest, r *config.RouteTarget) types.ChatCompletionRequest {
+	p.Provider = r.Provider
+	if r.UpstreamModel != "" {
+		p.Model = r.UpstreamModel
+	}
+	header := c.Request().Req().Header
+	switch r.Provider {
+	case claude.Provider:
+		cp := types.ClaudeCompletionRequest{}
+		if p.Claude != nil {
+			cp = *p.Claude
+		}
+		if r.Type != "" {
+			cp.Type = r.Type
+		} else if cp.Type == "" {
+			cp.Type = claude.ClaudeTypeApi
+		}
+		p.Claude = &cp
+	case coze.Provider:
+		if r.Type == "api" {
+			p.Model = coze.ApiChatModel
+		}
+		// coze的x-auth-id是user,密钥标识对应bot_id
+		if r.KeyId != "" && header.Get("x-bot-id") == "" {
+			header.Set("x-bot-id", r.KeyId)
+		}
+		return p
+	case Provider, gemini.Provider, bing.Provider:
+	default:
+		// 官方api直接转发body,需替换模型
+		if r.UpstreamModel != "" {
+			resetBodyModel(c, r.UpstreamModel)
+		}
+	}
+	if r.KeyId != "" && header.Get("x-auth-id") == "" {
+		header.Set("x-auth-id", r.KeyId)
+	}
+	return p
+}
+
+func resetBodyModel(c *fhblade.Context, model string) {
+	var body map[string]interface{}
+	if err := fhblade.Json.Unmarshal(c.GetKeyByte(fhblade.BodyBytesKey), &body); err != nil {
+		return
+	}
+	body["model"] = model
+	b, err := fhblade.Json.Marshal(body)
+	if err != nil {
+		return
 	}
+	c.SetKey(fhblade.BodyBytesKey, b)
+	req := c.Request().Req()
+	req.Body = ioutil.NopCloser(bytes.NewReader(b))
+	req.ContentLength = int64(len(b))
 }
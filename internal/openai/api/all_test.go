@@ -0,0 +1,61 @@
+package api
+
+import (
+	"bytes"
+	"testing"
+
+	http "github.com/bogdanfinn/fhttp"
+	"github.com/bogdanfinn/fhttp/httptest"
+	"github.com/zatxm/any-proxy/internal/access"
+	"github.com/zatxm/any-proxy/internal/config"
+	"github.com/zatxm/fhblade"
+)
+
+// 客户端密钥不能使用的provider、模型不作为fallback
+func TestFallbackTargets(t *testing.T) {
+	cfg, err := config.Parse("../../../etc/c.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.ClientKeys = []config.ClientKey{
+		{Key: "sk-route", Enabled: true, Providers: []string{"claude", "gemini"}, Models: []string{"smart", "gemini-*"}},
+	}
+	t.Cleanup(func() { cfg.ClientKeys = nil })
+
+	r := &config.Route{
+		Model:       "smart",
+		RouteTarget: config.RouteTarget{Provider: "claude", UpstreamModel: "claude-3-opus"},
+		Fallbacks: []config.RouteTarget{
+			{Provider: "gemini", UpstreamModel: "gemini-1.5-pro"},
+			{Provider: "openai", UpstreamModel: "gpt-4o"},
+			{Provider: "claude", UpstreamModel: "claude-3-haiku"},
+			{Provider: "claude", Type: "web"},
+		},
+	}
+	var got []string
+	app := fhblade.New()
+	app.Use(access.Middleware())
+	app.Post("/c/v1/chat/completions", func(c *fhblade.Context) error {
+		for _, t := range fallbackTargets(c, "smart", r) {
+			got = append(got, routeName(&t)+":"+t.UpstreamModel)
+		}
+		return c.JSONAndStatus(http.StatusOK, fhblade.H{})
+	})
+	req := httptest.NewRequest(http.MethodPost, "/c/v1/chat/completions", bytes.NewBufferString(`{"provider":"claude","model":"smart"}`))
+	req.Header.Set("Authorization", "Bearer sk-route")
+	rec := httptest.NewRecorder()
+	app.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("code = %d, body %s", rec.Code, rec.Body.String())
+	}
+	want := []string{"claude:claude-3-opus", "gemini:gemini-1.5-pro", "claude/web:"}
+	if len(got) != len(want) {
+		t.Fatalf("targets = %v, want %v", got, want)
+	}
+	for k := range want {
+		if got[k] != want[k] {
+			t.Errorf("targets = %v, want %v", got, want)
+			break
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+
+	http "github.com/bogdanfinn/fhttp"
+	"github.com/zatxm/any-proxy/internal/chat"
+	"github.com/zatxm/any-proxy/internal/config"
+	"github.com/zatxm/any-proxy/internal/types"
+	"github.com/zatxm/fhblade"
+)
+
+const (
+	completionPrompt       = "You are a text completion engine. Continue the text given by the user. Output only the continuation, without repeating the given text or adding any explanation."
+	completionInsertPrompt = "You are a text completion engine. The user gives a prefix and a suffix. Output only the text that goes between them, without repeating either of them or adding any explanation."
+)
+
+var (
+	ErrCompletionPrompt = errors.New("prompt must be a string or an array of strings")
+	ErrCompletionStop   = errors.New("stop must be a string or an array of strings")
+)
+
+// v1/completions通用接口,旧版文本补全格式
+// prompt包装成chat请求,按provider或路由转到各上游,都没有的走openai官方api
+// 多个prompt依次请求,choice的index为prompt序号*n+第几个
+func DoCompletions() func(*fhblade.Context) error {
+	return func(c *fhblade.Context) error {
+		var rq types.CompletionRequest
+		if err := c.ShouldBindJSON(&rq); err != nil {
+			return c.JSONAndStatus(http.StatusBadRequest, types.ErrorResponse{
+				Error: &types.CError{
+					Message: "params error",
+					Type:    "invalid_request_error",
+					Code:    "invalid_parameter",
+				},
+			})
+		}
+		prompts, ok := stringList(rq.Prompt)
+		if !ok || len(prompts) == 0 {
+			return c.JSONAndStatus(http.StatusBadRequest, types.ErrorResponse{
+				Error: &types.CError{
+					Message: ErrCompletionPrompt.Error(),
+					Type:    "invalid_request_error",
+					Param:   "prompt",
+					Code:    "invalid_parameter",
+				},
+			})
+		}
+		stop, ok := stringList(rq.Stop)
+		if !ok {
+			return c.JSONAndStatus(http.StatusBadRequest, types.ErrorResponse{
+				Error: &types.CError{
+					Message: ErrCompletionStop.Error(),
+					Type:    "invalid_request_error",
+					Param:   "stop",
+					Code:    "invalid_parameter",
+				},
+			})
+		}
+		n := rq.N
+		if n < 1 {
+			n = 1
+		}
+		var echo []string
+		if rq.Echo {
+			for _, prompt := range prompts {
+				for i := 0; i < n; i++ {
+					echo = append(echo, prompt)
+				}
+			}
+		}
+		if len(prompts) == 1 {
+			p := completionToChat(rq, prompts[0], stop)
+			w := chat.NewUsageWriter(c, p, chat.NewCompletionsWriter(c, rq.Stream, echo, stop))
+			return doConvert(c, p, w)
+		}
+		total := len(prompts) * n
+		if max, _ := config.ChatN(); total > max {
+			return c.JSONAndStatus(http.StatusBadRequest, types.ErrorResponse{
+				Error: &types.CError{
+					Message: fmt.Sprintf("number of prompts * n must be less than or equal to %d", max),
+					Type:    "invalid_request_error",
+					Param:   "prompt",
+					Code:    "invalid_parameter",
+				},
+			})
+		}
+		p := completionToChat(rq, prompts[0], stop)
+		w := chat.NewUsageWriter(c, p, chat.NewCompletionsWriter(c, rq.Stream, echo, stop))
+		// 路由会修改请求头,依次请求
+		return chat.FanOut(c.Request().Context(), total, 1, w, func(i int, w chat.Writer) error {
+			cp := completionToChat(rq, prompts[i/n], stop)
+			cp.N = 1
+			return doConvert(c, cp, w)
+		})
+	}
+}
+
+// 提示词作为user消息,有suffix时让模型补全中间部分
+func completionToChat(rq types.CompletionRequest, prompt string, stop []string) types.ChatCompletionRequest {
+	p := types.ChatCompletionRequest{
+		Model:         rq.Model,
+		MaxTokens:     rq.MaxTokens,
+		N:             rq.N,
+		Stop:          stop,
+		Stream:        rq.Stream,
+		StreamOptions: rq.StreamOptions,
+		Temperature:   rq.Temperature,
+		TopP:          rq.TopP,
+		User:          rq.User,
+		Provider:      rq.Provider,
+	}
+	if rq.Suffix == "" {
+		p.Messages = []*types.ChatCompletionMessage{
+			&types.ChatCompletionMessage{Role: "system", Content: completionPrompt},
+			&types.ChatCompletionMessage{Role: "user", Content: prompt},
+		}
+		return p
+	}
+	p.Messages = []*types.ChatCompletionMessage{
+		&types.ChatCompletionMessage{Role: "system", Content: completionInsertPrompt},
+		&types.ChatCompletionMessage{
+			Role:    "user",
+			Content: "<prefix>\n" + prompt + "\n</prefix>\n<suffix>\n" + rq.Suffix + "\n</suffix>",
+		},
+	}
+	return p
+}
+
+// 字符串或字符串数组
+func stringList(v any) ([]string, bool) {
+	switch val := v.(type) {
+	case nil:
+		return nil, true
+	case string:
+		return []string{val}, true
+	case []any:
+		out := make([]string, 0, len(val))
+		for _, item := range val {
+			s, ok := item.(string)
+			if !ok {
+				return nil, false
+			}
+			out = append(out, s)
+		}
+		return out, true
+	}
+	return nil, false
+}
@@ -0,0 +1,53 @@
+package api
+
+import (
+	http "github.com/bogdanfinn/fhttp"
+	"github.com/zatxm/any-proxy/internal/config"
+	"github.com/zatxm/any-proxy/internal/gemini"
+	"github.com/zatxm/any-proxy/internal/types"
+	"github.com/zatxm/fhblade"
+)
+
+// v1/embeddings通用接口
+// provider为gemini或路由到gemini的走embedContent,其余走openai官方api
+func DoEmbeddings() func(*fhblade.Context) error {
+	return func(c *fhblade.Context) error {
+		var p types.EmbeddingRequest
+		if err := c.ShouldBindJSON(&p); err != nil || p.Input == nil {
+			return c.JSONAndStatus(http.StatusBadRequest, types.ErrorResponse{
+				Error: &types.CError{
+					Message: "params error",
+					Type:    "invalid_request_error",
+					Code:    "invalid_parameter",
+				},
+			})
+		}
+		if p.Provider == "" {
+			if r := config.MatchRoute(p.Model); r != nil {
+				p.Provider = r.Provider
+				if r.UpstreamModel != "" {
+					p.Model = r.UpstreamModel
+				}
+				header := c.Request().Req().Header
+				if r.KeyId != "" && header.Get("x-auth-id") == "" {
+					header.Set("x-auth-id", r.KeyId)
+				}
+				c.Response().SetHeader("x-provider", routeName(&r.RouteTarget))
+			}
+		}
+		switch p.Provider {
+		case gemini.Provider:
+			return gemini.DoEmbeddings(c, p)
+		case "", "openai":
+			return doPlatformEmbeddings(c, p)
+		}
+		return c.JSONAndStatus(http.StatusBadRequest, types.ErrorResponse{
+			Error: &types.CError{
+				Message: "provider " + p.Provider + " does not support embeddings",
+				Type:    "invalid_request_error",
+				Param:   "provider",
+				Code:    "invalid_parameter",
+			},
+		})
+	}
+}
@@ -0,0 +1,182 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	http "github.com/bogdanfinn/fhttp"
+	"github.com/google/uuid"
+	"github.com/zatxm/any-proxy/internal/chat"
+	"github.com/zatxm/any-proxy/internal/client"
+	"github.com/zatxm/any-proxy/internal/config"
+	"github.com/zatxm/any-proxy/internal/openai/cst"
+	"github.com/zatxm/any-proxy/internal/types"
+	"github.com/zatxm/any-proxy/internal/vars"
+	"github.com/zatxm/fhblade"
+	"github.com/zatxm/fhblade/tools"
+	tlsClient "github.com/zatxm/tls-client"
+	"go.uber.org/zap"
+)
+
+var (
+	ErrWebImageAnon = errors.New("image input requires a chatgpt web session")
+)
+
+// 消息是否带图片
+func hasImage(m *types.ChatCompletionMessage) bool {
+	if m == nil {
+		return false
+	}
+	for _, part := range m.MultiContent {
+		if part.Type == "image_url" && part.ImageURL != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// 上传消息中的图片,返回multimodal_text内容及附件
+// 图片在前文本在后,与网页端一致
+func webMultimodalContent(ctx context.Context, auth string, m *types.ChatCompletionMessage, prompt string) (*types.OpenAiContent, *types.OpenAiMessageMetadata, error) {
+	if auth == "" {
+		return nil, nil, ErrWebImageAnon
+	}
+	content := &types.OpenAiContent{ContentType: "multimodal_text"}
+	metadata := &types.OpenAiMessageMetadata{}
+	for _, part := range m.MultiContent {
+		if part.Type != "image_url" || part.ImageURL == nil {
+			continue
+		}
+		img, err := chat.LoadImage(ctx, part.ImageURL.URL, "")
+		if err != nil {
+			return nil, nil, err
+		}
+		attachment, err := uploadWebFile(auth, img)
+		if err != nil {
+			return nil, nil, err
+		}
+		content.Parts = append(content.Parts, &types.OpenAiImageAssetPointer{
+			ContentType:  "image_asset_pointer",
+			AssetPointer: "file-service://" + attachment.ID,
+			SizeBytes:    attachment.Size,
+			Width:        attachment.Width,
+			Height:       attachment.Height,
+		})
+		metadata.Attachments = append(metadata.Attachments, attachment)
+	}
+	if prompt != "" {
+		content.Parts = append(content.Parts, prompt)
+	}
+	return content, metadata, nil
+}
+
+// chatgpt web上传文件,创建文件、上传到blob、确认上传
+func uploadWebFile(auth string, img *chat.Image) (*types.OpenAiAttachment, error) {
+	webChatUrl := config.OpenaiChatWebUrl()
+	if webChatUrl == "" {
+		webChatUrl = cst.ChatOriginUrl
+	}
+	if !strings.HasPrefix(auth, "Bearer ") {
+		auth = "Bearer " + auth
+	}
+	width, height := img.Dimensions()
+	attachment := &types.OpenAiAttachment{
+		Name:     img.FileName(strings.ReplaceAll(uuid.NewString(), "-", "")),
+		MimeType: img.MimeType,
+		Size:     len(img.Data),
+		Width:    width,
+		Height:   height,
+	}
+
+	// 创建文件
+	createRes := &types.OpenAiCreateFileResponse{}
+	reqJson, _ := fhblade.Json.Marshal(&types.OpenAiCreateFileRequest{
+		FileName: attachment.Name,
+		FileSize: attachment.Size,
+		UseCase:  "multimodal",
+	})
+	if err := doWebFileReq(http.MethodPost, webChatUrl+"/backend-api/files", auth, reqJson, createRes); err != nil {
+		return nil, err
+	}
+	if createRes.Status != "success" || createRes.UploadUrl == "" {
+		return nil, fmt.Errorf("create file failed: %s %s", createRes.Status, createRes.ErrorCode)
+	}
+	attachment.ID = createRes.FileId
+
+	// 上传到blob
+	req, err := http.NewRequest(http.MethodPut, createRes.UploadUrl, bytes.NewReader(img.Data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header = http.Header{
+		"content-type":   {img.MimeType},
+		"origin":         {cst.ChatOriginUrl},
+		"user-agent":     {vars.UserAgent},
+		"x-ms-blob-type": {"BlockBlob"},
+		"x-ms-version":   {"2020-04-08"},
+	}
+	gClient := client.CPool.Get().(tlsClient.HttpClient)
+	resp, err := gClient.Do(req)
+	client.CPool.Put(gClient)
+	if err != nil {
+		fhblade.Log.Error("openai web file upload req err", zap.Error(err))
+		return nil, err
+	}
+	body, _ := tools.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		fhblade.Log.Error("openai web file upload res status err",
+			zap.Int("code", resp.StatusCode),
+			zap.ByteString("data", body))
+		return nil, fmt.Errorf("upload file failed with status %d", resp.StatusCode)
+	}
+
+	// 确认上传
+	uploadedRes := &types.OpenAiFileUploadedResponse{}
+	goUrl := webChatUrl + "/backend-api/files/" + attachment.ID + "/uploaded"
+	if err := doWebFileReq(http.MethodPost, goUrl, auth, []byte("{}"), uploadedRes); err != nil {
+		return nil, err
+	}
+	if uploadedRes.Status != "success" {
+		return nil, fmt.Errorf("confirm file upload failed: %s", uploadedRes.Status)
+	}
+	return attachment, nil
+}
+
+func doWebFileReq(method, goUrl, auth string, reqJson []byte, v any) error {
+	req, err := http.NewRequest(method, goUrl, bytes.NewReader(reqJson))
+	if err != nil {
+		return err
+	}
+	req.Header = http.Header{
+		"accept":          {vars.AcceptAll},
+		"accept-encoding": {vars.AcceptEncoding},
+		"authorization":   {auth},
+		"content-type":    {vars.ContentTypeJSON},
+		"oai-device-id":   {cst.OaiDeviceId},
+		"oai-language":    {cst.OaiLanguage},
+		"origin":          {cst.ChatOriginUrl},
+		"referer":         {cst.ChatRefererUrl},
+		"user-agent":      {vars.UserAgent},
+	}
+	gClient := client.CcPool.Get().(tlsClient.HttpClient)
+	resp, err := gClient.Do(req)
+	client.CcPool.Put(gClient)
+	if err != nil {
+		fhblade.Log.Error("openai web file req err", zap.Error(err), zap.String("url", goUrl))
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := tools.ReadAll(resp.Body)
+		fhblade.Log.Error("openai web file res status err",
+			zap.String("url", goUrl),
+			zap.Int("code", resp.StatusCode),
+			zap.ByteString("data", body))
+		return fmt.Errorf("%s status %d", goUrl, resp.StatusCode)
+	}
+	return fhblade.Json.NewDecoder(resp.Body).Decode(v)
+}
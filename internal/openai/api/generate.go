@@ -0,0 +1,255 @@
+package api
+
+import (
+	"strconv"
+	"strings"
+
+	http "github.com/bogdanfinn/fhttp"
+	"github.com/zatxm/any-proxy/internal/chat"
+	"github.com/zatxm/any-proxy/internal/config"
+	"github.com/zatxm/any-proxy/internal/gemini"
+	"github.com/zatxm/any-proxy/internal/types"
+	"github.com/zatxm/fhblade"
+)
+
+// gemini原生接口
+// models/{model}:generateContent、:streamGenerateContent的模型路由到其他上游时转换请求和响应
+// 其余的直接转发google
+func DoGemini() func(*fhblade.Context) error {
+	proxy := gemini.Do()
+	return func(c *fhblade.Context) error {
+		model, stream, ok := parseGeminiAction(c.Get("path"))
+		if !ok || c.Request().Method() != http.MethodPost {
+			return proxy(c)
+		}
+		r := config.MatchRoute(model)
+		if r == nil || r.Provider == gemini.Provider {
+			return proxy(c)
+		}
+		var rq types.StreamGenerateContent
+		if err := c.ShouldBindJSON(&rq); err != nil {
+			return c.JSONAndStatus(http.StatusBadRequest, types.GeminiErrorResponse{
+				Error: &types.GeminiError{
+					Code:    http.StatusBadRequest,
+					Message: "params error",
+					Status:  chat.GeminiErrorStatus(http.StatusBadRequest),
+				},
+			})
+		}
+		p := geminiToChat(rq, model, stream)
+		array := stream && c.Request().Req().URL.Query().Get("alt") != "sse"
+		w := chat.NewUsageWriter(c, p, chat.NewGeminiWriter(c, stream, array, model))
+		return doConvert(c, p, w)
+	}
+}
+
+// 解析{version}/models/{model}:{action}
+func parseGeminiAction(path string) (string, bool, bool) {
+	version, rest, ok := strings.Cut(path, "/models/")
+	if !ok || version == "" || strings.Contains(version, "/") {
+		return "", false, false
+	}
+	model, action, ok := strings.Cut(rest, ":")
+	if !ok || model == "" {
+		return "", false, false
+	}
+	switch action {
+	case "generateContent":
+		return model, false, true
+	case "streamGenerateContent":
+		return model, true, true
+	}
+	return "", false, false
+}
+
+// gemini请求转openai
+func geminiToChat(rq types.StreamGenerateContent, model string, stream bool) types.ChatCompletionRequest {
+	p := types.ChatCompletionRequest{
+		Model:         model,
+		Stream:        stream,
+		StreamOptions: &types.StreamOptions{IncludeUsage: true},
+	}
+	if rq.SystemInstruction != nil {
+		if system := geminiText(rq.SystemInstruction.Parts); system != "" {
+			p.Messages = append(p.Messages, &types.ChatCompletionMessage{Role: "system", Content: system})
+		}
+	}
+	// functionResponse只有函数名,按顺序对应之前functionCall生成的id
+	callIds := make(map[string][]string)
+	callIndex := 0
+	for _, content := range rq.Contents {
+		if content.Role == "model" {
+			msg := &types.ChatCompletionMessage{Role: "assistant", Content: geminiText(content.Parts)}
+			for _, part := range content.Parts {
+				if part.FunctionCall == nil {
+					continue
+				}
+				id := "call_" + strconv.Itoa(callIndex)
+				callIndex++
+				callIds[part.FunctionCall.Name] = append(callIds[part.FunctionCall.Name], id)
+				args, _ := fhblade.Json.MarshalToString(part.FunctionCall.Args)
+				if part.FunctionCall.Args == nil {
+					args = "{}"
+				}
+				msg.ToolCalls = append(msg.ToolCalls, &types.ToolCall{
+					ID:   id,
+					Type: "function",
+					Function: types.FunctionCall{
+						Name:      part.FunctionCall.Name,
+						Arguments: args,
+					},
+				})
+			}
+			if msg.Content != "" || len(msg.ToolCalls) > 0 {
+				p.Messages = append(p.Messages, msg)
+			}
+			continue
+		}
+		p.Messages = append(p.Messages, geminiUserToChat(content, callIds)...)
+	}
+	if cfg := rq.GenerationConfig; cfg != nil {
+		p.MaxTokens = cfg.MaxOutputTokens
+		p.Temperature = cfg.Temperature
+		p.TopP = cfg.TopP
+		p.Stop = cfg.StopSequences
+		if cfg.CandidateCount > 1 {
+			p.N = cfg.CandidateCount
+		}
+		if cfg.ResponseMimeType == "application/json" {
+			p.ResponseFormat = &types.ChatCompletionResponseFormat{Type: "json_object"}
+			if cfg.ResponseSchema != nil {
+				p.ResponseFormat = &types.ChatCompletionResponseFormat{
+					Type: "json_schema",
+					JSONSchema: &types.ChatCompletionResponseFormatJSONSchema{
+						Name:   "response",
+						Schema: geminiSchema(cfg.ResponseSchema),
+					},
+				}
+			}
+		}
+	}
+	for _, tool := range rq.Tools {
+		for _, fd := range tool.FunctionDeclarations {
+			params := geminiSchema(fd.Parameters)
+			if params == nil {
+				params = map[string]any{"type": "object", "properties": map[string]any{}}
+			}
+			p.Tools = append(p.Tools, types.Tool{
+				Type: "function",
+				Function: &types.FunctionDefinition{
+					Name:        fd.Name,
+					Description: fd.Description,
+					Parameters:  params,
+				},
+			})
+		}
+	}
+	if len(p.Tools) > 0 && rq.ToolConfig != nil && rq.ToolConfig.FunctionCallingConfig != nil {
+		fc := rq.ToolConfig.FunctionCallingConfig
+		switch fc.Mode {
+		case "AUTO":
+			p.ToolChoice = "auto"
+		case "NONE":
+			p.ToolChoice = "none"
+		case "ANY":
+			p.ToolChoice = "required"
+			if len(fc.AllowedFunctionNames) == 1 {
+				p.ToolChoice = map[string]any{
+					"type":     "function",
+					"function": map[string]any{"name": fc.AllowedFunctionNames[0]},
+				}
+			}
+		}
+	}
+	return p
+}
+
+// user、function角色的内容,functionResponse转成tool消息放在前面
+// 图片只支持inlineData及http(s)的fileData
+func geminiUserToChat(content *types.GeminiContent, callIds map[string][]string) []*types.ChatCompletionMessage {
+	var out []*types.ChatCompletionMessage
+	var parts []*types.ChatMessagePart
+	var texts []string
+	withImage := false
+	for _, part := range content.Parts {
+		switch {
+		case part.FunctionResponse != nil:
+			name := part.FunctionResponse.Name
+			var id string
+			if ids := callIds[name]; len(ids) > 0 {
+				id = ids[0]
+				callIds[name] = ids[1:]
+			}
+			res, _ := fhblade.Json.MarshalToString(part.FunctionResponse.Response)
+			out = append(out, &types.ChatCompletionMessage{
+				Role:       "tool",
+				Content:    res,
+				Name:       name,
+				ToolCallID: id,
+			})
+		case part.InlineData != nil:
+			withImage = true
+			parts = append(parts, &types.ChatMessagePart{
+				Type: "image_url",
+				ImageURL: &types.ChatMessageImageURL{
+					URL: "data:" + part.InlineData.MimeType + ";base64," + part.InlineData.Data,
+				},
+			})
+		case part.FileData != nil:
+			if !strings.HasPrefix(part.FileData.FileUri, "http") {
+				continue
+			}
+			withImage = true
+			parts = append(parts, &types.ChatMessagePart{
+				Type:     "image_url",
+				ImageURL: &types.ChatMessageImageURL{URL: part.FileData.FileUri},
+			})
+		case part.Text != "":
+			texts = append(texts, part.Text)
+			parts = append(parts, &types.ChatMessagePart{Type: "text", Text: part.Text})
+		}
+	}
+	msg := &types.ChatCompletionMessage{Role: "user"}
+	if withImage {
+		msg.MultiContent = parts
+	} else {
+		msg.Content = strings.Join(texts, "\n")
+	}
+	if msg.Content != "" || msg.MultiContent != nil {
+		out = append(out, msg)
+	}
+	return out
+}
+
+func geminiText(parts []*types.GeminiPart) string {
+	var texts []string
+	for _, part := range parts {
+		if part.Text != "" {
+			texts = append(texts, part.Text)
+		}
+	}
+	return strings.Join(texts, "\n")
+}
+
+// gemini schema的type为大写的OBJECT、STRING等,转成json schema小写
+func geminiSchema(schema any) any {
+	switch v := schema.(type) {
+	case map[string]any:
+		out := make(map[string]any, len(v))
+		for k, val := range v {
+			if t, ok := val.(string); ok && k == "type" {
+				out[k] = strings.ToLower(t)
+				continue
+			}
+			out[k] = geminiSchema(val)
+		}
+		return out
+	case []any:
+		out := make([]any, len(v))
+		for k := range v {
+			out[k] = geminiSchema(v[k])
+		}
+		return out
+	}
+	return schema
+}
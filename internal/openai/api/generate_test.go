@@ -0,0 +1,136 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/zatxm/any-proxy/internal/types"
+	"github.com/zatxm/fhblade"
+)
+
+func parseGeminiRequest(t *testing.T, body string) types.StreamGenerateContent {
+	t.Helper()
+	var rq types.StreamGenerateContent
+	if err := fhblade.Json.UnmarshalFromString(body, &rq); err != nil {
+		t.Fatal(err)
+	}
+	return rq
+}
+
+// functionResponse按函数名和顺序对应之前functionCall的id
+func TestGeminiToChatFunctionCallIds(t *testing.T) {
+	rq := parseGeminiRequest(t, `{
+		"systemInstruction": {"parts": [{"text": "be brief"}]},
+		"contents": [
+			{"role": "user", "parts": [{"text": "weather in Paris and Rome, time in Paris"}]},
+			{"role": "model", "parts": [
+				{"text": "checking"},
+				{"functionCall": {"name": "get_weather", "args": {"city": "Paris"}}},
+				{"functionCall": {"name": "get_time"}},
+				{"functionCall": {"name": "get_weather", "args": {"city": "Rome"}}}
+			]},
+			{"role": "function", "parts": [
+				{"functionResponse": {"name": "get_weather", "response": {"temp": 20}}},
+				{"functionResponse": {"name": "get_weather", "response": {"temp": 25}}},
+				{"functionResponse": {"name": "get_time", "response": {"time": "12:00"}}}
+			]},
+			{"role": "model", "parts": [{"functionCall": {"name": "get_weather", "args": {"city": "Oslo"}}}]},
+			{"role": "user", "parts": [
+				{"functionResponse": {"name": "get_weather", "response": {"temp": 5}}},
+				{"text": "thanks"}
+			]}
+		]
+	}`)
+	p := geminiToChat(rq, "gpt-test", true)
+	if p.Model != "gpt-test" || !p.Stream || p.StreamOptions == nil || !p.StreamOptions.IncludeUsage {
+		t.Errorf("model %s, stream %v, options %+v", p.Model, p.Stream, p.StreamOptions)
+	}
+	want := []struct {
+		role, content, toolCallId string
+		toolCalls                 []string
+	}{
+		{"system", "be brief", "", nil},
+		{"user", "weather in Paris and Rome, time in Paris", "", nil},
+		{"assistant", "checking", "", []string{"call_0", "call_1", "call_2"}},
+		{"tool", `{"temp":20}`, "call_0", nil},
+		{"tool", `{"temp":25}`, "call_2", nil},
+		{"tool", `{"time":"12:00"}`, "call_1", nil},
+		{"assistant", "", "", []string{"call_3"}},
+		{"tool", `{"temp":5}`, "call_3", nil},
+		{"user", "thanks", "", nil},
+	}
+	if len(p.Messages) != len(want) {
+		t.Fatalf("got %d messages, want %d", len(p.Messages), len(want))
+	}
+	for k, w := range want {
+		m := p.Messages[k]
+		if m.Role != w.role || m.Content != w.content || m.ToolCallID != w.toolCallId {
+			t.Errorf("message %d = %s %q %s, want %s %q %s", k, m.Role, m.Content, m.ToolCallID, w.role, w.content, w.toolCallId)
+		}
+		if len(m.ToolCalls) != len(w.toolCalls) {
+			t.Errorf("message %d has %d tool calls, want %d", k, len(m.ToolCalls), len(w.toolCalls))
+			continue
+		}
+		for i, id := range w.toolCalls {
+			if m.ToolCalls[i].ID != id {
+				t.Errorf("message %d tool call %d id = %s, want %s", k, i, m.ToolCalls[i].ID, id)
+			}
+		}
+	}
+	calls := p.Messages[2].ToolCalls
+	if calls[0].Function.Arguments != `{"city":"Paris"}` || calls[1].Function.Arguments != "{}" {
+		t.Errorf("arguments = %s, %s", calls[0].Function.Arguments, calls[1].Function.Arguments)
+	}
+}
+
+func TestGeminiToChatConfig(t *testing.T) {
+	rq := parseGeminiRequest(t, `{
+		"contents": [{"role": "user", "parts": [
+			{"text": "what is this"},
+			{"inlineData": {"mimeType": "image/png", "data": "aGk="}},
+			{"fileData": {"mimeType": "image/png", "fileUri": "gs://bucket/a.png"}}
+		]}],
+		"generationConfig": {
+			"maxOutputTokens": 100,
+			"candidateCount": 2,
+			"stopSequences": ["END"],
+			"responseMimeType": "application/json",
+			"responseSchema": {"type": "OBJECT", "properties": {"name": {"type": "STRING"}}}
+		},
+		"tools": [{"functionDeclarations": [
+			{"name": "get_weather", "parameters": {"type": "OBJECT", "properties": {"city": {"type": "STRING"}}}},
+			{"name": "get_time"}
+		]}],
+		"toolConfig": {"functionCallingConfig": {"mode": "ANY", "allowedFunctionNames": ["get_weather"]}}
+	}`)
+	p := geminiToChat(rq, "gpt-test", false)
+	if len(p.Messages) != 1 {
+		t.Fatalf("got %d messages, want 1", len(p.Messages))
+	}
+	// 非http(s)的fileData忽略
+	parts := p.Messages[0].MultiContent
+	if len(parts) != 2 || parts[0].Text != "what is this" || parts[1].ImageURL == nil || parts[1].ImageURL.URL != "data:image/png;base64,aGk=" {
+		t.Errorf("parts = %+v", parts)
+	}
+	if p.MaxTokens != 100 || p.N != 2 || len(p.Stop) != 1 || p.Stop[0] != "END" {
+		t.Errorf("max_tokens %d, n %d, stop %v", p.MaxTokens, p.N, p.Stop)
+	}
+	if p.ResponseFormat == nil || p.ResponseFormat.Type != "json_schema" {
+		t.Fatalf("response_format = %+v", p.ResponseFormat)
+	}
+	schema, _ := fhblade.Json.MarshalToString(p.ResponseFormat.JSONSchema.Schema)
+	if schema != `{"properties":{"name":{"type":"string"}},"type":"object"}` {
+		t.Errorf("schema = %s", schema)
+	}
+	if len(p.Tools) != 2 {
+		t.Fatalf("got %d tools, want 2", len(p.Tools))
+	}
+	// 没有参数的补空object
+	params, _ := fhblade.Json.MarshalToString(p.Tools[1].Function.Parameters)
+	if params != `{"properties":{},"type":"object"}` {
+		t.Errorf("empty parameters = %s", params)
+	}
+	choice, _ := fhblade.Json.MarshalToString(p.ToolChoice)
+	if choice != `{"function":{"name":"get_weather"},"type":"function"}` {
+		t.Errorf("tool_choice = %s", choice)
+	}
+}
@@ -0,0 +1,341 @@
+package api
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	http "github.com/bogdanfinn/fhttp"
+	"github.com/google/uuid"
+	"github.com/zatxm/any-proxy/internal/bing"
+	"github.com/zatxm/any-proxy/internal/chat"
+	"github.com/zatxm/any-proxy/internal/config"
+	coze "github.com/zatxm/any-proxy/internal/coze/api"
+	"github.com/zatxm/any-proxy/internal/openai/cst"
+	"github.com/zatxm/any-proxy/internal/openai/image"
+	"github.com/zatxm/any-proxy/internal/types"
+	"github.com/zatxm/fhblade"
+	"github.com/zatxm/fhblade/tools"
+	"go.uber.org/zap"
+)
+
+const (
+	// 每次请求最多返回的图片数
+	maxImageN = 10
+	// chatgpt web没有指定上游模型时由网页端自动选择
+	webImageModel  = "auto"
+	webImagePrompt = "Use the image generation tool to create an image from the following description. Do not ask any questions.\n\n"
+)
+
+var (
+	ErrWebImageAuth     = errors.New("image generation requires a chatgpt web session")
+	ErrWebImageResponse = errors.New("chatgpt web image response error")
+	ErrNoImage          = errors.New("no image generated")
+)
+
+// v1/images/generations通用接口
+// 按provider或路由转到chatgpt web、bing image creator、coze discord,等生成结束后返回
+// url格式的图片下载后通过/gptimage访问,没配置image_path的返回上游地址
+func DoImagesGenerations() func(*fhblade.Context) error {
+	return func(c *fhblade.Context) error {
+		var p types.ImagesGenerationRequest
+		if err := c.ShouldBindJSON(&p); err != nil || p.Prompt == "" {
+			return c.JSONAndStatus(http.StatusBadRequest, types.ErrorResponse{
+				Error: &types.CError{
+					Message: "params error",
+					Type:    "invalid_request_error",
+					Code:    "invalid_parameter",
+				},
+			})
+		}
+		if p.N < 1 {
+			p.N = 1
+		}
+		if p.N > maxImageN {
+			return c.JSONAndStatus(http.StatusBadRequest, types.ErrorResponse{
+				Error: &types.CError{
+					Message: fmt.Sprintf("n must be less than or equal to %d", maxImageN),
+					Type:    "invalid_request_error",
+					Param:   "n",
+					Code:    "invalid_parameter",
+				},
+			})
+		}
+		switch p.ResponseFormat {
+		case "":
+			p.ResponseFormat = "url"
+		case "url", "b64_json":
+		default:
+			return c.JSONAndStatus(http.StatusBadRequest, types.ErrorResponse{
+				Error: &types.CError{
+					Message: "response_format must be url or b64_json",
+					Type:    "invalid_request_error",
+					Param:   "response_format",
+					Code:    "invalid_parameter",
+				},
+			})
+		}
+		webModel := webImageModel
+		if p.Provider == "" {
+			if r := config.MatchRoute(p.Model); r != nil {
+				p.Provider = r.Provider
+				if r.UpstreamModel != "" {
+					webModel = r.UpstreamModel
+				}
+				header := c.Request().Req().Header
+				if r.KeyId != "" && header.Get("x-auth-id") == "" {
+					header.Set("x-auth-id", r.KeyId)
+				}
+				c.Response().SetHeader("x-provider", routeName(&r.RouteTarget))
+			}
+		}
+		prompt := p.Prompt
+		if p.Size != "" {
+			prompt += "\n\nImage size: " + p.Size
+		}
+		var generate func() ([]string, error)
+		switch p.Provider {
+		case Provider:
+			generate = func() ([]string, error) {
+				return generateWebImages(c, webImagePrompt+prompt, webModel)
+			}
+		case bing.Provider:
+			generate = func() ([]string, error) {
+				return bing.GenerateImages(c, prompt)
+			}
+		case coze.Provider:
+			generate = func() ([]string, error) {
+				return coze.GenerateImages(c, prompt)
+			}
+		default:
+			return c.JSONAndStatus(http.StatusBadRequest, types.ErrorResponse{
+				Error: &types.CError{
+					Message: "provider " + p.Provider + " does not support image generation",
+					Type:    "invalid_request_error",
+					Param:   "provider",
+					Code:    "invalid_parameter",
+				},
+			})
+		}
+
+		// 一次生成的数量不够n时继续请求
+		var urls []string
+		for len(urls) < p.N {
+			res, err := generate()
+			if err == nil && len(res) == 0 {
+				err = ErrNoImage
+			}
+			if err != nil {
+				fhblade.Log.Debug("images generations err",
+					zap.String("provider", p.Provider),
+					zap.Error(err))
+				return imageError(err).JSON(c)
+			}
+			urls = append(urls, res...)
+		}
+		urls = urls[:p.N]
+
+		out := &types.ImagesGenerationResponse{Created: time.Now().Unix()}
+		for _, u := range urls {
+			data, err := imageData(c, u, p.ResponseFormat)
+			if err != nil {
+				return c.JSONAndStatus(http.StatusBadGateway, types.ErrorResponse{
+					Error: &types.CError{
+						Message: err.Error(),
+						Type:    "server_error",
+						Code:    "image_download_error",
+					},
+				})
+			}
+			out.Data = append(out.Data, data)
+		}
+		return c.JSONAndStatus(http.StatusOK, out)
+	}
+}
+
+// b64_json下载后编码,url保存到image_path后返回代理地址
+func imageData(c *fhblade.Context, u, format string) (*types.ImageData, error) {
+	if format == "b64_json" {
+		img, err := chat.LoadImage(c.Request().Context(), u, "")
+		if err != nil {
+			return nil, err
+		}
+		return &types.ImageData{B64JSON: img.Base64()}, nil
+	}
+	if config.V().Openai.ImagePath == "" {
+		return &types.ImageData{URL: u}, nil
+	}
+	id := strings.ReplaceAll(uuid.NewString(), "-", "")
+	if err := image.SaveAs(u, id); err != nil {
+		return nil, err
+	}
+	return &types.ImageData{URL: proxyBaseUrl(c) + "/gptimage/file-" + id}, nil
+}
+
+// 代理对外的地址,经过反向代理时取X-Forwarded-*
+func proxyBaseUrl(c *fhblade.Context) string {
+	req := c.Request().Req()
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	if v := req.Header.Get("X-Forwarded-Proto"); v != "" {
+		scheme = v
+	}
+	host := req.Host
+	if v := req.Header.Get("X-Forwarded-Host"); v != "" {
+		host = v
+	}
+	return scheme + "://" + host
+}
+
+// 各上游的错误转成openai图片接口的错误
+func imageError(err error) *chat.UpstreamError {
+	var ue *chat.UpstreamError
+	if errors.As(err, &ue) {
+		return ue
+	}
+	switch {
+	case errors.Is(err, ErrWebImageAuth), errors.Is(err, bing.ErrImageCookie), errors.Is(err, coze.ErrDiscordDisabled):
+		return &chat.UpstreamError{
+			Code: http.StatusInternalServerError,
+			Err: &types.CError{
+				Message: err.Error(),
+				Type:    "invalid_config_error",
+				Code:    "systems_err",
+			},
+		}
+	case errors.Is(err, bing.ErrImageBlocked):
+		e := chat.StatusError(http.StatusBadRequest, err.Error())
+		e.Err.Param = "prompt"
+		e.Err.Code = "content_policy_violation"
+		return e
+	case errors.Is(err, bing.ErrImageLanguage):
+		e := chat.StatusError(http.StatusBadRequest, err.Error())
+		e.Err.Param = "prompt"
+		return e
+	case errors.Is(err, coze.ErrImageDailyLimit):
+		return chat.StatusError(http.StatusTooManyRequests, err.Error())
+	case errors.Is(err, bing.ErrImageTimeout), errors.Is(err, coze.ErrImageTimeout):
+		return chat.StatusError(http.StatusGatewayTimeout, err.Error())
+	}
+	return chat.StatusError(http.StatusBadGateway, err.Error())
+}
+
+// chatgpt web对话生成图片,从返回的image_asset_pointer取文件下载地址
+// 只支持sse返回,不支持websocket
+func generateWebImages(c *fhblade.Context, prompt, model string) ([]string, error) {
+	auth, _, lease := parseAuth(c, "web", "")
+	defer lease.Done()
+	if auth == "" {
+		return nil, ErrWebImageAuth
+	}
+	rp := types.OpenAiCompletionChatRequest{
+		Action: "next",
+		Messages: []*types.OpenAiMessage{
+			&types.OpenAiMessage{
+				ID:     uuid.NewString(),
+				Author: &types.OpenAiAuthor{Role: "user"},
+				Content: &types.OpenAiContent{
+					ContentType: "text",
+					Parts:       []any{prompt},
+				},
+			},
+		},
+		ParentMessageId: uuid.NewString(),
+		Model:           model,
+	}
+	resp, code, e := askConversationWebHttp(c.Request().Context(), rp, "backend-api", auth, lease)
+	if e != nil {
+		return nil, &chat.UpstreamError{Code: code, Err: e.Error}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := tools.ReadAll(resp.Body)
+		fhblade.Log.Error("openai web image res status err", zap.ByteString("data", body))
+		return nil, chat.WebError(resp.StatusCode, body).WithHeader(resp.Header).Report(lease)
+	}
+	lease.Report(resp.StatusCode, 0)
+	if !strings.Contains(resp.Header.Get("Content-Type"), "event-stream") {
+		body, _ := tools.ReadAll(resp.Body)
+		fhblade.Log.Error("openai web image res err", zap.ByteString("data", body))
+		return nil, ErrWebImageResponse
+	}
+
+	var fileIds []string
+	seen := make(map[string]bool)
+	lastText := ""
+	reader := bufio.NewReader(resp.Body)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			break
+		}
+		raw, ok := strings.CutPrefix(strings.TrimSpace(line), "data: ")
+		if !ok {
+			continue
+		}
+		if raw == "[DONE]" {
+			break
+		}
+		chatRes := &types.OpenAiCompletionChatResponse{}
+		if err := fhblade.Json.UnmarshalFromString(raw, &chatRes); err != nil {
+			continue
+		}
+		if chatRes.Error != nil {
+			return nil, chat.StatusError(http.StatusBadGateway, fmt.Sprint(chatRes.Error))
+		}
+		if chatRes.Message == nil || chatRes.Message.Content == nil {
+			continue
+		}
+		for _, part := range chatRes.Message.Content.Parts {
+			if text := partText(part); text != "" {
+				if chatRes.Message.Author != nil && chatRes.Message.Author.Role == "assistant" {
+					lastText = text
+				}
+				continue
+			}
+			m, ok := part.(map[string]any)
+			if !ok || m["content_type"] != "image_asset_pointer" {
+				continue
+			}
+			pointer, _ := m["asset_pointer"].(string)
+			_, id, ok := strings.Cut(pointer, "://")
+			if !ok || seen[id] {
+				continue
+			}
+			seen[id] = true
+			fileIds = append(fileIds, id)
+		}
+	}
+	if len(fileIds) == 0 {
+		// 拒绝生成时返回助手的回复
+		if lastText != "" {
+			return nil, fmt.Errorf("%w: %s", ErrNoImage, lastText)
+		}
+		return nil, ErrNoImage
+	}
+
+	webChatUrl := config.OpenaiChatWebUrl()
+	if webChatUrl == "" {
+		webChatUrl = cst.ChatOriginUrl
+	}
+	if !strings.HasPrefix(auth, "Bearer ") {
+		auth = "Bearer " + auth
+	}
+	urls := make([]string, 0, len(fileIds))
+	for _, id := range fileIds {
+		res := &types.OpenAiFileUploadedResponse{}
+		goUrl := webChatUrl + "/backend-api/files/" + id + "/download"
+		if err := doWebFileReq(http.MethodGet, goUrl, auth, nil, res); err != nil {
+			return nil, err
+		}
+		if res.DownloadUrl == "" {
+			return nil, fmt.Errorf("download file %s failed: %s", id, res.Status)
+		}
+		urls = append(urls, res.DownloadUrl)
+	}
+	return urls, nil
+}
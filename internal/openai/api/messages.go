@@ -0,0 +1,171 @@
+package api
+
+import (
+	"strings"
+
+	http "github.com/bogdanfinn/fhttp"
+	"github.com/zatxm/any-proxy/internal/chat"
+	"github.com/zatxm/any-proxy/internal/claude"
+	"github.com/zatxm/any-proxy/internal/config"
+	"github.com/zatxm/any-proxy/internal/types"
+	"github.com/zatxm/fhblade"
+)
+
+// v1/messages通用接口,claude messages api格式
+// 按provider或路由转到各上游,都没有的走claude
+func DoMessages() func(*fhblade.Context) error {
+	return func(c *fhblade.Context) error {
+		var rq types.ClaudeApiCompletionRequest
+		if err := c.ShouldBindJSON(&rq); err != nil {
+			return c.JSONAndStatus(http.StatusBadRequest, types.ClaudeErrorResponse{
+				Type: "error",
+				Error: &types.ClaudeError{
+					Type:    "invalid_request_error",
+					Message: "params error",
+				},
+			})
+		}
+		p := claudeToChat(rq)
+		if p.Provider == "" && config.MatchRoute(p.Model) == nil {
+			p.Provider = claude.Provider
+		}
+		w := chat.NewUsageWriter(c, p, chat.NewClaudeWriter(c, p.Stream, p.Model, chat.PromptTokens(p)))
+		return doConvert(c, p, w)
+	}
+}
+
+// claude请求转openai
+func claudeToChat(rq types.ClaudeApiCompletionRequest) types.ChatCompletionRequest {
+	p := types.ChatCompletionRequest{
+		Model:         rq.Model,
+		MaxTokens:     rq.MaxTokens,
+		Stop:          rq.StopSequences,
+		Stream:        rq.Stream,
+		Temperature:   rq.Temperature,
+		TopP:          rq.TopP,
+		StreamOptions: &types.StreamOptions{IncludeUsage: true},
+		Provider:      rq.Provider,
+	}
+	if system := claudeText(rq.System); system != "" {
+		p.Messages = append(p.Messages, &types.ChatCompletionMessage{Role: "system", Content: system})
+	}
+	for _, m := range rq.Messages {
+		p.Messages = append(p.Messages, claudeMessageToChat(m)...)
+	}
+	for _, v := range rq.Tools {
+		tool := &types.ClaudeApiTool{}
+		b, _ := fhblade.Json.Marshal(v)
+		// 服务端工具(web_search等)没有input_schema,不支持
+		if err := fhblade.Json.Unmarshal(b, tool); err != nil || tool.Name == "" || tool.InputSchema == nil {
+			continue
+		}
+		p.Tools = append(p.Tools, types.Tool{
+			Type: "function",
+			Function: &types.FunctionDefinition{
+				Name:        tool.Name,
+				Description: tool.Description,
+				Parameters:  tool.InputSchema,
+			},
+		})
+	}
+	if len(p.Tools) > 0 && rq.ToolChoice != nil {
+		choice := &types.ClaudeApiToolChoice{}
+		b, _ := fhblade.Json.Marshal(rq.ToolChoice)
+		if err := fhblade.Json.Unmarshal(b, choice); err == nil {
+			switch choice.Type {
+			case "auto", "none":
+				p.ToolChoice = choice.Type
+			case "any":
+				p.ToolChoice = "required"
+			case "tool":
+				p.ToolChoice = map[string]any{
+					"type":     "function",
+					"function": map[string]any{"name": choice.Name},
+				}
+			}
+		}
+	}
+	return p
+}
+
+// tool_result转成tool消息放在前面,其余内容按顺序转换
+// 没有图片时合并成文本,web等上游只处理文本消息
+func claudeMessageToChat(m *types.ClaudeApiMessage) []*types.ChatCompletionMessage {
+	if m.MultiContent == nil {
+		return []*types.ChatCompletionMessage{&types.ChatCompletionMessage{Role: m.Role, Content: m.Content}}
+	}
+	var out []*types.ChatCompletionMessage
+	msg := &types.ChatCompletionMessage{Role: m.Role}
+	var parts []*types.ChatMessagePart
+	var texts []string
+	withImage := false
+	for _, part := range m.MultiContent {
+		switch part.Type {
+		case "text":
+			texts = append(texts, part.Text)
+			parts = append(parts, &types.ChatMessagePart{Type: "text", Text: part.Text})
+		case "image":
+			if part.Source == nil {
+				continue
+			}
+			u := part.Source.Url
+			if part.Source.Type == "base64" {
+				u = "data:" + part.Source.MediaType + ";base64," + part.Source.Data
+			}
+			withImage = true
+			parts = append(parts, &types.ChatMessagePart{
+				Type:     "image_url",
+				ImageURL: &types.ChatMessageImageURL{URL: u},
+			})
+		case "tool_use":
+			args, _ := fhblade.Json.MarshalToString(part.Input)
+			if part.Input == nil {
+				args = "{}"
+			}
+			msg.ToolCalls = append(msg.ToolCalls, &types.ToolCall{
+				ID:   part.ID,
+				Type: "function",
+				Function: types.FunctionCall{
+					Name:      part.Name,
+					Arguments: args,
+				},
+			})
+		case "tool_result":
+			out = append(out, &types.ChatCompletionMessage{
+				Role:       "tool",
+				Content:    claudeText(part.Content),
+				ToolCallID: part.ToolUseId,
+			})
+		}
+	}
+	if withImage && m.Role == "user" {
+		msg.MultiContent = parts
+	} else {
+		msg.Content = strings.Join(texts, "\n")
+	}
+	if msg.Content != "" || msg.MultiContent != nil || len(msg.ToolCalls) > 0 {
+		out = append(out, msg)
+	}
+	return out
+}
+
+// system、tool_result的内容可以是字符串或text块数组
+func claudeText(v any) string {
+	switch val := v.(type) {
+	case string:
+		return val
+	case []any:
+		var texts []string
+		for _, item := range val {
+			block, ok := item.(map[string]any)
+			if !ok {
+				continue
+			}
+			if text, ok := block["text"].(string); ok && text != "" {
+				texts = append(texts, text)
+			}
+		}
+		return strings.Join(texts, "\n")
+	}
+	return ""
+}
@@ -0,0 +1,221 @@
+package api
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	http "github.com/bogdanfinn/fhttp"
+	"github.com/zatxm/any-proxy/internal/access"
+	"github.com/zatxm/any-proxy/internal/bing"
+	"github.com/zatxm/any-proxy/internal/claude"
+	"github.com/zatxm/any-proxy/internal/client"
+	"github.com/zatxm/any-proxy/internal/config"
+	coze "github.com/zatxm/any-proxy/internal/coze/api"
+	"github.com/zatxm/any-proxy/internal/gemini"
+	"github.com/zatxm/any-proxy/internal/openai/cst"
+	"github.com/zatxm/any-proxy/internal/types"
+	"github.com/zatxm/any-proxy/internal/vars"
+	"github.com/zatxm/fhblade"
+	"github.com/zatxm/fhblade/tools"
+	tlsClient "github.com/zatxm/tls-client"
+	"go.uber.org/zap"
+)
+
+const (
+	// 需要请求上游的模型列表缓存时间,没取到的缓存较短
+	modelsTTL      = 10 * time.Minute
+	modelsRetryTTL = time.Minute
+)
+
+var (
+	webModelsCache    = &modelsCache{}
+	claudeModelsCache = &modelsCache{}
+)
+
+// 模型列表缓存,客户端会定时获取,避免每次都请求上游
+type modelsCache struct {
+	sync.Mutex
+	models []*types.Model
+	expire time.Time
+}
+
+// 过期才重新获取,获取时持有锁,同时的请求等待同一次结果
+func (mc *modelsCache) get(fn func() []*types.Model) []*types.Model {
+	mc.Lock()
+	defer mc.Unlock()
+	now := time.Now()
+	if now.Before(mc.expire) {
+		return mc.models
+	}
+	mc.models = fn()
+	ttl := modelsTTL
+	if len(mc.models) == 0 {
+		ttl = modelsRetryTTL
+	}
+	mc.expire = now.Add(ttl)
+	return mc.models
+}
+
+// v1/models通用接口,汇总配置的各provider模型
+// 同名模型只保留第一个,路由别名优先
+func DoModels() func(*fhblade.Context) error {
+	return func(c *fhblade.Context) error {
+		fns := []func() []*types.Model{
+			routeModels,
+			func() []*types.Model {
+				return webModelsCache.get(webModels)
+			},
+			gemini.Models,
+			func() []*types.Model {
+				return claudeModelsCache.get(func() []*types.Model {
+					return claude.Models(c)
+				})
+			},
+			bing.Models,
+			coze.Models,
+		}
+		results := make([][]*types.Model, len(fns))
+		var wg sync.WaitGroup
+		for k := range fns {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				results[i] = fns[i]()
+			}(k)
+		}
+		wg.Wait()
+
+		data := []*types.Model{}
+		exist := make(map[string]bool)
+		for k := range results {
+			for _, m := range results[k] {
+				// 只返回客户端密钥可以使用的
+				if exist[m.ID] || !access.Allowed(c, m.Provider, m.ID) {
+					continue
+				}
+				exist[m.ID] = true
+				data = append(data, m)
+			}
+		}
+		return c.JSONAndStatus(http.StatusOK, types.ModelListResponse{
+			Object: "list",
+			Data:   data,
+		})
+	}
+}
+
+// 配置的路由别名,通配的不返回
+func routeModels() []*types.Model {
+	var models []*types.Model
+	now := time.Now().Unix()
+	routes := config.Routes()
+	for k := range routes {
+		r := routes[k]
+		if strings.ContainsAny(r.Model, "*?[") {
+			continue
+		}
+		m := &types.Model{
+			ID:            r.Model,
+			Object:        "model",
+			Created:       now,
+			OwnedBy:       r.Provider,
+			Provider:      r.Provider,
+			Type:          r.Type,
+			UpstreamModel: r.UpstreamModel,
+		}
+		if r.KeyId != "" {
+			m.KeyIds = []string{r.KeyId}
+		}
+		models = append(models, m)
+	}
+	return models
+}
+
+// chatgpt web每个session的模型
+func webModels() []*types.Model {
+	sessions := config.V().Openai.WebSessions
+	if len(sessions) == 0 {
+		return nil
+	}
+	results := make([][]*types.OpenAiWebModel, len(sessions))
+	var wg sync.WaitGroup
+	for k := range sessions {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = webSessionModels(sessions[i].Val)
+		}(k)
+	}
+	wg.Wait()
+
+	var models []*types.Model
+	modelMap := make(map[string]*types.Model)
+	now := time.Now().Unix()
+	for k := range results {
+		for _, v := range results[k] {
+			m, ok := modelMap[v.Slug]
+			if !ok {
+				m = &types.Model{
+					ID:       v.Slug,
+					Object:   "model",
+					Created:  now,
+					OwnedBy:  "openai",
+					Provider: Provider,
+					Type:     "web",
+				}
+				modelMap[v.Slug] = m
+				models = append(models, m)
+			}
+			m.KeyIds = append(m.KeyIds, sessions[k].ID)
+		}
+	}
+	return models
+}
+
+func webSessionModels(auth string) []*types.OpenAiWebModel {
+	webChatUrl := config.OpenaiChatWebUrl()
+	if webChatUrl == "" {
+		webChatUrl = cst.ChatOriginUrl
+	}
+	goUrl := webChatUrl + "/backend-api/models?history_and_training_disabled=false"
+	req, err := http.NewRequest(http.MethodGet, goUrl, nil)
+	if err != nil {
+		fhblade.Log.Error("openai web models new req err", zap.Error(err))
+		return nil
+	}
+	if !strings.HasPrefix(auth, "Bearer ") {
+		auth = "Bearer " + auth
+	}
+	req.Header = http.Header{
+		"accept":          {vars.AcceptAll},
+		"accept-encoding": {vars.AcceptEncoding},
+		"authorization":   {auth},
+		"oai-device-id":   {cst.OaiDeviceId},
+		"oai-language":    {cst.OaiLanguage},
+		"origin":          {cst.ChatOriginUrl},
+		"referer":         {cst.ChatRefererUrl},
+		"user-agent":      {vars.UserAgent},
+	}
+	gClient := client.CcPool.Get().(tlsClient.HttpClient)
+	resp, err := gClient.Do(req)
+	client.CcPool.Put(gClient)
+	if err != nil {
+		fhblade.Log.Error("openai web models req err", zap.Error(err))
+		return nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := tools.ReadAll(resp.Body)
+		fhblade.Log.Error("openai web models res status err",
+			zap.Int("code", resp.StatusCode),
+			zap.ByteString("data", body))
+		return nil
+	}
+	res := &types.OpenAiWebModelsResponse{}
+	if err := fhblade.Json.NewDecoder(resp.Body).Decode(res); err != nil {
+		fhblade.Log.Error("openai web models res err", zap.Error(err))
+		return nil
+	}
+	return res.Models
+}
@@ -0,0 +1,46 @@
+package api
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zatxm/any-proxy/internal/types"
+)
+
+func TestModelsCache(t *testing.T) {
+	mc := &modelsCache{}
+	calls := 0
+	fetch := func() []*types.Model {
+		calls++
+		time.Sleep(10 * time.Millisecond)
+		return []*types.Model{{ID: "m"}}
+	}
+	// 同时请求只获取一次
+	var wg sync.WaitGroup
+	for k := 0; k < 5; k++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if ms := mc.get(fetch); len(ms) != 1 {
+				t.Errorf("models = %v", ms)
+			}
+		}()
+	}
+	wg.Wait()
+	if calls != 1 {
+		t.Fatalf("fetched %d times, want 1", calls)
+	}
+	if d := time.Until(mc.expire); d > modelsTTL || d < modelsTTL-time.Second {
+		t.Errorf("expire in %s, want %s", d, modelsTTL)
+	}
+
+	// 过期后重新获取,没取到的缓存较短
+	mc.expire = time.Now().Add(-time.Second)
+	if ms := mc.get(func() []*types.Model { calls++; return nil }); ms != nil || calls != 2 {
+		t.Errorf("models = %v, calls = %d after expire", ms, calls)
+	}
+	if d := time.Until(mc.expire); d > modelsRetryTTL || d < modelsRetryTTL-time.Second {
+		t.Errorf("empty result expire in %s, want %s", d, modelsRetryTTL)
+	}
+}
@@ -1,17 +1,24 @@
 package api
 
 import (
-	"math/rand"
+	"bufio"
+	"bytes"
+	"io"
 	"strings"
-	"time"
 
 	http "github.com/bogdanfinn/fhttp"
 	"github.com/bogdanfinn/fhttp/httputil"
+	"github.com/zatxm/any-proxy/internal/access"
+	"github.com/zatxm/any-proxy/internal/chat"
 	"github.com/zatxm/any-proxy/internal/client"
 	"github.com/zatxm/any-proxy/internal/config"
+	"github.com/zatxm/any-proxy/internal/pool"
+	"github.com/zatxm/any-proxy/internal/types"
 	"github.com/zatxm/any-proxy/internal/vars"
 	"github.com/zatxm/fhblade"
+	"github.com/zatxm/fhblade/tools"
 	tlsClient "github.com/zatxm/tls-client"
+	"go.uber.org/zap"
 )
 
 func DoPlatform(tag string) func(*fhblade.Context) error {
@@ -29,7 +36,8 @@ func DoHttp(c *fhblade.Context, path string) error {
 	if accept == "" {
 		accept = "*/*"
 	}
-	auth, index := parseAuth(c, "api", "")
+	auth, index, lease := parseAuth(c, "api", "")
+	defer lease.Done()
 	if index != "" {
 		c.Response().SetHeader("x-auth-id", index)
 	}
@@ -50,53 +58,162 @@ func DoHttp(c *fhblade.Context, path string) error {
 			req.URL.RawQuery = query
 		},
 		Transport: gClient.TClient().Transport,
+		ModifyResponse: func(resp *http.Response) error {
+			lease.Report(resp.StatusCode, chat.RetryAfter(resp.Header))
+			return nil
+		},
 	}
 	goProxy.ServeHTTP(c.Response().Rw(), c.Request().Req())
 	return nil
 }
 
-// tag: api和web两种
-func parseAuth(c *fhblade.Context, tag string, index string) (string, string) {
-	auth := c.Request().Header("Authorization")
-	if auth != "" {
-		if strings.HasPrefix(auth, "Bearer ") {
-			return strings.TrimPrefix(auth, "Bearer "), ""
-		}
-		return auth, ""
+// 转换后的请求调用官方v1/chat/completions,流式读取后统一输出
+func doPlatformChat(c *fhblade.Context, p types.ChatCompletionRequest, w chat.Writer) error {
+	auth, _, lease := parseAuth(c, "api", "")
+	defer lease.Done()
+	if auth == "" {
+		return chat.NoKeyError("openai api").Write(c, w)
 	}
-
-	var keys []config.ApiKeyMap
-	if tag == "web" {
-		keys = config.V().Openai.WebSessions
-	} else {
-		keys = config.V().Openai.ApiKeys
+	// 去掉通用接口的扩展字段
+	p.Provider = ""
+	p.Gemini = nil
+	p.OpenAi = nil
+	p.Bing = nil
+	p.Coze = nil
+	p.Claude = nil
+	p.Stream = true
+	p.StreamOptions = &types.StreamOptions{IncludeUsage: true}
+	reqJson, _ := fhblade.Json.Marshal(p)
+	req, err := http.NewRequest(http.MethodPost, "https://api.openai.com/v1/chat/completions", bytes.NewReader(reqJson))
+	if err != nil {
+		return w.Error(http.StatusInternalServerError, &types.CError{
+			Message: err.Error(),
+			Type:    "invalid_request_error",
+			Code:    "request_err",
+		})
 	}
-	l := len(keys)
-	if l == 0 {
-		return "", ""
+	req.Header = http.Header{
+		"Accept":          {vars.ContentTypeStream},
+		"Accept-Encoding": {vars.AcceptEncoding},
+		"User-Agent":      {vars.UserAgentOkHttp},
+		"Content-Type":    {vars.ContentTypeJSON},
+		"Authorization":   {"Bearer " + auth},
 	}
-
-	hIndex := c.Request().Header("x-auth-id")
-	if hIndex != "" {
-		index = hIndex
+	gClient := client.CPool.Get().(tlsClient.HttpClient)
+	resp, err := gClient.Do(req)
+	client.CPool.Put(gClient)
+	if err != nil {
+		fhblade.Log.Error("openai platform chat req err", zap.Error(err))
+		return chat.ConnError(err).Write(c, w)
 	}
-	if index != "" {
-		for k := range keys {
-			v := keys[k]
-			if index == v.ID {
-				return v.Val, index
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := tools.ReadAll(resp.Body)
+		return chat.OpenaiError(resp.StatusCode, body).WithHeader(resp.Header).Report(lease).Write(c, w)
+	}
+	lease.Report(resp.StatusCode, 0)
+	reader := bufio.NewReader(resp.Body)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			if err != io.EOF {
+				fhblade.Log.Error("openai platform chat res read err", zap.Error(err))
 			}
+			break
+		}
+		if !strings.HasPrefix(line, "data: ") {
+			continue
 		}
-		return "", ""
+		raw := strings.TrimSpace(strings.TrimPrefix(line, "data: "))
+		if raw == "[DONE]" {
+			break
+		}
+		chatRes := &types.ChatCompletionResponse{}
+		if err := fhblade.Json.UnmarshalFromString(raw, chatRes); err != nil {
+			fhblade.Log.Error("openai platform chat deal data err",
+				zap.Error(err),
+				zap.String("data", raw))
+			continue
+		}
+		w.Write(chatRes)
 	}
+	return w.Done()
+}
 
-	if l == 1 {
-		v := keys[0]
-		return v.Val, v.ID
+// 调用官方v1/embeddings,使用配置的api密钥
+func doPlatformEmbeddings(c *fhblade.Context, p types.EmbeddingRequest) error {
+	auth, index, lease := parseAuth(c, "api", "")
+	defer lease.Done()
+	if auth == "" {
+		return chat.NoKeyError("openai api").JSON(c)
+	}
+	if index != "" {
+		c.Response().SetHeader("x-auth-id", index)
+	}
+	p.Provider = ""
+	reqJson, _ := fhblade.Json.Marshal(p)
+	req, err := http.NewRequest(http.MethodPost, "https://api.openai.com/v1/embeddings", bytes.NewReader(reqJson))
+	if err != nil {
+		return c.JSONAndStatus(http.StatusInternalServerError, types.ErrorResponse{
+			Error: &types.CError{
+				Message: err.Error(),
+				Type:    "invalid_request_error",
+				Code:    "request_err",
+			},
+		})
+	}
+	req.Header = http.Header{
+		"Accept":          {vars.ContentTypeJSON},
+		"Accept-Encoding": {vars.AcceptEncoding},
+		"User-Agent":      {vars.UserAgentOkHttp},
+		"Content-Type":    {vars.ContentTypeJSON},
+		"Authorization":   {"Bearer " + auth},
+	}
+	gClient := client.CPool.Get().(tlsClient.HttpClient)
+	resp, err := gClient.Do(req)
+	client.CPool.Put(gClient)
+	if err != nil {
+		fhblade.Log.Error("openai platform embeddings req err", zap.Error(err))
+		return chat.ConnError(err).JSON(c)
+	}
+	defer resp.Body.Close()
+	body, _ := tools.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return chat.OpenaiError(resp.StatusCode, body).WithHeader(resp.Header).Report(lease).JSON(c)
 	}
+	lease.Report(resp.StatusCode, 0)
+	res := &types.EmbeddingResponse{}
+	if err := fhblade.Json.Unmarshal(body, res); err != nil {
+		fhblade.Log.Error("openai platform embeddings deal data err", zap.ByteString("data", body))
+		return c.JSONAndStatus(http.StatusBadGateway, types.ErrorResponse{
+			Error: &types.CError{
+				Message: "invalid embeddings response",
+				Type:    "invalid_request_error",
+				Code:    "response_err",
+			},
+		})
+	}
+	if res.Usage != nil {
+		access.Consume(c, res.Usage.TotalTokens)
+	}
+	return c.JSONAndStatus(http.StatusOK, res)
+}
 
-	rand.Seed(time.Now().UnixNano())
-	i := rand.Intn(l)
-	v := keys[i]
-	return v.Val, v.ID
+// tag: api和web两种,lease用于上报上游状态及结束请求
+func parseAuth(c *fhblade.Context, tag string, index string) (string, string, *pool.Lease) {
+	if auth := pool.Authorization(c); auth != "" {
+		return auth, "", nil
+	}
+	keys := config.V().Openai.ApiKeys
+	if tag == "web" {
+		keys = config.V().Openai.WebSessions
+	}
+	if hIndex := c.Request().Header("x-auth-id"); hIndex != "" {
+		index = hIndex
+	}
+	i, lease := pool.Pick(c, "openai-"+tag, config.V().Openai.Balance, keys, index)
+	if i < 0 {
+		return "", "", lease
+	}
+	return keys[i].Val, keys[i].ID, lease
 }
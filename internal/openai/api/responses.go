@@ -0,0 +1,363 @@
+package api
+
+import (
+	"container/list"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	http "github.com/bogdanfinn/fhttp"
+	"github.com/zatxm/any-proxy/internal/chat"
+	"github.com/zatxm/any-proxy/internal/types"
+	"github.com/zatxm/fhblade"
+)
+
+const (
+	// 保存的对话用于previous_response_id,过期清除
+	responseTTL = 24 * time.Hour
+	// 最多保存的对话数,超出淘汰最久没用的
+	maxResponses = 10000
+)
+
+var (
+	ErrResponsesInput = errors.New("input must be a string or an array of input items")
+
+	responses = newResponseStore(maxResponses)
+)
+
+// 内存保存每个response结束时的完整对话,不含instructions
+// 按最近使用排序,队尾最久没用
+type responseStore struct {
+	sync.Mutex
+	max   int
+	items map[string]*list.Element
+	lru   *list.List
+}
+
+type storedResponse struct {
+	id       string
+	messages []*types.ChatCompletionMessage
+	expire   time.Time
+}
+
+func newResponseStore(max int) *responseStore {
+	return &responseStore{
+		max:   max,
+		items: make(map[string]*list.Element),
+		lru:   list.New(),
+	}
+}
+
+func (s *responseStore) get(id string) ([]*types.ChatCompletionMessage, bool) {
+	s.Lock()
+	defer s.Unlock()
+	e, ok := s.items[id]
+	if !ok {
+		return nil, false
+	}
+	item := e.Value.(*storedResponse)
+	if time.Now().After(item.expire) {
+		s.remove(e)
+		return nil, false
+	}
+	s.lru.MoveToFront(e)
+	return item.messages, true
+}
+
+// 只清理队尾过期的及超出数量的,不遍历全部
+func (s *responseStore) set(id string, messages []*types.ChatCompletionMessage) {
+	s.Lock()
+	defer s.Unlock()
+	now := time.Now()
+	item := &storedResponse{id: id, messages: messages, expire: now.Add(responseTTL)}
+	if e, ok := s.items[id]; ok {
+		e.Value = item
+		s.lru.MoveToFront(e)
+	} else {
+		s.items[id] = s.lru.PushFront(item)
+	}
+	for e := s.lru.Back(); e != nil; e = s.lru.Back() {
+		if s.lru.Len() <= s.max && !now.After(e.Value.(*storedResponse).expire) {
+			break
+		}
+		s.remove(e)
+	}
+}
+
+func (s *responseStore) remove(e *list.Element) {
+	s.lru.Remove(e)
+	delete(s.items, e.Value.(*storedResponse).id)
+}
+
+// v1/responses通用接口,openai responses api格式
+// 转成chat请求按provider或路由转到各上游,都没有的走openai官方api
+func DoResponses() func(*fhblade.Context) error {
+	return func(c *fhblade.Context) error {
+		var rq types.ResponsesRequest
+		if err := c.ShouldBindJSON(&rq); err != nil {
+			return c.JSONAndStatus(http.StatusBadRequest, types.ErrorResponse{
+				Error: &types.CError{
+					Message: "params error",
+					Type:    "invalid_request_error",
+					Code:    "invalid_parameter",
+				},
+			})
+		}
+		var history []*types.ChatCompletionMessage
+		if rq.PreviousResponseID != "" {
+			ms, ok := responses.get(rq.PreviousResponseID)
+			if !ok {
+				return c.JSONAndStatus(http.StatusNotFound, types.ErrorResponse{
+					Error: &types.CError{
+						Message: "Previous response with id '" + rq.PreviousResponseID + "' not found.",
+						Type:    "invalid_request_error",
+						Param:   "previous_response_id",
+						Code:    "previous_response_not_found",
+					},
+				})
+			}
+			history = ms
+		}
+		input, err := responsesInput(rq.Input)
+		if err != nil {
+			return c.JSONAndStatus(http.StatusBadRequest, types.ErrorResponse{
+				Error: &types.CError{
+					Message: err.Error(),
+					Type:    "invalid_request_error",
+					Param:   "input",
+					Code:    "invalid_parameter",
+				},
+			})
+		}
+		messages := make([]*types.ChatCompletionMessage, 0, len(history)+len(input))
+		messages = append(append(messages, history...), input...)
+		p := responsesToChat(rq, messages)
+		res := newResponse(rq)
+		w := chat.NewUsageWriter(c, p, chat.NewResponsesWriter(c, rq.Stream, res, func(res *types.Response) {
+			if !res.Store {
+				return
+			}
+			if msg := responseMessage(res); msg.Content != "" || len(msg.ToolCalls) > 0 {
+				messages = append(messages, msg)
+			}
+			responses.set(res.ID, messages)
+		}))
+		return doConvert(c, p, w)
+	}
+}
+
+// 返回的response对象,回显请求参数
+func newResponse(rq types.ResponsesRequest) *types.Response {
+	res := &types.Response{
+		ID:                 chat.ResponseItemId("resp"),
+		Object:             "response",
+		CreatedAt:          time.Now().Unix(),
+		Status:             "in_progress",
+		Instructions:       rq.Instructions,
+		MaxOutputTokens:    rq.MaxOutputTokens,
+		Model:              rq.Model,
+		Output:             []any{},
+		ParallelToolCalls:  rq.ParallelToolCalls == nil || *rq.ParallelToolCalls,
+		PreviousResponseID: rq.PreviousResponseID,
+		Temperature:        rq.Temperature,
+		TopP:               rq.TopP,
+		Text:               rq.Text,
+		ToolChoice:         rq.ToolChoice,
+		Tools:              rq.Tools,
+		Metadata:           rq.Metadata,
+		Store:              rq.Store == nil || *rq.Store,
+	}
+	if res.Text == nil {
+		res.Text = &types.ResponsesText{Format: &types.ResponsesTextFormat{Type: "text"}}
+	}
+	if res.ToolChoice == nil {
+		res.ToolChoice = "auto"
+	}
+	if res.Tools == nil {
+		res.Tools = []*types.ResponsesTool{}
+	}
+	if res.Metadata == nil {
+		res.Metadata = map[string]string{}
+	}
+	return res
+}
+
+// response输出转成assistant消息,文本及函数调用合并为一条
+func responseMessage(res *types.Response) *types.ChatCompletionMessage {
+	msg := &types.ChatCompletionMessage{Role: "assistant"}
+	for _, item := range res.Output {
+		switch v := item.(type) {
+		case *types.ResponseOutputMessage:
+			for _, part := range v.Content {
+				msg.Content += part.Text
+			}
+		case *types.ResponseFunctionCall:
+			msg.ToolCalls = append(msg.ToolCalls, &types.ToolCall{
+				ID:   v.CallID,
+				Type: "function",
+				Function: types.FunctionCall{
+					Name:      v.Name,
+					Arguments: v.Arguments,
+				},
+			})
+		}
+	}
+	return msg
+}
+
+// responses请求转openai,instructions放在最前面的system消息
+func responsesToChat(rq types.ResponsesRequest, messages []*types.ChatCompletionMessage) types.ChatCompletionRequest {
+	p := types.ChatCompletionRequest{
+		Model:         rq.Model,
+		MaxTokens:     rq.MaxOutputTokens,
+		Stream:        rq.Stream,
+		Temperature:   rq.Temperature,
+		TopP:          rq.TopP,
+		User:          rq.User,
+		StreamOptions: &types.StreamOptions{IncludeUsage: true},
+		Provider:      rq.Provider,
+	}
+	if rq.Instructions != "" {
+		p.Messages = append(p.Messages, &types.ChatCompletionMessage{Role: "system", Content: rq.Instructions})
+	}
+	p.Messages = append(p.Messages, messages...)
+	// 只支持函数工具,web_search等内置工具忽略
+	for _, tool := range rq.Tools {
+		if tool.Type != "function" || tool.Name == "" {
+			continue
+		}
+		p.Tools = append(p.Tools, types.Tool{
+			Type: "function",
+			Function: &types.FunctionDefinition{
+				Name:        tool.Name,
+				Description: tool.Description,
+				Parameters:  tool.Parameters,
+			},
+		})
+	}
+	if len(p.Tools) > 0 {
+		switch v := rq.ToolChoice.(type) {
+		case string:
+			p.ToolChoice = v
+		case map[string]any:
+			if name, ok := v["name"].(string); ok && v["type"] == "function" {
+				p.ToolChoice = map[string]any{
+					"type":     "function",
+					"function": map[string]any{"name": name},
+				}
+			}
+		}
+	}
+	if rq.Text != nil && rq.Text.Format != nil {
+		format := rq.Text.Format
+		switch format.Type {
+		case "json_object":
+			p.ResponseFormat = &types.ChatCompletionResponseFormat{Type: "json_object"}
+		case "json_schema":
+			p.ResponseFormat = &types.ChatCompletionResponseFormat{
+				Type: "json_schema",
+				JSONSchema: &types.ChatCompletionResponseFormatJSONSchema{
+					Name:        format.Name,
+					Description: format.Description,
+					Schema:      format.Schema,
+					Strict:      format.Strict,
+				},
+			}
+		}
+	}
+	return p
+}
+
+// input为字符串时作为user消息,否则按输入项转换
+// 连续的function_call合并到同一条assistant消息
+func responsesInput(input any) ([]*types.ChatCompletionMessage, error) {
+	switch v := input.(type) {
+	case string:
+		return []*types.ChatCompletionMessage{&types.ChatCompletionMessage{Role: "user", Content: v}}, nil
+	case []any:
+	default:
+		return nil, ErrResponsesInput
+	}
+	var items []*types.ResponsesInputItem
+	b, _ := fhblade.Json.Marshal(input)
+	if err := fhblade.Json.Unmarshal(b, &items); err != nil {
+		return nil, ErrResponsesInput
+	}
+	var messages []*types.ChatCompletionMessage
+	for _, item := range items {
+		switch item.Type {
+		case "function_call":
+			tc := &types.ToolCall{
+				ID:   item.CallID,
+				Type: "function",
+				Function: types.FunctionCall{
+					Name:      item.Name,
+					Arguments: item.Arguments,
+				},
+			}
+			l := len(messages)
+			if l > 0 && messages[l-1].Role == "assistant" && messages[l-1].MultiContent == nil {
+				messages[l-1].ToolCalls = append(messages[l-1].ToolCalls, tc)
+				continue
+			}
+			messages = append(messages, &types.ChatCompletionMessage{
+				Role:      "assistant",
+				ToolCalls: []*types.ToolCall{tc},
+			})
+		case "function_call_output":
+			output, ok := item.Output.(string)
+			if !ok {
+				output, _ = fhblade.Json.MarshalToString(item.Output)
+			}
+			messages = append(messages, &types.ChatCompletionMessage{
+				Role:       "tool",
+				Content:    output,
+				ToolCallID: item.CallID,
+			})
+		case "", "message":
+			if item.Role == "" {
+				return nil, ErrResponsesInput
+			}
+			messages = append(messages, responsesMessage(item))
+		}
+	}
+	return messages, nil
+}
+
+// 文本块合并,user消息带图片时保留多模态内容
+func responsesMessage(item *types.ResponsesInputItem) *types.ChatCompletionMessage {
+	msg := &types.ChatCompletionMessage{Role: item.Role}
+	if text, ok := item.Content.(string); ok {
+		msg.Content = text
+		return msg
+	}
+	var parts []*types.ResponsesContentPart
+	b, _ := fhblade.Json.Marshal(item.Content)
+	fhblade.Json.Unmarshal(b, &parts)
+	var multi []*types.ChatMessagePart
+	var texts []string
+	withImage := false
+	for _, part := range parts {
+		switch part.Type {
+		case "input_text", "output_text", "text":
+			texts = append(texts, part.Text)
+			multi = append(multi, &types.ChatMessagePart{Type: "text", Text: part.Text})
+		case "input_image":
+			if part.ImageURL == "" {
+				continue
+			}
+			withImage = true
+			multi = append(multi, &types.ChatMessagePart{
+				Type:     "image_url",
+				ImageURL: &types.ChatMessageImageURL{URL: part.ImageURL, Detail: part.Detail},
+			})
+		}
+	}
+	if withImage && item.Role == "user" {
+		msg.MultiContent = multi
+	} else {
+		msg.Content = strings.Join(texts, "\n")
+	}
+	return msg
+}
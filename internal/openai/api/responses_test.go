@@ -0,0 +1,58 @@
+package api
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/zatxm/any-proxy/internal/types"
+)
+
+func TestResponseStoreEviction(t *testing.T) {
+	s := newResponseStore(3)
+	ms := []*types.ChatCompletionMessage{{Role: "user", Content: "hi"}}
+	for i := 0; i < 3; i++ {
+		s.set("resp_"+strconv.Itoa(i), ms)
+	}
+	// 用过的不淘汰
+	if _, ok := s.get("resp_0"); !ok {
+		t.Fatal("resp_0 not found")
+	}
+	s.set("resp_3", ms)
+	if _, ok := s.get("resp_1"); ok {
+		t.Error("least recently used resp_1 not evicted")
+	}
+	for _, id := range []string{"resp_0", "resp_2", "resp_3"} {
+		if _, ok := s.get(id); !ok {
+			t.Errorf("%s evicted", id)
+		}
+	}
+	if s.lru.Len() != 3 || len(s.items) != 3 {
+		t.Errorf("size = %d, %d, want 3", s.lru.Len(), len(s.items))
+	}
+	// 重复保存不增加数量
+	s.set("resp_3", ms)
+	if s.lru.Len() != 3 {
+		t.Errorf("size = %d after overwrite, want 3", s.lru.Len())
+	}
+}
+
+func TestResponseStoreExpire(t *testing.T) {
+	s := newResponseStore(10)
+	ms := []*types.ChatCompletionMessage{{Role: "user", Content: "hi"}}
+	s.set("resp_old", ms)
+	s.items["resp_old"].Value.(*storedResponse).expire = time.Now().Add(-time.Second)
+	if _, ok := s.get("resp_old"); ok {
+		t.Error("expired response returned")
+	}
+	if len(s.items) != 0 {
+		t.Error("expired response not removed on get")
+	}
+	// 写入时清理队尾过期的
+	s.set("resp_old", ms)
+	s.items["resp_old"].Value.(*storedResponse).expire = time.Now().Add(-time.Second)
+	s.set("resp_new", ms)
+	if _, ok := s.items["resp_old"]; ok || s.lru.Len() != 1 {
+		t.Errorf("expired response not swept, size %d", s.lru.Len())
+	}
+}
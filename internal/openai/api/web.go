@@ -3,6 +3,7 @@ package api
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/hex"
 	"fmt"
@@ -17,9 +18,11 @@ import (
 	"github.com/bogdanfinn/fhttp/httputil"
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
+	"github.com/zatxm/any-proxy/internal/chat"
 	"github.com/zatxm/any-proxy/internal/client"
 	"github.com/zatxm/any-proxy/internal/config"
 	"github.com/zatxm/any-proxy/internal/openai/cst"
+	"github.com/zatxm/any-proxy/internal/pool"
 	"github.com/zatxm/any-proxy/internal/types"
 	"github.com/zatxm/any-proxy/internal/vars"
 	"github.com/zatxm/fhblade"
@@ -100,12 +103,13 @@ func DoAskOrigin(c *fhblade.Context, tag string) error {
 			},
 		})
 	}
-	auth, index := parseAuth(c, "web", "")
-	resp, code, err := askConversationWebHttp(p, tag, auth)
+	auth, index, lease := parseAuth(c, "web", "")
+	defer lease.Done()
+	resp, code, err := askConversationWebHttp(c.Request().Context(), p, tag, auth, lease)
 	if err != nil {
 		return c.JSONAndStatus(code, err)
 	}
-	return handleOriginStreamData(c, resp, index)
+	return handleOriginStreamData(c, resp, index, lease)
 }
 
 func DoWebToApi(c *fhblade.Context, tag string) error {
@@ -120,15 +124,17 @@ func DoWebToApi(c *fhblade.Context, tag string) error {
 			},
 		})
 	}
-	auth, index := parseAuth(c, "web", "")
-	resp, code, err := askConversationWebHttp(p, tag, auth)
+	auth, index, lease := parseAuth(c, "web", "")
+	defer lease.Done()
+	resp, code, err := askConversationWebHttp(c.Request().Context(), p, tag, auth, lease)
 	if err != nil {
 		return c.JSONAndStatus(code, err)
 	}
-	return handleV1StreamData(c, resp, index)
+	return handleV1StreamData(c, chat.NewWriter(c, true), resp, index, lease)
 }
 
-func askConversationWebHttp(p types.OpenAiCompletionChatRequest, mt, auth string) (*http.Response, int, *types.ErrorResponse) {
+// lease为使用的会话,requirements返回的鉴权、限流错误更新会话状态
+func askConversationWebHttp(ctx context.Context, p types.OpenAiCompletionChatRequest, mt, auth string, lease *pool.Lease) (*http.Response, int, *types.ErrorResponse) {
 	chatCfg, ok := cst.ChatAskMap[mt]
 	if !ok {
 		return nil, http.StatusInternalServerError, &types.ErrorResponse{
@@ -146,7 +152,7 @@ func askConversationWebHttp(p types.OpenAiCompletionChatRequest, mt, auth string
 	}
 	// anon token
 	requirementsUrl := webChatUrl + chatCfg["requirementsPath"]
-	req, err := http.NewRequest(http.MethodPost, requirementsUrl, nil)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, requirementsUrl, nil)
 	if err != nil {
 		fhblade.Log.Error("chat-requirements new req err",
 			zap.Error(err),
@@ -179,15 +185,20 @@ func askConversationWebHttp(p types.OpenAiCompletionChatRequest, mt, auth string
 		fhblade.Log.Error("chat-requirements req err",
 			zap.Error(err),
 			zap.String("tag", mt))
-		return nil, http.StatusInternalServerError, &types.ErrorResponse{
-			Error: &types.CError{
-				Message: err.Error(),
-				Type:    "invalid_request_error",
-				Code:    "request_err",
-			},
-		}
+		e := chat.ConnError(err)
+		return nil, e.Code, &types.ErrorResponse{Error: e.Err}
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		client.CcPool.Put(gClient)
+		body, _ := tools.ReadAll(resp.Body)
+		fhblade.Log.Error("chat-requirements res status err",
+			zap.Int("code", resp.StatusCode),
+			zap.ByteString("data", body),
+			zap.String("tag", mt))
+		e := chat.WebError(resp.StatusCode, body).WithHeader(resp.Header).Report(lease)
+		return nil, e.Code, &types.ErrorResponse{Error: e.Err}
+	}
 	res := &types.RequirementsTokenResponse{}
 	err = fhblade.Json.NewDecoder(resp.Body).Decode(&res)
 	if err != nil {
@@ -228,7 +239,7 @@ func askConversationWebHttp(p types.OpenAiCompletionChatRequest, mt, auth string
 	p.WebsocketRequestId = uuid.NewString()
 	reqJson, _ := fhblade.Json.Marshal(p)
 	chatUrl := webChatUrl + chatCfg["askPath"]
-	req, err = http.NewRequest(http.MethodPost, chatUrl, bytes.NewReader(reqJson))
+	req, err = http.NewRequestWithContext(ctx, http.MethodPost, chatUrl, bytes.NewReader(reqJson))
 	if err != nil {
 		client.CcPool.Put(gClient)
 		fhblade.Log.Error("openai send msg new req err",
@@ -269,20 +280,18 @@ func askConversationWebHttp(p types.OpenAiCompletionChatRequest, mt, auth string
 		fhblade.Log.Error("openai anon send msg req err",
 			zap.Error(err),
 			zap.String("tag", mt))
-		return nil, http.StatusInternalServerError, &types.ErrorResponse{
-			Error: &types.CError{
-				Message: err.Error(),
-				Type:    "invalid_request_error",
-				Code:    "request_err",
-			},
-		}
+		e := chat.ConnError(err)
+		return nil, e.Code, &types.ErrorResponse{Error: e.Err}
 	}
 	client.CcPool.Put(gClient)
 	return resp, resp.StatusCode, nil
 }
 
-func handleOriginStreamData(c *fhblade.Context, resp *http.Response, index string) error {
+func handleOriginStreamData(c *fhblade.Context, resp *http.Response, index string, lease *pool.Lease) error {
 	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		lease.Report(resp.StatusCode, 0)
+	}
 	if strings.Contains(resp.Header.Get("Content-Type"), "event-stream") {
 		if index != "" {
 			c.Response().SetHeader("x-auth-id", index)
@@ -303,13 +312,7 @@ func handleOriginStreamData(c *fhblade.Context, resp *http.Response, index strin
 	if resp.StatusCode != http.StatusOK {
 		body, _ := tools.ReadAll(resp.Body)
 		fhblade.Log.Error("openai send msg res status err", zap.ByteString("data", body))
-		return c.JSONAndStatus(resp.StatusCode, types.ErrorResponse{
-			Error: &types.CError{
-				Message: "request status error",
-				Type:    "invalid_request_error",
-				Code:    "request_err",
-			},
-		})
+		return chat.WebError(resp.StatusCode, body).WithHeader(resp.Header).Report(lease).JSON(c)
 	}
 	res := map[string]interface{}{}
 	err := fhblade.Json.NewDecoder(resp.Body).Decode(&res)
@@ -363,13 +366,7 @@ func handleOriginStreamData(c *fhblade.Context, resp *http.Response, index strin
 		fhblade.Log.Error("openai send msg wc req err",
 			zap.Error(err),
 			zap.String("url", wsUrl.(string)))
-		return c.JSONAndStatus(http.StatusBadRequest, types.ErrorResponse{
-			Error: &types.CError{
-				Message: err.Error(),
-				Type:    "invalid_request_error",
-				Code:    "request_err",
-			},
-		})
+		return chat.ConnError(err).JSON(c)
 	}
 	defer wc.Close()
 
@@ -434,30 +431,14 @@ func handleOriginStreamData(c *fhblade.Context, resp *http.Response, index strin
 			return nil
 		}
 	}
-
-	return nil
 }
 
-func handleV1StreamData(c *fhblade.Context, resp *http.Response, index string) error {
+func handleV1StreamData(c *fhblade.Context, w chat.Writer, resp *http.Response, index string, lease *pool.Lease) error {
 	defer resp.Body.Close()
-	rw := c.Response().Rw()
-	flusher, ok := rw.(http.Flusher)
-	if !ok {
-		return c.JSONAndStatus(http.StatusNotImplemented, types.ErrorResponse{
-			Error: &types.CError{
-				Message: "Flushing not supported",
-				Type:    "invalid_systems_error",
-				Code:    "systems_error",
-			},
-		})
+	if resp.StatusCode == http.StatusOK {
+		lease.Report(resp.StatusCode, 0)
 	}
 	if strings.Contains(resp.Header.Get("Content-Type"), "event-stream") {
-		header := rw.Header()
-		header.Set("Content-Type", vars.ContentTypeStream)
-		header.Set("Cache-Control", "no-cache")
-		header.Set("Connection", "keep-alive")
-		header.Set("Access-Control-Allow-Origin", "*")
-		rw.WriteHeader(200)
 		// 读取响应体
 		reader := bufio.NewReader(resp.Body)
 		lastMsg := ""
@@ -484,14 +465,13 @@ func handleV1StreamData(c *fhblade.Context, resp *http.Response, index string) e
 					continue
 				}
 				if chatRes.Error != nil {
-					fmt.Fprintf(rw, "data: %s\n\n", raw)
-					flusher.Flush()
-					break
+					return chat.StatusError(http.StatusBadGateway, fmt.Sprint(chatRes.Error)).Write(c, w)
 				}
 				parts := chatRes.Message.Content.Parts
-				if len(parts) > 0 && chatRes.Message.Author.Role == "assistant" && parts[0] != "" {
-					tMsg := strings.TrimPrefix(parts[0], lastMsg)
-					lastMsg = parts[0]
+				if len(parts) > 0 && chatRes.Message.Author.Role == "assistant" && partText(parts[0]) != "" {
+					text := partText(parts[0])
+					tMsg := strings.TrimPrefix(text, lastMsg)
+					lastMsg = text
 					if tMsg != "" {
 						var choices []*types.ChatCompletionChoice
 						choices = append(choices, &types.ChatCompletionChoice{
@@ -514,27 +494,17 @@ func handleV1StreamData(c *fhblade.Context, resp *http.Response, index string) e
 								LastMessageId:   chatRes.Message.ID,
 							},
 						}
-						outJson, _ := fhblade.Json.Marshal(outRes)
-						fmt.Fprintf(rw, "data: %s\n\n", outJson)
-						flusher.Flush()
+						w.Write(outRes)
 					}
 				}
 			}
 		}
-		fmt.Fprint(rw, "data: [DONE]\n\n")
-		flusher.Flush()
-		return nil
+		return w.Done()
 	}
 	if resp.StatusCode != http.StatusOK {
 		body, _ := tools.ReadAll(resp.Body)
 		fhblade.Log.Error("openai send msg res status err", zap.ByteString("data", body))
-		return c.JSONAndStatus(resp.StatusCode, types.ErrorResponse{
-			Error: &types.CError{
-				Message: "request status error",
-				Type:    "invalid_request_error",
-				Code:    "request_err",
-			},
-		})
+		return chat.WebError(resp.StatusCode, body).WithHeader(resp.Header).Report(lease).Write(c, w)
 	}
 	res := map[string]interface{}{}
 	err := fhblade.Json.NewDecoder(resp.Body).Decode(&res)
@@ -543,23 +513,19 @@ func handleV1StreamData(c *fhblade.Context, resp *http.Response, index string) e
 		fhblade.Log.Error("openai send msg res err",
 			zap.Error(err),
 			zap.ByteString("data", body))
-		return c.JSONAndStatus(http.StatusInternalServerError, types.ErrorResponse{
-			Error: &types.CError{
-				Message: err.Error(),
-				Type:    "invalid_request_error",
-				Code:    "request_err",
-			},
+		return w.Error(http.StatusInternalServerError, &types.CError{
+			Message: err.Error(),
+			Type:    "invalid_request_error",
+			Code:    "request_err",
 		})
 	}
 	wsUrl, ok := res["wss_url"]
 	if !ok {
 		fhblade.Log.Debug("openai send msg res wss err", zap.Any("data", res))
-		return c.JSONAndStatus(http.StatusInternalServerError, types.ErrorResponse{
-			Error: &types.CError{
-				Message: "data error",
-				Type:    "invalid_request_error",
-				Code:    "request_err",
-			},
+		return w.Error(http.StatusInternalServerError, &types.CError{
+			Message: "data error",
+			Type:    "invalid_request_error",
+			Code:    "request_err",
 		})
 	}
 
@@ -571,12 +537,10 @@ func handleV1StreamData(c *fhblade.Context, resp *http.Response, index string) e
 			fhblade.Log.Error("openai send msg set proxy err",
 				zap.Error(err),
 				zap.String("url", proxyCfgUrl))
-			return c.JSONAndStatus(http.StatusBadRequest, types.ErrorResponse{
-				Error: &types.CError{
-					Message: err.Error(),
-					Type:    "invalid_request_error",
-					Code:    "request_err",
-				},
+			return w.Error(http.StatusBadRequest, &types.CError{
+				Message: err.Error(),
+				Type:    "invalid_request_error",
+				Code:    "request_err",
 			})
 		}
 		dialer.Proxy = ohttp.ProxyURL(proxyURL)
@@ -588,23 +552,13 @@ func handleV1StreamData(c *fhblade.Context, resp *http.Response, index string) e
 		fhblade.Log.Error("openai send msg wc req err",
 			zap.Error(err),
 			zap.String("url", wsUrl.(string)))
-		return c.JSONAndStatus(http.StatusBadRequest, types.ErrorResponse{
-			Error: &types.CError{
-				Message: err.Error(),
-				Type:    "invalid_request_error",
-				Code:    "request_err",
-			},
-		})
+		return chat.ConnError(err).Write(c, w)
 	}
 	defer wc.Close()
+	// 并发请求中其他请求出错时关闭连接结束读取
+	defer context.AfterFunc(chat.Context(c, w), func() { wc.Close() })()
 
-	header := rw.Header()
-	header.Set("Content-Type", vars.ContentTypeStream)
-	header.Set("Cache-Control", "no-cache")
-	header.Set("Connection", "keep-alive")
-	header.Set("Access-Control-Allow-Origin", "*")
-	rw.WriteHeader(200)
-
+	var wsErr *chat.UpstreamError
 	cancle := make(chan struct{})
 	// 处理返回数据
 	go func() {
@@ -626,8 +580,6 @@ func handleV1StreamData(c *fhblade.Context, resp *http.Response, index string) e
 				return
 			}
 			if one["body"].(string) == "ZGF0YTogW0RPTkVdCgo=" {
-				fmt.Fprint(rw, "data: [DONE]\n\n")
-				flusher.Flush()
 				close(cancle)
 				return
 			}
@@ -652,15 +604,15 @@ func handleV1StreamData(c *fhblade.Context, resp *http.Response, index string) e
 					continue
 				}
 				if chatRes.Error != nil {
-					fmt.Fprintf(rw, "data: %s\n\n", raw)
-					flusher.Flush()
+					wsErr = chat.StatusError(http.StatusBadGateway, fmt.Sprint(chatRes.Error))
 					close(cancle)
 					return
 				}
 				parts := chatRes.Message.Content.Parts
-				if len(parts) > 0 && chatRes.Message.Author.Role == "assistant" && parts[0] != "" {
-					tMsg := strings.TrimPrefix(parts[0], lastMsg)
-					lastMsg = parts[0]
+				if len(parts) > 0 && chatRes.Message.Author.Role == "assistant" && partText(parts[0]) != "" {
+					text := partText(parts[0])
+					tMsg := strings.TrimPrefix(text, lastMsg)
+					lastMsg = text
 					if tMsg != "" {
 						var choices []*types.ChatCompletionChoice
 						choices = append(choices, &types.ChatCompletionChoice{
@@ -682,30 +634,28 @@ func handleV1StreamData(c *fhblade.Context, resp *http.Response, index string) e
 								LastMessageId:   chatRes.Message.ID,
 							},
 						}
-						outJson, _ := fhblade.Json.Marshal(outRes)
-						fmt.Fprintf(rw, "data: %s\n\n", outJson)
-						flusher.Flush()
+						w.Write(outRes)
 					}
 				}
 			}
 		}
 	}()
 
+	// 超时关闭连接,等读取协程退出后再结束输出
 	timer := time.NewTimer(900 * time.Second)
 	defer timer.Stop()
-	for {
-		select {
-		case <-cancle:
-			wc.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
-			return nil
-		case <-timer.C:
-			close(cancle)
-			wc.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
-			return nil
-		}
-	}
-
-	return nil
+	select {
+	case <-cancle:
+		wc.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	case <-timer.C:
+		wc.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+		wc.Close()
+		<-cancle
+	}
+	if wsErr != nil {
+		return wsErr.Write(c, w)
+	}
+	return w.Done()
 }
 
 func DoAnonOrigin() func(*fhblade.Context) error {
@@ -721,11 +671,11 @@ func DoAnonOrigin() func(*fhblade.Context) error {
 				},
 			})
 		}
-		resp, code, err := askConversationWebHttp(p, "backend-anon", "")
+		resp, code, err := askConversationWebHttp(c.Request().Context(), p, "backend-anon", "", nil)
 		if err != nil {
 			return c.JSONAndStatus(code, err)
 		}
-		return handleOriginStreamData(c, resp, "")
+		return handleOriginStreamData(c, resp, "", nil)
 	}
 }
 
@@ -767,16 +717,20 @@ func GenerateProofToken(seed string, diff string) string {
 	return "gAAAAABwQ8Lk5FbGpA2NcR9dShT6gYjU7VxZ4D" + base64.StdEncoding.EncodeToString([]byte(`"`+seed+`"`))
 }
 
-func DoChatCompletionsByWeb(c *fhblade.Context, p types.ChatCompletionRequest) error {
+func DoChatCompletionsByWeb(c *fhblade.Context, p types.ChatCompletionRequest, w chat.Writer) error {
 	// 判断、构造请求参数
+	// 最后一条user消息带图片时上传后作为multimodal_text发送
 	prompt := p.ParsePromptText()
-	if prompt == "" {
-		return c.JSONAndStatus(http.StatusBadRequest, types.ErrorResponse{
-			Error: &types.CError{
-				Message: "params error",
-				Type:    "invalid_request_error",
-				Code:    "request_err",
-			},
+	_, lastUser := chat.SplitHistory(p.Messages)
+	withImage := hasImage(lastUser)
+	if withImage {
+		prompt = chat.MessageText(lastUser)
+	}
+	if prompt == "" && !withImage {
+		return w.Error(http.StatusBadRequest, &types.CError{
+			Message: "params error",
+			Type:    "invalid_request_error",
+			Code:    "request_err",
 		})
 	}
 	if p.OpenAi == nil {
@@ -792,14 +746,46 @@ func DoChatCompletionsByWeb(c *fhblade.Context, p types.ChatCompletionRequest) e
 		messageId = uuid.NewString()
 	}
 	var messages []*types.OpenAiMessage
-	messages = append(messages, &types.OpenAiMessage{
+	// 新对话按配置带上之前的消息
+	if p.OpenAi.Conversation.ID == "" {
+		history, last := chat.SplitHistory(p.Messages)
+		if last != nil && len(history) > 0 {
+			switch config.V().Openai.HistoryMode {
+			case chat.HistoryTranscript:
+				prompt = chat.Transcript(history, chat.MessageText(last))
+			case chat.HistoryChain:
+				messages = webHistoryMessages(history)
+				prompt = chat.MessageText(last)
+			}
+		}
+	}
+	reqIndex := ""
+	if p.OpenAi != nil && p.OpenAi.Conversation != nil {
+		reqIndex = p.OpenAi.Conversation.Index
+	}
+	auth, index, lease := parseAuth(c, "web", reqIndex)
+	defer lease.Done()
+	message := &types.OpenAiMessage{
 		ID:     messageId,
 		Author: &types.OpenAiAuthor{Role: "user"},
 		Content: &types.OpenAiContent{
 			ContentType: "text",
-			Parts:       []string{prompt},
+			Parts:       []any{prompt},
 		},
-	})
+	}
+	if withImage {
+		content, metadata, err := webMultimodalContent(chat.Context(c, w), auth, lastUser, prompt)
+		if err != nil {
+			return w.Error(http.StatusBadRequest, &types.CError{
+				Message: err.Error(),
+				Type:    "invalid_request_error",
+				Code:    "invalid_image_url",
+			})
+		}
+		message.Content = content
+		message.Metadata = metadata
+	}
+	messages = append(messages, message)
 	parentMessageId := ""
 	if p.OpenAi.Conversation.LastMessageId != "" {
 		parentMessageId = p.OpenAi.Conversation.LastMessageId
@@ -818,18 +804,47 @@ func DoChatCompletionsByWeb(c *fhblade.Context, p types.ChatCompletionRequest) e
 	if p.OpenAi.ArkoseToken != "" {
 		rp.ArkoseToken = p.OpenAi.ArkoseToken
 	}
-	reqIndex := ""
-	if p.OpenAi != nil && p.OpenAi.Conversation != nil {
-		reqIndex = p.OpenAi.Conversation.Index
-	}
-	auth, index := parseAuth(c, "web", reqIndex)
 	mt := "backend-api"
 	if auth == "" {
 		mt = "backend-anon"
 	}
-	resp, code, err := askConversationWebHttp(*rp, mt, auth)
+	resp, code, err := askConversationWebHttp(chat.Context(c, w), *rp, mt, auth, lease)
 	if err != nil {
-		return c.JSONAndStatus(code, err)
+		return w.Error(code, err.Error)
+	}
+	return handleV1StreamData(c, w, resp, index, lease)
+}
+
+// 之前的消息作为同一请求中的父消息链,tool结果作为user消息
+func webHistoryMessages(history []*types.ChatCompletionMessage) []*types.OpenAiMessage {
+	var messages []*types.OpenAiMessage
+	for _, m := range history {
+		text := chat.MessageText(m)
+		if text == "" {
+			continue
+		}
+		role := m.Role
+		switch role {
+		case "system", "assistant":
+		case "developer":
+			role = "system"
+		default:
+			role = "user"
+		}
+		messages = append(messages, &types.OpenAiMessage{
+			ID:     uuid.NewString(),
+			Author: &types.OpenAiAuthor{Role: role},
+			Content: &types.OpenAiContent{
+				ContentType: "text",
+				Parts:       []any{text},
+			},
+		})
 	}
-	return handleV1StreamData(c, resp, index)
+	return messages
+}
+
+// 返回内容的文本,图片等其他内容返回空
+func partText(part any) string {
+	text, _ := part.(string)
+	return text
 }
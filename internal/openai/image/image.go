@@ -66,14 +66,22 @@ func Save(imageUrl string) (string, error) {
 			zap.String("url", imageUrl))
 		return "", err
 	}
+	id := strings.TrimPrefix(u.Path, "/file-")
+	if err := SaveAs(imageUrl, id); err != nil {
+		return "", err
+	}
+	return id, nil
+}
 
+// 下载图片保存为指定id,通过/gptimage/file-{id}访问
+func SaveAs(imageUrl, id string) error {
 	// 请求
 	req, err := http.NewRequest(http.MethodGet, imageUrl, nil)
 	if err != nil {
 		fhblade.Log.Error("openai save image req err",
 			zap.Error(err),
 			zap.String("url", imageUrl))
-		return "", err
+		return err
 	}
 	req.Header = http.Header{
 		"accept":          {"image/avif,image/webp,image/apng,image/svg+xml,image/*,*/*;q=0.8"},
@@ -86,31 +94,30 @@ func Save(imageUrl string) (string, error) {
 		fhblade.Log.Error("openai save image req do err",
 			zap.Error(err),
 			zap.String("url", imageUrl))
-		return "", err
+		return err
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
 		fhblade.Log.Error("openai save image res status err",
 			zap.Int("status", resp.StatusCode),
 			zap.String("url", imageUrl))
-		return "", errors.New("request image error")
+		return errors.New("request image error")
 	}
 	// 创建一个文件用于保存图片
-	id := strings.TrimPrefix(u.Path, "/file-")
 	fileName := config.V().Openai.ImagePath + "/" + id
 	file, err := os.Create(fileName)
 	if err != nil {
 		fhblade.Log.Error("openai save image openfile err",
 			zap.String("url", imageUrl))
-		return "", err
+		return err
 	}
 	defer file.Close()
 	_, err = io.Copy(file, resp.Body)
 	if err != nil {
 		fhblade.Log.Error("openai save image save err",
 			zap.String("url", imageUrl))
-		return "", err
+		return err
 	}
 
-	return id, nil
+	return nil
 }
@@ -0,0 +1,166 @@
+package pool
+
+import (
+	"crypto/subtle"
+	"strings"
+	"time"
+
+	http "github.com/bogdanfinn/fhttp"
+	"github.com/zatxm/any-proxy/internal/config"
+	"github.com/zatxm/any-proxy/internal/types"
+	"github.com/zatxm/fhblade"
+)
+
+// 密钥当前状态,管理接口返回
+type KeyState struct {
+	Pool     string `json:"pool"`
+	ID       string `json:"id"`
+	State    string `json:"state"`
+	InFlight int    `json:"in_flight"`
+	// 连续鉴权失败次数
+	Failures int `json:"failures,omitempty"`
+	// 最后一次导致状态变化的上游状态码
+	LastCode int `json:"last_code,omitempty"`
+	// 恢复或重新探测的时间
+	Until int64 `json:"until,omitempty"`
+	// 到期后正在探测
+	Probing   bool  `json:"probing,omitempty"`
+	UpdatedAt int64 `json:"updated_at,omitempty"`
+}
+
+type resetRequest struct {
+	Pool string `json:"pool"`
+	ID   string `json:"id"`
+}
+
+type poolKeys struct {
+	name string
+	ids  []string
+}
+
+// 配置的各密钥池,名称同各provider调用Pick时的name
+func configured() []poolKeys {
+	cfg := config.V()
+	return []poolKeys{
+		{"openai-api", keyIds(cfg.Openai.ApiKeys)},
+		{"openai-web", keyIds(cfg.Openai.WebSessions)},
+		{"gemini", keyIds(cfg.Gemini.ApiKeys)},
+		{"claude-api", keyIds(cfg.Claude.ApiKeys)},
+		{"claude-web", keyIds(cfg.Claude.WebSessions)},
+		{"coze-api", keyIds(cfg.Coze.ApiChat.Bots)},
+	}
+}
+
+func keyIds[K Key](keys []K) []string {
+	ids := make([]string, len(keys))
+	for k := range keys {
+		ids[k] = keys[k].KeyId()
+	}
+	return ids
+}
+
+// 所有配置密钥的状态
+func States() []*KeyState {
+	var states []*KeyState
+	for _, pk := range configured() {
+		p := get(pk.name)
+		p.mu.Lock()
+		for _, id := range pk.ids {
+			s := &KeyState{
+				Pool:     pk.name,
+				ID:       id,
+				State:    StateHealthy,
+				InFlight: p.inFlight[id],
+			}
+			if h := p.health[id]; h != nil {
+				s.State = h.state
+				s.Failures = h.failures
+				s.LastCode = h.code
+				s.Until = h.until.Unix()
+				s.Probing = h.probing
+				s.UpdatedAt = h.updated.Unix()
+			}
+			states = append(states, s)
+		}
+		p.mu.Unlock()
+	}
+	return states
+}
+
+// 手动恢复密钥,name为空恢复全部,id为空恢复整个池
+func Reset(name, id string) int {
+	n := 0
+	for _, pk := range configured() {
+		if name != "" && name != pk.name {
+			continue
+		}
+		p := get(pk.name)
+		p.mu.Lock()
+		for k := range p.health {
+			if id == "" || id == k {
+				delete(p.health, k)
+				n++
+			}
+		}
+		p.mu.Unlock()
+	}
+	return n
+}
+
+// 管理接口需配置admin_key,请求头Authorization传Bearer admin_key
+func adminError(c *fhblade.Context) (int, *types.CError) {
+	adminKey := config.V().AdminKey
+	if adminKey == "" {
+		return http.StatusNotFound, &types.CError{
+			Message: "admin api is disabled, configure admin_key to enable it",
+			Type:    "invalid_request_error",
+			Code:    "not_found",
+		}
+	}
+	auth := strings.TrimPrefix(c.Request().Header("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(auth), []byte(adminKey)) != 1 {
+		return http.StatusUnauthorized, &types.CError{
+			Message: "invalid admin key",
+			Type:    "invalid_request_error",
+			Code:    "invalid_api_key",
+		}
+	}
+	return 0, nil
+}
+
+// get /c/admin/keys
+func DoKeys() func(*fhblade.Context) error {
+	return func(c *fhblade.Context) error {
+		if code, e := adminError(c); e != nil {
+			return c.JSONAndStatus(code, types.ErrorResponse{Error: e})
+		}
+		return c.JSONAndStatus(http.StatusOK, fhblade.H{
+			"object": "list",
+			"now":    time.Now().Unix(),
+			"data":   States(),
+		})
+	}
+}
+
+// post /c/admin/keys/reset,body传pool、id,不传恢复全部
+func DoResetKeys() func(*fhblade.Context) error {
+	return func(c *fhblade.Context) error {
+		if code, e := adminError(c); e != nil {
+			return c.JSONAndStatus(code, types.ErrorResponse{Error: e})
+		}
+		var p resetRequest
+		body, _ := c.Request().RawDataSetBody()
+		if len(body) > 0 {
+			if err := fhblade.Json.Unmarshal(body, &p); err != nil {
+				return c.JSONAndStatus(http.StatusBadRequest, types.ErrorResponse{
+					Error: &types.CError{
+						Message: "params error",
+						Type:    "invalid_request_error",
+						Code:    "invalid_parameter",
+					},
+				})
+			}
+		}
+		return c.JSONAndStatus(http.StatusOK, fhblade.H{"reset": Reset(p.Pool, p.ID)})
+	}
+}
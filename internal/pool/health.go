@@ -0,0 +1,113 @@
+package pool
+
+import (
+	"time"
+
+	http "github.com/bogdanfinn/fhttp"
+	"github.com/zatxm/fhblade"
+	"go.uber.org/zap"
+)
+
+// 密钥状态
+const (
+	StateHealthy = "healthy"
+	// 429限流,到上游给的重置时间后恢复
+	StateCooldown = "cooldown"
+	// 401、403鉴权失败及402余额不足,隔离一段时间后重新探测,连续失败时间翻倍
+	StateQuarantined = "quarantined"
+)
+
+const (
+	// 上游没给重置时间时的冷却时间
+	defaultCooldown = time.Minute
+	// 首次隔离时间及上限
+	quarantineBase = 10 * time.Minute
+	quarantineMax  = 6 * time.Hour
+)
+
+type health struct {
+	state    string
+	until    time.Time
+	failures int
+	code     int
+	probing  bool
+	updated  time.Time
+}
+
+// 状态不是正常的,到期后且没有探测中的请求才能选
+func (p *Pool) available(id string, now time.Time) bool {
+	h := p.health[id]
+	if h == nil || h.state == StateHealthy {
+		return true
+	}
+	return !now.Before(h.until) && !h.probing
+}
+
+// 全部不可用时取最早恢复的
+func earliest[K Key](p *Pool, keys []K, allowed []int) int {
+	i := allowed[0]
+	var until time.Time
+	for j, k := range allowed {
+		h := p.health[keys[k].KeyId()]
+		if h == nil {
+			return k
+		}
+		if j == 0 || h.until.Before(until) {
+			i, until = k, h.until
+		}
+	}
+	return i
+}
+
+// 上游响应状态码,retryAfter为上游建议的重试秒数
+// 2xx恢复正常,401、402、403隔离(连续失败次数决定时长),429冷却,其他不影响状态
+func (l *Lease) Report(code, retryAfter int) {
+	if l == nil {
+		return
+	}
+	p := l.p
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	h := p.health[l.id]
+	switch {
+	case code >= 200 && code < 300:
+		if h != nil && h.state != StateHealthy {
+			fhblade.Log.Info("credential reinstated", zap.String("id", l.id))
+			delete(p.health, l.id)
+		}
+		return
+	case code == http.StatusUnauthorized || code == http.StatusPaymentRequired || code == http.StatusForbidden:
+		if h == nil {
+			h = &health{}
+			p.health[l.id] = h
+		}
+		h.failures++
+		d := quarantineBase << (h.failures - 1)
+		if d > quarantineMax || d <= 0 {
+			d = quarantineMax
+		}
+		h.state, h.until = StateQuarantined, now.Add(d)
+	case code == http.StatusTooManyRequests:
+		if h == nil {
+			h = &health{}
+			p.health[l.id] = h
+		}
+		d := defaultCooldown
+		if retryAfter > 0 {
+			d = time.Duration(retryAfter) * time.Second
+		}
+		// 隔离中的不因为限流提前恢复
+		if h.state != StateQuarantined || now.Add(d).After(h.until) {
+			h.state, h.until = StateCooldown, now.Add(d)
+		}
+	default:
+		return
+	}
+	h.code, h.updated = code, now
+	fhblade.Log.Info("credential unhealthy",
+		zap.String("id", l.id),
+		zap.String("state", h.state),
+		zap.Int("code", code),
+		zap.Time("until", h.until))
+}
@@ -0,0 +1,178 @@
+package pool
+
+import (
+	"testing"
+	"time"
+)
+
+// 选一次并上报状态码
+func pickReport(t *testing.T, name, id string, keys []testKey, code, retryAfter int) {
+	t.Helper()
+	i, lease := Pick(testCtx, name, RoundRobin, keys, id)
+	if i < 0 {
+		t.Fatalf("no key %s", id)
+	}
+	lease.Report(code, retryAfter)
+	lease.Done()
+}
+
+func stateOf(name, id string) *health {
+	p := get(name)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if h := p.health[id]; h != nil {
+		cp := *h
+		return &cp
+	}
+	return nil
+}
+
+// 让状态到期
+func expire(name, id string) {
+	p := get(name)
+	p.mu.Lock()
+	p.health[id].until = time.Now().Add(-time.Second)
+	p.mu.Unlock()
+}
+
+func TestReportTransitions(t *testing.T) {
+	tests := []struct {
+		name       string
+		codes      []int
+		retryAfter int
+		state      string
+		failures   int
+		// 期望的不可用时长
+		duration time.Duration
+	}{
+		{"ok stays healthy", []int{200}, 0, "", 0, 0},
+		{"server error ignored", []int{500, 502}, 0, "", 0, 0},
+		{"429 default cooldown", []int{429}, 0, StateCooldown, 0, defaultCooldown},
+		{"429 retry after", []int{429}, 30, StateCooldown, 0, 30 * time.Second},
+		{"401 quarantine", []int{401}, 0, StateQuarantined, 1, quarantineBase},
+		{"403 quarantine", []int{403}, 0, StateQuarantined, 1, quarantineBase},
+		{"402 quarantine", []int{402}, 0, StateQuarantined, 1, quarantineBase},
+		{"402 after 401 doubles", []int{401, 402}, 0, StateQuarantined, 2, 2 * quarantineBase},
+		{"repeated 401 doubles", []int{401, 401, 401}, 0, StateQuarantined, 3, 4 * quarantineBase},
+		{"quarantine capped", []int{401, 401, 401, 401, 401, 401, 401, 401, 401, 401}, 0, StateQuarantined, 10, quarantineMax},
+		{"429 keeps longer quarantine", []int{401, 429}, 5, StateQuarantined, 1, quarantineBase},
+		{"recovered by 2xx", []int{401, 200}, 0, "", 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name := newPool("test-report-" + tt.name)
+			keys := testKeys(1)
+			for _, code := range tt.codes {
+				pickReport(t, name, "a", keys, code, tt.retryAfter)
+			}
+			h := stateOf(name, "a")
+			if tt.state == "" {
+				if h != nil {
+					t.Fatalf("state = %s, want healthy", h.state)
+				}
+				return
+			}
+			if h == nil || h.state != tt.state {
+				t.Fatalf("state = %v, want %s", h, tt.state)
+			}
+			if h.failures != tt.failures {
+				t.Errorf("failures = %d, want %d", h.failures, tt.failures)
+			}
+			if d := time.Until(h.until); d > tt.duration || d < tt.duration-5*time.Second {
+				t.Errorf("until in %s, want %s", d, tt.duration)
+			}
+		})
+	}
+}
+
+// 冷却中的密钥跳过,到期后放一个请求探测,成功后恢复
+func TestCooldownProbe(t *testing.T) {
+	name := newPool("test-probe")
+	keys := testKeys(1, 1)
+	pickReport(t, name, "a", keys, 429, 60)
+	if counts := pickCounts(t, name, RoundRobin, keys, 4); counts["a"] != 0 {
+		t.Fatalf("cooldown key picked %d times", counts["a"])
+	}
+
+	expire(name, "a")
+	var probe *Lease
+	for k := 0; k < 2 && probe == nil; k++ {
+		i, lease := Pick(testCtx, name, RoundRobin, keys, "")
+		if keys[i].id == "a" {
+			probe = lease
+		} else {
+			lease.Done()
+		}
+	}
+	if probe == nil {
+		t.Fatal("expired key not probed")
+	}
+	if h := stateOf(name, "a"); h == nil || !h.probing {
+		t.Fatal("probe not marked")
+	}
+	// 探测中不再选
+	if counts := pickCounts(t, name, RoundRobin, keys, 4); counts["a"] != 0 {
+		t.Errorf("probing key picked %d times", counts["a"])
+	}
+	probe.Report(200, 0)
+	probe.Done()
+	if h := stateOf(name, "a"); h != nil {
+		t.Fatalf("state = %s, want healthy", h.state)
+	}
+	if counts := pickCounts(t, name, RoundRobin, keys, 4); counts["a"] != 2 {
+		t.Errorf("recovered key picked %d times, want 2", counts["a"])
+	}
+}
+
+// 全部不可用时取最早恢复的,指定标识的不管状态
+func TestAllUnavailable(t *testing.T) {
+	name := newPool("test-unavailable")
+	keys := testKeys(1, 1)
+	pickReport(t, name, "a", keys, 401, 0)
+	pickReport(t, name, "b", keys, 429, 30)
+	i, lease := Pick(testCtx, name, RoundRobin, keys, "")
+	lease.Done()
+	if keys[i].id != "b" {
+		t.Errorf("picked %s, want earliest recovering b", keys[i].id)
+	}
+	i, lease = Pick(testCtx, name, RoundRobin, keys, "a")
+	lease.Done()
+	if i != 0 {
+		t.Errorf("pinned picked %d, want 0", i)
+	}
+}
+
+// 只有探测的请求结束才清除探测状态,之前进行中的请求结束不影响
+func TestProbeLeaseDone(t *testing.T) {
+	name := newPool("test-probe-lease")
+	keys := testKeys(1, 1)
+	_, inFlight := Pick(testCtx, name, RoundRobin, keys, "a")
+	pickReport(t, name, "a", keys, 429, 60)
+	expire(name, "a")
+
+	_, probe := Pick(testCtx, name, RoundRobin, keys, "a")
+	if !probe.probe || !stateOf(name, "a").probing {
+		t.Fatal("expired key not probed")
+	}
+	// 探测中指定标识的请求不再作为探测
+	_, pinned := Pick(testCtx, name, RoundRobin, keys, "a")
+	if pinned.probe {
+		t.Error("second probe while probing")
+	}
+	pinned.Done()
+	inFlight.Done()
+	if h := stateOf(name, "a"); h == nil || !h.probing {
+		t.Fatal("probe cleared by other lease")
+	}
+	if counts := pickCounts(t, name, RoundRobin, keys, 4); counts["a"] != 0 {
+		t.Errorf("probing key picked %d times", counts["a"])
+	}
+	// 探测没有结果时结束,到期的可以再探测
+	probe.Done()
+	if h := stateOf(name, "a"); h == nil || h.probing || h.state != StateCooldown {
+		t.Fatalf("state after probe done = %+v", h)
+	}
+	if counts := pickCounts(t, name, RoundRobin, keys, 2); counts["a"] != 1 {
+		t.Errorf("expired key picked %d times, want 1", counts["a"])
+	}
+}
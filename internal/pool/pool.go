@@ -0,0 +1,179 @@
+package pool
+
+import (
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zatxm/any-proxy/internal/access"
+	"github.com/zatxm/fhblade"
+)
+
+// 密钥选取策略,配置文件各provider的balance
+const (
+	// 依次轮流
+	RoundRobin = "round_robin"
+	// 按weight加权随机
+	Weighted = "weighted"
+	// 取进行中请求数最少的,相同时轮流
+	LeastInFlight = "least_in_flight"
+	// 随机,默认
+	Random = "random"
+)
+
+// 可放入池中的密钥,ID为请求头x-auth-id传的标识
+type Key interface {
+	KeyId() string
+	// 权重,小于1按1
+	KeyWeight() int
+}
+
+// 一组密钥的选取状态,按名称区分如openai-api、claude-web
+type Pool struct {
+	mu       sync.Mutex
+	next     int
+	inFlight map[string]int
+	health   map[string]*health
+}
+
+var pools sync.Map
+
+func get(name string) *Pool {
+	if v, ok := pools.Load(name); ok {
+		return v.(*Pool)
+	}
+	v, _ := pools.LoadOrStore(name, &Pool{
+		inFlight: make(map[string]int),
+		health:   make(map[string]*health),
+	})
+	return v.(*Pool)
+}
+
+// 请求头Authorization作为上游密钥时直接使用,去掉Bearer前缀
+func Authorization(c *fhblade.Context) string {
+	return strings.TrimPrefix(c.Request().Header("Authorization"), "Bearer ")
+}
+
+// 一次选取,请求结束调用Done,拿到上游状态码后调用Report更新密钥状态
+// 请求头直接传密钥时为nil,方法都可以直接调用
+type Lease struct {
+	p  *Pool
+	id string
+	// 到期后取得探测的请求,结束时才清除探测状态
+	probe bool
+	once  sync.Once
+}
+
+// 按策略从keys中选一个,id不为空时只取对应标识的密钥(不管状态)
+// 只在客户端密钥允许的标识中选,隔离、冷却中的密钥跳过,全部不可用时取最早恢复的一个
+// 返回下标,没有的为-1
+func Pick[K Key](c *fhblade.Context, name, strategy string, keys []K, id string) (int, *Lease) {
+	allowed := make([]int, 0, len(keys))
+	for k := range keys {
+		if (id == "" || keys[k].KeyId() == id) && access.KeyAllowed(c, keys[k].KeyId()) {
+			allowed = append(allowed, k)
+		}
+	}
+	if len(allowed) == 0 {
+		return -1, nil
+	}
+	p := get(name)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	i := -1
+	if id != "" {
+		i = allowed[0]
+	} else {
+		now := time.Now()
+		avail := make([]int, 0, len(allowed))
+		for _, k := range allowed {
+			if p.available(keys[k].KeyId(), now) {
+				avail = append(avail, k)
+			}
+		}
+		switch {
+		case len(avail) == 0:
+			i = earliest(p, keys, allowed)
+		case len(avail) == 1:
+			i = avail[0]
+		default:
+			switch strategy {
+			case RoundRobin:
+				i = avail[p.next%len(avail)]
+				p.next++
+			case Weighted:
+				i = avail[weighted(keys, avail)]
+			case LeastInFlight:
+				i = avail[least(p, keys, avail)]
+			default:
+				i = avail[rand.Intn(len(avail))]
+			}
+		}
+	}
+
+	kid := keys[i].KeyId()
+	p.inFlight[kid]++
+	l := &Lease{p: p, id: kid}
+	if h := p.health[kid]; h != nil && h.state != StateHealthy && !h.probing && !time.Now().Before(h.until) {
+		// 到期后放一个请求重新探测
+		h.probing, l.probe = true, true
+	}
+	return i, l
+}
+
+// 请求结束,减少进行中的请求数
+func (l *Lease) Done() {
+	if l == nil {
+		return
+	}
+	l.once.Do(func() {
+		p := l.p
+		p.mu.Lock()
+		if p.inFlight[l.id]--; p.inFlight[l.id] <= 0 {
+			delete(p.inFlight, l.id)
+		}
+		if h := p.health[l.id]; h != nil && l.probe {
+			h.probing = false
+		}
+		p.mu.Unlock()
+	})
+}
+
+func weight(k Key) int {
+	if w := k.KeyWeight(); w > 0 {
+		return w
+	}
+	return 1
+}
+
+// 返回avail中的位置
+func weighted[K Key](keys []K, avail []int) int {
+	total := 0
+	for _, k := range avail {
+		total += weight(keys[k])
+	}
+	n := rand.Intn(total)
+	for j, k := range avail {
+		if n -= weight(keys[k]); n < 0 {
+			return j
+		}
+	}
+	return len(avail) - 1
+}
+
+// 从轮流的位置开始找,进行中请求数相同时分散到不同密钥
+func least[K Key](p *Pool, keys []K, avail []int) int {
+	l := len(avail)
+	start := p.next % l
+	p.next++
+	j := start
+	for k := 1; k < l; k++ {
+		n := (start + k) % l
+		if p.inFlight[keys[avail[n]].KeyId()] < p.inFlight[keys[avail[j]].KeyId()] {
+			j = n
+		}
+	}
+	return j
+}
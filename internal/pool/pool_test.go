@@ -0,0 +1,149 @@
+package pool
+
+import (
+	"testing"
+
+	"github.com/zatxm/fhblade"
+)
+
+type testKey struct {
+	id     string
+	weight int
+}
+
+func (k testKey) KeyId() string {
+	return k.id
+}
+
+func (k testKey) KeyWeight() int {
+	return k.weight
+}
+
+func testKeys(weights ...int) []testKey {
+	keys := make([]testKey, len(weights))
+	for k, w := range weights {
+		keys[k] = testKey{id: string(rune('a' + k)), weight: w}
+	}
+	return keys
+}
+
+// 没开启客户端密钥,不限制可用的标识
+var testCtx = &fhblade.Context{}
+
+// 池的状态是全局的,每个测试用新的池
+func newPool(name string) string {
+	pools.Delete(name)
+	return name
+}
+
+// 每次选取后立即结束,返回各密钥被选中的次数
+func pickCounts(t *testing.T, name, strategy string, keys []testKey, n int) map[string]int {
+	t.Helper()
+	counts := make(map[string]int)
+	for k := 0; k < n; k++ {
+		i, lease := Pick(testCtx, name, strategy, keys, "")
+		if i < 0 {
+			t.Fatalf("pick %d: no key", k)
+		}
+		counts[keys[i].id]++
+		lease.Done()
+	}
+	return counts
+}
+
+func TestPickDistribution(t *testing.T) {
+	tests := []struct {
+		name     string
+		strategy string
+		weights  []int
+		n        int
+		// 各密钥期望的选中比例及允许误差
+		want      []float64
+		tolerance float64
+	}{
+		{"round robin", RoundRobin, []int{1, 1, 1}, 300, []float64{1.0 / 3, 1.0 / 3, 1.0 / 3}, 0},
+		{"weighted", Weighted, []int{1, 3}, 4000, []float64{0.25, 0.75}, 0.05},
+		{"weighted zero as one", Weighted, []int{0, 1}, 4000, []float64{0.5, 0.5}, 0.05},
+		{"least in flight", LeastInFlight, []int{1, 1, 1, 1}, 400, []float64{0.25, 0.25, 0.25, 0.25}, 0},
+		{"random", Random, []int{1, 1}, 4000, []float64{0.5, 0.5}, 0.05},
+		{"single", RoundRobin, []int{1}, 10, []float64{1}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys := testKeys(tt.weights...)
+			counts := pickCounts(t, newPool("test-dist-"+tt.name), tt.strategy, keys, tt.n)
+			for k, key := range keys {
+				got := float64(counts[key.id]) / float64(tt.n)
+				if diff := got - tt.want[k]; diff > tt.tolerance+1e-9 || diff < -tt.tolerance-1e-9 {
+					t.Errorf("key %s: ratio %.3f, want %.3f±%.2f", key.id, got, tt.want[k], tt.tolerance)
+				}
+			}
+		})
+	}
+}
+
+func TestRoundRobinOrder(t *testing.T) {
+	keys := testKeys(1, 1, 1)
+	name := newPool("test-rr-order")
+	var got string
+	for k := 0; k < 6; k++ {
+		i, lease := Pick(testCtx, name, RoundRobin, keys, "")
+		got += keys[i].id
+		lease.Done()
+	}
+	if got != "abcabc" {
+		t.Errorf("order = %s, want abcabc", got)
+	}
+}
+
+// 进行中的请求没结束时选其他密钥,结束后优先选空闲的
+func TestLeastInFlight(t *testing.T) {
+	keys := testKeys(1, 1, 1)
+	name := newPool("test-least")
+	leases := make(map[string]*Lease)
+	for k := 0; k < 3; k++ {
+		i, lease := Pick(testCtx, name, LeastInFlight, keys, "")
+		if leases[keys[i].id] != nil {
+			t.Fatalf("key %s picked twice while others idle", keys[i].id)
+		}
+		leases[keys[i].id] = lease
+	}
+	leases["b"].Done()
+	// 重复调用Done不会多减
+	leases["b"].Done()
+	i, lease := Pick(testCtx, name, LeastInFlight, keys, "")
+	if keys[i].id != "b" {
+		t.Errorf("picked %s, want idle key b", keys[i].id)
+	}
+	lease.Done()
+	leases["a"].Done()
+	leases["c"].Done()
+	if n := len(get(name).inFlight); n != 0 {
+		t.Errorf("in flight not released: %v", get(name).inFlight)
+	}
+}
+
+func TestPickPinned(t *testing.T) {
+	keys := testKeys(1, 1, 1)
+	name := newPool("test-pinned")
+	for k := 0; k < 3; k++ {
+		i, lease := Pick(testCtx, name, RoundRobin, keys, "c")
+		if i != 2 {
+			t.Fatalf("picked %d, want pinned key 2", i)
+		}
+		lease.Done()
+	}
+	if i, lease := Pick(testCtx, name, RoundRobin, keys, "x"); i != -1 || lease != nil {
+		t.Errorf("unknown id picked %d", i)
+	}
+	if i, _ := Pick(testCtx, name, RoundRobin, []testKey{}, ""); i != -1 {
+		t.Errorf("empty keys picked %d", i)
+	}
+}
+
+// 请求头直接传密钥时lease为nil,方法可以直接调用
+func TestNilLease(t *testing.T) {
+	var l *Lease
+	l.Report(401, 0)
+	l.Done()
+}
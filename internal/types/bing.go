@@ -36,6 +36,16 @@ type BingRequestArgument struct {
 	SpokenTextMode                 string           `json:"spokenTextMode"`
 	ConversationId                 string           `json:"conversationId"`
 	Participant                    *BingParticipant `json:"participant"`
+	// 作为上下文的之前消息
+	PreviousMessages []*BingPreviousMessage `json:"previousMessages,omitempty"`
+}
+
+type BingPreviousMessage struct {
+	Author      string `json:"author"`
+	Description string `json:"description"`
+	ContextType string `json:"contextType"`
+	MessageType string `json:"messageType"`
+	MessageId   string `json:"messageId"`
 }
 
 type BingLocationHint struct {
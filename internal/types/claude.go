@@ -56,6 +56,12 @@ type ClaudeError struct {
 	Message string `json:"message"`
 }
 
+// api错误返回
+type ClaudeErrorResponse struct {
+	Type  string       `json:"type"`
+	Error *ClaudeError `json:"error"`
+}
+
 type ClaudeApiCompletionRequest struct {
 	Model         string              `json:"model"`
 	Messages      []*ClaudeApiMessage `json:"messages"`
@@ -63,11 +69,14 @@ type ClaudeApiCompletionRequest struct {
 	Metadata      map[string]string   `json:"metadata,omitempty"`
 	StopSequences []string            `json:"stop_sequences,omitempty"`
 	Stream        bool                `json:"stream,omitempty"`
-	System        string              `json:"system,omitempty"`
+	System        any                 `json:"system,omitempty"`
 	Temperature   float64             `json:"temperature,omitempty"`
 	Tools         []any               `json:"tools,omitempty"`
+	ToolChoice    any                 `json:"tool_choice,omitempty"`
 	TopK          float64             `json:"top_k,omitempty"`
 	TopP          float64             `json:"top_p,omitempty"`
+	// 通用接口/c/v1/messages使用,指定上游
+	Provider string `json:"provider,omitempty"`
 }
 
 type ClaudeApiMessage struct {
@@ -122,12 +131,33 @@ type ClaudeApiMessagePart struct {
 	Type   string           `json:"type"`
 	Source *ClaudeApiSource `json:"source,omitempty"`
 	Text   string           `json:"text,omitempty"`
+	// type为tool_use时
+	ID    string `json:"id,omitempty"`
+	Name  string `json:"name,omitempty"`
+	Input any    `json:"input,omitempty"`
+	// type为tool_result时
+	ToolUseId string `json:"tool_use_id,omitempty"`
+	Content   any    `json:"content,omitempty"`
+}
+
+type ClaudeApiTool struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	InputSchema any    `json:"input_schema"`
+}
+
+type ClaudeApiToolChoice struct {
+	// auto、any、tool
+	Type string `json:"type"`
+	Name string `json:"name,omitempty"`
 }
 
 type ClaudeApiSource struct {
+	// base64或url
 	Type      string `json:"type"`
-	MediaType string `json:"media_type"`
-	Data      string `json:"data"`
+	MediaType string `json:"media_type,omitempty"`
+	Data      string `json:"data,omitempty"`
+	Url       string `json:"url,omitempty"`
 }
 
 type ClaudeApiCompletionStreamResponse struct {
@@ -137,6 +167,8 @@ type ClaudeApiCompletionStreamResponse struct {
 	Index   int                          `json:"index,omitempty"`
 	Delta   *ClaudeApiDelta              `json:"delta,omitempty"`
 	Usage   *ClaudeApiUsage              `json:"usage,omitempty"`
+	// content_block_start返回
+	ContentBlock *ClaudeApiContent `json:"content_block,omitempty"`
 }
 
 type ClaudeApiCompletionResponse struct {
@@ -155,6 +187,9 @@ type ClaudeApiContent struct {
 	Text    string `json:"text,omitempty"`
 	Role    string `json:"role,omitempty"`
 	Content string `json:"content,omitempty"`
+	ID      string `json:"id,omitempty"`
+	Name    string `json:"name,omitempty"`
+	Input   any    `json:"input,omitempty"`
 }
 
 type ClaudeApiUsage struct {
@@ -165,6 +200,7 @@ type ClaudeApiUsage struct {
 type ClaudeApiDelta struct {
 	Type         string     `json:"type,omitempty"`
 	Text         string     `json:"text,omitempty"`
+	PartialJson  string     `json:"partial_json,omitempty"`
 	StopReason   NullString `json:"stop_reason,omitempty"`
 	StopSequence NullString `json:"stop_sequence,omitempty"`
 }
@@ -180,3 +216,16 @@ type ClaudeWebChatCompletionRequest struct {
 	attachments []interface{} `json:"attachments"`
 	files       []interface{} `json:"files"`
 }
+
+// api模型列表/v1/models
+type ClaudeApiModelsResponse struct {
+	Data    []*ClaudeApiModel `json:"data"`
+	HasMore bool              `json:"has_more"`
+}
+
+type ClaudeApiModel struct {
+	ID          string `json:"id"`
+	Type        string `json:"type"`
+	DisplayName string `json:"display_name"`
+	CreatedAt   string `json:"created_at"`
+}
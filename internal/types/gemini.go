@@ -18,9 +18,13 @@ type StreamGenerateContent struct {
 	// 对于多轮查询，此字段为重复字段，包含对话记录和最新请求
 	Contents []*GeminiContent `json:"contents"`
 	// 可选,开发者集系统说明,目前仅支持文字
-	SystemInstruction []*GeminiContent `json:"systemInstruction,omitempty"`
+	SystemInstruction *GeminiContent `json:"systemInstruction,omitempty"`
 	// 可选,用于模型生成和输出的配置选项
 	GenerationConfig *GenerationConfig `json:"generationConfig,omitempty"`
+	// 可选,模型可调用的函数
+	Tools []*GeminiTool `json:"tools,omitempty"`
+	// 可选,函数调用配置
+	ToolConfig *GeminiToolConfig `json:"toolConfig,omitempty"`
 }
 
 type GeminiContent struct {
@@ -33,11 +37,114 @@ type GeminiPart struct {
 	// 文本
 	Text string `json:"text,omitempty"`
 	// 原始媒体字节
-	MimeType string `json:"mimeType,omitempty"` //image/png等
-	Data     string `json:"data,omitempty"`     //媒体格式的原始字节,使用base64编码的字符串
+	InlineData *GeminiBlob `json:"inlineData,omitempty"`
 	// 基于URI的数据
-	UriMimeType string `json:"mimeType,omitempty"` //可选,源数据的IANA标准MIME类型
-	FileUri     string `json:"fileUri,omitempty"`  //必需,URI值
+	FileData *GeminiFileData `json:"fileData,omitempty"`
+	// 模型返回的函数调用
+	FunctionCall *GeminiFunctionCall `json:"functionCall,omitempty"`
+	// 函数调用的结果
+	FunctionResponse *GeminiFunctionResponse `json:"functionResponse,omitempty"`
+}
+
+type GeminiBlob struct {
+	MimeType string `json:"mimeType"` //image/png等
+	Data     string `json:"data"`     //媒体格式的原始字节,使用base64编码的字符串
+}
+
+type GeminiFileData struct {
+	MimeType string `json:"mimeType,omitempty"` //可选,源数据的IANA标准MIME类型
+	FileUri  string `json:"fileUri"`            //必需,URI值
+}
+
+type GeminiFunctionCall struct {
+	Name string         `json:"name"`
+	Args map[string]any `json:"args,omitempty"`
+}
+
+type GeminiFunctionResponse struct {
+	Name     string `json:"name"`
+	Response any    `json:"response"`
+}
+
+type GeminiTool struct {
+	FunctionDeclarations []*GeminiFunctionDeclaration `json:"functionDeclarations,omitempty"`
+}
+
+type GeminiFunctionDeclaration struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	// OpenAPI子集的schema,参数为空时不传
+	Parameters any `json:"parameters,omitempty"`
+}
+
+type GeminiToolConfig struct {
+	FunctionCallingConfig *GeminiFunctionCallingConfig `json:"functionCallingConfig"`
+}
+
+type GeminiFunctionCallingConfig struct {
+	// AUTO、ANY、NONE
+	Mode string `json:"mode"`
+	// mode为ANY时限定可调用的函数
+	AllowedFunctionNames []string `json:"allowedFunctionNames,omitempty"`
+}
+
+// 流式返回(alt=sse)的每条数据
+type GeminiGenerateContentResponse struct {
+	Candidates     []*GeminiCandidate   `json:"candidates"`
+	PromptFeedback any                  `json:"promptFeedback,omitempty"`
+	UsageMetadata  *GeminiUsageMetadata `json:"usageMetadata,omitempty"`
+	ModelVersion   string               `json:"modelVersion,omitempty"`
+}
+
+// api错误返回
+type GeminiErrorResponse struct {
+	Error *GeminiError `json:"error"`
+}
+
+type GeminiError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	// INVALID_ARGUMENT、RESOURCE_EXHAUSTED等
+	Status string `json:"status"`
+	// ErrorInfo的reason、RetryInfo的retryDelay等
+	Details []map[string]any `json:"details,omitempty"`
+}
+
+type GeminiCandidate struct {
+	Content       *GeminiContent `json:"content"`
+	FinishReason  string         `json:"finishReason,omitempty"`
+	Index         int            `json:"index"`
+	SafetyRatings any            `json:"safetyRatings,omitempty"`
+}
+
+type GeminiUsageMetadata struct {
+	PromptTokenCount     int `json:"promptTokenCount"`
+	CandidatesTokenCount int `json:"candidatesTokenCount"`
+	TotalTokenCount      int `json:"totalTokenCount"`
+}
+
+// embedContent请求,batchEmbedContents的每一项相同
+type GeminiEmbedContentRequest struct {
+	Model   string         `json:"model"`
+	Content *GeminiContent `json:"content"`
+	// 可选,输出向量截断的维度
+	OutputDimensionality int `json:"outputDimensionality,omitempty"`
+}
+
+type GeminiBatchEmbedContentsRequest struct {
+	Requests []*GeminiEmbedContentRequest `json:"requests"`
+}
+
+type GeminiEmbedContentResponse struct {
+	Embedding *GeminiContentEmbedding `json:"embedding"`
+}
+
+type GeminiBatchEmbedContentsResponse struct {
+	Embeddings []*GeminiContentEmbedding `json:"embeddings"`
+}
+
+type GeminiContentEmbedding struct {
+	Values []float64 `json:"values"`
 }
 
 type GenerationConfig struct {
@@ -48,6 +155,8 @@ type GenerationConfig struct {
 	// 生成的候选文本的输出响应MIME类型
 	// 支持的mimetype：text/plain(默认)文本输出,application/json JSON响应
 	ResponseMimeType string `json:"responseMimeType,omitempty"`
+	// responseMimeType为application/json时输出的schema,OpenAPI子集
+	ResponseSchema any `json:"responseSchema,omitempty"`
 	// 要返回的已生成响应数
 	// 目前此值只能设置为1或者未设置默认为1
 	CandidateCount int `json:"candidateCount,omitempty"`
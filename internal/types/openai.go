@@ -109,8 +109,8 @@ func (m *ChatCompletionMessage) UnmarshalJSON(bs []byte) error {
 
 type ToolCall struct {
 	Index    *int         `json:"index,omitempty"`
-	ID       string       `json:"id"`
-	Type     string       `json:"type"`
+	ID       string       `json:"id,omitempty"`
+	Type     string       `json:"type,omitempty"`
 	Function FunctionCall `json:"function"`
 }
 
@@ -131,7 +131,16 @@ type ChatMessageImageURL struct {
 }
 
 type ChatCompletionResponseFormat struct {
-	Type string `json:"type"`
+	// text、json_object、json_schema
+	Type       string                                  `json:"type"`
+	JSONSchema *ChatCompletionResponseFormatJSONSchema `json:"json_schema,omitempty"`
+}
+
+type ChatCompletionResponseFormatJSONSchema struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Schema      any    `json:"schema"`
+	Strict      bool   `json:"strict"`
 }
 
 type Tool struct {
@@ -158,6 +167,8 @@ type CError struct {
 	Type    string `json:"type"`
 	Param   string `json:"param"`
 	Code    string `json:"code"`
+	// 上游建议的重试秒数,输出错误时写入Retry-After
+	RetryAfter int `json:"-"`
 }
 
 type ChatCompletionResponse struct {
@@ -207,15 +218,264 @@ type Usage struct {
 	TotalTokens      int `json:"total_tokens"`
 }
 
+type ModelListResponse struct {
+	Object string   `json:"object"`
+	Data   []*Model `json:"data"`
+}
+
+type Model struct {
+	ID      string `json:"id"`
+	Object  string `json:"object"`
+	Created int64  `json:"created"`
+	OwnedBy string `json:"owned_by"`
+	// 对应的provider,请求时可直接传此值
+	Provider string `json:"provider"`
+	// provider下的类型,如claude的api、web
+	Type string `json:"type,omitempty"`
+	// 可用的密钥标识,coze为bot_id
+	KeyIds []string `json:"key_ids,omitempty"`
+	// 路由别名实际请求的上游模型
+	UpstreamModel string `json:"upstream_model,omitempty"`
+}
+
+// chatgpt web模型列表/backend-api/models
+type OpenAiWebModelsResponse struct {
+	Models []*OpenAiWebModel `json:"models"`
+}
+
+type OpenAiWebModel struct {
+	Slug        string   `json:"slug"`
+	MaxTokens   int      `json:"max_tokens"`
+	Title       string   `json:"title"`
+	Description string   `json:"description"`
+	Tags        []string `json:"tags"`
+}
+
 type ImagesGenerationRequest struct {
 	Model  string `json:"model"`
 	Prompt string `json:"prompt"`
+	N      int    `json:"n,omitempty"`
+	// 上游不支持指定尺寸,加在提示词里
+	Size string `json:"size,omitempty"`
+	// url(默认)、b64_json
+	ResponseFormat string `json:"response_format,omitempty"`
+	User           string `json:"user,omitempty"`
+	// 可选openai-chat-web、bing、coze,为空按routes选择
+	Provider string `json:"provider,omitempty"`
 }
 
 type ImagesGenerationResponse struct {
-	Created    int64                  `json:"created"`
-	Data       []*ChatMessageImageURL `json:"data"`
-	DailyLimit bool                   `json:"dailyLimit,omitempty"`
+	Created    int64        `json:"created"`
+	Data       []*ImageData `json:"data"`
+	DailyLimit bool         `json:"dailyLimit,omitempty"`
+}
+
+type ImageData struct {
+	URL           string `json:"url,omitempty"`
+	B64JSON       string `json:"b64_json,omitempty"`
+	RevisedPrompt string `json:"revised_prompt,omitempty"`
+}
+
+// v1/embeddings请求
+type EmbeddingRequest struct {
+	// 字符串、字符串数组或token数组
+	Input any    `json:"input"`
+	Model string `json:"model"`
+	// float(默认)、base64
+	EncodingFormat string `json:"encoding_format,omitempty"`
+	Dimensions     int    `json:"dimensions,omitempty"`
+	User           string `json:"user,omitempty"`
+	Provider       string `json:"provider,omitempty"`
+}
+
+type EmbeddingResponse struct {
+	Object string          `json:"object"`
+	Data   []*Embedding    `json:"data"`
+	Model  string          `json:"model"`
+	Usage  *EmbeddingUsage `json:"usage"`
+}
+
+type Embedding struct {
+	Object string `json:"object"`
+	// float数组或base64字符串
+	Embedding any `json:"embedding"`
+	Index     int `json:"index"`
+}
+
+type EmbeddingUsage struct {
+	PromptTokens int `json:"prompt_tokens"`
+	TotalTokens  int `json:"total_tokens"`
+}
+
+// v1/completions请求
+type CompletionRequest struct {
+	Model string `json:"model"`
+	// 字符串或字符串数组
+	Prompt any    `json:"prompt"`
+	Suffix string `json:"suffix,omitempty"`
+	Echo   bool   `json:"echo,omitempty"`
+	// 字符串或字符串数组
+	Stop          any            `json:"stop,omitempty"`
+	MaxTokens     int            `json:"max_tokens,omitempty"`
+	N             int            `json:"n,omitempty"`
+	Stream        bool           `json:"stream,omitempty"`
+	StreamOptions *StreamOptions `json:"stream_options,omitempty"`
+	Temperature   float64        `json:"temperature,omitempty"`
+	TopP          float64        `json:"top_p,omitempty"`
+	User          string         `json:"user,omitempty"`
+	Provider      string         `json:"provider,omitempty"`
+}
+
+// text_completion返回,流式每条数据格式相同
+type CompletionResponse struct {
+	ID      string              `json:"id"`
+	Object  string              `json:"object"`
+	Created int64               `json:"created"`
+	Model   string              `json:"model"`
+	Choices []*CompletionChoice `json:"choices"`
+	Usage   *Usage              `json:"usage,omitempty"`
+}
+
+type CompletionChoice struct {
+	Text         string `json:"text"`
+	Index        int    `json:"index"`
+	Logprobs     any    `json:"logprobs"`
+	FinishReason string `json:"finish_reason"`
+}
+
+// v1/responses请求
+type ResponsesRequest struct {
+	Model string `json:"model"`
+	// 字符串或输入项数组
+	Input              any               `json:"input"`
+	Instructions       string            `json:"instructions,omitempty"`
+	PreviousResponseID string            `json:"previous_response_id,omitempty"`
+	Stream             bool              `json:"stream,omitempty"`
+	Store              *bool             `json:"store,omitempty"`
+	MaxOutputTokens    int               `json:"max_output_tokens,omitempty"`
+	Temperature        float64           `json:"temperature,omitempty"`
+	TopP               float64           `json:"top_p,omitempty"`
+	Tools              []*ResponsesTool  `json:"tools,omitempty"`
+	ToolChoice         any               `json:"tool_choice,omitempty"`
+	ParallelToolCalls  *bool             `json:"parallel_tool_calls,omitempty"`
+	Text               *ResponsesText    `json:"text,omitempty"`
+	Metadata           map[string]string `json:"metadata,omitempty"`
+	User               string            `json:"user,omitempty"`
+	Provider           string            `json:"provider,omitempty"`
+}
+
+// 输入项,message、function_call、function_call_output
+type ResponsesInputItem struct {
+	Type string `json:"type,omitempty"`
+	Role string `json:"role,omitempty"`
+	// 字符串或内容块数组
+	Content   any    `json:"content,omitempty"`
+	CallID    string `json:"call_id,omitempty"`
+	Name      string `json:"name,omitempty"`
+	Arguments string `json:"arguments,omitempty"`
+	Output    any    `json:"output,omitempty"`
+}
+
+// 内容块,input_text、output_text、input_image
+type ResponsesContentPart struct {
+	Type     string `json:"type"`
+	Text     string `json:"text,omitempty"`
+	ImageURL string `json:"image_url,omitempty"`
+	Detail   string `json:"detail,omitempty"`
+}
+
+type ResponsesTool struct {
+	Type        string `json:"type"`
+	Name        string `json:"name,omitempty"`
+	Description string `json:"description,omitempty"`
+	Parameters  any    `json:"parameters,omitempty"`
+	Strict      bool   `json:"strict,omitempty"`
+}
+
+type ResponsesText struct {
+	Format *ResponsesTextFormat `json:"format,omitempty"`
+}
+
+type ResponsesTextFormat struct {
+	// text、json_object、json_schema
+	Type        string `json:"type"`
+	Name        string `json:"name,omitempty"`
+	Description string `json:"description,omitempty"`
+	Schema      any    `json:"schema,omitempty"`
+	Strict      bool   `json:"strict,omitempty"`
+}
+
+// v1/responses返回的response对象
+type Response struct {
+	ID                string                     `json:"id"`
+	Object            string                     `json:"object"`
+	CreatedAt         int64                      `json:"created_at"`
+	Status            string                     `json:"status"`
+	Error             *ResponseError             `json:"error"`
+	IncompleteDetails *ResponseIncompleteDetails `json:"incomplete_details"`
+	Instructions      string                     `json:"instructions,omitempty"`
+	MaxOutputTokens   int                        `json:"max_output_tokens,omitempty"`
+	Model             string                     `json:"model"`
+	// ResponseOutputMessage或ResponseFunctionCall
+	Output             []any             `json:"output"`
+	ParallelToolCalls  bool              `json:"parallel_tool_calls"`
+	PreviousResponseID string            `json:"previous_response_id,omitempty"`
+	Temperature        float64           `json:"temperature,omitempty"`
+	TopP               float64           `json:"top_p,omitempty"`
+	Text               *ResponsesText    `json:"text,omitempty"`
+	ToolChoice         any               `json:"tool_choice"`
+	Tools              []*ResponsesTool  `json:"tools"`
+	Usage              *ResponseUsage    `json:"usage,omitempty"`
+	Metadata           map[string]string `json:"metadata"`
+	Store              bool              `json:"store"`
+}
+
+type ResponseError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type ResponseIncompleteDetails struct {
+	Reason string `json:"reason"`
+}
+
+type ResponseOutputMessage struct {
+	Type    string                `json:"type"`
+	ID      string                `json:"id"`
+	Status  string                `json:"status"`
+	Role    string                `json:"role"`
+	Content []*ResponseOutputText `json:"content"`
+}
+
+type ResponseOutputText struct {
+	Type        string `json:"type"`
+	Text        string `json:"text"`
+	Annotations []any  `json:"annotations"`
+}
+
+type ResponseFunctionCall struct {
+	Type      string `json:"type"`
+	ID        string `json:"id"`
+	CallID    string `json:"call_id"`
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+	Status    string `json:"status"`
+}
+
+type ResponseUsage struct {
+	InputTokens         int                         `json:"input_tokens"`
+	InputTokensDetails  ResponseInputTokensDetails  `json:"input_tokens_details"`
+	OutputTokens        int                         `json:"output_tokens"`
+	OutputTokensDetails ResponseOutputTokensDetails `json:"output_tokens_details"`
+	TotalTokens         int                         `json:"total_tokens"`
+}
+
+type ResponseInputTokensDetails struct {
+	CachedTokens int `json:"cached_tokens"`
+}
+
+type ResponseOutputTokensDetails struct {
+	ReasoningTokens int `json:"reasoning_tokens"`
 }
 
 type OpenAiCompletionRequest struct {
@@ -251,9 +511,24 @@ type OpenAiCompletionChatRequest struct {
 }
 
 type OpenAiMessage struct {
-	ID      string         `json:"id" binding:"required"`
-	Author  *OpenAiAuthor  `json:"author" binding:"required"`
-	Content *OpenAiContent `json:"content" binding:"required"`
+	ID       string                 `json:"id" binding:"required"`
+	Author   *OpenAiAuthor          `json:"author" binding:"required"`
+	Content  *OpenAiContent         `json:"content" binding:"required"`
+	Metadata *OpenAiMessageMetadata `json:"metadata,omitempty"`
+}
+
+type OpenAiMessageMetadata struct {
+	Attachments []*OpenAiAttachment `json:"attachments,omitempty"`
+}
+
+// 消息附件,对应上传的文件
+type OpenAiAttachment struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	MimeType string `json:"mimeType"`
+	Size     int    `json:"size"`
+	Width    int    `json:"width,omitempty"`
+	Height   int    `json:"height,omitempty"`
 }
 
 type OpenAiAuthor struct {
@@ -263,8 +538,38 @@ type OpenAiAuthor struct {
 }
 
 type OpenAiContent struct {
-	ContentType string   `json:"content_type" binding:"required"`
-	Parts       []string `json:"parts" binding:"required"`
+	// text或multimodal_text
+	ContentType string `json:"content_type" binding:"required"`
+	// text为字符串,multimodal_text时图片为OpenAiImageAssetPointer
+	Parts []any `json:"parts" binding:"required"`
+}
+
+type OpenAiImageAssetPointer struct {
+	ContentType  string `json:"content_type"`
+	AssetPointer string `json:"asset_pointer"`
+	SizeBytes    int    `json:"size_bytes"`
+	Width        int    `json:"width"`
+	Height       int    `json:"height"`
+}
+
+// 上传文件第一步,创建文件
+type OpenAiCreateFileRequest struct {
+	FileName string `json:"file_name"`
+	FileSize int    `json:"file_size"`
+	UseCase  string `json:"use_case"`
+}
+
+type OpenAiCreateFileResponse struct {
+	Status    string `json:"status"`
+	UploadUrl string `json:"upload_url"`
+	FileId    string `json:"file_id"`
+	ErrorCode string `json:"error_code,omitempty"`
+}
+
+// 上传文件第三步,确认已上传
+type OpenAiFileUploadedResponse struct {
+	Status      string `json:"status"`
+	DownloadUrl string `json:"download_url"`
 }
 
 type OpenAiMetadata struct {